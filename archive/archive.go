@@ -0,0 +1,458 @@
+// Package archive inspects uploaded product files before they are offered to
+// buyers. Archives are unpacked as a stream without touching the disk, so
+// their declared sizes, paths and contents can be checked against a policy.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Format is how an uploaded file is packaged
+type Format string
+
+const (
+	FormatZip    Format = "zip"
+	FormatTar    Format = "tar"
+	FormatTarGz  Format = "tar.gz"
+	FormatSingle Format = "file"
+)
+
+// Checks a problem can be reported under
+const (
+	CheckStructure = "structure"
+	CheckZipBomb   = "zip_bomb"
+	CheckPath      = "path_traversal"
+	CheckFileType  = "file_type"
+	CheckSize      = "size"
+)
+
+// maxProblems caps how many problems a report lists
+const maxProblems = 50
+
+// Limits bound what an archive may unpack to
+type Limits struct {
+	MaxFiles        int
+	MaxFileSize     int64
+	MaxUnpackedSize int64
+	// MaxRatio is the highest compression ratio tolerated for entries over
+	// ratioThreshold; real content rarely compresses past 100:1
+	MaxRatio      float64
+	MaxPathDepth  int
+	MaxPathLength int
+}
+
+// ratioThreshold is the size below which compression ratios are ignored,
+// as tiny highly repetitive files are common and harmless
+const ratioThreshold = 1 << 20
+
+var DefaultLimits = Limits{
+	MaxFiles:        5000,
+	MaxFileSize:     1 << 30,
+	MaxUnpackedSize: 4 << 30,
+	MaxRatio:        200,
+	MaxPathDepth:    32,
+	MaxPathLength:   512,
+}
+
+// Policy is what a product's files are checked against
+type Policy struct {
+	Limits
+	// Extensions lists the allowed lower-case file extensions, such as
+	// ".png". An empty string allows files without one. A nil list allows
+	// anything that is not an executable.
+	Extensions []string
+}
+
+// deniedExtensions are compiled programs and installers, refused whatever
+// the policy allows
+var deniedExtensions = map[string]bool{
+	".exe": true, ".dll": true, ".so": true, ".dylib": true, ".com": true, ".scr": true,
+	".pif": true, ".msi": true, ".apk": true, ".dmg": true, ".pkg": true, ".deb": true, ".rpm": true,
+}
+
+// File is one file in an upload
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Problem is a failed check
+type Problem struct {
+	Check   string `json:"check"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// Report is the outcome of inspecting an upload. Files lists what was read
+// before inspection stopped, so it is only a manifest when Passed.
+type Report struct {
+	Format       Format    `json:"format"`
+	FileCount    int       `json:"file_count"`
+	UnpackedSize int64     `json:"unpacked_size"`
+	Files        []File    `json:"files"`
+	Problems     []Problem `json:"problems"`
+	// Truncated is set when more problems were found than are listed
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Passed reports whether every check passed
+func (r *Report) Passed() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) fail(check, path, format string, args ...interface{}) {
+	if len(r.Problems) == maxProblems {
+		r.Truncated = true
+		return
+	}
+	r.Problems = append(r.Problems, Problem{Check: check, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// errStop ends inspection after a problem that makes reading on pointless
+var errStop = errors.New("inspection stopped")
+
+// FormatOf picks the format from the upload's file name. Formats built on
+// zip, such as .docx or .epub, are single files rather than archives.
+func FormatOf(name string) Format {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return FormatZip
+	case strings.HasSuffix(name, ".tar"):
+		return FormatTar
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return FormatTarGz
+	}
+	return FormatSingle
+}
+
+// Inspect checks the size bytes of r, uploaded under name, against policy
+func Inspect(r io.ReaderAt, size int64, name string, policy Policy) *Report {
+	in := &inspector{
+		policy: policy,
+		size:   size,
+		seen:   map[string]bool{},
+		report: &Report{Format: FormatOf(name), Files: []File{}, Problems: []Problem{}},
+	}
+	switch in.report.Format {
+	case FormatZip:
+		in.inspectZip(r, size)
+	case FormatTar:
+		in.inspectTar(io.NewSectionReader(r, 0, size))
+	case FormatTarGz:
+		in.inspectTarGz(io.NewSectionReader(r, 0, size))
+	default:
+		in.inspectSingle(io.NewSectionReader(r, 0, size), name)
+	}
+	return in.report
+}
+
+type inspector struct {
+	policy Policy
+	size   int64
+	seen   map[string]bool
+	report *Report
+}
+
+func (in *inspector) inspectSingle(r io.Reader, name string) {
+	in.report.FileCount = 1
+	if in.size > in.policy.MaxFileSize {
+		in.report.fail(CheckSize, name, "file is larger than %d bytes", in.policy.MaxFileSize)
+		return
+	}
+	in.readFile(name, r, in.size)
+}
+
+func (in *inspector) inspectZip(r io.ReaderAt, size int64) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		in.report.fail(CheckStructure, "", "not a valid zip archive: %v", err)
+		return
+	}
+	if len(zr.File) == 0 {
+		in.report.fail(CheckStructure, "", "archive is empty")
+		return
+	}
+	for _, f := range zr.File {
+		name, ok := in.entry(f.Name, f.FileInfo().IsDir())
+		if !ok {
+			continue
+		}
+		mode := f.Mode()
+		switch {
+		case mode&fs.ModeSymlink != 0:
+			in.report.fail(CheckPath, name, "links are not allowed")
+			continue
+		case f.FileInfo().IsDir():
+			continue
+		case !mode.IsRegular():
+			in.report.fail(CheckStructure, name, "only regular files and directories are allowed")
+			continue
+		case f.Flags&0x1 != 0:
+			in.report.fail(CheckStructure, name, "encrypted entries cannot be inspected")
+			continue
+		}
+		if err := in.countFile(name, int64(f.UncompressedSize64)); err != nil {
+			return
+		}
+		if f.UncompressedSize64 > ratioThreshold && f.CompressedSize64 > 0 &&
+			float64(f.UncompressedSize64)/float64(f.CompressedSize64) > in.policy.MaxRatio {
+			in.report.fail(CheckZipBomb, name, "compression ratio exceeds %g:1", in.policy.MaxRatio)
+			return
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			in.report.fail(CheckStructure, name, "cannot be read: %v", err)
+			continue
+		}
+		err = in.readFile(name, rc, int64(f.UncompressedSize64))
+		rc.Close()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (in *inspector) inspectTarGz(r io.Reader) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		in.report.fail(CheckStructure, "", "not a valid gzip file: %v", err)
+		return
+	}
+	defer gz.Close()
+	in.inspectTar(gz)
+}
+
+// compressedTooFar reports whether a compressed tarball has so far unpacked
+// to more than the ratio allows. As the whole stream is compressed together
+// this can only be judged on the running total.
+func (in *inspector) compressedTooFar() bool {
+	unpacked := in.report.UnpackedSize
+	return in.report.Format == FormatTarGz && unpacked > ratioThreshold && in.size > 0 &&
+		float64(unpacked)/float64(in.size) > in.policy.MaxRatio
+}
+
+func (in *inspector) inspectTar(r io.Reader) {
+	tr := tar.NewReader(r)
+	for entries := 0; ; entries++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if entries == 0 {
+				in.report.fail(CheckStructure, "", "archive is empty")
+			}
+			return
+		}
+		if err != nil {
+			in.report.fail(CheckStructure, "", "not a valid tar archive: %v", err)
+			return
+		}
+		// Skipping an entry still decompresses its content, so only regular
+		// files may have any
+		if hdr.Typeflag != tar.TypeReg && hdr.Size > 0 {
+			in.report.fail(CheckStructure, hdr.Name, "only regular files may have content")
+			return
+		}
+		name, ok := in.entry(hdr.Name, hdr.Typeflag == tar.TypeDir)
+		if !ok {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeDir:
+			continue
+		case tar.TypeSymlink, tar.TypeLink:
+			in.report.fail(CheckPath, name, "links are not allowed")
+			continue
+		default:
+			in.report.fail(CheckStructure, name, "only regular files and directories are allowed")
+			continue
+		}
+		if err := in.countFile(name, hdr.Size); err != nil {
+			return
+		}
+		if err := in.readFile(name, tr, hdr.Size); err != nil {
+			return
+		}
+		if in.compressedTooFar() {
+			in.report.fail(CheckZipBomb, "", "compression ratio exceeds %g:1", in.policy.MaxRatio)
+			return
+		}
+	}
+}
+
+// entry checks an entry's path and returns it cleaned, reporting whether
+// the entry should be inspected further
+func (in *inspector) entry(raw string, dir bool) (string, bool) {
+	name, problem := cleanPath(raw, in.policy.Limits)
+	if problem != "" {
+		in.report.fail(CheckPath, raw, "%s", problem)
+		return "", false
+	}
+	if dir {
+		return name, true
+	}
+	key := strings.ToLower(name)
+	if in.seen[key] {
+		in.report.fail(CheckStructure, name, "appears more than once")
+		return "", false
+	}
+	in.seen[key] = true
+	return name, true
+}
+
+// cleanPath rejects paths that could escape the directory an archive is
+// extracted into and returns the rest in canonical form
+func cleanPath(name string, limits Limits) (string, string) {
+	switch {
+	case name == "":
+		return "", "empty path"
+	case strings.ContainsRune(name, 0):
+		return "", "path contains a NUL byte"
+	case strings.Contains(name, "\\"):
+		return "", "path uses backslash separators"
+	case strings.HasPrefix(name, "/"):
+		return "", "absolute path"
+	case len(name) >= 2 && name[1] == ':':
+		return "", "path starts with a drive letter"
+	case len(name) > limits.MaxPathLength:
+		return "", fmt.Sprintf("path is longer than %d characters", limits.MaxPathLength)
+	}
+	parts := strings.Split(strings.TrimSuffix(name, "/"), "/")
+	for _, part := range parts {
+		if part == ".." {
+			return "", "path escapes the archive"
+		}
+	}
+	if len(parts) > limits.MaxPathDepth {
+		return "", fmt.Sprintf("path is nested deeper than %d directories", limits.MaxPathDepth)
+	}
+	return path.Clean(name), ""
+}
+
+// countFile checks an entry's declared size against the limits before it is
+// read
+func (in *inspector) countFile(name string, size int64) error {
+	in.report.FileCount++
+	if in.report.FileCount > in.policy.MaxFiles {
+		in.report.fail(CheckZipBomb, "", "archive holds more than %d files", in.policy.MaxFiles)
+		return errStop
+	}
+	if size > in.policy.MaxFileSize {
+		in.report.fail(CheckSize, name, "file is larger than %d bytes", in.policy.MaxFileSize)
+		return errStop
+	}
+	if in.report.UnpackedSize+size > in.policy.MaxUnpackedSize {
+		in.report.fail(CheckZipBomb, name, "archive unpacks to more than %d bytes", in.policy.MaxUnpackedSize)
+		return errStop
+	}
+	return nil
+}
+
+// readFile reads one file, hashing it and checking its type. Declared sizes
+// are not trusted: reading stops as soon as the content outgrows them.
+func (in *inspector) readFile(name string, r io.Reader, declared int64) error {
+	hash := sha256.New()
+	head := &headWriter{}
+	n, err := io.Copy(io.MultiWriter(hash, head), io.LimitReader(r, declared+1))
+	if err != nil {
+		in.report.fail(CheckStructure, name, "cannot be read: %v", err)
+		return nil
+	}
+	if n != declared {
+		in.report.fail(CheckZipBomb, name, "content does not match its declared size")
+		return errStop
+	}
+	in.report.UnpackedSize += n
+	in.report.Files = append(in.report.Files, File{Path: name, Size: n, SHA256: hex.EncodeToString(hash.Sum(nil))})
+	in.checkType(name, head.buf)
+	return nil
+}
+
+func (in *inspector) checkType(name string, head []byte) {
+	if isExecutable(head) {
+		in.report.fail(CheckFileType, name, "executables are not allowed")
+		return
+	}
+	ext := strings.ToLower(path.Ext(path.Base(name)))
+	if deniedExtensions[ext] {
+		in.report.fail(CheckFileType, name, "%s files are not allowed", ext)
+		return
+	}
+	if in.policy.Extensions == nil {
+		return
+	}
+	for _, allowed := range in.policy.Extensions {
+		if ext == allowed {
+			return
+		}
+	}
+	if ext == "" {
+		in.report.fail(CheckFileType, name, "files without an extension are not allowed")
+		return
+	}
+	in.report.fail(CheckFileType, name, "%s files are not allowed for this category", ext)
+}
+
+// executableMagic are the leading bytes of native executables. Java class
+// files share Mach-O's universal binary magic and are left alone. Windows
+// executables are recognised by isPE.
+var executableMagic = [][]byte{
+	[]byte("\x7fELF"),        // Linux and BSD
+	{0xfe, 0xed, 0xfa, 0xce}, // Mach-O 32-bit
+	{0xfe, 0xed, 0xfa, 0xcf}, // Mach-O 64-bit
+	{0xce, 0xfa, 0xed, 0xfe}, // Mach-O 32-bit, little-endian
+	{0xcf, 0xfa, 0xed, 0xfe}, // Mach-O 64-bit, little-endian
+}
+
+func isExecutable(head []byte) bool {
+	if isPE(head) {
+		return true
+	}
+	for _, magic := range executableMagic {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPE reports whether head starts a Windows PE image: a DOS header whose
+// e_lfanew field, at 0x3c, points to the "PE\0\0" signature. Plenty of text
+// starts with "MZ", so the prefix alone proves nothing.
+func isPE(head []byte) bool {
+	if len(head) < 0x40 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+	offset := binary.LittleEndian.Uint32(head[0x3c:])
+	return offset <= uint32(len(head)-4) && bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// headSize is how much of each file is kept to recognise its type. It
+// reaches the PE signature of any executable a linker produces.
+const headSize = 4096
+
+// headWriter keeps the first headSize bytes written to it
+type headWriter struct {
+	buf []byte
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if room := headSize - len(w.buf); room > 0 {
+		w.buf = append(w.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,185 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type entry struct {
+	name    string
+	body    string
+	symlink bool
+}
+
+func buildZip(t *testing.T, entries ...entry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		if e.symlink {
+			hdr.SetMode(fs.ModeSymlink | 0o777)
+		}
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(e.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func buildTarGz(t *testing.T, entries ...entry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.symlink {
+			hdr = &tar.Header{Name: e.name, Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink}
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func inspect(data []byte, name string, policy Policy) *Report {
+	return Inspect(bytes.NewReader(data), int64(len(data)), name, policy)
+}
+
+func checks(r *Report) []string {
+	var out []string
+	for _, p := range r.Problems {
+		out = append(out, p.Check+" "+p.Path)
+	}
+	return out
+}
+
+var webPolicy = Policy{Limits: DefaultLimits, Extensions: []string{"", ".html", ".css", ".js", ".md"}}
+
+func TestInspectCleanArchives(t *testing.T) {
+	files := []entry{
+		{name: "site/"},
+		{name: "site/index.html", body: "<h1>Hi</h1>"},
+		{name: "site/css/app.css", body: "body{}"},
+		{name: "LICENSE", body: "MIT"},
+	}
+
+	report := inspect(buildZip(t, files...), "kit.zip", webPolicy)
+	assert.True(t, report.Passed(), checks(report))
+	assert.Equal(t, FormatZip, report.Format)
+	assert.Equal(t, 3, report.FileCount)
+	assert.Equal(t, int64(len("<h1>Hi</h1>")+len("body{}")+len("MIT")), report.UnpackedSize)
+	require.Len(t, report.Files, 3)
+	assert.Equal(t, "site/index.html", report.Files[0].Path)
+	assert.Len(t, report.Files[0].SHA256, 64)
+
+	report = inspect(buildTarGz(t, files[1:]...), "kit.tar.gz", webPolicy)
+	assert.True(t, report.Passed(), checks(report))
+	assert.Equal(t, FormatTarGz, report.Format)
+	assert.Equal(t, 3, report.FileCount)
+}
+
+func TestInspectRejectsUnsafePaths(t *testing.T) {
+	report := inspect(buildZip(t,
+		entry{name: "../../etc/cron.d/evil", body: "x"},
+		entry{name: "/abs.html", body: "x"},
+		entry{name: "C:/win.html", body: "x"},
+		entry{name: `dir\back.html`, body: "x"},
+		entry{name: "link", body: "/etc/passwd", symlink: true},
+		entry{name: "ok.html", body: "x"},
+		entry{name: "OK.html", body: "x"},
+	), "kit.zip", webPolicy)
+	assert.Equal(t, []string{
+		"path_traversal ../../etc/cron.d/evil",
+		"path_traversal /abs.html",
+		"path_traversal C:/win.html",
+		`path_traversal dir\back.html`,
+		"path_traversal link",
+		"structure OK.html",
+	}, checks(report))
+
+	report = inspect(buildTarGz(t, entry{name: "link", symlink: true}), "kit.tgz", webPolicy)
+	assert.Equal(t, []string{"path_traversal link"}, checks(report))
+}
+
+func TestInspectFileTypes(t *testing.T) {
+	report := inspect(buildZip(t,
+		entry{name: "app.js", body: "console.log(1)"},
+		entry{name: "tool.exe", body: "not really"},
+		entry{name: "bin/run", body: "\x7fELF\x02\x01\x01"},
+		entry{name: "notes.docx", body: "PK"},
+	), "kit.zip", webPolicy)
+	assert.Equal(t, []string{"file_type tool.exe", "file_type bin/run", "file_type notes.docx"}, checks(report))
+
+	anything := Policy{Limits: DefaultLimits}
+	report = inspect(buildZip(t, entry{name: "main.go", body: "package main"}, entry{name: "setup.exe", body: "MZ\x90\x00"}), "src.zip", anything)
+	assert.Equal(t, []string{"file_type setup.exe"}, checks(report), "executables are refused even without an allowlist")
+	report = inspect(buildZip(t,
+		entry{name: "README.txt", body: "MZ Studio sample pack\n" + strings.Repeat("-", 80)},
+		entry{name: "bin/setup", body: peStub()},
+	), "src.zip", anything)
+	assert.Equal(t, []string{"file_type bin/setup"}, checks(report), "only a real PE header marks a Windows executable")
+
+	guide := Policy{Limits: DefaultLimits, Extensions: []string{".pdf", ".epub"}}
+	report = inspect(buildZip(t, entry{name: "mimetype", body: "application/epub+zip"}), "book.epub", guide)
+	assert.True(t, report.Passed(), "zip based documents are single files")
+	assert.Equal(t, FormatSingle, report.Format)
+	report = inspect([]byte("\x7fELF\x02\x01\x01\x00"), "guide.pdf", guide)
+	assert.Equal(t, []string{"file_type guide.pdf"}, checks(report))
+}
+
+func TestInspectBombs(t *testing.T) {
+	zeros := string(make([]byte, 4<<20))
+	report := inspect(buildZip(t, entry{name: "zeros.txt", body: zeros}), "kit.zip", Policy{Limits: DefaultLimits})
+	assert.Equal(t, []string{"zip_bomb zeros.txt"}, checks(report))
+
+	report = inspect(buildTarGz(t, entry{name: "zeros.txt", body: zeros}), "kit.tar.gz", Policy{Limits: DefaultLimits})
+	assert.Equal(t, []string{"zip_bomb "}, checks(report))
+
+	limits := DefaultLimits
+	limits.MaxFiles = 2
+	report = inspect(buildZip(t, entry{name: "a.md"}, entry{name: "b.md"}, entry{name: "c.md"}), "kit.zip", Policy{Limits: limits})
+	assert.Equal(t, []string{"zip_bomb "}, checks(report))
+
+	limits = DefaultLimits
+	limits.MaxUnpackedSize = 10
+	report = inspect(buildZip(t, entry{name: "a.md", body: "123456"}, entry{name: "b.md", body: "123456"}), "kit.zip", Policy{Limits: limits})
+	assert.Equal(t, []string{"zip_bomb b.md"}, checks(report))
+}
+
+func TestInspectMalformed(t *testing.T) {
+	report := inspect([]byte("definitely not a zip"), "kit.zip", webPolicy)
+	assert.Equal(t, []string{"structure "}, checks(report))
+
+	report = inspect(buildZip(t), "empty.zip", webPolicy)
+	assert.Equal(t, []string{"structure "}, checks(report))
+
+	data := buildZip(t, entry{name: "index.html", body: "hello hello hello"})
+	corrupt := append([]byte(nil), data...)
+	corrupt[bytes.Index(corrupt, []byte("index.html"))+len("index.html")+2] ^= 0xff
+	report = inspect(corrupt, "kit.zip", webPolicy)
+	assert.False(t, report.Passed(), "corrupted content fails its checksum")
+}
+
+// peStub returns the start of a Windows executable: a DOS header whose
+// e_lfanew points to the PE signature
+func peStub() string {
+	stub := make([]byte, 0x84)
+	copy(stub, "MZ")
+	binary.LittleEndian.PutUint32(stub[0x3c:], 0x80)
+	copy(stub[0x80:], "PE\x00\x00")
+	return string(stub)
+}
@@ -1,23 +1,90 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
-	MongoURL      string
-	DatabaseName  string
-	JWTSecret     string
-	RedisURL      string
-	RedisPassword string
-	AllowedHosts  []string
+	MongoURL           string
+	DatabaseName       string
+	JWTSecret          string
+	CursorSecret       string
+	RedisURL           string
+	RedisPassword      string
+	AllowedHosts       []string
+	RateLimitAllowlist []string
+	TrustedProxies     []string
+	CacheLocalSize     int
+	CacheLocalTTL      time.Duration
+	StorageBackend     string
+	StorageLocalDir    string
+	S3Endpoint         string
+	S3Region           string
+	S3Bucket           string
+	S3AccessKey        string
+	S3SecretKey        string
+	S3PathStyle        bool
+	MaxUploadSize      int64
+	MaxImageUploadSize int64
+	ImageWorkers       int
+	CWebPPath          string
+	DownloadSigningKey string
+	DownloadLinkTTL    time.Duration
+	MaxDownloads       int
+	ViewDedupWindow    time.Duration
+	ViewFlushInterval  time.Duration
+	RecommendRefresh   time.Duration
+	WishlistInterval   time.Duration
+	ExchangeRatesFile  string
+	IdempotencyTTL     time.Duration
+	StripeAPIBase      string
+	StripeSecretKey    string
+	StripeWebhookKey   string
+	DepositSuccessURL  string
+	DepositCancelURL   string
 }
 
 func LoadConfig() *Config {
 	return &Config{
-		MongoURL:      getEnvOrDefault("MONGO_URL", "mongodb://localhost:27017"),
-		DatabaseName:  getEnvOrDefault("DB_NAME", "marketplace"),
-		JWTSecret:     getEnvOrDefault("JWT_SECRET", "your-secret-key"),
-		RedisURL:      getEnvOrDefault("REDIS_URL", "localhost:6379"),
-		RedisPassword: getEnvOrDefault("REDIS_PASSWORD", ""),
+		MongoURL:           getEnvOrDefault("MONGO_URL", "mongodb://localhost:27017"),
+		DatabaseName:       getEnvOrDefault("DB_NAME", "marketplace"),
+		JWTSecret:          getEnvOrDefault("JWT_SECRET", "your-secret-key"),
+		CursorSecret:       getEnvOrDefault("CURSOR_SECRET", "your-cursor-secret"),
+		RedisURL:           getEnvOrDefault("REDIS_URL", "localhost:6379"),
+		RedisPassword:      getEnvOrDefault("REDIS_PASSWORD", ""),
+		RateLimitAllowlist: getEnvList("RATE_LIMIT_ALLOWLIST"),
+		TrustedProxies:     getEnvList("TRUSTED_PROXIES"),
+		CacheLocalSize:     getEnvInt("CACHE_LOCAL_SIZE", 10000),
+		CacheLocalTTL:      getEnvDuration("CACHE_LOCAL_TTL", 30*time.Second),
+		StorageBackend:     getEnvOrDefault("STORAGE_BACKEND", "local"),
+		StorageLocalDir:    getEnvOrDefault("STORAGE_LOCAL_DIR", "./uploads"),
+		S3Endpoint:         getEnvOrDefault("S3_ENDPOINT", "https://s3.amazonaws.com"),
+		S3Region:           getEnvOrDefault("S3_REGION", "us-east-1"),
+		S3Bucket:           getEnvOrDefault("S3_BUCKET", "marketplace"),
+		S3AccessKey:        getEnvOrDefault("S3_ACCESS_KEY", ""),
+		S3SecretKey:        getEnvOrDefault("S3_SECRET_KEY", ""),
+		S3PathStyle:        getEnvBool("S3_PATH_STYLE", false),
+		MaxUploadSize:      int64(getEnvInt("MAX_UPLOAD_SIZE", 512<<20)),
+		MaxImageUploadSize: int64(getEnvInt("MAX_IMAGE_UPLOAD_SIZE", 20<<20)),
+		ImageWorkers:       getEnvInt("IMAGE_WORKERS", 2),
+		CWebPPath:          getEnvOrDefault("CWEBP_PATH", "cwebp"),
+		DownloadSigningKey: getEnvOrDefault("DOWNLOAD_SIGNING_KEY", "your-download-signing-key"),
+		DownloadLinkTTL:    getEnvDuration("DOWNLOAD_LINK_TTL", 15*time.Minute),
+		MaxDownloads:       getEnvInt("MAX_DOWNLOADS_PER_PURCHASE", 10),
+		ViewDedupWindow:    getEnvDuration("VIEW_DEDUP_WINDOW", 30*time.Minute),
+		ViewFlushInterval:  getEnvDuration("VIEW_FLUSH_INTERVAL", time.Minute),
+		RecommendRefresh:   getEnvDuration("RECOMMENDATIONS_REFRESH_INTERVAL", time.Hour),
+		WishlistInterval:   getEnvDuration("WISHLIST_CHECK_INTERVAL", 5*time.Minute),
+		ExchangeRatesFile:  getEnvOrDefault("EXCHANGE_RATES_FILE", ""),
+		IdempotencyTTL:     getEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+		StripeAPIBase:      getEnvOrDefault("STRIPE_API_BASE", "https://api.stripe.com"),
+		StripeSecretKey:    getEnvOrDefault("STRIPE_SECRET_KEY", ""),
+		StripeWebhookKey:   getEnvOrDefault("STRIPE_WEBHOOK_SECRET", ""),
+		DepositSuccessURL:  getEnvOrDefault("DEPOSIT_SUCCESS_URL", "http://localhost:3000/credits?deposit=success"),
+		DepositCancelURL:   getEnvOrDefault("DEPOSIT_CANCEL_URL", "http://localhost:3000/credits?deposit=cancelled"),
 	}
 }
 
@@ -27,3 +94,35 @@ func getEnvOrDefault(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvList splits a comma separated environment variable, dropping empty items
+func getEnvList(key string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,224 @@
+package data
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AnalyticsRepository computes creator performance over a period from view
+// buckets and purchases
+type AnalyticsRepository struct {
+	mongo *MongoDB
+}
+
+func NewAnalyticsRepository(mongo *MongoDB) *AnalyticsRepository {
+	return &AnalyticsRepository{mongo: mongo}
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// ConversionRate is the percentage of views that led to a sale, or zero
+// without views
+func ConversionRate(unitsSold, views int) float64 {
+	if views <= 0 {
+		return 0
+	}
+	return roundCents(float64(unitsSold) / float64(views) * 100)
+}
+
+// CreatorAnalytics summarises views and completed sales of the creator's
+// products between from and to. Products with neither are left out of the
+// per-product breakdown.
+func (r *AnalyticsRepository) CreatorAnalytics(ctx context.Context, creatorID primitive.ObjectID, from, to time.Time) (*CreatorAnalytics, error) {
+	var products []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Title string             `bson:"title"`
+	}
+	cursor, err := r.mongo.Products().Find(ctx, bson.M{"creator_id": creatorID},
+		options.Find().SetProjection(bson.M{"title": 1}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+
+	perf := map[primitive.ObjectID]*ProductPerformance{}
+	ids := make([]primitive.ObjectID, 0, len(products))
+	for _, p := range products {
+		ids = append(ids, p.ID)
+		perf[p.ID] = &ProductPerformance{ProductID: p.ID, ProductTitle: p.Title}
+	}
+
+	views, err := r.viewsByProduct(ctx, bson.M{"creator_id": creatorID, "date": dayRange(from, to)})
+	if err != nil {
+		return nil, err
+	}
+	sales, err := r.salesByProduct(ctx, ids, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	analytics := &CreatorAnalytics{
+		CreatorID:          creatorID,
+		ProductPerformance: []ProductPerformance{},
+		UpdatedAt:          time.Now(),
+	}
+	for id, n := range views {
+		if p, ok := perf[id]; ok {
+			p.TotalViews = n
+			analytics.TotalViews += n
+		}
+	}
+	for id, s := range sales {
+		if p, ok := perf[id]; ok {
+			p.UnitsSold = s.Units
+			p.TotalRevenue = s.Revenue
+			analytics.TotalProductsSold += s.Units
+			analytics.TotalRevenue = analytics.TotalRevenue.Add(s.Revenue)
+		}
+	}
+
+	for _, p := range perf {
+		if p.TotalViews == 0 && p.UnitsSold == 0 {
+			continue
+		}
+		p.ConversionRate = ConversionRate(p.UnitsSold, p.TotalViews)
+		analytics.ProductPerformance = append(analytics.ProductPerformance, *p)
+	}
+	sort.Slice(analytics.ProductPerformance, func(i, j int) bool {
+		a, b := analytics.ProductPerformance[i], analytics.ProductPerformance[j]
+		if a.TotalViews != b.TotalViews {
+			return a.TotalViews > b.TotalViews
+		}
+		return a.ProductID.Hex() < b.ProductID.Hex()
+	})
+	return analytics, nil
+}
+
+// DailyViews returns a product's views for each UTC day between from and
+// to, including days without any
+func (r *AnalyticsRepository) DailyViews(ctx context.Context, productID primitive.ObjectID, from, to time.Time) ([]DailyMetric, error) {
+	cursor, err := r.mongo.ProductViews().Find(ctx, bson.M{"product_id": productID, "date": dayRange(from, to)})
+	if err != nil {
+		return nil, err
+	}
+	var buckets []struct {
+		Date  time.Time `bson:"date"`
+		Views int       `bson:"views"`
+	}
+	if err := cursor.All(ctx, &buckets); err != nil {
+		return nil, err
+	}
+	byDay := map[time.Time]int{}
+	for _, b := range buckets {
+		byDay[b.Date.UTC()] += b.Views
+	}
+
+	metrics := []DailyMetric{}
+	for day := from.UTC().Truncate(24 * time.Hour); !day.After(to); day = day.AddDate(0, 0, 1) {
+		metrics = append(metrics, DailyMetric{Date: day, Value: float64(byDay[day])})
+	}
+	return metrics, nil
+}
+
+// dayRange matches the daily buckets covering from to to
+func dayRange(from, to time.Time) bson.M {
+	return bson.M{"$gte": from.UTC().Truncate(24 * time.Hour), "$lte": to.UTC()}
+}
+
+func (r *AnalyticsRepository) viewsByProduct(ctx context.Context, match bson.M) (map[primitive.ObjectID]int, error) {
+	cursor, err := r.mongo.ProductViews().Aggregate(ctx, bson.A{
+		bson.M{"$match": match},
+		bson.M{"$group": bson.M{"_id": "$product_id", "views": bson.M{"$sum": "$views"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Views int                `bson:"views"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	views := make(map[primitive.ObjectID]int, len(rows))
+	for _, row := range rows {
+		views[row.ID] = row.Views
+	}
+	return views, nil
+}
+
+type productSales struct {
+	Units   int
+	Revenue money.Money
+}
+
+func (r *AnalyticsRepository) salesByProduct(ctx context.Context, productIDs []primitive.ObjectID, from, to time.Time) (map[primitive.ObjectID]productSales, error) {
+	sales := map[primitive.ObjectID]productSales{}
+	if len(productIDs) == 0 {
+		return sales, nil
+	}
+	cursor, err := r.mongo.Purchases().Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{
+			"product_id": bson.M{"$in": productIDs},
+			"status":     PurchaseStatusCompleted,
+			"created_at": bson.M{"$gte": from, "$lte": to},
+		}},
+		bson.M{"$group": bson.M{
+			"_id":     "$product_id",
+			"units":   bson.M{"$sum": 1},
+			"revenue": bson.M{"$sum": "$price.amount"},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID      primitive.ObjectID `bson:"_id"`
+		Units   int                `bson:"units"`
+		Revenue int64              `bson:"revenue"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		sales[row.ID] = productSales{Units: row.Units, Revenue: money.New(row.Revenue, money.DefaultCurrency)}
+	}
+	return sales, nil
+}
+
+// ProductPerformance summarises one product's views and completed sales
+// between from and to, with its views broken down by day
+func (r *AnalyticsRepository) ProductPerformance(ctx context.Context, product *Product, from, to time.Time) (*ProductPerformance, []DailyMetric, error) {
+	daily, err := r.DailyViews(ctx, product.ID, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	sales, err := r.salesByProduct(ctx, []primitive.ObjectID{product.ID}, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	perf := &ProductPerformance{
+		ProductID:     product.ID,
+		ProductTitle:  product.Title,
+		AverageRating: product.AverageRating,
+		UnitsSold:     sales[product.ID].Units,
+		TotalRevenue:  sales[product.ID].Revenue,
+	}
+	for _, day := range daily {
+		perf.TotalViews += int(day.Value)
+	}
+	perf.ConversionRate = ConversionRate(perf.UnitsSold, perf.TotalViews)
+	return perf, daily, nil
+}
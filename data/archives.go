@@ -0,0 +1,62 @@
+package data
+
+import (
+	"time"
+
+	"github.com/kordlab/marketplace/archive"
+)
+
+var (
+	imageFileTypes = []string{".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico"}
+	fontFileTypes  = []string{".ttf", ".otf", ".woff", ".woff2", ".eot"}
+	docFileTypes   = []string{"", ".md", ".mdx", ".txt", ".pdf", ".html", ".htm", ".css", ".json", ".csv"}
+	webFileTypes   = []string{
+		".js", ".jsx", ".mjs", ".cjs", ".ts", ".tsx", ".vue", ".svelte", ".astro",
+		".scss", ".sass", ".less", ".map", ".xml", ".yml", ".yaml", ".toml", ".lock",
+		".gitignore", ".npmrc", ".nvmrc", ".editorconfig", ".prettierrc", ".eslintrc",
+	}
+	mediaFileTypes = []string{".mp4", ".mov", ".webm", ".mkv", ".mp3", ".m4a", ".wav", ".ogg", ".srt", ".vtt"}
+)
+
+func fileTypes(groups ...[]string) []string {
+	var all []string
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
+
+// CategoryFileTypes lists the file extensions uploads of each category may
+// contain. Source code may contain anything except executables.
+var CategoryFileTypes = map[ProductCategory][]string{
+	CategoryTemplate: fileTypes(docFileTypes, webFileTypes, imageFileTypes, fontFileTypes, []string{".mp4", ".webm"}),
+	CategoryPlugin:   fileTypes(docFileTypes, webFileTypes, imageFileTypes, []string{".php", ".py", ".liquid", ".pot", ".po", ".mo", ".vsix"}),
+	CategoryAsset: fileTypes(docFileTypes, imageFileTypes, fontFileTypes, []string{
+		".tif", ".tiff", ".psd", ".ai", ".eps", ".fig", ".sketch", ".xd",
+		".blend", ".fbx", ".obj", ".mtl", ".gltf", ".glb", ".stl", ".dae", ".usdz",
+		".wav", ".mp3", ".ogg", ".flac", ".mp4", ".mov", ".webm", ".lottie",
+	}),
+	CategoryCourse: fileTypes(docFileTypes, imageFileTypes, mediaFileTypes, webFileTypes, []string{".epub", ".pptx", ".key", ".docx", ".xlsx", ".ipynb", ".py"}),
+	CategoryGuide:  fileTypes(docFileTypes, imageFileTypes, []string{".epub", ".mobi", ".docx", ".xlsx"}),
+	CategorySource: nil,
+}
+
+// ArchivePolicy is what uploads of a category are checked against
+func ArchivePolicy(category ProductCategory) archive.Policy {
+	return archive.Policy{Limits: archive.DefaultLimits, Extensions: CategoryFileTypes[category]}
+}
+
+// NewVersionManifest records the files of an upload that passed inspection
+func NewVersionManifest(report *archive.Report, now time.Time) *VersionManifest {
+	files := make([]ManifestFile, 0, len(report.Files))
+	for _, f := range report.Files {
+		files = append(files, ManifestFile{Path: f.Path, Size: f.Size, SHA256: f.SHA256})
+	}
+	return &VersionManifest{
+		Format:       string(report.Format),
+		FileCount:    report.FileCount,
+		UnpackedSize: report.UnpackedSize,
+		Files:        files,
+		InspectedAt:  now,
+	}
+}
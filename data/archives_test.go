@@ -0,0 +1,41 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kordlab/marketplace/archive"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchivePolicy(t *testing.T) {
+	for category := range SpecSchemas {
+		policy := ArchivePolicy(category)
+		assert.Equal(t, archive.DefaultLimits, policy.Limits)
+		if category == CategorySource {
+			assert.Nil(t, policy.Extensions, "source code may contain any file type")
+			continue
+		}
+		assert.Contains(t, policy.Extensions, ".md", "every category may ship a readme")
+		assert.NotContains(t, policy.Extensions, ".exe")
+	}
+	assert.Contains(t, ArchivePolicy(CategoryTemplate).Extensions, ".tsx")
+	assert.NotContains(t, ArchivePolicy(CategoryGuide).Extensions, ".php")
+}
+
+func TestNewVersionManifest(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	manifest := NewVersionManifest(&archive.Report{
+		Format:       archive.FormatZip,
+		FileCount:    1,
+		UnpackedSize: 3,
+		Files:        []archive.File{{Path: "LICENSE", Size: 3, SHA256: "abc"}},
+	}, now)
+	assert.Equal(t, &VersionManifest{
+		Format:       "zip",
+		FileCount:    1,
+		UnpackedSize: 3,
+		Files:        []ManifestFile{{Path: "LICENSE", Size: 3, SHA256: "abc"}},
+		InspectedAt:  now,
+	}, manifest)
+}
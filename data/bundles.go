@@ -0,0 +1,75 @@
+package data
+
+import (
+	"errors"
+
+	"github.com/kordlab/marketplace/money"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MinBundleItems is the smallest number of products a bundle may contain
+const MinBundleItems = 2
+
+// AdjustmentOwnedItems is the price adjustment for bundle items the buyer
+// already owns
+const AdjustmentOwnedItems = "owned_items"
+
+var (
+	ErrBundleTooSmall    = errors.New("a bundle must contain at least two products")
+	ErrInvalidBundleItem = errors.New("bundle items must be the creator's own non-bundle products")
+)
+
+// IsBundle reports whether the product is a bundle of other products
+func (p *Product) IsBundle() bool {
+	return p.Type == ProductTypeBundle && p.Bundle != nil
+}
+
+// ValidateBundleItems checks that items can be bundled into bundle: each
+// must be a non-bundle, non-archived product by the bundle's creator, and
+// there must be enough distinct ones.
+func ValidateBundleItems(bundle *Product, items []Product) error {
+	seen := map[primitive.ObjectID]bool{}
+	for _, item := range items {
+		if item.CreatorID != bundle.CreatorID || item.IsBundle() || item.ID == bundle.ID ||
+			item.Status == ProductStatusArchived {
+			return ErrInvalidBundleItem
+		}
+		seen[item.ID] = true
+	}
+	if len(seen) < MinBundleItems {
+		return ErrBundleTooSmall
+	}
+	return nil
+}
+
+// BundleOwnedCredit returns the adjustment that removes already owned items
+// from a bundle's subtotal, or nil if the buyer owns none of them. Each item
+// accounts for a share of the bundle proportional to its own price, or an
+// equal share if every item is free or the items are priced in different
+// currencies.
+func BundleOwnedCredit(items []Product, owned map[primitive.ObjectID]bool, subtotal money.Money) *PriceAdjustment {
+	var total, ownedTotal int64
+	ownedCount, mixed := 0, false
+	for i := range items {
+		mixed = mixed || !items[i].Price.SameCurrency(items[0].Price)
+		price := items[i].EffectivePrice().Amount
+		total += price
+		if owned[items[i].ID] {
+			ownedTotal += price
+			ownedCount++
+		}
+	}
+	if ownedCount == 0 || len(items) == 0 {
+		return nil
+	}
+
+	credit := subtotal.Scale(int64(ownedCount), int64(len(items)))
+	if total > 0 && !mixed {
+		credit = subtotal.Scale(ownedTotal, total)
+	}
+	return &PriceAdjustment{
+		Kind:        AdjustmentOwnedItems,
+		Description: "Items you already own",
+		Amount:      money.Min(credit, subtotal).Neg(),
+	}
+}
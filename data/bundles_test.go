@@ -0,0 +1,99 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidateBundleItems(t *testing.T) {
+	creator := primitive.NewObjectID()
+	bundle := &Product{ID: primitive.NewObjectID(), CreatorID: creator, Type: ProductTypeBundle, Bundle: &BundleOptions{}}
+	item := func() Product {
+		return Product{ID: primitive.NewObjectID(), CreatorID: creator, Status: ProductStatusActive}
+	}
+
+	a, b := item(), item()
+	assert.NoError(t, ValidateBundleItems(bundle, []Product{a, b}))
+	assert.Equal(t, ErrBundleTooSmall, ValidateBundleItems(bundle, []Product{a}))
+	assert.Equal(t, ErrBundleTooSmall, ValidateBundleItems(bundle, []Product{a, a}))
+
+	foreign := item()
+	foreign.CreatorID = primitive.NewObjectID()
+	assert.Equal(t, ErrInvalidBundleItem, ValidateBundleItems(bundle, []Product{a, foreign}))
+
+	nested := item()
+	nested.Type, nested.Bundle = ProductTypeBundle, &BundleOptions{}
+	assert.Equal(t, ErrInvalidBundleItem, ValidateBundleItems(bundle, []Product{a, nested}))
+
+	archived := item()
+	archived.Status = ProductStatusArchived
+	assert.Equal(t, ErrInvalidBundleItem, ValidateBundleItems(bundle, []Product{a, archived}))
+}
+
+func TestBundleOwnedCredit(t *testing.T) {
+	a := Product{ID: primitive.NewObjectID(), Price: usd(3000)}
+	b := Product{ID: primitive.NewObjectID(), Price: usd(2000), DiscountedPrice: usd(1000)}
+	items := []Product{a, b}
+
+	assert.Nil(t, BundleOwnedCredit(items, nil, usd(3000)))
+
+	credit := BundleOwnedCredit(items, map[primitive.ObjectID]bool{a.ID: true}, usd(3000))
+	require.NotNil(t, credit)
+	assert.Equal(t, AdjustmentOwnedItems, credit.Kind)
+	assert.Equal(t, usd(-2250), credit.Amount, "a is three quarters of the items' combined price")
+
+	credit = BundleOwnedCredit(items, map[primitive.ObjectID]bool{a.ID: true, b.ID: true}, usd(3000))
+	require.NotNil(t, credit)
+	assert.Equal(t, usd(-3000), credit.Amount)
+
+	free := []Product{{ID: a.ID}, {ID: b.ID}}
+	credit = BundleOwnedCredit(free, map[primitive.ObjectID]bool{b.ID: true}, usd(1000))
+	require.NotNil(t, credit)
+	assert.Equal(t, usd(-500), credit.Amount, "free items share the bundle equally")
+
+	mixed := []Product{a, {ID: b.ID, Price: money.New(2000, "EUR")}}
+	credit = BundleOwnedCredit(mixed, map[primitive.ObjectID]bool{a.ID: true}, usd(3000))
+	require.NotNil(t, credit)
+	assert.Equal(t, usd(-1500), credit.Amount, "prices in different currencies are not compared")
+
+	bundle := &Product{Price: usd(3000), Type: ProductTypeBundle, Bundle: &BundleOptions{ExcludeOwned: true}}
+	quote, err := QuotePrice(bundle, []PriceAdjustment{*BundleOwnedCredit(items, map[primitive.ObjectID]bool{b.ID: true}, usd(3000))}, nil, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, usd(2250), quote.FinalPrice)
+	assert.Equal(t, usd(2250), quote.Adjustments[0].Subtotal)
+}
+
+func TestEntitlementsForPurchase(t *testing.T) {
+	purchase := &Purchase{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), ProductVersion: "2.0.0"}
+
+	single := &Product{ID: primitive.NewObjectID()}
+	entitlements := EntitlementsForPurchase(purchase, single, nil)
+	require.Len(t, entitlements, 1)
+	assert.Equal(t, single.ID, entitlements[0].ProductID)
+	assert.Equal(t, "2.0.0", entitlements[0].Version)
+	assert.True(t, entitlements[0].IncludesUpdates)
+	assert.True(t, entitlements[0].BundleID.IsZero())
+
+	items := []Product{
+		{ID: primitive.NewObjectID(), Versions: []ProductVersion{{Version: "1.0.0"}, {Version: "1.3.0"}}},
+		{ID: primitive.NewObjectID()},
+	}
+	bundle := &Product{ID: primitive.NewObjectID(), Type: ProductTypeBundle, Bundle: &BundleOptions{
+		Items: []primitive.ObjectID{items[0].ID, items[1].ID},
+	}}
+	entitlements = EntitlementsForPurchase(purchase, bundle, items)
+	require.Len(t, entitlements, 2)
+	for i, ent := range entitlements {
+		assert.Equal(t, items[i].ID, ent.ProductID)
+		assert.Equal(t, bundle.ID, ent.BundleID)
+		assert.Equal(t, purchase.ID, ent.PurchaseID)
+		assert.False(t, ent.IncludesUpdates)
+	}
+	assert.Equal(t, "1.3.0", entitlements[0].Version)
+	assert.Empty(t, entitlements[1].Version)
+}
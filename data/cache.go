@@ -0,0 +1,255 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/sync/singleflight"
+)
+
+// Cache namespaces
+const (
+	CacheNamespaceUsers         = "users"
+	CacheNamespaceProducts      = "products"
+	CacheNamespaceExchangeRates = "exchange_rates"
+)
+
+const (
+	cacheInvalidationChannel = "cache:invalidate"
+	cacheRedisTTL            = time.Hour
+	// cacheVersionTTL must outlive cacheRedisTTL so a version counter can
+	// never reset while an entry written under it is still readable.
+	cacheVersionTTL = 24 * time.Hour
+)
+
+// CacheStats counts read-through cache outcomes since startup
+type CacheStats struct {
+	LocalHits uint64 `json:"local_hits"`
+	RedisHits uint64 `json:"redis_hits"`
+	Misses    uint64 `json:"misses"`
+	Errors    uint64 `json:"errors"`
+}
+
+// cacheEnvelope is what gets stored in Redis: the payload tagged with the
+// version of the key it was loaded under.
+type cacheEnvelope struct {
+	Version int64           `json:"v"`
+	Data    json.RawMessage `json:"d"`
+}
+
+// invalidationMessage is broadcast to every instance when a key changes
+type invalidationMessage struct {
+	Key     string `json:"key"`
+	Version int64  `json:"version"`
+}
+
+// setIfVersionScript writes an entry only if the key's version has not moved
+// since the caller started loading it, so a slow loader can never put stale
+// data back after an invalidation.
+//
+// KEYS = version key, data key
+// ARGV = expected version, envelope, ttl (ms)
+var setIfVersionScript = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+if current ~= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// TieredCache is a read-through cache with an in-process LRU in front of
+// Redis. Every key has a version counter in Redis: writes bump it and
+// broadcast an eviction over pub/sub, and readers only accept entries tagged
+// with the current version. A replica that misses a broadcast therefore
+// serves stale data for at most the local TTL, and never from Redis.
+type TieredCache struct {
+	redis *RedisDB
+	local *lruCache
+	group singleflight.Group
+
+	localHits atomic.Uint64
+	redisHits atomic.Uint64
+	misses    atomic.Uint64
+	errors    atomic.Uint64
+}
+
+func NewTieredCache(redis *RedisDB, localSize int, localTTL time.Duration) *TieredCache {
+	return &TieredCache{
+		redis: redis,
+		local: newLRUCache(localSize, localTTL),
+	}
+}
+
+func cacheKey(namespace, id string) string {
+	return "cache:" + namespace + ":" + id
+}
+
+func cacheVersionKey(key string) string {
+	return key + ":ver"
+}
+
+// Fetch decodes the cached value for namespace/id into dest. On a miss it
+// calls load, stores the result and decodes that instead. Concurrent misses
+// for the same key on this instance share a single load.
+func (c *TieredCache) Fetch(ctx context.Context, namespace, id string, dest interface{}, load func(ctx context.Context) (interface{}, error)) error {
+	key := cacheKey(namespace, id)
+
+	if entry, ok := c.local.get(key); ok {
+		c.localHits.Add(1)
+		return json.Unmarshal(entry.payload, dest)
+	}
+
+	// The load is shared with other callers, so it must not be cut short when
+	// the request that happened to start it goes away.
+	loadCtx := context.WithoutCancel(ctx)
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		version, payload, err := c.readRedis(loadCtx, key)
+		if err != nil {
+			c.errors.Add(1)
+		}
+		if payload != nil {
+			c.redisHits.Add(1)
+			c.local.set(key, version, payload)
+			return payload, nil
+		}
+		c.misses.Add(1)
+
+		value, err := load(loadCtx)
+		if err != nil {
+			return nil, err
+		}
+		payload, err = json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if c.writeRedis(loadCtx, key, version, payload) {
+			c.local.set(key, version, payload)
+		}
+		return payload, nil
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(v.([]byte), dest)
+}
+
+// readRedis returns the current version of key and, if the stored entry
+// matches it, the cached payload.
+func (c *TieredCache) readRedis(ctx context.Context, key string) (int64, []byte, error) {
+	vals, err := c.redis.client.MGet(ctx, cacheVersionKey(key), key).Result()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var version int64
+	if s, ok := vals[0].(string); ok {
+		if version, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	raw, ok := vals[1].(string)
+	if !ok {
+		return version, nil, nil
+	}
+	var env cacheEnvelope
+	if err := json.Unmarshal([]byte(raw), &env); err != nil || env.Version != version {
+		return version, nil, nil
+	}
+	return version, env.Data, nil
+}
+
+// writeRedis stores payload under key if version is still current and
+// reports whether it did.
+func (c *TieredCache) writeRedis(ctx context.Context, key string, version int64, payload []byte) bool {
+	env, err := json.Marshal(cacheEnvelope{Version: version, Data: payload})
+	if err != nil {
+		return false
+	}
+	stored, err := setIfVersionScript.Run(ctx, c.redis.client,
+		[]string{cacheVersionKey(key), key}, version, env, cacheRedisTTL.Milliseconds()).Int()
+	if err != nil {
+		c.errors.Add(1)
+		return false
+	}
+	return stored == 1
+}
+
+// Invalidate bumps the version of namespace/id, drops the Redis entry and
+// tells every instance to evict its local copy.
+func (c *TieredCache) Invalidate(ctx context.Context, namespace, id string) error {
+	key := cacheKey(namespace, id)
+	c.group.Forget(key)
+	c.local.evict(key, 0)
+
+	pipe := c.redis.client.TxPipeline()
+	incr := pipe.Incr(ctx, cacheVersionKey(key))
+	pipe.Expire(ctx, cacheVersionKey(key), cacheVersionTTL)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.errors.Add(1)
+		return err
+	}
+
+	msg, err := json.Marshal(invalidationMessage{Key: key, Version: incr.Val()})
+	if err != nil {
+		return err
+	}
+	if err := c.redis.client.Publish(ctx, cacheInvalidationChannel, msg).Err(); err != nil {
+		c.errors.Add(1)
+		return err
+	}
+	return nil
+}
+
+// Run listens for invalidations from other instances until ctx is done. The
+// local tier is purged whenever the subscription is (re)established, since
+// messages may have been missed while it was down.
+func (c *TieredCache) Run(ctx context.Context) {
+	pubsub := c.redis.client.Subscribe(ctx, cacheInvalidationChannel)
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Cache invalidation subscription error: %v", err)
+			c.local.purge()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			c.local.purge()
+		case *redis.Message:
+			var inv invalidationMessage
+			if err := json.Unmarshal([]byte(m.Payload), &inv); err != nil {
+				log.Printf("Ignoring malformed cache invalidation %q: %v", m.Payload, err)
+				continue
+			}
+			c.local.evict(inv.Key, inv.Version)
+		}
+	}
+}
+
+func (c *TieredCache) Stats() CacheStats {
+	return CacheStats{
+		LocalHits: c.localHits.Load(),
+		RedisHits: c.redisHits.Load(),
+		Misses:    c.misses.Load(),
+		Errors:    c.errors.Load(),
+	}
+}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kordlab/marketplace/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type cachedThing struct {
+	Name string `json:"name"`
+}
+
+func newTestRedis(t *testing.T, mr *miniredis.Miniredis) *RedisDB {
+	redis, err := NewRedisDB(&config.Config{RedisURL: mr.Addr()})
+	require.NoError(t, err)
+	t.Cleanup(func() { redis.Close() })
+	return redis
+}
+
+func TestTieredCacheFetch(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache := NewTieredCache(newTestRedis(t, mr), 10, time.Minute)
+	ctx := context.Background()
+
+	loads := 0
+	load := func(ctx context.Context) (interface{}, error) {
+		loads++
+		return cachedThing{Name: "first"}, nil
+	}
+
+	var got cachedThing
+	require.NoError(t, cache.Fetch(ctx, "things", "1", &got, load))
+	assert.Equal(t, "first", got.Name)
+	require.NoError(t, cache.Fetch(ctx, "things", "1", &got, load))
+	assert.Equal(t, 1, loads)
+
+	// A fresh instance misses locally but hits Redis
+	other := NewTieredCache(newTestRedis(t, mr), 10, time.Minute)
+	require.NoError(t, other.Fetch(ctx, "things", "1", &got, load))
+	assert.Equal(t, 1, loads)
+
+	assert.Equal(t, CacheStats{LocalHits: 1, Misses: 1}, cache.Stats())
+	assert.Equal(t, CacheStats{RedisHits: 1}, other.Stats())
+}
+
+func TestTieredCacheCrossInstanceInvalidation(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replicaA := NewTieredCache(newTestRedis(t, mr), 10, time.Minute)
+	replicaB := NewTieredCache(newTestRedis(t, mr), 10, time.Minute)
+	go replicaA.Run(ctx)
+
+	name := "old"
+	load := func(ctx context.Context) (interface{}, error) {
+		return cachedThing{Name: name}, nil
+	}
+
+	// Wait until the subscription is live before populating the local tier
+	require.Eventually(t, func() bool {
+		return len(mr.PubSubChannels("")) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	var got cachedThing
+	require.NoError(t, replicaA.Fetch(ctx, "things", "1", &got, load))
+	assert.Equal(t, "old", got.Name)
+
+	name = "new"
+	require.NoError(t, replicaB.Invalidate(ctx, "things", "1"))
+
+	assert.Eventually(t, func() bool {
+		var got cachedThing
+		return replicaA.Fetch(ctx, "things", "1", &got, load) == nil && got.Name == "new"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTieredCacheRejectsStaleWrites(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache := NewTieredCache(newTestRedis(t, mr), 10, time.Minute)
+	ctx := context.Background()
+	key := cacheKey("things", "1")
+
+	// A loader that read version 0 must not overwrite data once the key has
+	// been invalidated underneath it.
+	require.NoError(t, cache.Invalidate(ctx, "things", "1"))
+	assert.False(t, cache.writeRedis(ctx, key, 0, []byte(`{"name":"stale"}`)))
+	assert.True(t, cache.writeRedis(ctx, key, 1, []byte(`{"name":"fresh"}`)))
+
+	version, payload, err := cache.readRedis(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), version)
+	assert.JSONEq(t, `{"name":"fresh"}`, string(payload))
+}
@@ -0,0 +1,218 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kordlab/marketplace/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrProductNotForSale   = errors.New("product is not for sale")
+	ErrOwnProduct          = errors.New("you cannot buy your own product")
+	ErrAlreadyOwned        = errors.New("you already own this product")
+	ErrInsufficientCredits = errors.New("insufficient credits")
+)
+
+// CheckoutResult is what a completed checkout produced
+type CheckoutResult struct {
+	Purchase   *Purchase         `json:"purchase"`
+	Quote      *PriceQuote       `json:"quote"`
+	Redemption *CouponRedemption `json:"redemption,omitempty"`
+	// Balance is the buyer's credit balance after the purchase
+	Balance money.Money `json:"balance"`
+}
+
+// SplitSale divides a sale price into the marketplace's commission and the
+// creator's earnings. The commission is rounded half to even and the
+// earnings are what is left, so the two always add up to the price.
+func SplitSale(price money.Money, commissionRate float64) (commission, earnings money.Money) {
+	return price.Split(commissionRate)
+}
+
+// CheckoutService sells products for credits
+type CheckoutService struct {
+	mongo        *MongoDB
+	products     *ProductRepository
+	coupons      *CouponRepository
+	entitlements *EntitlementRepository
+	settings     *SettingsRepository
+	ledger       *LedgerRepository
+	rates        *ExchangeRateRepository
+}
+
+func NewCheckoutService(mongo *MongoDB, products *ProductRepository, coupons *CouponRepository,
+	entitlements *EntitlementRepository, settings *SettingsRepository, ledger *LedgerRepository,
+	rates *ExchangeRateRepository) *CheckoutService {
+	return &CheckoutService{
+		mongo:        mongo,
+		products:     products,
+		coupons:      coupons,
+		entitlements: entitlements,
+		settings:     settings,
+		ledger:       ledger,
+		rates:        rates,
+	}
+}
+
+// Checkout buys productID for buyerID with an optional coupon code. The
+// quote, in the product's currency, is charged in SettlementCurrency at the
+// current exchange rate. Every read and write happens in one transaction:
+// the buyer is debited, the creator's pending earnings are credited minus
+// the marketplace commission, the sale is posted to the ledger, the coupon
+// is redeemed, and the purchase and its entitlements are stored, or none of
+// it is. Concurrent checkouts by the same buyer both write the buyer's
+// document, so one of them conflicts and is retried against the balance the
+// other left behind.
+func (s *CheckoutService) Checkout(ctx context.Context, buyerID, productID primitive.ObjectID, couponCode string) (*CheckoutResult, error) {
+	result, err := s.mongo.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return s.checkout(sc, buyerID, productID, couponCode)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*CheckoutResult), nil
+}
+
+// checkout runs inside the transaction and may be retried, so it must not
+// carry state between attempts
+func (s *CheckoutService) checkout(ctx mongo.SessionContext, buyerID, productID primitive.ObjectID, couponCode string) (*CheckoutResult, error) {
+	product, err := s.products.FindByID(ctx, productID)
+	if err == ErrProductNotFound {
+		return nil, ErrProductNotForSale
+	}
+	if err != nil {
+		return nil, err
+	}
+	if product.Status != ProductStatusActive {
+		return nil, ErrProductNotForSale
+	}
+	if product.CreatorID == buyerID {
+		return nil, ErrOwnProduct
+	}
+	owned, err := s.entitlements.OwnedProducts(ctx, buyerID, []primitive.ObjectID{product.ID})
+	if err != nil {
+		return nil, err
+	}
+	if owned[product.ID] {
+		return nil, ErrAlreadyOwned
+	}
+
+	var items []Product
+	var credits []PriceAdjustment
+	if product.IsBundle() {
+		if items, err = s.products.FindMany(ctx, product.Bundle.Items); err != nil {
+			return nil, err
+		}
+		if credits, err = s.entitlements.OwnedItemsCredit(ctx, product, items, buyerID); err != nil {
+			return nil, err
+		}
+	}
+	quote, err := s.coupons.Quote(ctx, product, credits, couponCode, buyerID)
+	if err != nil {
+		return nil, err
+	}
+
+	rates, err := s.rates.Rates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	charged, rate, err := rates.Convert(quote.FinalPrice, SettlementCurrency)
+	if err != nil {
+		return nil, err
+	}
+	purchase, err := product.NewPurchase(buyerID, charged)
+	if err != nil {
+		return nil, err
+	}
+	purchase.QuotedPrice, purchase.ExchangeRate = quote.FinalPrice, rate
+	purchase.Status = PurchaseStatusCompleted
+
+	balance, err := s.debit(ctx, buyerID, purchase.Price)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := s.settings.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	commission, earnings := SplitSale(purchase.Price, settings.CommissionRate)
+	if earnings.IsPositive() {
+		if err := s.creditCreator(ctx, product, earnings); err != nil {
+			return nil, err
+		}
+	}
+	entry := NewLedgerEntry(CreditTransactionPurchase, purchase.ID, fmt.Sprintf("Purchase of %s", product.Title)).
+		Debit(BalanceAccount(buyerID), purchase.Price).
+		Credit(EarningsAccount(product.CreatorID), earnings).
+		Credit(AccountCommission, commission)
+	if err := s.ledger.Post(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	redemption, err := s.coupons.Redeem(ctx, quote, buyerID, purchase.ID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.mongo.Purchases().InsertOne(ctx, purchase); err != nil {
+		return nil, err
+	}
+	if err := s.entitlements.Grant(ctx, EntitlementsForPurchase(purchase, product, items)); err != nil {
+		return nil, err
+	}
+
+	return &CheckoutResult{
+		Purchase:   purchase,
+		Quote:      quote,
+		Redemption: redemption,
+		Balance:    balance,
+	}, nil
+}
+
+// debit takes price off an active buyer's balance and returns the new
+// balance
+func (s *CheckoutService) debit(ctx context.Context, buyerID primitive.ObjectID, price money.Money) (money.Money, error) {
+	var buyer User
+	err := s.mongo.Users().FindOneAndUpdate(ctx, bson.M{
+		"_id":                    buyerID,
+		"status":                 UserStatusActive,
+		"credits.balance.amount": bson.M{"$gte": price.Amount},
+	}, bson.M{
+		"$inc": bson.M{"credits.balance.amount": -price.Amount},
+	}, options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"credits.balance": 1}),
+	).Decode(&buyer)
+	if err != mongo.ErrNoDocuments {
+		return buyer.Credits.Balance, err
+	}
+
+	// Tell a missing or suspended buyer apart from a short balance
+	n, err := s.mongo.Users().CountDocuments(ctx, bson.M{"_id": buyerID, "status": UserStatusActive})
+	if err != nil {
+		return money.Money{}, err
+	}
+	if n == 0 {
+		return money.Money{}, ErrUserNotFound
+	}
+	return money.Money{}, ErrInsufficientCredits
+}
+
+// creditCreator adds the creator's share of a sale to their pending earnings
+func (s *CheckoutService) creditCreator(ctx context.Context, product *Product, earnings money.Money) error {
+	res, err := s.mongo.Users().UpdateOne(ctx, bson.M{"_id": product.CreatorID},
+		bson.M{"$inc": bson.M{"credits.pending_earnings.amount": earnings.Amount}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("creator %s of product %s not found", product.CreatorID.Hex(), product.ID.Hex())
+	}
+	return nil
+}
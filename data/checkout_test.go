@@ -0,0 +1,250 @@
+package data
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kordlab/marketplace/config"
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestSplitSale(t *testing.T) {
+	tests := []struct {
+		price, commission, earnings int64
+		rate                        float64
+	}{
+		{price: 2000, rate: 0.15, commission: 300, earnings: 1700},
+		{price: 999, rate: 0.15, commission: 150, earnings: 849},
+		{price: 1010, rate: 0.15, commission: 152, earnings: 858},
+		{price: 1, rate: 0.3, commission: 0, earnings: 1},
+		{price: 1000, rate: 0, commission: 0, earnings: 1000},
+		{price: 1000, rate: 1.5, commission: 1000, earnings: 0},
+		{price: 1000, rate: -0.2, commission: 0, earnings: 1000},
+	}
+	for _, tt := range tests {
+		commission, earnings := SplitSale(usd(tt.price), tt.rate)
+		assert.Equal(t, usd(tt.commission), commission, "commission on %v at %v", tt.price, tt.rate)
+		assert.Equal(t, usd(tt.earnings), earnings, "earnings on %v at %v", tt.price, tt.rate)
+	}
+}
+
+// newCheckoutTestService connects to the configured MongoDB, which must be a
+// replica set for transactions, using a throwaway database
+func newCheckoutTestService(t *testing.T) (*CheckoutService, *MongoDB) {
+	cfg := config.LoadConfig()
+	cfg.DatabaseName = "marketplace_checkout_test_" + primitive.NewObjectID().Hex()
+	m, err := NewMongoDB(cfg)
+	if err != nil {
+		t.Skipf("MongoDB unavailable: %v", err)
+	}
+	ctx := context.Background()
+	var hello bson.M
+	if err := m.client.Database("admin").RunCommand(ctx, bson.M{"hello": 1}).Decode(&hello); err != nil || hello["setName"] == nil {
+		m.Close(ctx)
+		t.Skip("checkout needs a MongoDB replica set")
+	}
+	t.Cleanup(func() {
+		m.database.Drop(ctx)
+		m.Close(ctx)
+	})
+
+	products := NewProductRepository(m, nil)
+	rates := NewExchangeRateRepository(m, NewTieredCache(m.redis, 100, time.Minute))
+	service := NewCheckoutService(m, products, NewCouponRepository(m), NewEntitlementRepository(m),
+		NewSettingsRepository(m), NewLedgerRepository(m), rates)
+	return service, m
+}
+
+func seedCheckout(t *testing.T, m *MongoDB, balance money.Money, prices ...money.Money) (buyer, creator primitive.ObjectID, products []primitive.ObjectID) {
+	ctx := context.Background()
+	buyer, creator = primitive.NewObjectID(), primitive.NewObjectID()
+	for _, u := range []User{
+		{ID: buyer, Username: "buyer", Email: "buyer@example.com", Status: UserStatusActive, Credits: Credits{Balance: balance}},
+		{ID: creator, Username: "creator", Email: "creator@example.com", Role: RoleCreator, Status: UserStatusActive},
+	} {
+		_, err := m.Users().InsertOne(ctx, u)
+		require.NoError(t, err)
+	}
+	for _, price := range prices {
+		p := Product{
+			ID:        primitive.NewObjectID(),
+			CreatorID: creator,
+			Title:     "Starter kit",
+			Price:     price,
+			Category:  CategoryTemplate,
+			Status:    ProductStatusActive,
+			Versions:  []ProductVersion{{Version: "1.0.0", Status: VersionStatusPublished}},
+			CreatedAt: time.Now(),
+		}
+		_, err := m.Products().InsertOne(ctx, p)
+		require.NoError(t, err)
+		products = append(products, p.ID)
+	}
+	return buyer, creator, products
+}
+
+func loadCredits(t *testing.T, m *MongoDB, id primitive.ObjectID) Credits {
+	var u User
+	require.NoError(t, m.Users().FindOne(context.Background(), bson.M{"_id": id}).Decode(&u))
+	return u.Credits
+}
+
+func TestCheckout(t *testing.T) {
+	service, m := newCheckoutTestService(t)
+	ctx := context.Background()
+	buyer, creator, products := seedCheckout(t, m, usd(5000), usd(2000))
+
+	result, err := service.Checkout(ctx, buyer, products[0], "")
+	require.NoError(t, err)
+	assert.Equal(t, PurchaseStatusCompleted, result.Purchase.Status)
+	assert.Equal(t, "1.0.0", result.Purchase.ProductVersion)
+	assert.Equal(t, usd(3000), result.Balance)
+
+	assert.Equal(t, usd(1700), loadCredits(t, m, creator).PendingEarnings, "default commission is kept")
+	// The seeded balance never went through the ledger, so only the sale shows
+	ledger := NewLedgerRepository(m)
+	for account, want := range map[string]money.Money{
+		BalanceAccount(buyer):    usd(-2000),
+		EarningsAccount(creator): usd(1700),
+		AccountCommission:        usd(300),
+	} {
+		balance, err := ledger.Balance(ctx, account)
+		require.NoError(t, err)
+		assert.Equal(t, want, balance, account)
+	}
+
+	_, err = NewEntitlementRepository(m).Find(ctx, buyer, products[0], result.Purchase.ID)
+	assert.NoError(t, err)
+
+	page, err := pagination.New("test").Parse(url.Values{}, pagination.Sort{Field: "created_at", Desc: true}, "purchases")
+	require.NoError(t, err)
+	purchases, err := NewPurchaseRepository(m).ListForUser(ctx, buyer, page)
+	require.NoError(t, err)
+	require.Len(t, purchases, 1)
+	assert.Equal(t, result.Purchase.ID, purchases[0].ID)
+	purchases, err = NewPurchaseRepository(m).ListForUser(ctx, creator, page)
+	require.NoError(t, err)
+	assert.Empty(t, purchases, "only the buyer's own purchases are listed")
+
+	_, err = service.Checkout(ctx, buyer, products[0], "")
+	assert.Equal(t, ErrAlreadyOwned, err)
+	_, err = service.Checkout(ctx, creator, products[0], "")
+	assert.Equal(t, ErrOwnProduct, err)
+}
+
+func TestCheckoutConvertsCurrency(t *testing.T) {
+	service, m := newCheckoutTestService(t)
+	ctx := context.Background()
+	buyer, creator, products := seedCheckout(t, m, usd(5000), money.New(1000, "EUR"))
+
+	_, err := service.Checkout(ctx, buyer, products[0], "")
+	assert.Equal(t, ErrUnsupportedCurrency, err, "products in a currency without a rate cannot be sold")
+
+	require.NoError(t, service.rates.Set(ctx, []ExchangeRate{{Currency: "eur", Rate: 0.8, Source: "test"}}))
+	result, err := service.Checkout(ctx, buyer, products[0], "")
+	require.NoError(t, err)
+	assert.Equal(t, usd(1250), result.Purchase.Price)
+	assert.Equal(t, money.New(1000, "EUR"), result.Purchase.QuotedPrice)
+	assert.Equal(t, 1.25, result.Purchase.ExchangeRate)
+	assert.Equal(t, usd(3750), result.Balance)
+	assert.Equal(t, usd(1062), loadCredits(t, m, creator).PendingEarnings, "commission is taken from the charged price")
+
+	var stored Product
+	require.NoError(t, m.Products().FindOne(ctx, bson.M{"_id": products[0]}).Decode(&stored))
+	assert.Equal(t, usd(1250), stored.ReferencePrice, "setting a rate reprices the catalog")
+}
+
+func TestCheckoutRollsBack(t *testing.T) {
+	service, m := newCheckoutTestService(t)
+	ctx := context.Background()
+	buyer, creator, products := seedCheckout(t, m, usd(5000), usd(2000))
+
+	// With the creator gone the sale fails after the buyer was debited
+	_, err := m.Users().DeleteOne(ctx, bson.M{"_id": creator})
+	require.NoError(t, err)
+
+	_, err = service.Checkout(ctx, buyer, products[0], "")
+	require.Error(t, err)
+
+	assert.Equal(t, Credits{Balance: usd(5000), PendingEarnings: usd(0)}, loadCredits(t, m, buyer))
+	for _, coll := range []*mongo.Collection{m.Purchases(), m.Ledger()} {
+		n, err := coll.CountDocuments(ctx, bson.M{})
+		require.NoError(t, err)
+		assert.Zero(t, n, coll.Name())
+	}
+}
+
+func TestCheckoutDoubleSpend(t *testing.T) {
+	const attempts = 8
+
+	t.Run("different products", func(t *testing.T) {
+		service, m := newCheckoutTestService(t)
+		prices := make([]money.Money, attempts)
+		for i := range prices {
+			prices[i] = usd(2000)
+		}
+		buyer, creator, products := seedCheckout(t, m, usd(3000), prices...)
+
+		errs := make([]error, attempts)
+		var wg sync.WaitGroup
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = service.Checkout(context.Background(), buyer, products[i], "")
+			}(i)
+		}
+		wg.Wait()
+
+		succeeded := 0
+		for _, err := range errs {
+			if err == nil {
+				succeeded++
+				continue
+			}
+			assert.Equal(t, ErrInsufficientCredits, err)
+		}
+		assert.Equal(t, 1, succeeded)
+		assert.Equal(t, usd(1000), loadCredits(t, m, buyer).Balance)
+		assert.Equal(t, usd(1700), loadCredits(t, m, creator).PendingEarnings)
+	})
+
+	t.Run("same product", func(t *testing.T) {
+		service, m := newCheckoutTestService(t)
+		buyer, _, products := seedCheckout(t, m, usd(10000), usd(2000))
+
+		errs := make([]error, attempts)
+		var wg sync.WaitGroup
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = service.Checkout(context.Background(), buyer, products[0], "")
+			}(i)
+		}
+		wg.Wait()
+
+		succeeded := 0
+		for _, err := range errs {
+			if err == nil {
+				succeeded++
+				continue
+			}
+			assert.Equal(t, ErrAlreadyOwned, err)
+		}
+		assert.Equal(t, 1, succeeded)
+		assert.Equal(t, usd(8000), loadCredits(t, m, buyer).Balance)
+		n, err := m.Purchases().CountDocuments(context.Background(), bson.M{"user_id": buyer})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+	})
+}
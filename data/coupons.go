@@ -0,0 +1,374 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrCouponNotFound      = errors.New("coupon not found")
+	ErrCouponCodeTaken     = errors.New("coupon code is already in use")
+	ErrCouponInactive      = errors.New("coupon is not active")
+	ErrCouponNotStarted    = errors.New("coupon is not valid yet")
+	ErrCouponExpired       = errors.New("coupon has expired")
+	ErrCouponExhausted     = errors.New("coupon has reached its redemption limit")
+	ErrCouponUserLimit     = errors.New("you have already used this coupon the maximum number of times")
+	ErrCouponNotApplicable = errors.New("coupon does not apply to this product")
+	ErrCouponMinSpend      = errors.New("order does not reach the coupon's minimum spend")
+)
+
+// Price adjustment kinds
+const (
+	AdjustmentSale   = "sale"
+	AdjustmentCoupon = "coupon"
+)
+
+// PriceAdjustment is one step in deriving a price. Amount is negative for
+// discounts and Subtotal is the running price after the step.
+type PriceAdjustment struct {
+	Kind        string      `json:"kind"`
+	Code        string      `json:"code,omitempty"`
+	Description string      `json:"description"`
+	Amount      money.Money `json:"amount"`
+	Subtotal    money.Money `json:"subtotal"`
+}
+
+// PriceQuote shows how a product's final price is derived from its list
+// price
+type PriceQuote struct {
+	ProductID   primitive.ObjectID `json:"product_id"`
+	ListPrice   money.Money        `json:"list_price"`
+	Adjustments []PriceAdjustment  `json:"adjustments"`
+	FinalPrice  money.Money        `json:"final_price"`
+	// LocalFinalPrice is FinalPrice in the currency the client asked for,
+	// for display only
+	LocalFinalPrice *money.Money `json:"local_final_price,omitempty"`
+	// Coupon is the applied coupon, needed to redeem it at checkout
+	Coupon *Coupon `json:"-"`
+}
+
+// CouponDiscount returns the discount the applied coupon contributed
+func (q *PriceQuote) CouponDiscount() money.Money {
+	for _, adj := range q.Adjustments {
+		if adj.Kind == AdjustmentCoupon {
+			return adj.Amount.Neg()
+		}
+	}
+	return money.Zero(q.FinalPrice.Currency)
+}
+
+// NormalizeCouponCode makes coupon codes case-insensitive
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Check reports why the coupon cannot be applied to product at subtotal, or
+// nil if it can. Per-user limits need the redemption history and are checked
+// by the repository.
+func (c *Coupon) Check(product *Product, subtotal money.Money, now time.Time) error {
+	switch {
+	case !c.Active:
+		return ErrCouponInactive
+	case !c.StartsAt.IsZero() && now.Before(c.StartsAt):
+		return ErrCouponNotStarted
+	case !c.EndsAt.IsZero() && !now.Before(c.EndsAt):
+		return ErrCouponExpired
+	case c.MaxRedemptions > 0 && c.RedemptionCount >= c.MaxRedemptions:
+		return ErrCouponExhausted
+	case !c.CreatorID.IsZero() && c.CreatorID != product.CreatorID:
+		return ErrCouponNotApplicable
+	case (c.Type == CouponTypeFixed || c.MinSpend.IsPositive()) && !subtotal.SameCurrency(money.Zero(c.Currency)):
+		return ErrCouponNotApplicable
+	case subtotal.Amount < c.MinSpend.Amount:
+		return ErrCouponMinSpend
+	}
+	if len(c.ProductIDs) > 0 {
+		for _, id := range c.ProductIDs {
+			if id == product.ID {
+				return nil
+			}
+		}
+		return ErrCouponNotApplicable
+	}
+	return nil
+}
+
+// Discount returns how much the coupon takes off subtotal. Percentages are
+// rounded half to even; a fixed discount never exceeds the subtotal.
+func (c *Coupon) Discount(subtotal money.Money) money.Money {
+	switch c.Type {
+	case CouponTypePercentage:
+		return subtotal.Mul(math.Min(c.Percent, 100) / 100)
+	case CouponTypeFixed:
+		if c.Amount.SameCurrency(subtotal) {
+			return money.Min(c.Amount, subtotal)
+		}
+	}
+	return money.Zero(subtotal.Currency)
+}
+
+// EffectivePrice is what the product sells for before credits and coupons:
+// its sale price while one is set, otherwise its list price
+func (p *Product) EffectivePrice() money.Money {
+	if p.DiscountedPrice.IsPositive() && p.DiscountedPrice.Amount < p.Price.Amount {
+		return p.DiscountedPrice
+	}
+	return p.Price
+}
+
+// QuotePrice prices product, applying its sale price, then any credits such
+// as owned bundle items, then coupon, if given. The coupon's own limits are
+// checked against now.
+func QuotePrice(product *Product, credits []PriceAdjustment, coupon *Coupon, now time.Time) (*PriceQuote, error) {
+	q := &PriceQuote{
+		ProductID:   product.ID,
+		ListPrice:   product.Price,
+		Adjustments: []PriceAdjustment{},
+		FinalPrice:  product.Price,
+	}
+
+	if sale := product.EffectivePrice(); sale.Amount < product.Price.Amount {
+		q.Adjustments = append(q.Adjustments, PriceAdjustment{
+			Kind:        AdjustmentSale,
+			Description: "Sale price",
+			Amount:      sale.Sub(product.Price),
+			Subtotal:    sale,
+		})
+		q.FinalPrice = sale
+	}
+
+	for _, credit := range credits {
+		q.FinalPrice = money.Max(q.FinalPrice.Add(credit.Amount), money.Zero(q.FinalPrice.Currency))
+		credit.Subtotal = q.FinalPrice
+		q.Adjustments = append(q.Adjustments, credit)
+	}
+
+	if coupon != nil {
+		if err := coupon.Check(product, q.FinalPrice, now); err != nil {
+			return nil, err
+		}
+		discount := coupon.Discount(q.FinalPrice)
+		description := fmt.Sprintf("%g%% off", coupon.Percent)
+		if coupon.Type == CouponTypeFixed {
+			description = fmt.Sprintf("%s off", coupon.Amount.Display())
+		}
+		q.FinalPrice = q.FinalPrice.Sub(discount)
+		q.Adjustments = append(q.Adjustments, PriceAdjustment{
+			Kind:        AdjustmentCoupon,
+			Code:        coupon.Code,
+			Description: description,
+			Amount:      discount.Neg(),
+			Subtotal:    q.FinalPrice,
+		})
+		q.Coupon = coupon
+	}
+	return q, nil
+}
+
+// CouponRepository stores coupons, per-user usage counters and redemptions
+type CouponRepository struct {
+	mongo *MongoDB
+}
+
+func NewCouponRepository(mongo *MongoDB) *CouponRepository {
+	return &CouponRepository{mongo: mongo}
+}
+
+func (r *CouponRepository) Create(ctx context.Context, coupon *Coupon) error {
+	coupon.Code = NormalizeCouponCode(coupon.Code)
+	_, err := r.mongo.Coupons().InsertOne(ctx, coupon)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrCouponCodeTaken
+	}
+	return err
+}
+
+func (r *CouponRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*Coupon, error) {
+	return r.findOne(ctx, bson.M{"_id": id})
+}
+
+func (r *CouponRepository) FindByCode(ctx context.Context, code string) (*Coupon, error) {
+	return r.findOne(ctx, bson.M{"code": NormalizeCouponCode(code)})
+}
+
+func (r *CouponRepository) findOne(ctx context.Context, filter bson.M) (*Coupon, error) {
+	var coupon Coupon
+	err := r.mongo.Coupons().FindOne(ctx, filter).Decode(&coupon)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrCouponNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+// Update applies a $set to the coupon and maintains UpdatedAt
+func (r *CouponRepository) Update(ctx context.Context, id primitive.ObjectID, set bson.M) error {
+	fields := bson.M{"updated_at": time.Now()}
+	for k, v := range set {
+		fields[k] = v
+	}
+	res, err := r.mongo.Coupons().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrCouponNotFound
+	}
+	return nil
+}
+
+// ListByCreator returns a page of a creator's coupons, or of platform
+// coupons when creatorID is zero
+func (r *CouponRepository) ListByCreator(ctx context.Context, creatorID primitive.ObjectID, page pagination.Request) ([]Coupon, error) {
+	filter := bson.M{"creator_id": creatorID}
+	if creatorID.IsZero() {
+		filter = bson.M{"creator_id": bson.M{"$exists": false}}
+	}
+	return findPage[Coupon](ctx, r.mongo.Coupons(), filter, page)
+}
+
+// UserRedemptions returns how many times userID has redeemed the coupon
+func (r *CouponRepository) UserRedemptions(ctx context.Context, couponID, userID primitive.ObjectID) (int, error) {
+	var usage struct {
+		Count int `bson:"count"`
+	}
+	err := r.mongo.CouponUsage().FindOne(ctx, bson.M{"coupon_id": couponID, "user_id": userID}).Decode(&usage)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return usage.Count, err
+}
+
+// Quote prices product for userID with credits and the coupon named by
+// code, if any. userID may be zero for anonymous quotes, which skips the
+// per-user limit.
+func (r *CouponRepository) Quote(ctx context.Context, product *Product, credits []PriceAdjustment, code string, userID primitive.ObjectID) (*PriceQuote, error) {
+	if code == "" {
+		return QuotePrice(product, credits, nil, time.Now())
+	}
+	coupon, err := r.FindByCode(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if coupon.PerUserLimit > 0 && !userID.IsZero() {
+		used, err := r.UserRedemptions(ctx, coupon.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if used >= coupon.PerUserLimit {
+			return nil, ErrCouponUserLimit
+		}
+	}
+	return QuotePrice(product, credits, coupon, time.Now())
+}
+
+// Redeem counts one use of the quote's coupon by userID. The per-user and
+// global counters are each incremented with a conditional update, so
+// concurrent checkouts cannot push either past its limit; if the global
+// limit is hit the per-user increment is undone.
+func (r *CouponRepository) Redeem(ctx context.Context, quote *PriceQuote, userID, purchaseID primitive.ObjectID) (*CouponRedemption, error) {
+	coupon := quote.Coupon
+	if coupon == nil {
+		return nil, nil
+	}
+
+	// The usage document is upserted; when the user is at their limit the
+	// filter misses, the upsert collides with the unique index and the
+	// redemption is refused.
+	usageFilter := bson.M{"coupon_id": coupon.ID, "user_id": userID}
+	if coupon.PerUserLimit > 0 {
+		usageFilter["count"] = bson.M{"$lt": coupon.PerUserLimit}
+	}
+	_, err := r.mongo.CouponUsage().UpdateOne(ctx, usageFilter,
+		bson.M{"$inc": bson.M{"count": 1}}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrCouponUserLimit
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	res, err := r.mongo.Coupons().UpdateOne(ctx, bson.M{
+		"_id":    coupon.ID,
+		"active": true,
+		"$expr": bson.M{"$or": bson.A{
+			bson.M{"$eq": bson.A{"$max_redemptions", 0}},
+			bson.M{"$lt": bson.A{"$redemption_count", "$max_redemptions"}},
+		}},
+	}, bson.M{
+		"$inc": bson.M{"redemption_count": 1},
+		"$set": bson.M{"updated_at": now},
+	})
+	if err == nil && res.MatchedCount == 0 {
+		err = ErrCouponExhausted
+	}
+	if err != nil {
+		if _, undoErr := r.mongo.CouponUsage().UpdateOne(ctx,
+			bson.M{"coupon_id": coupon.ID, "user_id": userID},
+			bson.M{"$inc": bson.M{"count": -1}}); undoErr != nil {
+			return nil, fmt.Errorf("%w (and failed to release per-user count: %v)", err, undoErr)
+		}
+		return nil, err
+	}
+
+	redemption := &CouponRedemption{
+		ID:         primitive.NewObjectID(),
+		CouponID:   coupon.ID,
+		Code:       coupon.Code,
+		UserID:     userID,
+		ProductID:  quote.ProductID,
+		PurchaseID: purchaseID,
+		Discount:   quote.CouponDiscount(),
+		CreatedAt:  now,
+	}
+	if _, err := r.mongo.CouponRedemptions().InsertOne(ctx, redemption); err != nil {
+		return nil, err
+	}
+	return redemption, nil
+}
+
+// Release gives back the coupon use redeemed for purchaseID once the
+// purchase is reversed: the redemption is marked reversed and the per-user
+// and global counters Redeem incremented are decremented. Purchases made
+// without a coupon, or whose redemption was already released, are left
+// alone. Callers release inside the transaction that reverses the purchase.
+func (r *CouponRepository) Release(ctx context.Context, purchaseID primitive.ObjectID) error {
+	now := time.Now()
+	var redemption CouponRedemption
+	err := r.mongo.CouponRedemptions().FindOneAndUpdate(ctx,
+		bson.M{"purchase_id": purchaseID, "reversed_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"reversed_at": now}}).Decode(&redemption)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.mongo.CouponUsage().UpdateOne(ctx,
+		bson.M{"coupon_id": redemption.CouponID, "user_id": redemption.UserID, "count": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"count": -1}}); err != nil {
+		return err
+	}
+	_, err = r.mongo.Coupons().UpdateOne(ctx,
+		bson.M{"_id": redemption.CouponID, "redemption_count": bson.M{"$gt": 0}},
+		bson.M{
+			"$inc": bson.M{"redemption_count": -1},
+			"$set": bson.M{"updated_at": now},
+		})
+	return err
+}
@@ -0,0 +1,128 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// usd returns cents US cents
+func usd(cents int64) money.Money {
+	return money.New(cents, money.DefaultCurrency)
+}
+
+func TestQuotePrice(t *testing.T) {
+	creator := primitive.NewObjectID()
+	product := &Product{ID: primitive.NewObjectID(), CreatorID: creator, Price: usd(5000), DiscountedPrice: usd(4000)}
+	now := time.Now()
+
+	quote, err := QuotePrice(product, nil, nil, now)
+	require.NoError(t, err)
+	assert.Equal(t, usd(4000), quote.FinalPrice)
+	require.Len(t, quote.Adjustments, 1)
+	assert.Equal(t, AdjustmentSale, quote.Adjustments[0].Kind)
+	assert.Equal(t, usd(-1000), quote.Adjustments[0].Amount)
+
+	percent := &Coupon{Code: "SAVE15", Type: CouponTypePercentage, Percent: 15, CreatorID: creator, Active: true}
+	quote, err = QuotePrice(product, nil, percent, now)
+	require.NoError(t, err)
+	assert.Equal(t, usd(3400), quote.FinalPrice)
+	assert.Equal(t, usd(600), quote.CouponDiscount())
+	assert.Equal(t, []money.Money{usd(4000), usd(3400)}, []money.Money{quote.Adjustments[0].Subtotal, quote.Adjustments[1].Subtotal})
+
+	fixed := &Coupon{Code: "TAKE100", Type: CouponTypeFixed, Amount: usd(10000), Active: true}
+	quote, err = QuotePrice(product, nil, fixed, now)
+	require.NoError(t, err)
+	assert.Equal(t, usd(0), quote.FinalPrice, "fixed discounts never go below zero")
+
+	odd := &Coupon{Code: "THIRD", Type: CouponTypePercentage, Percent: 33.333, Active: true}
+	quote, err = QuotePrice(&Product{Price: usd(999)}, nil, odd, now)
+	require.NoError(t, err)
+	assert.Equal(t, usd(333), quote.CouponDiscount())
+	assert.Equal(t, usd(666), quote.FinalPrice)
+
+	euro := &Coupon{Code: "EURO", Type: CouponTypeFixed, Amount: money.New(110, "EUR"), Currency: "EUR", Active: true}
+	quote, err = QuotePrice(&Product{Price: money.New(1000, "EUR")}, nil, euro, now)
+	require.NoError(t, err)
+	assert.Equal(t, money.New(890, "EUR"), quote.FinalPrice, "fixed discounts are exact")
+	assert.Equal(t, "1.10 EUR off", quote.Adjustments[0].Description)
+}
+
+func TestCouponCheck(t *testing.T) {
+	creator := primitive.NewObjectID()
+	product := &Product{ID: primitive.NewObjectID(), CreatorID: creator, Price: usd(5000)}
+	now := time.Now()
+
+	base := Coupon{Type: CouponTypeFixed, Amount: usd(500), Active: true}
+	tests := []struct {
+		name   string
+		modify func(c *Coupon)
+		err    error
+	}{
+		{"Store Wide", func(c *Coupon) {}, nil},
+		{"Creator Store Wide", func(c *Coupon) { c.CreatorID = creator }, nil},
+		{"Other Creator", func(c *Coupon) { c.CreatorID = primitive.NewObjectID() }, ErrCouponNotApplicable},
+		{"Listed Product", func(c *Coupon) { c.ProductIDs = []primitive.ObjectID{product.ID} }, nil},
+		{"Unlisted Product", func(c *Coupon) { c.ProductIDs = []primitive.ObjectID{primitive.NewObjectID()} }, ErrCouponNotApplicable},
+		{"Inactive", func(c *Coupon) { c.Active = false }, ErrCouponInactive},
+		{"Not Started", func(c *Coupon) { c.StartsAt = now.Add(time.Hour) }, ErrCouponNotStarted},
+		{"Expired", func(c *Coupon) { c.EndsAt = now.Add(-time.Hour) }, ErrCouponExpired},
+		{"Within Window", func(c *Coupon) { c.StartsAt, c.EndsAt = now.Add(-time.Hour), now.Add(time.Hour) }, nil},
+		{"Exhausted", func(c *Coupon) { c.MaxRedemptions, c.RedemptionCount = 10, 10 }, ErrCouponExhausted},
+		{"Below Minimum Spend", func(c *Coupon) { c.MinSpend = usd(6000) }, ErrCouponMinSpend},
+		{"Meets Minimum Spend", func(c *Coupon) { c.MinSpend = usd(5000) }, nil},
+		{"Fixed In Other Currency", func(c *Coupon) { c.Currency = "EUR" }, ErrCouponNotApplicable},
+		{"Minimum Spend In Other Currency", func(c *Coupon) {
+			c.Type, c.Currency, c.MinSpend = CouponTypePercentage, "EUR", money.New(1000, "EUR")
+		}, ErrCouponNotApplicable},
+		{"Percentage In Other Currency", func(c *Coupon) { c.Type, c.Currency = CouponTypePercentage, "EUR" }, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coupon := base
+			tt.modify(&coupon)
+			assert.Equal(t, tt.err, coupon.Check(product, product.Price, now))
+		})
+	}
+}
+
+func TestMigrateCouponValues(t *testing.T) {
+	_, m := newCheckoutTestService(t)
+	ctx := context.Background()
+
+	percent, fixed, euro := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	_, err := m.Coupons().InsertMany(ctx, []interface{}{
+		bson.M{"_id": percent, "code": "SAVE15", "type": CouponTypePercentage, "value": 15.5, "min_spend": 20},
+		bson.M{"_id": fixed, "code": "TAKE5", "type": CouponTypeFixed, "value": 4.99},
+		bson.M{"_id": euro, "code": "EURO", "type": CouponTypeFixed, "value": 2.5, "currency": "EUR"},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, m.MigrateMoney(ctx))
+	require.NoError(t, m.MigrateMoney(ctx), "running again is a no-op")
+
+	load := func(id primitive.ObjectID) (Coupon, bson.M) {
+		var coupon Coupon
+		var raw bson.M
+		require.NoError(t, m.Coupons().FindOne(ctx, bson.M{"_id": id}).Decode(&coupon))
+		require.NoError(t, m.Coupons().FindOne(ctx, bson.M{"_id": id}).Decode(&raw))
+		assert.NotContains(t, raw, "value")
+		return coupon, raw
+	}
+	coupon, _ := load(percent)
+	assert.Equal(t, 15.5, coupon.Percent)
+	assert.True(t, coupon.Amount.IsZero())
+	assert.Equal(t, usd(2000), coupon.MinSpend)
+	coupon, raw := load(fixed)
+	assert.Equal(t, usd(499), coupon.Amount)
+	assert.Equal(t, bson.M{"amount": int64(499), "currency": "USD"}, raw["amount"])
+	coupon, _ = load(euro)
+	assert.Equal(t, money.New(250, "EUR"), coupon.Amount)
+}
@@ -0,0 +1,454 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrCreditPackNotFound    = errors.New("credit pack not found")
+	ErrDepositNotFound       = errors.New("deposit not found")
+	ErrDepositNotPending     = errors.New("deposit is no longer pending")
+	ErrDepositNotSettled     = errors.New("deposit has not settled yet")
+	ErrDepositNotInReview    = errors.New("deposit is not awaiting review")
+	ErrPaymentEventProcessed = errors.New("payment event was already processed")
+)
+
+// CreditPack is an amount of credits sold for a card payment
+type CreditPack struct {
+	ID      string      `json:"id"`
+	Credits money.Money `json:"credits"`
+	Price   money.Money `json:"price"`
+}
+
+// CreditPacks are the top-ups on sale, in SettlementCurrency
+var CreditPacks = []CreditPack{
+	{ID: "credits_10", Credits: money.New(1000, SettlementCurrency), Price: money.New(1000, SettlementCurrency)},
+	{ID: "credits_25", Credits: money.New(2500, SettlementCurrency), Price: money.New(2500, SettlementCurrency)},
+	{ID: "credits_50", Credits: money.New(5000, SettlementCurrency), Price: money.New(5000, SettlementCurrency)},
+	{ID: "credits_100", Credits: money.New(10000, SettlementCurrency), Price: money.New(10000, SettlementCurrency)},
+}
+
+// FindCreditPack returns the pack with id
+func FindCreditPack(id string) (*CreditPack, error) {
+	for i := range CreditPacks {
+		if CreditPacks[i].ID == id {
+			return &CreditPacks[i], nil
+		}
+	}
+	return nil, ErrCreditPackNotFound
+}
+
+// DepositService tracks card payments for credits. The payment provider's
+// events move deposits along; each event is recorded in the transaction
+// that applies it, so a redelivered event is refused with
+// ErrPaymentEventProcessed and a payment is credited exactly once.
+// Users are notified once a change is committed; a failed notification is
+// logged, not retried.
+type DepositService struct {
+	mongo         *MongoDB
+	ledger        *LedgerRepository
+	notifications *NotificationRepository
+}
+
+func NewDepositService(mongo *MongoDB, ledger *LedgerRepository, notifications *NotificationRepository) *DepositService {
+	return &DepositService{mongo: mongo, ledger: ledger, notifications: notifications}
+}
+
+// Create starts a pending deposit of pack for userID
+func (s *DepositService) Create(ctx context.Context, userID primitive.ObjectID, pack *CreditPack) (*Deposit, error) {
+	now := time.Now()
+	deposit := &Deposit{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Pack:      pack.ID,
+		Credits:   pack.Credits,
+		Price:     pack.Price,
+		Status:    DepositStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if _, err := s.mongo.Deposits().InsertOne(ctx, deposit); err != nil {
+		return nil, err
+	}
+	return deposit, nil
+}
+
+// AttachCheckout records the provider's checkout session for a deposit
+func (s *DepositService) AttachCheckout(ctx context.Context, id primitive.ObjectID, sessionID string) error {
+	_, err := s.mongo.Deposits().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"checkout_session_id": sessionID,
+		"updated_at":          time.Now(),
+	}})
+	return err
+}
+
+// FindByID returns a deposit
+func (s *DepositService) FindByID(ctx context.Context, id primitive.ObjectID) (*Deposit, error) {
+	return s.findOne(ctx, bson.M{"_id": id})
+}
+
+func (s *DepositService) findOne(ctx context.Context, filter bson.M) (*Deposit, error) {
+	var deposit Deposit
+	err := s.mongo.Deposits().FindOne(ctx, filter).Decode(&deposit)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrDepositNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &deposit, nil
+}
+
+// ListForUser returns a page of the user's deposits
+func (s *DepositService) ListForUser(ctx context.Context, userID primitive.ObjectID, page pagination.Request) ([]Deposit, error) {
+	return findPage[Deposit](ctx, s.mongo.Deposits(), bson.M{"user_id": userID}, page)
+}
+
+// ListByStatus returns a page of deposits in status, for moderators
+func (s *DepositService) ListByStatus(ctx context.Context, status DepositStatus, page pagination.Request) ([]Deposit, error) {
+	return findPage[Deposit](ctx, s.mongo.Deposits(), bson.M{"status": status}, page)
+}
+
+// recordEvent marks eventID as applied. An empty eventID records nothing.
+func (s *DepositService) recordEvent(ctx context.Context, eventID, eventType string, depositID primitive.ObjectID) error {
+	if eventID == "" {
+		return nil
+	}
+	_, err := s.mongo.PaymentEvents().InsertOne(ctx, PaymentEvent{
+		ID:         eventID,
+		Type:       eventType,
+		DepositID:  depositID,
+		ReceivedAt: time.Now(),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrPaymentEventProcessed
+	}
+	return err
+}
+
+// transition moves a deposit from one status to another, returning
+// ErrDepositNotPending when it is no longer in from
+func (s *DepositService) transition(ctx context.Context, id primitive.ObjectID, from DepositStatus, set bson.M) error {
+	set["updated_at"] = time.Now()
+	res, err := s.mongo.Deposits().UpdateOne(ctx, bson.M{"_id": id, "status": from}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrDepositNotPending
+	}
+	return nil
+}
+
+// move adds amount to the user's balance, or takes it off when negative,
+// and posts the movement against AccountFunding
+func (s *DepositService) move(ctx context.Context, deposit *Deposit, typ CreditTransactionType, amount money.Money, description string) error {
+	if _, err := s.mongo.Users().UpdateOne(ctx, bson.M{"_id": deposit.UserID},
+		bson.M{"$inc": bson.M{"credits.balance.amount": amount.Amount}}); err != nil {
+		return err
+	}
+	entry := NewLedgerEntry(typ, deposit.ID, description)
+	if amount.IsPositive() {
+		entry.Debit(AccountFunding, amount).Credit(BalanceAccount(deposit.UserID), amount)
+	} else {
+		entry.Debit(BalanceAccount(deposit.UserID), amount.Neg()).Credit(AccountFunding, amount.Neg())
+	}
+	return s.ledger.Post(ctx, entry)
+}
+
+// Complete credits a deposit once eventID reports that paid was collected
+// for it through paymentIntentID. A deposit already given up on as failed
+// is still credited, since the payment went through after all; a payment
+// that does not match the price is held for review instead. A deposit that
+// has already settled is returned unchanged.
+func (s *DepositService) Complete(ctx context.Context, eventID, eventType string, id primitive.ObjectID, paymentIntentID string, paid money.Money) (*Deposit, error) {
+	result, err := s.mongo.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := s.recordEvent(sc, eventID, eventType, id); err != nil {
+			return nil, err
+		}
+		deposit, err := s.FindByID(sc, id)
+		if err != nil {
+			return nil, err
+		}
+		if deposit.Status != DepositStatusPending && deposit.Status != DepositStatusFailed {
+			return nil, nil
+		}
+		if !paid.SameCurrency(deposit.Price) || paid.Cmp(deposit.Price) != 0 {
+			reason := fmt.Sprintf("Paid %s for a price of %s", paid.Display(), deposit.Price.Display())
+			err := s.transition(sc, id, deposit.Status, bson.M{
+				"status":            DepositStatusReview,
+				"payment_intent_id": paymentIntentID,
+				"failure_reason":    reason,
+			})
+			if err != nil {
+				return nil, err
+			}
+			deposit.Status, deposit.PaymentIntentID, deposit.FailureReason = DepositStatusReview, paymentIntentID, reason
+			return deposit, nil
+		}
+		now := time.Now()
+		err = s.transition(sc, id, deposit.Status, bson.M{
+			"status":            DepositStatusSucceeded,
+			"payment_intent_id": paymentIntentID,
+			"failure_reason":    "",
+			"completed_at":      now,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.move(sc, deposit, CreditTransactionDeposit, deposit.Credits, fmt.Sprintf("Card top-up of %s", deposit.Credits.Display())); err != nil {
+			return nil, err
+		}
+		deposit.Status, deposit.PaymentIntentID, deposit.FailureReason, deposit.CompletedAt = DepositStatusSucceeded, paymentIntentID, "", now
+		return deposit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return s.FindByID(ctx, id)
+	}
+	deposit := result.(*Deposit)
+	if deposit.Status == DepositStatusReview {
+		s.notify(ctx, deposit, fmt.Sprintf("Your payment for %s in credits is being reviewed before the credits are added", deposit.Credits.Display()))
+		return deposit, nil
+	}
+	s.notify(ctx, deposit, fmt.Sprintf("%s in credits were added to your balance", deposit.Credits.Display()))
+	return deposit, nil
+}
+
+// NoteFailure records why a payment attempt for a pending deposit failed.
+// The deposit stays pending, since the buyer may try again until the
+// checkout session expires.
+func (s *DepositService) NoteFailure(ctx context.Context, id primitive.ObjectID, reason string) error {
+	err := s.transition(ctx, id, DepositStatusPending, bson.M{"failure_reason": reason})
+	if err == ErrDepositNotPending {
+		return nil
+	}
+	return err
+}
+
+// Fail gives up on a pending deposit, as reported by eventID if there is
+// one. Nothing was credited, so nothing is taken back.
+func (s *DepositService) Fail(ctx context.Context, eventID, eventType string, id primitive.ObjectID, reason string) error {
+	result, err := s.mongo.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := s.recordEvent(sc, eventID, eventType, id); err != nil {
+			return nil, err
+		}
+		deposit, err := s.FindByID(sc, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.transition(sc, id, DepositStatusPending, bson.M{
+			"status":         DepositStatusFailed,
+			"failure_reason": reason,
+		}); err != nil {
+			return nil, err
+		}
+		return deposit, nil
+	})
+	if err != nil {
+		return err
+	}
+	deposit := result.(*Deposit)
+	s.notify(ctx, deposit, fmt.Sprintf("Your payment for %s in credits did not go through: %s", deposit.Credits.Display(), reason))
+	return nil
+}
+
+// Dispute takes the disputed amount of a deposit back off the user's
+// balance while the card payment behind it is disputed. The balance may go
+// negative if the credits have been spent. A deposit held for review had
+// nothing credited, so the amount is only noted on it. The provider does
+// not deliver events in order: a dispute for a deposit that has not been
+// completed yet returns ErrDepositNotSettled, to be retried once it has.
+func (s *DepositService) Dispute(ctx context.Context, eventID, eventType string, id primitive.ObjectID, amount money.Money) error {
+	result, err := s.mongo.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := s.recordEvent(sc, eventID, eventType, id); err != nil {
+			return nil, err
+		}
+		deposit, err := s.FindByID(sc, id)
+		if err != nil {
+			return nil, err
+		}
+		if !amount.SameCurrency(deposit.Credits) || amount.Cmp(deposit.Credits) > 0 {
+			amount = deposit.Credits
+		}
+		switch deposit.Status {
+		case DepositStatusSucceeded:
+		case DepositStatusReview:
+			return nil, s.transition(sc, id, DepositStatusReview, bson.M{"disputed_amount": amount})
+		case DepositStatusPending, DepositStatusFailed:
+			return nil, ErrDepositNotSettled
+		default:
+			return nil, ErrDepositNotPending
+		}
+		if err := s.transition(sc, id, DepositStatusSucceeded, bson.M{
+			"status":          DepositStatusDisputed,
+			"disputed_amount": amount,
+		}); err != nil {
+			return nil, err
+		}
+		if err := s.move(sc, deposit, CreditTransactionAdjustment, amount.Neg(), "Card payment disputed"); err != nil {
+			return nil, err
+		}
+		deposit.DisputedAmount = amount
+		return deposit, nil
+	})
+	if err != nil || result == nil {
+		return err
+	}
+	deposit := result.(*Deposit)
+	s.notify(ctx, deposit, fmt.Sprintf("Your card payment for %s in credits was disputed, so %s was taken off your balance",
+		deposit.Credits.Display(), deposit.DisputedAmount.Display()))
+	return nil
+}
+
+// ResolveDispute closes a disputed deposit. A won dispute returns the
+// credits that were taken back; a lost one leaves the deposit reversed.
+// Deposits held for review are left for the reviewer. A dispute closed
+// before it was opened here returns ErrDepositNotSettled, to be retried
+// once it has been.
+func (s *DepositService) ResolveDispute(ctx context.Context, eventID, eventType string, id primitive.ObjectID, won bool) error {
+	result, err := s.mongo.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := s.recordEvent(sc, eventID, eventType, id); err != nil {
+			return nil, err
+		}
+		deposit, err := s.FindByID(sc, id)
+		if err != nil {
+			return nil, err
+		}
+		switch deposit.Status {
+		case DepositStatusDisputed:
+		case DepositStatusReview:
+			return nil, nil
+		case DepositStatusPending, DepositStatusFailed, DepositStatusSucceeded:
+			return nil, ErrDepositNotSettled
+		default:
+			return nil, ErrDepositNotPending
+		}
+		status := DepositStatusReversed
+		if won {
+			status = DepositStatusSucceeded
+		}
+		if err := s.transition(sc, id, DepositStatusDisputed, bson.M{"status": status}); err != nil {
+			return nil, err
+		}
+		if won {
+			if err := s.move(sc, deposit, CreditTransactionAdjustment, deposit.DisputedAmount, "Card payment dispute won"); err != nil {
+				return nil, err
+			}
+		}
+		deposit.Status = status
+		return deposit, nil
+	})
+	if err != nil || result == nil {
+		return err
+	}
+	deposit := result.(*Deposit)
+	message := fmt.Sprintf("The dispute over your card payment for %s in credits was closed and the credits stay reversed", deposit.Credits.Display())
+	if won {
+		message = fmt.Sprintf("The dispute over your card payment for %s in credits was resolved and %s was returned to your balance",
+			deposit.Credits.Display(), deposit.DisputedAmount.Display())
+	}
+	s.notify(ctx, deposit, message)
+	return nil
+}
+
+// Decide settles a deposit held for review on behalf of reviewerID, with
+// note for the buyer. Approving credits the deposit as Complete would have.
+// Rejecting moves it to DepositStatusRefunding; the caller refunds the
+// payment and reports it with Refunded. Deciding a deposit the way it was
+// already decided returns it unchanged, so a rejection whose refund was
+// interrupted can be retried; any other decision on a deposit that is not
+// in review returns ErrDepositNotInReview.
+func (s *DepositService) Decide(ctx context.Context, id, reviewerID primitive.ObjectID, approve bool, note string) (*Deposit, error) {
+	var changed bool
+	result, err := s.mongo.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		changed = false
+		deposit, err := s.FindByID(sc, id)
+		if err != nil {
+			return nil, err
+		}
+		if deposit.Status != DepositStatusReview {
+			if !deposit.ReviewerID.IsZero() && approve == (deposit.Status == DepositStatusSucceeded) {
+				return deposit, nil
+			}
+			return nil, ErrDepositNotInReview
+		}
+
+		status := DepositStatusRefunding
+		set := bson.M{"reviewer_id": reviewerID, "review_note": note}
+		if approve {
+			status, set["completed_at"] = DepositStatusSucceeded, time.Now()
+		}
+		set["status"] = status
+		if err := s.transition(sc, id, DepositStatusReview, set); err != nil {
+			return nil, err
+		}
+		if approve {
+			if err := s.move(sc, deposit, CreditTransactionDeposit, deposit.Credits, fmt.Sprintf("Card top-up of %s", deposit.Credits.Display())); err != nil {
+				return nil, err
+			}
+		}
+		deposit.Status, deposit.ReviewerID, deposit.ReviewNote = status, reviewerID, note
+		changed = true
+		return deposit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	deposit := result.(*Deposit)
+	if changed && approve {
+		s.notify(ctx, deposit, fmt.Sprintf("Your payment was reviewed and %s in credits were added to your balance", deposit.Credits.Display()))
+	}
+	return deposit, nil
+}
+
+// Refunded records that the payment of a rejected deposit was refunded
+// through refundID, which leaves the deposit reversed. A deposit already
+// recorded as refunded is returned unchanged.
+func (s *DepositService) Refunded(ctx context.Context, id primitive.ObjectID, refundID string) (*Deposit, error) {
+	err := s.transition(ctx, id, DepositStatusRefunding, bson.M{
+		"status":    DepositStatusReversed,
+		"refund_id": refundID,
+	})
+	if err == ErrDepositNotPending {
+		deposit, err := s.FindByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if deposit.RefundID == "" {
+			return nil, ErrDepositNotInReview
+		}
+		return deposit, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	deposit, err := s.FindByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	message := fmt.Sprintf("Your payment for %s in credits could not be accepted and was refunded to your card", deposit.Credits.Display())
+	if deposit.ReviewNote != "" {
+		message += ": " + deposit.ReviewNote
+	}
+	s.notify(ctx, deposit, message)
+	return deposit, nil
+}
+
+func (s *DepositService) notify(ctx context.Context, deposit *Deposit, message string) {
+	if err := s.notifications.Notify(ctx, deposit.UserID, NotificationDeposit, message, deposit.ID); err != nil {
+		log.Printf("Failed to notify user %s of deposit %s: %v", deposit.UserID.Hex(), deposit.ID.Hex(), err)
+	}
+}
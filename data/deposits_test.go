@@ -0,0 +1,239 @@
+package data
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/kordlab/marketplace/pagination"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFindCreditPack(t *testing.T) {
+	pack, err := FindCreditPack("credits_25")
+	require.NoError(t, err)
+	assert.Equal(t, usd(2500), pack.Credits)
+	assert.Equal(t, usd(2500), pack.Price)
+
+	_, err = FindCreditPack("credits_1000")
+	assert.Equal(t, ErrCreditPackNotFound, err)
+}
+
+func newDepositTestService(t *testing.T) (*DepositService, *MongoDB) {
+	checkout, m := newCheckoutTestService(t)
+	return NewDepositService(m, checkout.ledger, NewNotificationRepository(m)), m
+}
+
+func TestDepositLifecycle(t *testing.T) {
+	deposits, m := newDepositTestService(t)
+	ctx := context.Background()
+	buyer, _, _ := seedCheckout(t, m, usd(0))
+	pack, err := FindCreditPack("credits_25")
+	require.NoError(t, err)
+
+	deposit, err := deposits.Create(ctx, buyer, pack)
+	require.NoError(t, err)
+	assert.Equal(t, DepositStatusPending, deposit.Status)
+	require.NoError(t, deposits.AttachCheckout(ctx, deposit.ID, "cs_1"))
+
+	completed, err := deposits.Complete(ctx, "evt_1", "checkout.session.completed", deposit.ID, "pi_1", usd(2500))
+	require.NoError(t, err)
+	assert.Equal(t, DepositStatusSucceeded, completed.Status)
+	assert.Equal(t, usd(2500), loadCredits(t, m, buyer).Balance)
+
+	_, err = deposits.Complete(ctx, "evt_1", "checkout.session.completed", deposit.ID, "pi_1", usd(2500))
+	assert.Equal(t, ErrPaymentEventProcessed, err, "a redelivered event")
+	_, err = deposits.Complete(ctx, "evt_2", "checkout.session.async_payment_succeeded", deposit.ID, "pi_1", usd(2500))
+	require.NoError(t, err)
+	assert.Equal(t, usd(2500), loadCredits(t, m, buyer).Balance, "a second event for the same payment credits nothing")
+	assert.Equal(t, ErrDepositNotPending, deposits.Fail(ctx, "evt_3", "checkout.session.expired", deposit.ID, "expired"))
+
+	require.NoError(t, deposits.Dispute(ctx, "evt_4", "charge.dispute.created", deposit.ID, usd(2500)))
+	assert.Equal(t, usd(0), loadCredits(t, m, buyer).Balance)
+	assert.Equal(t, ErrPaymentEventProcessed, deposits.Dispute(ctx, "evt_4", "charge.dispute.created", deposit.ID, usd(2500)))
+	require.NoError(t, deposits.ResolveDispute(ctx, "evt_5", "charge.dispute.closed", deposit.ID, true))
+	assert.Equal(t, usd(2500), loadCredits(t, m, buyer).Balance)
+
+	deposit, err = deposits.FindByID(ctx, deposit.ID)
+	require.NoError(t, err)
+	assert.Equal(t, DepositStatusSucceeded, deposit.Status)
+}
+
+func TestDepositAmountMismatchNeedsReview(t *testing.T) {
+	deposits, m := newDepositTestService(t)
+	ctx := context.Background()
+	buyer, _, _ := seedCheckout(t, m, usd(0))
+	pack, err := FindCreditPack("credits_25")
+	require.NoError(t, err)
+	deposit, err := deposits.Create(ctx, buyer, pack)
+	require.NoError(t, err)
+
+	held, err := deposits.Complete(ctx, "evt_1", "checkout.session.completed", deposit.ID, "pi_1", usd(100))
+	require.NoError(t, err)
+	assert.Equal(t, DepositStatusReview, held.Status)
+	assert.NotEmpty(t, held.FailureReason)
+	assert.Equal(t, usd(0), loadCredits(t, m, buyer).Balance)
+
+	_, err = deposits.Complete(ctx, "evt_2", "checkout.session.async_payment_succeeded", deposit.ID, "pi_1", usd(2500))
+	require.NoError(t, err)
+	assert.Equal(t, usd(0), loadCredits(t, m, buyer).Balance, "a held payment is left to the reviewer")
+
+	require.NoError(t, deposits.Dispute(ctx, "evt_3", "charge.dispute.created", deposit.ID, usd(100)))
+	assert.Equal(t, usd(0), loadCredits(t, m, buyer).Balance, "nothing was credited, so nothing is taken back")
+
+	page, err := pagination.New("test").Parse(url.Values{}, pagination.Sort{Field: "created_at", Desc: true}, "deposits:review")
+	require.NoError(t, err)
+	review, err := deposits.ListByStatus(ctx, DepositStatusReview, page)
+	require.NoError(t, err)
+	require.Len(t, review, 1)
+	assert.Equal(t, usd(100), review[0].DisputedAmount)
+}
+
+func TestDepositPaidAfterExpiry(t *testing.T) {
+	deposits, m := newDepositTestService(t)
+	ctx := context.Background()
+	buyer, _, _ := seedCheckout(t, m, usd(0))
+	pack, err := FindCreditPack("credits_10")
+	require.NoError(t, err)
+	deposit, err := deposits.Create(ctx, buyer, pack)
+	require.NoError(t, err)
+
+	require.NoError(t, deposits.NoteFailure(ctx, deposit.ID, "Your card was declined."))
+	require.NoError(t, deposits.Fail(ctx, "evt_1", "checkout.session.expired", deposit.ID, "The checkout session expired"))
+	assert.Equal(t, usd(0), loadCredits(t, m, buyer).Balance)
+
+	completed, err := deposits.Complete(ctx, "evt_2", "checkout.session.completed", deposit.ID, "pi_1", usd(1000))
+	require.NoError(t, err)
+	assert.Equal(t, DepositStatusSucceeded, completed.Status)
+	assert.Empty(t, completed.FailureReason)
+	assert.Equal(t, usd(1000), loadCredits(t, m, buyer).Balance, "a collected payment is credited")
+}
+
+func TestDepositDisputeBeforeCompletion(t *testing.T) {
+	deposits, m := newDepositTestService(t)
+	ctx := context.Background()
+	buyer, _, _ := seedCheckout(t, m, usd(0))
+	pack, err := FindCreditPack("credits_25")
+	require.NoError(t, err)
+	deposit, err := deposits.Create(ctx, buyer, pack)
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrDepositNotSettled, deposits.Dispute(ctx, "evt_2", "charge.dispute.created", deposit.ID, usd(2500)))
+	_, err = deposits.Complete(ctx, "evt_1", "checkout.session.completed", deposit.ID, "pi_1", usd(2500))
+	require.NoError(t, err)
+
+	require.NoError(t, deposits.Dispute(ctx, "evt_2", "charge.dispute.created", deposit.ID, usd(2500)), "the redelivered dispute applies")
+	assert.Equal(t, usd(0), loadCredits(t, m, buyer).Balance)
+}
+
+func TestDepositDisputeClosedBeforeCreated(t *testing.T) {
+	deposits, m := newDepositTestService(t)
+	ctx := context.Background()
+	buyer, _, _ := seedCheckout(t, m, usd(0))
+	pack, err := FindCreditPack("credits_25")
+	require.NoError(t, err)
+	deposit, err := deposits.Create(ctx, buyer, pack)
+	require.NoError(t, err)
+	_, err = deposits.Complete(ctx, "evt_1", "checkout.session.completed", deposit.ID, "pi_1", usd(2500))
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrDepositNotSettled, deposits.ResolveDispute(ctx, "evt_3", "charge.dispute.closed", deposit.ID, true))
+	require.NoError(t, deposits.Dispute(ctx, "evt_2", "charge.dispute.created", deposit.ID, usd(2500)))
+	assert.Equal(t, usd(0), loadCredits(t, m, buyer).Balance)
+
+	require.NoError(t, deposits.ResolveDispute(ctx, "evt_3", "charge.dispute.closed", deposit.ID, true), "the redelivered close applies")
+	assert.Equal(t, usd(2500), loadCredits(t, m, buyer).Balance, "a won dispute returns the credits")
+}
+
+func TestDepositFailed(t *testing.T) {
+	deposits, m := newDepositTestService(t)
+	ctx := context.Background()
+	buyer, _, _ := seedCheckout(t, m, usd(0))
+	pack, err := FindCreditPack("credits_10")
+	require.NoError(t, err)
+
+	deposit, err := deposits.Create(ctx, buyer, pack)
+	require.NoError(t, err)
+	require.NoError(t, deposits.Fail(ctx, "evt_1", "checkout.session.async_payment_failed", deposit.ID, "The payment failed"))
+	assert.Equal(t, ErrDepositNotPending, deposits.Fail(ctx, "evt_2", "checkout.session.expired", deposit.ID, "expired"))
+
+	failed, err := deposits.FindByID(ctx, deposit.ID)
+	require.NoError(t, err)
+	assert.Equal(t, DepositStatusFailed, failed.Status)
+	assert.Equal(t, usd(0), loadCredits(t, m, buyer).Balance)
+}
+
+// heldDeposit creates a deposit that was paid the wrong amount and is held
+// for review
+func heldDeposit(t *testing.T, deposits *DepositService, buyer primitive.ObjectID) *Deposit {
+	pack, err := FindCreditPack("credits_25")
+	require.NoError(t, err)
+	deposit, err := deposits.Create(context.Background(), buyer, pack)
+	require.NoError(t, err)
+	held, err := deposits.Complete(context.Background(), "evt_"+deposit.ID.Hex(), "checkout.session.completed", deposit.ID, "pi_"+deposit.ID.Hex(), usd(100))
+	require.NoError(t, err)
+	require.Equal(t, DepositStatusReview, held.Status)
+	return held
+}
+
+func TestDepositReviewApproved(t *testing.T) {
+	deposits, m := newDepositTestService(t)
+	ctx := context.Background()
+	buyer, moderator, _ := seedCheckout(t, m, usd(0))
+	deposit := heldDeposit(t, deposits, buyer)
+
+	approved, err := deposits.Decide(ctx, deposit.ID, moderator, true, "")
+	require.NoError(t, err)
+	assert.Equal(t, DepositStatusSucceeded, approved.Status)
+	assert.Equal(t, moderator, approved.ReviewerID)
+	assert.Equal(t, usd(2500), loadCredits(t, m, buyer).Balance)
+	balance, err := deposits.ledger.Balance(ctx, BalanceAccount(buyer))
+	require.NoError(t, err)
+	assert.Equal(t, usd(2500), balance)
+
+	_, err = deposits.Decide(ctx, deposit.ID, moderator, true, "")
+	require.NoError(t, err)
+	assert.Equal(t, usd(2500), loadCredits(t, m, buyer).Balance, "approving again credits nothing")
+	_, err = deposits.Decide(ctx, deposit.ID, moderator, false, "")
+	assert.Equal(t, ErrDepositNotInReview, err)
+
+	n, err := m.Notifications().CountDocuments(ctx, bson.M{"user_id": buyer, "type": NotificationDeposit})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, n, "the buyer hears of the review and of its outcome")
+}
+
+func TestDepositReviewRejected(t *testing.T) {
+	deposits, m := newDepositTestService(t)
+	ctx := context.Background()
+	buyer, moderator, _ := seedCheckout(t, m, usd(0))
+	deposit := heldDeposit(t, deposits, buyer)
+
+	rejected, err := deposits.Decide(ctx, deposit.ID, moderator, false, "Wrong amount paid")
+	require.NoError(t, err)
+	assert.Equal(t, DepositStatusRefunding, rejected.Status)
+	_, err = deposits.Decide(ctx, deposit.ID, moderator, true, "")
+	assert.Equal(t, ErrDepositNotInReview, err, "a refunding deposit cannot be credited")
+	rejected, err = deposits.Decide(ctx, deposit.ID, moderator, false, "Wrong amount paid")
+	require.NoError(t, err, "an interrupted rejection can be retried")
+	assert.Equal(t, DepositStatusRefunding, rejected.Status)
+
+	reversed, err := deposits.Refunded(ctx, deposit.ID, "re_1")
+	require.NoError(t, err)
+	assert.Equal(t, DepositStatusReversed, reversed.Status)
+	assert.Equal(t, "re_1", reversed.RefundID)
+	_, err = deposits.Refunded(ctx, deposit.ID, "re_1")
+	require.NoError(t, err)
+	assert.Equal(t, usd(0), loadCredits(t, m, buyer).Balance, "nothing is credited for a refunded payment")
+
+	n, err := m.Notifications().CountDocuments(ctx, bson.M{"user_id": buyer, "type": NotificationDeposit})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, n)
+
+	other := heldDeposit(t, deposits, buyer)
+	_, err = deposits.Refunded(ctx, other.ID, "re_2")
+	assert.Equal(t, ErrDepositNotInReview, err, "only rejected deposits are refunded")
+}
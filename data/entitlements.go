@@ -0,0 +1,154 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrNotEntitled = errors.New("purchase does not include this product")
+
+// EntitlementRepository tracks which products each user may access
+type EntitlementRepository struct {
+	mongo *MongoDB
+}
+
+func NewEntitlementRepository(mongo *MongoDB) *EntitlementRepository {
+	return &EntitlementRepository{mongo: mongo}
+}
+
+// EntitlementsForPurchase builds the entitlements a completed purchase of
+// product grants. Buyers of a single product may fetch any later version;
+// bundle items are pinned to the version current at purchase time unless
+// the bundle includes updates.
+func EntitlementsForPurchase(purchase *Purchase, product *Product, items []Product) []Entitlement {
+	now := time.Now()
+	if !product.IsBundle() {
+		return []Entitlement{{
+			ID:              primitive.NewObjectID(),
+			UserID:          purchase.UserID,
+			ProductID:       product.ID,
+			PurchaseID:      purchase.ID,
+			Version:         purchase.ProductVersion,
+			IncludesUpdates: true,
+			GrantedAt:       now,
+		}}
+	}
+
+	entitlements := make([]Entitlement, 0, len(items))
+	for i := range items {
+		version := ""
+		if latest, err := items[i].LatestVersion(); err == nil {
+			version = latest.Version
+		}
+		entitlements = append(entitlements, Entitlement{
+			ID:              primitive.NewObjectID(),
+			UserID:          purchase.UserID,
+			ProductID:       items[i].ID,
+			PurchaseID:      purchase.ID,
+			BundleID:        product.ID,
+			Version:         version,
+			IncludesUpdates: product.Bundle.IncludeUpdates,
+			GrantedAt:       now,
+		})
+	}
+	return entitlements
+}
+
+// Grant stores entitlements. Granting is idempotent per user, product and
+// purchase, so a retried purchase completion does not duplicate them.
+func (r *EntitlementRepository) Grant(ctx context.Context, entitlements []Entitlement) error {
+	if len(entitlements) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(entitlements))
+	for i := range entitlements {
+		docs[i] = entitlements[i]
+	}
+	_, err := r.mongo.Entitlements().InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// Revoke ends every entitlement purchaseID granted
+func (r *EntitlementRepository) Revoke(ctx context.Context, purchaseID primitive.ObjectID) error {
+	_, err := r.mongo.Entitlements().UpdateMany(ctx,
+		bson.M{"purchase_id": purchaseID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	return err
+}
+
+// Find returns the active entitlement purchaseID granted userID to productID
+func (r *EntitlementRepository) Find(ctx context.Context, userID, productID, purchaseID primitive.ObjectID) (*Entitlement, error) {
+	var entitlement Entitlement
+	err := r.mongo.Entitlements().FindOne(ctx, bson.M{
+		"user_id":     userID,
+		"product_id":  productID,
+		"purchase_id": purchaseID,
+		"revoked_at":  bson.M{"$exists": false},
+	}).Decode(&entitlement)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotEntitled
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entitlement, nil
+}
+
+// OwnedProducts reports which of productIDs userID already owns, either
+// through an entitlement or a completed purchase made before entitlements
+// existed.
+func (r *EntitlementRepository) OwnedProducts(ctx context.Context, userID primitive.ObjectID, productIDs []primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	owned := map[primitive.ObjectID]bool{}
+	if len(productIDs) == 0 {
+		return owned, nil
+	}
+
+	ids, err := r.mongo.Entitlements().Distinct(ctx, "product_id", bson.M{
+		"user_id":    userID,
+		"product_id": bson.M{"$in": productIDs},
+		"revoked_at": bson.M{"$exists": false},
+	})
+	if err != nil {
+		return nil, err
+	}
+	purchased, err := r.mongo.Purchases().Distinct(ctx, "product_id", bson.M{
+		"user_id":    userID,
+		"product_id": bson.M{"$in": productIDs},
+		"status":     PurchaseStatusCompleted,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range append(ids, purchased...) {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			owned[oid] = true
+		}
+	}
+	return owned, nil
+}
+
+// OwnedItemsCredit returns the credits that take the bundle items userID
+// already owns off the bundle's price, if the bundle is configured for it
+func (r *EntitlementRepository) OwnedItemsCredit(ctx context.Context, bundle *Product, items []Product, userID primitive.ObjectID) ([]PriceAdjustment, error) {
+	if !bundle.IsBundle() || !bundle.Bundle.ExcludeOwned || userID.IsZero() {
+		return nil, nil
+	}
+	owned, err := r.OwnedProducts(ctx, userID, bundle.Bundle.Items)
+	if err != nil {
+		return nil, err
+	}
+	if credit := BundleOwnedCredit(items, owned, bundle.EffectivePrice()); credit != nil {
+		return []PriceAdjustment{*credit}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	errIdempotencyKeyContended = errors.New("idempotency key kept changing while it was claimed")
+	// ErrIdempotencyClaimLost is returned when a request's claim on a key
+	// expired and the key was taken by another request since
+	ErrIdempotencyClaimLost = errors.New("idempotency key is no longer claimed by this request")
+)
+
+// The scripts below act on an idempotency key only while it still holds the
+// caller's claim, so a request whose claim expired cannot overwrite, extend
+// or drop the claim of the request that took the key after it.
+//
+// KEYS = idempotency key
+// ARGV = claim, then the script's own arguments
+var (
+	// ARGV[2] = lock ttl (ms)
+	refreshIdempotencyScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+	// ARGV[2] = response, ARGV[3] = ttl (ms)
+	storeIdempotentScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+	releaseIdempotencyScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+)
+
+// IdempotentResponse is what is stored under an idempotency key. Status is
+// zero while the first request with the key is still being handled.
+// Fingerprint identifies that request, so a key reused for a different one
+// can be told apart from a retry. Token is unique to the request holding
+// the claim and is dropped once its response is stored.
+type IdempotentResponse struct {
+	Fingerprint string              `json:"fingerprint"`
+	Token       string              `json:"token,omitempty"`
+	Status      int                 `json:"status,omitempty"`
+	Header      map[string][]string `json:"header,omitempty"`
+	Body        []byte              `json:"body,omitempty"`
+}
+
+// InFlight reports whether the request that claimed the key has not
+// finished yet
+func (r *IdempotentResponse) InFlight() bool {
+	return r.Status == 0
+}
+
+func idempotencyClaim(fingerprint, token string) ([]byte, error) {
+	return json.Marshal(IdempotentResponse{Fingerprint: fingerprint, Token: token})
+}
+
+// ClaimIdempotencyKey claims key for the request with fingerprint and
+// token, holding it for lockTTL unless RefreshIdempotencyKey extends it.
+// When the key is already taken it returns what is stored under it instead.
+func (r *RedisDB) ClaimIdempotencyKey(ctx context.Context, key, fingerprint, token string, lockTTL time.Duration) (*IdempotentResponse, bool, error) {
+	claim, err := idempotencyClaim(fingerprint, token)
+	if err != nil {
+		return nil, false, err
+	}
+	// The stored value can expire between SETNX and GET, so try again once
+	for attempt := 0; attempt < 2; attempt++ {
+		ok, err := r.client.SetNX(ctx, key, claim, lockTTL).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return nil, true, nil
+		}
+		raw, err := r.client.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		var stored IdempotentResponse
+		if err := json.Unmarshal(raw, &stored); err != nil {
+			return nil, false, err
+		}
+		return &stored, false, nil
+	}
+	return nil, false, errIdempotencyKeyContended
+}
+
+// runIfClaimed runs script on key if it still holds the claim of fingerprint
+// and token
+func (r *RedisDB) runIfClaimed(ctx context.Context, script *redis.Script, key, fingerprint, token string, args ...interface{}) error {
+	claim, err := idempotencyClaim(fingerprint, token)
+	if err != nil {
+		return err
+	}
+	ok, err := script.Run(ctx, r.client, []string{key}, append([]interface{}{claim}, args...)...).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrIdempotencyClaimLost
+	}
+	return nil
+}
+
+// RefreshIdempotencyKey holds the claim on key for another lockTTL
+func (r *RedisDB) RefreshIdempotencyKey(ctx context.Context, key, fingerprint, token string, lockTTL time.Duration) error {
+	return r.runIfClaimed(ctx, refreshIdempotencyScript, key, fingerprint, token, lockTTL.Milliseconds())
+}
+
+// StoreIdempotentResponse replaces the claim token holds on key with the
+// finished response, kept for ttl
+func (r *RedisDB) StoreIdempotentResponse(ctx context.Context, key, token string, response *IdempotentResponse, ttl time.Duration) error {
+	raw, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return r.runIfClaimed(ctx, storeIdempotentScript, key, response.Fingerprint, token, raw, ttl.Milliseconds())
+}
+
+// ReleaseIdempotencyKey drops the claim token holds on key so the request
+// can be retried
+func (r *RedisDB) ReleaseIdempotencyKey(ctx context.Context, key, fingerprint, token string) error {
+	return r.runIfClaimed(ctx, releaseIdempotencyScript, key, fingerprint, token)
+}
@@ -0,0 +1,226 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MaxProductImages caps the size of a product's gallery
+const MaxProductImages = 12
+
+// ImageSizeOriginal names the full size variant of an image
+const ImageSizeOriginal = "original"
+
+var (
+	ErrImageNotFound = errors.New("image not found")
+	ErrTooManyImages = fmt.Errorf("a product may have at most %d images", MaxProductImages)
+)
+
+// NewLinkedImage records an image hosted elsewhere
+func NewLinkedImage(url string) ProductImage {
+	return ProductImage{
+		ID:       primitive.NewObjectID(),
+		Status:   ImageStatusReady,
+		Linked:   true,
+		Variants: []ImageVariant{{Size: ImageSizeOriginal, URL: url}},
+	}
+}
+
+// productImageFields avoids recursing into the custom decoders below
+type productImageFields ProductImage
+
+// UnmarshalBSONValue accepts the bare URL strings images were stored as
+// before they had variants
+func (img *ProductImage) UnmarshalBSONValue(t bsontype.Type, raw []byte) error {
+	if t == bsontype.String {
+		url, ok := bson.RawValue{Type: t, Value: raw}.StringValueOK()
+		if !ok {
+			return errors.New("invalid image URL")
+		}
+		*img = legacyImage(url)
+		return nil
+	}
+	return bson.Unmarshal(raw, (*productImageFields)(img))
+}
+
+// UnmarshalJSON accepts bare URL strings, which products cached before
+// images had variants still contain
+func (img *ProductImage) UnmarshalJSON(raw []byte) error {
+	if len(raw) > 0 && raw[0] == '"' {
+		var url string
+		if err := json.Unmarshal(raw, &url); err != nil {
+			return err
+		}
+		*img = legacyImage(url)
+		return nil
+	}
+	return json.Unmarshal(raw, (*productImageFields)(img))
+}
+
+// legacyImage is NewLinkedImage without an ID, which legacy images never had.
+// They are replaced along with the other linked images on update.
+func legacyImage(url string) ProductImage {
+	return ProductImage{
+		Status:   ImageStatusReady,
+		Linked:   true,
+		Variants: []ImageVariant{{Size: ImageSizeOriginal, URL: url}},
+	}
+}
+
+// FindImage returns the product's image with the given ID
+func (p *Product) FindImage(id primitive.ObjectID) (*ProductImage, bool) {
+	if id.IsZero() {
+		return nil, false
+	}
+	for i := range p.Images {
+		if p.Images[i].ID == id {
+			return &p.Images[i], true
+		}
+	}
+	return nil, false
+}
+
+// ReplaceLinkedImages swaps the product's linked images for urls, keeping
+// uploaded images in place ahead of them, and returns the new images
+func (p *Product) ReplaceLinkedImages(urls []string) []ProductImage {
+	images := []ProductImage{}
+	for _, img := range p.Images {
+		if !img.Linked {
+			images = append(images, img)
+		}
+	}
+	linked := make([]ProductImage, 0, len(urls))
+	for _, url := range urls {
+		linked = append(linked, NewLinkedImage(url))
+	}
+	p.Images = append(images, linked...)
+	return linked
+}
+
+// FindVariant returns the uploaded variant served under file, the last
+// element of its URL
+func (img *ProductImage) FindVariant(file string) (*ImageVariant, bool) {
+	if img.Linked {
+		return nil, false
+	}
+	for i := range img.Variants {
+		if strings.HasSuffix(img.Variants[i].URL, "/"+file) {
+			return &img.Variants[i], true
+		}
+	}
+	return nil, false
+}
+
+// AddImage appends an image to the product's gallery, refusing once the
+// gallery is full
+func (r *ProductRepository) AddImage(ctx context.Context, productID primitive.ObjectID, img ProductImage) error {
+	err := r.UpdateRaw(ctx, bson.M{
+		"_id": productID,
+		fmt.Sprintf("images.%d", MaxProductImages-1): bson.M{"$exists": false},
+	}, bson.M{
+		"$push": bson.M{"images": img},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+	if err == ErrProductNotFound {
+		return ErrTooManyImages
+	}
+	return err
+}
+
+// CompleteImage records the variants rendered for a processing image. It
+// returns ErrImageNotFound if the image was removed in the meantime, so the
+// caller can discard the variants.
+func (r *ProductRepository) CompleteImage(ctx context.Context, productID, imageID primitive.ObjectID, width, height int, variants []ImageVariant) error {
+	return r.finishImage(ctx, productID, imageID, bson.M{
+		"images.$.status":   ImageStatusReady,
+		"images.$.width":    width,
+		"images.$.height":   height,
+		"images.$.variants": variants,
+	})
+}
+
+// FailImage marks a processing image as failed with reason
+func (r *ProductRepository) FailImage(ctx context.Context, productID, imageID primitive.ObjectID, reason string) error {
+	return r.finishImage(ctx, productID, imageID, bson.M{
+		"images.$.status": ImageStatusFailed,
+		"images.$.error":  reason,
+	})
+}
+
+func (r *ProductRepository) finishImage(ctx context.Context, productID, imageID primitive.ObjectID, set bson.M) error {
+	set["updated_at"] = time.Now()
+	err := r.UpdateRaw(ctx, bson.M{
+		"_id":    productID,
+		"images": bson.M{"$elemMatch": bson.M{"id": imageID, "status": ImageStatusProcessing}},
+	}, bson.M{"$set": set})
+	if err == ErrProductNotFound {
+		return ErrImageNotFound
+	}
+	return err
+}
+
+// UpdateImageAltText sets the alt text of one of the product's images
+func (r *ProductRepository) UpdateImageAltText(ctx context.Context, productID, imageID primitive.ObjectID, altText string) error {
+	err := r.UpdateRaw(ctx, bson.M{"_id": productID, "images.id": imageID}, bson.M{
+		"$set": bson.M{"images.$.alt_text": altText, "updated_at": time.Now()},
+	})
+	if err == ErrProductNotFound {
+		return ErrImageNotFound
+	}
+	return err
+}
+
+// RemoveImage drops an image from the product's gallery
+func (r *ProductRepository) RemoveImage(ctx context.Context, productID, imageID primitive.ObjectID) error {
+	err := r.UpdateRaw(ctx, bson.M{"_id": productID, "images.id": imageID}, bson.M{
+		"$pull": bson.M{"images": bson.M{"id": imageID}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+	if err == ErrProductNotFound {
+		return ErrImageNotFound
+	}
+	return err
+}
+
+// ReplaceLinkedImages swaps the product's linked images, including bare URL
+// strings from before images had variants, for linked. Uploaded images are
+// left alone in the database, since workers may be updating them.
+func (r *ProductRepository) ReplaceLinkedImages(ctx context.Context, productID primitive.ObjectID, linked []ProductImage) error {
+	uploaded := bson.M{"$filter": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$images", bson.A{}}},
+		"as":    "img",
+		"cond": bson.M{"$and": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$type": "$$img"}, "object"}},
+			bson.M{"$ne": bson.A{"$$img.linked", true}},
+		}},
+	}}
+	return r.UpdateRaw(ctx, bson.M{"_id": productID}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"images":     bson.M{"$concatArrays": bson.A{uploaded, bson.M{"$literal": linked}}},
+			"updated_at": time.Now(),
+		}}},
+	})
+}
+
+// ListProcessingImages returns the products with images still waiting to be
+// processed, so work lost to a restart can be queued again
+func (r *ProductRepository) ListProcessingImages(ctx context.Context) ([]Product, error) {
+	cursor, err := r.mongo.Products().Find(ctx, bson.M{"images.status": ImageStatusProcessing})
+	if err != nil {
+		return nil, err
+	}
+	products := []Product{}
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
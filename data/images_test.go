@@ -0,0 +1,79 @@
+package data
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestProductImageDecodesLegacyURLs(t *testing.T) {
+	uploaded := ProductImage{
+		ID:       primitive.NewObjectID(),
+		Status:   ImageStatusReady,
+		Width:    800,
+		Height:   600,
+		AltText:  "Dashboard",
+		Variants: []ImageVariant{{Size: ImageSizeOriginal, Format: "jpeg", URL: "/images/p/i/original.jpg"}},
+	}
+
+	raw, err := bson.Marshal(bson.M{"images": bson.A{"https://cdn.example.com/a.png", uploaded}})
+	require.NoError(t, err)
+	var fromBSON struct {
+		Images []ProductImage `bson:"images"`
+	}
+	require.NoError(t, bson.Unmarshal(raw, &fromBSON))
+
+	body, err := json.Marshal(map[string]interface{}{"images": []interface{}{"https://cdn.example.com/a.png", uploaded}})
+	require.NoError(t, err)
+	var fromJSON struct {
+		Images []ProductImage `json:"images"`
+	}
+	require.NoError(t, json.Unmarshal(body, &fromJSON))
+
+	for _, images := range [][]ProductImage{fromBSON.Images, fromJSON.Images} {
+		require.Len(t, images, 2)
+		assert.True(t, images[0].Linked)
+		assert.Equal(t, ImageStatusReady, images[0].Status)
+		assert.Equal(t, []ImageVariant{{Size: ImageSizeOriginal, URL: "https://cdn.example.com/a.png"}}, images[0].Variants)
+		assert.Equal(t, uploaded.ID, images[1].ID)
+		assert.Equal(t, uploaded.AltText, images[1].AltText)
+		assert.Equal(t, uploaded.Variants, images[1].Variants)
+	}
+}
+
+func TestReplaceLinkedImages(t *testing.T) {
+	uploaded := ProductImage{ID: primitive.NewObjectID(), Status: ImageStatusProcessing}
+	product := &Product{Images: []ProductImage{legacyImage("https://old.example.com/a.png"), uploaded}}
+
+	linked := product.ReplaceLinkedImages([]string{"https://new.example.com/b.png"})
+	require.Len(t, linked, 1)
+	assert.False(t, linked[0].ID.IsZero())
+	require.Len(t, product.Images, 2)
+	assert.Equal(t, uploaded.ID, product.Images[0].ID)
+	assert.Equal(t, "https://new.example.com/b.png", product.Images[1].Variants[0].URL)
+
+	_, ok := product.FindImage(uploaded.ID)
+	assert.True(t, ok)
+	_, ok = product.FindImage(primitive.NilObjectID)
+	assert.False(t, ok)
+}
+
+func TestFindVariant(t *testing.T) {
+	img := ProductImage{Variants: []ImageVariant{
+		{Size: "thumb", URL: "/images/p/i/thumb.jpg"},
+		{Size: "thumb", URL: "/images/p/i/thumb.webp"},
+	}}
+	v, ok := img.FindVariant("thumb.webp")
+	require.True(t, ok)
+	assert.Equal(t, "/images/p/i/thumb.webp", v.URL)
+	_, ok = img.FindVariant("source")
+	assert.False(t, ok)
+
+	linked := NewLinkedImage("https://cdn.example.com/original.jpg")
+	_, ok = linked.FindVariant("original.jpg")
+	assert.False(t, ok, "linked images are not served from the blob store")
+}
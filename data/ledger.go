@@ -0,0 +1,382 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrUnbalancedEntry = errors.New("ledger entry does not balance")
+	ErrInvalidPosting  = errors.New("ledger postings need an account and a positive amount")
+	ErrLedgerCurrency  = errors.New("ledger postings must be in the settlement currency")
+)
+
+// Marketplace accounts. Every account is credit-normal, so its balance is
+// its credits minus its debits and the balances of all accounts add up to
+// zero.
+const (
+	// AccountCommission collects the marketplace's share of sales
+	AccountCommission = "marketplace:commission"
+	// AccountFunding is the other side of credits entering or leaving the
+	// marketplace: deposits, withdrawals, gifts and adjustments
+	AccountFunding = "marketplace:funding"
+	// AccountLegacySales is the other side of migrated purchases and sales,
+	// whose commission split was never recorded
+	AccountLegacySales = "marketplace:legacy_sales"
+)
+
+// BalanceAccount is the ledger account behind a user's credit balance
+func BalanceAccount(userID primitive.ObjectID) string {
+	return "user:" + userID.Hex() + ":balance"
+}
+
+// EarningsAccount is the ledger account behind a creator's pending earnings
+func EarningsAccount(userID primitive.ObjectID) string {
+	return "user:" + userID.Hex() + ":earnings"
+}
+
+// LedgerEntry is a set of postings that are stored together
+type LedgerEntry struct {
+	ID          primitive.ObjectID
+	Type        CreditTransactionType
+	Reference   primitive.ObjectID
+	Description string
+	CreatedAt   time.Time
+	Postings    []Posting
+}
+
+func NewLedgerEntry(typ CreditTransactionType, reference primitive.ObjectID, description string) *LedgerEntry {
+	return &LedgerEntry{
+		ID:          primitive.NewObjectID(),
+		Type:        typ,
+		Reference:   reference,
+		Description: description,
+		CreatedAt:   time.Now(),
+	}
+}
+
+// Debit adds amount to the entry's debit of account. Zero amounts are
+// dropped.
+func (e *LedgerEntry) Debit(account string, amount money.Money) *LedgerEntry {
+	return e.add(account, Debit, amount)
+}
+
+// Credit adds amount to the entry's credit of account. Zero amounts are
+// dropped.
+func (e *LedgerEntry) Credit(account string, amount money.Money) *LedgerEntry {
+	return e.add(account, Credit, amount)
+}
+
+func (e *LedgerEntry) add(account string, side PostingSide, amount money.Money) *LedgerEntry {
+	if amount.IsZero() {
+		return e
+	}
+	for i := range e.Postings {
+		p := &e.Postings[i]
+		if p.Account == account && p.Side == side && p.Amount.SameCurrency(amount) {
+			p.Amount = p.Amount.Add(amount)
+			return e
+		}
+	}
+	e.Postings = append(e.Postings, Posting{Account: account, Side: side, Amount: amount})
+	return e
+}
+
+// Net returns how much the entry moves account's balance in currency: its
+// credits to the account minus its debits from it
+func (e *LedgerEntry) Net(account, currency string) money.Money {
+	net := money.Zero(currency)
+	for _, p := range e.Postings {
+		if p.Account != account || !p.Amount.SameCurrency(net) {
+			continue
+		}
+		if p.Side == Credit {
+			net = net.Add(p.Amount)
+		} else {
+			net = net.Sub(p.Amount)
+		}
+	}
+	return net
+}
+
+// Validate checks that every posting has an account and a positive amount
+// and that in each currency the entry's debits equal its credits
+func (e *LedgerEntry) Validate() error {
+	net := map[string]int64{}
+	for _, p := range e.Postings {
+		if p.Account == "" || !p.Amount.IsPositive() {
+			return ErrInvalidPosting
+		}
+		if p.Side == Debit {
+			net[p.Amount.Code()] += p.Amount.Amount
+		} else {
+			net[p.Amount.Code()] -= p.Amount.Amount
+		}
+	}
+	for _, n := range net {
+		if n != 0 {
+			return ErrUnbalancedEntry
+		}
+	}
+	return nil
+}
+
+// LedgerRepository stores and reads ledger postings. Postings are never
+// changed once stored; a mistake is corrected by posting another entry.
+type LedgerRepository struct {
+	mongo *MongoDB
+}
+
+func NewLedgerRepository(mongo *MongoDB) *LedgerRepository {
+	return &LedgerRepository{mongo: mongo}
+}
+
+// Post stores an entry's postings. Callers post inside the transaction
+// that updates the Credits snapshots the entry moves, so the two never
+// disagree. An entry without postings is not stored.
+func (r *LedgerRepository) Post(ctx context.Context, entry *LedgerEntry) error {
+	if len(entry.Postings) == 0 {
+		return nil
+	}
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+	docs := make([]interface{}, len(entry.Postings))
+	for i, p := range entry.Postings {
+		p.ID = primitive.NewObjectID()
+		p.EntryID = entry.ID
+		p.Type = entry.Type
+		p.Reference = entry.Reference
+		p.Description = entry.Description
+		p.CreatedAt = entry.CreatedAt
+		docs[i] = p
+	}
+	_, err := r.mongo.Ledger().InsertMany(ctx, docs)
+	return err
+}
+
+// Reversal returns an entry of type typ that undoes the postings entries of
+// type original stored for reference. It has no postings when there were
+// none to undo.
+func (r *LedgerRepository) Reversal(ctx context.Context, original CreditTransactionType, reference primitive.ObjectID, typ CreditTransactionType, description string) (*LedgerEntry, error) {
+	cursor, err := r.mongo.Ledger().Find(ctx, bson.M{"type": original, "reference": reference})
+	if err != nil {
+		return nil, err
+	}
+	var postings []Posting
+	if err := cursor.All(ctx, &postings); err != nil {
+		return nil, err
+	}
+	entry := NewLedgerEntry(typ, reference, description)
+	for _, p := range postings {
+		if p.Side == Debit {
+			entry.Credit(p.Account, p.Amount)
+		} else {
+			entry.Debit(p.Account, p.Amount)
+		}
+	}
+	return entry, nil
+}
+
+// periodFilter matches an account's postings in [from, to). A zero time
+// leaves that end open.
+func periodFilter(account string, from, to time.Time) bson.M {
+	filter := bson.M{"account": account}
+	created := bson.M{}
+	if !from.IsZero() {
+		created["$gte"] = from
+	}
+	if !to.IsZero() {
+		created["$lt"] = to
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+	return filter
+}
+
+// Totals sums an account's credits and debits in [from, to). The ledger is
+// kept in SettlementCurrency; postings in any other currency fail with
+// ErrLedgerCurrency rather than being added to it.
+func (r *LedgerRepository) Totals(ctx context.Context, account string, from, to time.Time) (credits, debits money.Money, err error) {
+	credits, debits = money.Zero(SettlementCurrency), money.Zero(SettlementCurrency)
+	cursor, err := r.mongo.Ledger().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: periodFilter(account, from, to)}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"side": "$side", "currency": "$amount.currency"},
+			"total": bson.M{"$sum": "$amount.amount"},
+		}}},
+	})
+	if err != nil {
+		return credits, debits, err
+	}
+	var sums []struct {
+		Key struct {
+			Side     PostingSide `bson:"side"`
+			Currency string      `bson:"currency"`
+		} `bson:"_id"`
+		Total int64 `bson:"total"`
+	}
+	if err := cursor.All(ctx, &sums); err != nil {
+		return credits, debits, err
+	}
+	for _, s := range sums {
+		if s.Key.Currency != credits.Code() {
+			return credits, debits, fmt.Errorf("%w: %s holds %s postings", ErrLedgerCurrency, account, s.Key.Currency)
+		}
+		if s.Key.Side == Debit {
+			debits = money.New(s.Total, SettlementCurrency)
+		} else {
+			credits = money.New(s.Total, SettlementCurrency)
+		}
+	}
+	return credits, debits, nil
+}
+
+// Balance derives an account's balance from all its postings
+func (r *LedgerRepository) Balance(ctx context.Context, account string) (money.Money, error) {
+	credits, debits, err := r.Totals(ctx, account, time.Time{}, time.Time{})
+	if err != nil {
+		return money.Money{}, err
+	}
+	return credits.Sub(debits), nil
+}
+
+// Statement returns a keyset page of an account's postings in [from, to)
+func (r *LedgerRepository) Statement(ctx context.Context, account string, from, to time.Time, page pagination.Request) ([]Posting, error) {
+	return findPage[Posting](ctx, r.mongo.Ledger(), periodFilter(account, from, to), page)
+}
+
+// legacySkipped lists embedded transaction statuses that never moved credits
+var legacySkipped = map[string]bool{"failed": true, "cancelled": true}
+
+// legacyEntry turns a transaction embedded in a user's credits into a
+// ledger entry. The type decides which way credits moved; the sign of the
+// amount is only trusted for types that do not.
+func legacyEntry(userID primitive.ObjectID, tx CreditTransaction) *LedgerEntry {
+	entry := &LedgerEntry{
+		ID:          tx.ID,
+		Type:        tx.Type,
+		Reference:   tx.RelatedItemID,
+		Description: tx.Description,
+		CreatedAt:   tx.Timestamp,
+	}
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = entry.ID.Timestamp()
+	}
+
+	amount := money.FromMajor(math.Abs(tx.Amount), money.DefaultCurrency)
+	balance := BalanceAccount(userID)
+	switch {
+	case tx.Type == CreditTransactionPurchase:
+		entry.Debit(balance, amount).Credit(AccountLegacySales, amount)
+	case tx.Type == CreditTransactionRefund:
+		entry.Debit(AccountLegacySales, amount).Credit(balance, amount)
+	case tx.Type == CreditTransactionSale:
+		entry.Debit(AccountLegacySales, amount).Credit(EarningsAccount(userID), amount)
+	case tx.Type == CreditTransactionWithdrawal || tx.Amount < 0:
+		entry.Debit(balance, amount).Credit(AccountFunding, amount)
+	default:
+		entry.Debit(AccountFunding, amount).Credit(balance, amount)
+	}
+	return entry
+}
+
+// MigrateEmbedded moves the credit transactions still embedded in users
+// onto the ledger, one user per transaction. Where the migrated postings do
+// not add up to a user's Credits snapshot, an adjustment entry makes up the
+// difference so the ledger reconciles with it. It returns the number of
+// users migrated and is safe to run again.
+func (r *LedgerRepository) MigrateEmbedded(ctx context.Context) (int, error) {
+	cursor, err := r.mongo.Users().Find(ctx,
+		bson.M{"credits.transactions": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var users []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return 0, err
+	}
+
+	for i, u := range users {
+		_, err := r.mongo.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, r.migrateUser(sc, u.ID)
+		})
+		if err != nil {
+			return i, fmt.Errorf("migrating credits of user %s: %w", u.ID.Hex(), err)
+		}
+	}
+	return len(users), nil
+}
+
+func (r *LedgerRepository) migrateUser(ctx context.Context, userID primitive.ObjectID) error {
+	var legacy struct {
+		Credits struct {
+			Balance         money.Money         `bson:"balance"`
+			PendingEarnings money.Money         `bson:"pending_earnings"`
+			Transactions    []CreditTransaction `bson:"transactions"`
+		} `bson:"credits"`
+	}
+	err := r.mongo.Users().FindOne(ctx, bson.M{
+		"_id":                  userID,
+		"credits.transactions": bson.M{"$exists": true},
+	}).Decode(&legacy)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range legacy.Credits.Transactions {
+		if legacySkipped[tx.Status] {
+			continue
+		}
+		if err := r.Post(ctx, legacyEntry(userID, tx)); err != nil {
+			return err
+		}
+	}
+
+	for _, snapshot := range []struct {
+		account string
+		amount  money.Money
+	}{
+		{BalanceAccount(userID), legacy.Credits.Balance},
+		{EarningsAccount(userID), legacy.Credits.PendingEarnings},
+	} {
+		derived, err := r.Balance(ctx, snapshot.account)
+		if err != nil {
+			return err
+		}
+		diff := snapshot.amount.Sub(derived)
+		entry := NewLedgerEntry(CreditTransactionAdjustment, primitive.NilObjectID, "Opening balance carried over from embedded credits")
+		if diff.IsPositive() {
+			entry.Debit(AccountFunding, diff).Credit(snapshot.account, diff)
+		} else {
+			entry.Debit(snapshot.account, diff.Neg()).Credit(AccountFunding, diff.Neg())
+		}
+		if err := r.Post(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	_, err = r.mongo.Users().UpdateOne(ctx, bson.M{"_id": userID},
+		bson.M{"$unset": bson.M{"credits.transactions": ""}})
+	return err
+}
@@ -0,0 +1,160 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLedgerEntryValidate(t *testing.T) {
+	buyer, creator := primitive.NewObjectID(), primitive.NewObjectID()
+
+	entry := NewLedgerEntry(CreditTransactionPurchase, primitive.NewObjectID(), "Purchase").
+		Debit(BalanceAccount(buyer), usd(999)).
+		Credit(EarningsAccount(creator), usd(849)).
+		Credit(AccountCommission, usd(150))
+	assert.NoError(t, entry.Validate())
+	assert.Len(t, entry.Postings, 3)
+
+	entry.Credit(AccountCommission, usd(1))
+	assert.Len(t, entry.Postings, 3, "postings to the same account and side are merged")
+	assert.Equal(t, ErrUnbalancedEntry, entry.Validate())
+
+	free := NewLedgerEntry(CreditTransactionPurchase, primitive.NilObjectID, "Free").
+		Debit(BalanceAccount(buyer), usd(0)).
+		Credit(AccountCommission, usd(0))
+	assert.Empty(t, free.Postings, "zero amounts are dropped")
+
+	negative := NewLedgerEntry(CreditTransactionAdjustment, primitive.NilObjectID, "").
+		Debit(AccountFunding, usd(-500)).
+		Credit(BalanceAccount(buyer), usd(-500))
+	assert.Equal(t, ErrInvalidPosting, negative.Validate())
+}
+
+func TestLedgerEntryNet(t *testing.T) {
+	buyer := primitive.NewObjectID()
+	entry := NewLedgerEntry(CreditTransactionRefund, primitive.NewObjectID(), "Refund").
+		Credit(BalanceAccount(buyer), usd(999)).
+		Debit(BalanceAccount(buyer), usd(99)).
+		Debit(AccountCommission, usd(900))
+	assert.Equal(t, usd(900), entry.Net(BalanceAccount(buyer), "USD"))
+	assert.Equal(t, usd(-900), entry.Net(AccountCommission, "USD"))
+	assert.Equal(t, usd(0), entry.Net(AccountFunding, "USD"))
+}
+
+func TestLegacyEntry(t *testing.T) {
+	user := primitive.NewObjectID()
+	balance, earnings := BalanceAccount(user), EarningsAccount(user)
+
+	tests := []struct {
+		name          string
+		tx            CreditTransaction
+		debit, credit string
+	}{
+		{"purchase", CreditTransaction{Type: CreditTransactionPurchase, Amount: -20}, balance, AccountLegacySales},
+		{"unsigned purchase", CreditTransaction{Type: CreditTransactionPurchase, Amount: 20}, balance, AccountLegacySales},
+		{"refund", CreditTransaction{Type: CreditTransactionRefund, Amount: 20}, AccountLegacySales, balance},
+		{"sale", CreditTransaction{Type: CreditTransactionSale, Amount: 20}, AccountLegacySales, earnings},
+		{"deposit", CreditTransaction{Type: CreditTransactionDeposit, Amount: 20}, AccountFunding, balance},
+		{"withdrawal", CreditTransaction{Type: CreditTransactionWithdrawal, Amount: 20}, balance, AccountFunding},
+		{"negative gift", CreditTransaction{Type: CreditTransactionGift, Amount: -20}, balance, AccountFunding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.tx.ID = primitive.NewObjectID()
+			entry := legacyEntry(user, tt.tx)
+			require.NoError(t, entry.Validate())
+			assert.Equal(t, tt.tx.ID, entry.ID, "legacy IDs are kept")
+			assert.False(t, entry.CreatedAt.IsZero())
+			assert.ElementsMatch(t, []Posting{
+				{Account: tt.debit, Side: Debit, Amount: usd(2000)},
+				{Account: tt.credit, Side: Credit, Amount: usd(2000)},
+			}, entry.Postings)
+		})
+	}
+}
+
+func TestMigrateEmbedded(t *testing.T) {
+	_, m := newCheckoutTestService(t)
+	ctx := context.Background()
+	ledger := NewLedgerRepository(m)
+
+	user := primitive.NewObjectID()
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	_, err := m.Users().InsertOne(ctx, bson.M{
+		"_id":    user,
+		"status": UserStatusActive,
+		"credits": bson.M{
+			// 100 deposited, 30 spent and 5 carried over from before
+			// transactions were recorded
+			"balance":          75,
+			"pending_earnings": 12.5,
+			"transactions": bson.A{
+				CreditTransaction{ID: primitive.NewObjectID(), Type: CreditTransactionDeposit, Amount: 100, Status: "completed", Timestamp: day},
+				CreditTransaction{ID: primitive.NewObjectID(), Type: CreditTransactionPurchase, Amount: -30, Status: "completed", Timestamp: day.AddDate(0, 0, 1)},
+				CreditTransaction{ID: primitive.NewObjectID(), Type: CreditTransactionPurchase, Amount: -40, Status: "failed", Timestamp: day.AddDate(0, 0, 2)},
+				CreditTransaction{ID: primitive.NewObjectID(), Type: CreditTransactionSale, Amount: 12.5, Status: "pending", Timestamp: day.AddDate(0, 0, 3)},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// Startup rewrites the plain numbers before the ledger migration runs
+	require.NoError(t, m.MigrateMoney(ctx))
+	var raw bson.M
+	require.NoError(t, m.Users().FindOne(ctx, bson.M{"_id": user}).Decode(&raw))
+	assert.Equal(t, bson.M{"amount": int64(1250), "currency": "USD"}, raw["credits"].(bson.M)["pending_earnings"])
+
+	n, err := ledger.MigrateEmbedded(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = ledger.MigrateEmbedded(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n, "migrated users are not migrated again")
+
+	balance, err := ledger.Balance(ctx, BalanceAccount(user))
+	require.NoError(t, err)
+	assert.Equal(t, usd(7500), balance, "the ledger reconciles with the snapshot")
+	earnings, err := ledger.Balance(ctx, EarningsAccount(user))
+	require.NoError(t, err)
+	assert.Equal(t, usd(1250), earnings)
+
+	credits, debits, err := ledger.Totals(ctx, BalanceAccount(user), day, day.AddDate(0, 0, 2))
+	require.NoError(t, err)
+	assert.Equal(t, usd(10000), credits)
+	assert.Equal(t, usd(3000), debits)
+
+	raw = bson.M{}
+	require.NoError(t, m.Users().FindOne(ctx, bson.M{"_id": user}).Decode(&raw))
+	assert.NotContains(t, raw["credits"], "transactions")
+}
+
+func TestLedgerTotalsCurrency(t *testing.T) {
+	_, m := newCheckoutTestService(t)
+	ctx := context.Background()
+	ledger := NewLedgerRepository(m)
+	user := primitive.NewObjectID()
+
+	credits, debits, err := ledger.Totals(ctx, BalanceAccount(user), time.Time{}, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, usd(0), credits, "an empty account totals zero in the settlement currency")
+	assert.Equal(t, usd(0), debits)
+
+	require.NoError(t, ledger.Post(ctx, NewLedgerEntry(CreditTransactionDeposit, primitive.NewObjectID(), "Deposit").
+		Debit(AccountFunding, usd(1000)).
+		Credit(BalanceAccount(user), usd(1000))))
+	require.NoError(t, ledger.Post(ctx, NewLedgerEntry(CreditTransactionDeposit, primitive.NewObjectID(), "Deposit").
+		Debit(AccountFunding, money.New(500, "EUR")).
+		Credit(BalanceAccount(user), money.New(500, "EUR"))))
+
+	_, _, err = ledger.Totals(ctx, BalanceAccount(user), time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, ErrLedgerCurrency, "EUR postings are not added to USD ones")
+	_, err = ledger.Balance(ctx, BalanceAccount(user))
+	assert.ErrorIs(t, err, ErrLedgerCurrency)
+}
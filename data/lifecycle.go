@@ -0,0 +1,166 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	ErrInvalidProductTransition = errors.New("action is not allowed in the product's current status")
+	ErrUnknownProductAction     = errors.New("unknown product action")
+	ErrTransitionReasonRequired = errors.New("a reason is required for this action")
+	ErrNotSubmittable           = errors.New("product needs a published version with a file before it can be submitted")
+	// ErrProductStatusConflict is returned when the product's status changed
+	// between loading it and applying a transition.
+	ErrProductStatusConflict = errors.New("product status was modified concurrently")
+)
+
+// ProductAction names a lifecycle transition
+type ProductAction string
+
+const (
+	// Creator actions
+	ProductActionSubmit     ProductAction = "submit"
+	ProductActionWithdraw   ProductAction = "withdraw"
+	ProductActionDeactivate ProductAction = "deactivate"
+	ProductActionReactivate ProductAction = "reactivate"
+	ProductActionArchive    ProductAction = "archive"
+	// Moderator actions
+	ProductActionApprove  ProductAction = "approve"
+	ProductActionReject   ProductAction = "reject"
+	ProductActionTakeDown ProductAction = "take_down"
+)
+
+type productTransitionRule struct {
+	from           []ProductStatus
+	to             ProductStatus
+	moderator      bool
+	reasonRequired bool
+}
+
+// productTransitions is the product lifecycle. Creators submit drafts for
+// review; moderators approve them into the catalog or reject them with a
+// reason. Rejected and taken down products go back through review, while a
+// product the creator deactivated themselves can be reactivated directly.
+// Archiving is final.
+var productTransitions = map[ProductAction]productTransitionRule{
+	ProductActionSubmit: {
+		from: []ProductStatus{ProductStatusDraft, ProductStatusRejected},
+		to:   ProductStatusPendingReview,
+	},
+	ProductActionWithdraw: {
+		from: []ProductStatus{ProductStatusPendingReview},
+		to:   ProductStatusDraft,
+	},
+	ProductActionDeactivate: {
+		from: []ProductStatus{ProductStatusActive},
+		to:   ProductStatusInactive,
+	},
+	ProductActionReactivate: {
+		from: []ProductStatus{ProductStatusInactive},
+		to:   ProductStatusActive,
+	},
+	ProductActionArchive: {
+		from: []ProductStatus{
+			ProductStatusDraft, ProductStatusPendingReview, ProductStatusActive,
+			ProductStatusRejected, ProductStatusInactive,
+		},
+		to: ProductStatusArchived,
+	},
+	ProductActionApprove: {
+		from:      []ProductStatus{ProductStatusPendingReview},
+		to:        ProductStatusActive,
+		moderator: true,
+	},
+	ProductActionReject: {
+		from:           []ProductStatus{ProductStatusPendingReview},
+		to:             ProductStatusRejected,
+		moderator:      true,
+		reasonRequired: true,
+	},
+	ProductActionTakeDown: {
+		from:           []ProductStatus{ProductStatusActive, ProductStatusInactive},
+		to:             ProductStatusRejected,
+		moderator:      true,
+		reasonRequired: true,
+	},
+}
+
+// RequiresModerator reports whether only moderators and admins may perform
+// the action
+func (a ProductAction) RequiresModerator() bool {
+	return productTransitions[a].moderator
+}
+
+// NextStatus returns the status the product moves to under action, or an
+// error if the action is unknown or not allowed from its current status.
+func (p *Product) NextStatus(action ProductAction, reason string) (ProductStatus, error) {
+	rule, ok := productTransitions[action]
+	if !ok {
+		return "", ErrUnknownProductAction
+	}
+	allowed := false
+	for _, from := range rule.from {
+		allowed = allowed || p.Status == from
+	}
+	if !allowed {
+		return "", ErrInvalidProductTransition
+	}
+	if rule.reasonRequired && reason == "" {
+		return "", ErrTransitionReasonRequired
+	}
+	if action == ProductActionSubmit {
+		if p.IsBundle() {
+			if len(p.Bundle.Items) < MinBundleItems {
+				return "", ErrBundleTooSmall
+			}
+		} else if latest, err := p.LatestVersion(); err != nil || !latest.HasFile() {
+			return "", ErrNotSubmittable
+		}
+	}
+	return rule.to, nil
+}
+
+// Transition applies action to the product and appends it to the status
+// history. The write is conditional on the status the transition was
+// computed from.
+func (r *ProductRepository) Transition(ctx context.Context, product *Product, action ProductAction, actor *CachedUser, reason string) (*ProductTransition, error) {
+	to, err := product.NextStatus(action, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	t := ProductTransition{
+		From:      product.Status,
+		To:        to,
+		Action:    action,
+		ActorID:   actor.ID,
+		ActorRole: actor.Role,
+		Reason:    reason,
+		At:        time.Now(),
+	}
+	err = r.UpdateRaw(ctx, bson.M{"_id": product.ID, "status": product.Status}, bson.M{
+		"$set":  bson.M{"status": to, "updated_at": t.At},
+		"$push": bson.M{"status_history": t},
+	})
+	if err == ErrProductNotFound {
+		return nil, ErrProductStatusConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	product.Status = to
+	product.UpdatedAt = t.At
+	product.StatusHistory = append(product.StatusHistory, t)
+	return &t, nil
+}
+
+// ListPendingReview returns a page of the products awaiting moderation
+func (r *ProductRepository) ListPendingReview(ctx context.Context, page pagination.Request) ([]Product, error) {
+	return findPage[Product](ctx, r.mongo.Products(), bson.M{"status": ProductStatusPendingReview}, page)
+}
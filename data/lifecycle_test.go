@@ -0,0 +1,53 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProductNextStatus(t *testing.T) {
+	withFile := []ProductVersion{{Version: "1.0.0", Status: VersionStatusPublished, StorageKey: "products/x/file.zip"}}
+
+	tests := []struct {
+		name     string
+		status   ProductStatus
+		versions []ProductVersion
+		action   ProductAction
+		reason   string
+		want     ProductStatus
+		err      error
+	}{
+		{"Submit Draft", ProductStatusDraft, withFile, ProductActionSubmit, "", ProductStatusPendingReview, nil},
+		{"Resubmit Rejected", ProductStatusRejected, withFile, ProductActionSubmit, "", ProductStatusPendingReview, nil},
+		{"Submit Without Versions", ProductStatusDraft, nil, ProductActionSubmit, "", "", ErrNotSubmittable},
+		{"Submit Without File", ProductStatusDraft, []ProductVersion{{Version: "1.0.0"}}, ProductActionSubmit, "", "", ErrNotSubmittable},
+		{"Submit Active", ProductStatusActive, withFile, ProductActionSubmit, "", "", ErrInvalidProductTransition},
+		{"Withdraw", ProductStatusPendingReview, withFile, ProductActionWithdraw, "", ProductStatusDraft, nil},
+		{"Approve", ProductStatusPendingReview, withFile, ProductActionApprove, "", ProductStatusActive, nil},
+		{"Approve Draft", ProductStatusDraft, withFile, ProductActionApprove, "", "", ErrInvalidProductTransition},
+		{"Reject", ProductStatusPendingReview, withFile, ProductActionReject, "Missing screenshots", ProductStatusRejected, nil},
+		{"Reject Without Reason", ProductStatusPendingReview, withFile, ProductActionReject, "", "", ErrTransitionReasonRequired},
+		{"Deactivate", ProductStatusActive, withFile, ProductActionDeactivate, "", ProductStatusInactive, nil},
+		{"Reactivate", ProductStatusInactive, withFile, ProductActionReactivate, "", ProductStatusActive, nil},
+		{"Reactivate Rejected", ProductStatusRejected, withFile, ProductActionReactivate, "", "", ErrInvalidProductTransition},
+		{"Take Down", ProductStatusActive, withFile, ProductActionTakeDown, "Copyright claim", ProductStatusRejected, nil},
+		{"Archive", ProductStatusActive, withFile, ProductActionArchive, "", ProductStatusArchived, nil},
+		{"Archived Is Final", ProductStatusArchived, withFile, ProductActionSubmit, "", "", ErrInvalidProductTransition},
+		{"Archive Twice", ProductStatusArchived, withFile, ProductActionArchive, "", "", ErrInvalidProductTransition},
+		{"Unknown Action", ProductStatusDraft, withFile, "publish", "", "", ErrUnknownProductAction},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Product{Status: tt.status, Versions: tt.versions}
+			got, err := p.NextStatus(tt.action, tt.reason)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	assert.True(t, ProductActionApprove.RequiresModerator())
+	assert.True(t, ProductActionTakeDown.RequiresModerator())
+	assert.False(t, ProductActionSubmit.RequiresModerator())
+}
@@ -0,0 +1,108 @@
+package data
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// localEntry is a single value held by the in-process cache tier
+type localEntry struct {
+	key     string
+	version int64
+	payload []byte
+	expires time.Time
+}
+
+// lruCache is a fixed-size, TTL-bounded LRU safe for concurrent use. Values
+// are stored as encoded bytes so callers never share mutable state.
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (l *lruCache) get(key string) (*localEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*localEntry)
+	if time.Now().After(entry.expires) {
+		l.order.Remove(el)
+		delete(l.items, key)
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return entry, true
+}
+
+func (l *lruCache) set(key string, version int64, payload []byte) {
+	if l.size <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := &localEntry{
+		key:     key,
+		version: version,
+		payload: payload,
+		expires: time.Now().Add(l.ttl),
+	}
+	if el, ok := l.items[key]; ok {
+		// Never let a slow loader overwrite a newer version
+		if el.Value.(*localEntry).version > version {
+			return
+		}
+		el.Value = entry
+		l.order.MoveToFront(el)
+		return
+	}
+
+	l.items[key] = l.order.PushFront(entry)
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*localEntry).key)
+	}
+}
+
+// evict drops key if the cached copy is older than version. A version of
+// zero evicts unconditionally.
+func (l *lruCache) evict(key string, version int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.items[key]
+	if !ok {
+		return
+	}
+	if version == 0 || el.Value.(*localEntry).version < version {
+		l.order.Remove(el)
+		delete(l.items, key)
+	}
+}
+
+func (l *lruCache) purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.order.Init()
+	l.items = make(map[string]*list.Element)
+}
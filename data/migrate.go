@@ -0,0 +1,109 @@
+package data
+
+import (
+	"context"
+
+	"github.com/kordlab/marketplace/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// moneyFields lists, per collection, the fields that were stored as plain
+// float64 amounts before money.Money
+var moneyFields = map[string][]string{
+	UsersCollection:             {"credits.balance", "credits.pending_earnings"},
+	ProductsCollection:          {"price", "discounted_price"},
+	PurchasesCollection:         {"price"},
+	WishlistsCollection:         {"price"},
+	CouponsCollection:           {"min_spend", "amount"},
+	CouponRedemptionsCollection: {"discount"},
+	SettingsCollection:          {"minimum_withdrawal"},
+	LedgerCollection:            {"amount"},
+}
+
+// currencyFields names the field holding the currency of a collection's
+// plain amounts. Amounts in other collections, or in documents without a
+// currency, are in money.DefaultCurrency.
+var currencyFields = map[string]string{
+	CouponsCollection: "currency",
+}
+
+// MigrateMoney rewrites amounts stored as plain numbers into the
+// {amount, currency} documents money.Money stores. Decoding copes with
+// either form, but queries and atomic updates address "<field>.amount" and
+// would miss documents that were never rewritten. Only numeric fields are
+// matched, so an interrupted run resumes where it stopped and running it
+// again is a no-op.
+func (m *MongoDB) MigrateMoney(ctx context.Context) error {
+	if err := m.migrateCouponValues(ctx); err != nil {
+		return err
+	}
+	for collection, fields := range moneyFields {
+		coll := m.database.Collection(collection)
+		currencyField, ok := currencyFields[collection]
+		for _, field := range fields {
+			numeric := bson.M{"$type": "number"}
+			if !ok {
+				if err := rewriteMoney(ctx, coll, bson.M{field: numeric}, field, money.DefaultCurrency); err != nil {
+					return err
+				}
+				continue
+			}
+
+			currencies, err := coll.Distinct(ctx, currencyField, bson.M{field: numeric})
+			if err != nil {
+				return err
+			}
+			for _, c := range currencies {
+				code, _ := c.(string)
+				if code == "" {
+					continue
+				}
+				if err := rewriteMoney(ctx, coll, bson.M{field: numeric, currencyField: code}, field, code); err != nil {
+					return err
+				}
+			}
+			unset := bson.M{field: numeric, currencyField: bson.M{"$in": bson.A{nil, ""}}}
+			if err := rewriteMoney(ctx, coll, unset, field, money.DefaultCurrency); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteMoney turns the plain major-unit amounts of field in the documents
+// matching filter into money.Money documents in currency
+func rewriteMoney(ctx context.Context, coll *mongo.Collection, filter bson.M, field, currency string) error {
+	currency = money.Zero(currency).Code()
+	unit := 1
+	for i := 0; i < money.Exponent(currency); i++ {
+		unit *= 10
+	}
+	_, err := coll.UpdateMany(ctx, filter,
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{field: bson.M{
+			"amount": bson.M{"$toLong": bson.M{"$round": bson.A{
+				bson.M{"$multiply": bson.A{"$" + field, unit}}, 0,
+			}}},
+			"currency": currency,
+		}}}}})
+	return err
+}
+
+// migrateCouponValues splits the value coupons kept before money.Money: a
+// percentage coupon's rate moves to percent and a fixed coupon's amount to
+// amount, where MigrateMoney rewrites it in the coupon's currency
+func (m *MongoDB) migrateCouponValues(ctx context.Context) error {
+	for typ, field := range map[CouponType]string{CouponTypePercentage: "percent", CouponTypeFixed: "amount"} {
+		_, err := m.database.Collection(CouponsCollection).UpdateMany(ctx,
+			bson.M{"type": typ, "value": bson.M{"$type": "number"}},
+			mongo.Pipeline{
+				{{Key: "$set", Value: bson.M{field: "$value"}}},
+				{{Key: "$unset", Value: "value"}},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
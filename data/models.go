@@ -3,6 +3,7 @@ package data
 import (
 	"time"
 
+	"github.com/kordlab/marketplace/money"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -51,10 +52,13 @@ type UserProfile struct {
 	Links       []string `bson:"links" json:"links"`
 }
 
-// Credits manages user's digital marketplace credit system
+// Credits are snapshots of a user's ledger accounts, kept on the user so
+// checkout can check a balance with a conditional update. Every change is
+// made in the same transaction as the ledger postings behind it.
 type Credits struct {
-	Balance      float64             `bson:"balance" json:"balance"`
-	Transactions []CreditTransaction `bson:"transactions" json:"transactions"`
+	Balance money.Money `bson:"balance" json:"balance"`
+	// PendingEarnings holds a creator's share of sales until it is paid out
+	PendingEarnings money.Money `bson:"pending_earnings" json:"pending_earnings"`
 }
 
 // CreditTransactionType defines different credit transaction types
@@ -66,9 +70,12 @@ const (
 	CreditTransactionDeposit    CreditTransactionType = "deposit"
 	CreditTransactionWithdrawal CreditTransactionType = "withdrawal"
 	CreditTransactionGift       CreditTransactionType = "gift"
+	CreditTransactionSale       CreditTransactionType = "sale"
+	CreditTransactionAdjustment CreditTransactionType = "adjustment"
 )
 
-// CreditTransaction represents credit-based transactions
+// CreditTransaction is a credit movement as it used to be embedded in
+// Credits. It is only read to migrate users onto the ledger.
 type CreditTransaction struct {
 	ID            primitive.ObjectID    `bson:"_id,omitempty" json:"id"`
 	Type          CreditTransactionType `bson:"type" json:"type"`
@@ -79,16 +86,52 @@ type CreditTransaction struct {
 	Timestamp     time.Time             `bson:"timestamp" json:"timestamp"`
 }
 
+// PostingSide says whether a posting debits or credits its account
+type PostingSide string
+
+const (
+	Debit  PostingSide = "debit"
+	Credit PostingSide = "credit"
+)
+
+// Posting is one immutable line of a ledger entry. The postings of an entry
+// share its EntryID, Type, Reference and time, and their debits and credits
+// add up to the same amount. Amount is always positive.
+type Posting struct {
+	ID          primitive.ObjectID    `bson:"_id,omitempty" json:"id"`
+	EntryID     primitive.ObjectID    `bson:"entry_id" json:"entry_id"`
+	Account     string                `bson:"account" json:"account"`
+	Side        PostingSide           `bson:"side" json:"side"`
+	Amount      money.Money           `bson:"amount" json:"amount"`
+	Type        CreditTransactionType `bson:"type" json:"type"`
+	Reference   primitive.ObjectID    `bson:"reference,omitempty" json:"reference,omitempty"`
+	Description string                `bson:"description" json:"description"`
+	CreatedAt   time.Time             `bson:"created_at" json:"created_at"`
+}
+
 // ProductStatus represents the current status of a digital product
 type ProductStatus string
 
 const (
-	ProductStatusDraft    ProductStatus = "draft"
-	ProductStatusActive   ProductStatus = "active"
-	ProductStatusInactive ProductStatus = "inactive"
-	ProductStatusArchived ProductStatus = "archived"
+	ProductStatusDraft         ProductStatus = "draft"
+	ProductStatusPendingReview ProductStatus = "pending_review"
+	ProductStatusActive        ProductStatus = "active"
+	ProductStatusRejected      ProductStatus = "rejected"
+	ProductStatusInactive      ProductStatus = "inactive"
+	ProductStatusArchived      ProductStatus = "archived"
 )
 
+// ProductTransition records one status change of a product
+type ProductTransition struct {
+	From      ProductStatus      `bson:"from" json:"from"`
+	To        ProductStatus      `bson:"to" json:"to"`
+	Action    ProductAction      `bson:"action" json:"action"`
+	ActorID   primitive.ObjectID `bson:"actor_id" json:"actor_id"`
+	ActorRole UserRole           `bson:"actor_role" json:"actor_role"`
+	Reason    string             `bson:"reason,omitempty" json:"reason,omitempty"`
+	At        time.Time          `bson:"at" json:"at"`
+}
+
 // ProductCategory defines product categorization
 type ProductCategory string
 
@@ -101,34 +144,149 @@ const (
 	CategorySource   ProductCategory = "source_code"
 )
 
-// Product represents a digital item in the marketplace
+// ProductType distinguishes single products from bundles of other products
+type ProductType string
+
+const (
+	ProductTypeSingle ProductType = "single"
+	ProductTypeBundle ProductType = "bundle"
+)
+
+// BundleOptions configures what buying a bundle grants and how it is priced
+type BundleOptions struct {
+	// Items are the products the bundle contains
+	Items []primitive.ObjectID `bson:"items" json:"items"`
+	// IncludeUpdates entitles buyers to future versions of the items rather
+	// than the versions current at purchase time
+	IncludeUpdates bool `bson:"include_updates" json:"include_updates"`
+	// ExcludeOwned discounts the bundle by the share of items the buyer
+	// already owns
+	ExcludeOwned bool `bson:"exclude_owned" json:"exclude_owned"`
+}
+
+// Product represents a digital item in the marketplace. Creators price it in
+// any currency with an exchange rate. ReferencePrice is Price converted into
+// SettlementCurrency, kept up to date as rates change so the catalog can
+// filter and sort across currencies; Local is the price in the currency the
+// client asked for and is never stored.
 type Product struct {
-	ID              primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	CreatorID       primitive.ObjectID `bson:"creator_id" json:"creator_id"`
-	Title           string             `bson:"title" json:"title" validate:"required,min=3,max=200"`
-	Description     string             `bson:"description" json:"description"`
-	Price           float64            `bson:"price" json:"price" validate:"gte=0"`
-	DiscountedPrice float64            `bson:"discounted_price" json:"discounted_price"`
-	Category        ProductCategory    `bson:"category" json:"category"`
-	Status          ProductStatus      `bson:"status" json:"status"`
-	Tags            []string           `bson:"tags" json:"tags"`
-	Technologies    []string           `bson:"technologies" json:"technologies"`
-	Images          []string           `bson:"images" json:"images"`
-	Specifications  map[string]string  `bson:"specifications" json:"specifications"`
-	Versions        []ProductVersion   `bson:"versions" json:"versions"`
-	DownloadCount   int                `bson:"download_count" json:"download_count"`
-	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt       time.Time          `bson:"updated_at" json:"updated_at"`
-}
-
-// ProductVersion tracks different versions of a digital product
+	ID              primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	CreatorID       primitive.ObjectID  `bson:"creator_id" json:"creator_id"`
+	Title           string              `bson:"title" json:"title" validate:"required,min=3,max=200"`
+	Description     string              `bson:"description" json:"description"`
+	Price           money.Money         `bson:"price" json:"price" validate:"gte=0"`
+	DiscountedPrice money.Money         `bson:"discounted_price" json:"discounted_price" validate:"gte=0,ltefield=Price"`
+	Category        ProductCategory     `bson:"category" json:"category" validate:"required,oneof=template plugin asset course guide source_code"`
+	Type            ProductType         `bson:"type,omitempty" json:"type" validate:"omitempty,oneof=single bundle"`
+	Bundle          *BundleOptions      `bson:"bundle,omitempty" json:"bundle,omitempty"`
+	Status          ProductStatus       `bson:"status" json:"status" validate:"required,oneof=draft pending_review active rejected inactive archived"`
+	Tags            []string            `bson:"tags" json:"tags"`
+	Technologies    []string            `bson:"technologies" json:"technologies"`
+	Images          []ProductImage      `bson:"images" json:"images"`
+	Specifications  map[string]string   `bson:"specifications" json:"specifications"`
+	Versions        []ProductVersion    `bson:"versions" json:"versions"`
+	DownloadCount   int                 `bson:"download_count" json:"download_count"`
+	ViewCount       int                 `bson:"view_count" json:"view_count"`
+	AverageRating   float64             `bson:"average_rating" json:"average_rating"`
+	ReviewCount     int                 `bson:"review_count" json:"review_count"`
+	StatusHistory   []ProductTransition `bson:"status_history,omitempty" json:"-"`
+	CreatedAt       time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time           `bson:"updated_at" json:"updated_at"`
+	ReferencePrice  money.Money         `bson:"reference_price,omitempty" json:"-"`
+	Local           *LocalPrice         `bson:"-" json:"local,omitempty"`
+}
+
+// LocalPrice is a product's price converted for display. Purchases are
+// charged from the creator's price, not from this.
+type LocalPrice struct {
+	Price          money.Money `json:"price"`
+	EffectivePrice money.Money `json:"effective_price"`
+	// Rate is how many units of the local currency one unit of the
+	// product's currency buys
+	Rate float64 `json:"rate"`
+}
+
+// ImageStatus tracks the processing of an uploaded gallery image
+type ImageStatus string
+
+const (
+	ImageStatusProcessing ImageStatus = "processing"
+	ImageStatusReady      ImageStatus = "ready"
+	ImageStatusFailed     ImageStatus = "failed"
+)
+
+// ProductImage is a gallery image with its rendered variants. Linked images,
+// hosted elsewhere rather than uploaded, have a single "original" variant and
+// no dimensions.
+type ProductImage struct {
+	ID        primitive.ObjectID `bson:"id" json:"id"`
+	Status    ImageStatus        `bson:"status" json:"status"`
+	Width     int                `bson:"width,omitempty" json:"width,omitempty"`
+	Height    int                `bson:"height,omitempty" json:"height,omitempty"`
+	AltText   string             `bson:"alt_text" json:"alt_text"`
+	Linked    bool               `bson:"linked,omitempty" json:"linked,omitempty"`
+	Variants  []ImageVariant     `bson:"variants" json:"variants"`
+	Error     string             `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt time.Time          `bson:"created_at,omitempty" json:"created_at,omitempty"`
+}
+
+// ImageVariant is one size and format of a gallery image
+type ImageVariant struct {
+	Size        string `bson:"size" json:"size"`
+	Format      string `bson:"format,omitempty" json:"format,omitempty"`
+	ContentType string `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	Width       int    `bson:"width,omitempty" json:"width,omitempty"`
+	Height      int    `bson:"height,omitempty" json:"height,omitempty"`
+	FileSize    int64  `bson:"file_size,omitempty" json:"file_size,omitempty"`
+	URL         string `bson:"url" json:"url"`
+}
+
+// VersionStatus represents whether a product version is offered to buyers
+type VersionStatus string
+
+const (
+	VersionStatusPublished  VersionStatus = "published"
+	VersionStatusDeprecated VersionStatus = "deprecated"
+	VersionStatusYanked     VersionStatus = "yanked"
+)
+
+// ProductVersion tracks different versions of a digital product. DownloadURL
+// and StorageKey locate the file and are never serialised to clients, who get
+// signed, expiring links from the download endpoints instead.
 type ProductVersion struct {
-	Version       string    `bson:"version" json:"version"`
-	ReleaseNotes  string    `bson:"release_notes" json:"release_notes"`
-	DownloadURL   string    `bson:"download_url" json:"download_url"`
-	Compatibility []string  `bson:"compatibility" json:"compatibility"`
-	FileSize      int64     `bson:"file_size" json:"file_size"`
-	ReleasedAt    time.Time `bson:"released_at" json:"released_at"`
+	Version         string        `bson:"version" json:"version"`
+	ReleaseNotes    string        `bson:"release_notes" json:"release_notes"`
+	DownloadURL     string        `bson:"download_url" json:"-"`
+	Compatibility   []string      `bson:"compatibility" json:"compatibility"`
+	FileSize        int64         `bson:"file_size" json:"file_size"`
+	FileName        string        `bson:"file_name,omitempty" json:"file_name,omitempty"`
+	ContentType     string        `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	SHA256          string        `bson:"sha256,omitempty" json:"sha256,omitempty"`
+	StorageKey      string        `bson:"storage_key,omitempty" json:"-"`
+	Status          VersionStatus `bson:"status" json:"status"`
+	StatusReason    string        `bson:"status_reason,omitempty" json:"status_reason,omitempty"`
+	StatusChangedAt time.Time     `bson:"status_changed_at,omitempty" json:"status_changed_at,omitempty"`
+	ReleasedAt      time.Time     `bson:"released_at" json:"released_at"`
+	// Manifest lists the files in an uploaded version. It is kept out of
+	// product responses and served from its own endpoint.
+	Manifest *VersionManifest `bson:"manifest,omitempty" json:"-"`
+}
+
+// VersionManifest records what an uploaded version contains, as found by the
+// safety checks it passed before publishing
+type VersionManifest struct {
+	Format       string         `bson:"format" json:"format"`
+	FileCount    int            `bson:"file_count" json:"file_count"`
+	UnpackedSize int64          `bson:"unpacked_size" json:"unpacked_size"`
+	Files        []ManifestFile `bson:"files" json:"files"`
+	InspectedAt  time.Time      `bson:"inspected_at" json:"inspected_at"`
+}
+
+// ManifestFile is one file in a version's manifest
+type ManifestFile struct {
+	Path   string `bson:"path" json:"path"`
+	Size   int64  `bson:"size" json:"size"`
+	SHA256 string `bson:"sha256" json:"sha256"`
 }
 
 // PurchaseStatus defines different states of a digital product purchase
@@ -141,18 +299,135 @@ const (
 	PurchaseStatusFailed    PurchaseStatus = "failed"
 )
 
-// Purchase represents a customer's digital product acquisition
+// Purchase represents a customer's digital product acquisition. Price is
+// what was charged, in SettlementCurrency; QuotedPrice is the price in the
+// product's own currency, which ExchangeRate converted into Price.
 type Purchase struct {
 	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	UserID         primitive.ObjectID `bson:"user_id" json:"user_id"`
 	ProductID      primitive.ObjectID `bson:"product_id" json:"product_id"`
 	ProductVersion string             `bson:"product_version" json:"product_version"`
-	Price          float64            `bson:"price" json:"price"`
+	Price          money.Money        `bson:"price" json:"price"`
+	QuotedPrice    money.Money        `bson:"quoted_price" json:"quoted_price"`
+	ExchangeRate   float64            `bson:"exchange_rate" json:"exchange_rate"`
 	Status         PurchaseStatus     `bson:"status" json:"status"`
 	DownloadLink   string             `bson:"download_link" json:"download_link"`
 	LicenseKey     string             `bson:"license_key" json:"license_key"`
-	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
-	ExpiresAt      time.Time          `bson:"expires_at" json:"expires_at"`
+	DownloadCount  int                `bson:"download_count" json:"download_count"`
+	LastDownloadAt time.Time          `bson:"last_download_at,omitempty" json:"last_download_at,omitempty"`
+	// DownloadLinks identifies the download links already counted, so
+	// resuming one does not count again
+	DownloadLinks []string  `bson:"download_links,omitempty" json:"-"`
+	CreatedAt     time.Time `bson:"created_at" json:"created_at"`
+	ExpiresAt     time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// Entitlement grants a user access to a product. A purchase of a single
+// product grants one; a bundle purchase grants one per contained product.
+type Entitlement struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID          primitive.ObjectID `bson:"user_id" json:"user_id"`
+	ProductID       primitive.ObjectID `bson:"product_id" json:"product_id"`
+	PurchaseID      primitive.ObjectID `bson:"purchase_id" json:"purchase_id"`
+	BundleID        primitive.ObjectID `bson:"bundle_id,omitempty" json:"bundle_id,omitempty"`
+	Version         string             `bson:"version" json:"version"`
+	IncludesUpdates bool               `bson:"includes_updates" json:"includes_updates"`
+	GrantedAt       time.Time          `bson:"granted_at" json:"granted_at"`
+	RevokedAt       time.Time          `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// DepositStatus is where a card payment for credits stands
+type DepositStatus string
+
+const (
+	DepositStatusPending   DepositStatus = "pending"
+	DepositStatusSucceeded DepositStatus = "succeeded"
+	DepositStatusFailed    DepositStatus = "failed"
+	// DepositStatusReview holds a payment that was collected but could not
+	// be credited automatically, such as one for the wrong amount
+	DepositStatusReview DepositStatus = "review"
+	// DepositStatusRefunding is a reviewed payment that was rejected and is
+	// being refunded to the card it came from
+	DepositStatusRefunding DepositStatus = "refunding"
+	DepositStatusDisputed  DepositStatus = "disputed"
+	DepositStatusReversed  DepositStatus = "reversed"
+)
+
+// Deposit is a card payment for a pack of credits. Price is charged through
+// the payment provider and Credits are added to the balance once it reports
+// the payment succeeded, or the deposit is held for review when they cannot
+// be added automatically. A moderator either credits a held deposit or has
+// the payment refunded, which leaves it reversed. A disputed payment's
+// DisputedAmount is taken back until the dispute is won; a lost dispute
+// leaves it reversed.
+type Deposit struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID            primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Pack              string             `bson:"pack" json:"pack"`
+	Credits           money.Money        `bson:"credits" json:"credits"`
+	Price             money.Money        `bson:"price" json:"price"`
+	Status            DepositStatus      `bson:"status" json:"status"`
+	CheckoutSessionID string             `bson:"checkout_session_id,omitempty" json:"-"`
+	PaymentIntentID   string             `bson:"payment_intent_id,omitempty" json:"-"`
+	FailureReason     string             `bson:"failure_reason,omitempty" json:"failure_reason,omitempty"`
+	DisputedAmount    money.Money        `bson:"disputed_amount,omitempty" json:"disputed_amount"`
+	ReviewerID        primitive.ObjectID `bson:"reviewer_id,omitempty" json:"reviewer_id,omitempty"`
+	ReviewNote        string             `bson:"review_note,omitempty" json:"review_note,omitempty"`
+	RefundID          string             `bson:"refund_id,omitempty" json:"-"`
+	CreatedAt         time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt         time.Time          `bson:"updated_at" json:"updated_at"`
+	CompletedAt       time.Time          `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
+
+// PaymentEvent records a payment provider event that has been applied, so
+// redelivered events are not applied twice
+type PaymentEvent struct {
+	ID         string             `bson:"_id" json:"id"`
+	Type       string             `bson:"type" json:"type"`
+	DepositID  primitive.ObjectID `bson:"deposit_id" json:"deposit_id"`
+	ReceivedAt time.Time          `bson:"received_at" json:"received_at"`
+}
+
+// RefundStatus is where a refund request stands
+type RefundStatus string
+
+const (
+	RefundStatusPending  RefundStatus = "pending"
+	RefundStatusApproved RefundStatus = "approved"
+	RefundStatusRejected RefundStatus = "rejected"
+)
+
+// RefundRequest is a buyer asking for a purchase to be refunded. Amount is
+// what the purchase charged, in SettlementCurrency. Requests approved
+// without review have AutoApproved set and no ReviewerID; Response is the
+// reviewer's note to the buyer.
+type RefundRequest struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	PurchaseID   primitive.ObjectID `bson:"purchase_id" json:"purchase_id"`
+	ProductID    primitive.ObjectID `bson:"product_id" json:"product_id"`
+	ProductTitle string             `bson:"product_title" json:"product_title"`
+	UserID       primitive.ObjectID `bson:"user_id" json:"user_id"`
+	CreatorID    primitive.ObjectID `bson:"creator_id" json:"creator_id"`
+	Amount       money.Money        `bson:"amount" json:"amount"`
+	Reason       string             `bson:"reason" json:"reason"`
+	Status       RefundStatus       `bson:"status" json:"status"`
+	AutoApproved bool               `bson:"auto_approved" json:"auto_approved"`
+	ReviewerID   primitive.ObjectID `bson:"reviewer_id,omitempty" json:"reviewer_id,omitempty"`
+	Response     string             `bson:"response,omitempty" json:"response,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	DecidedAt    time.Time          `bson:"decided_at,omitempty" json:"decided_at,omitempty"`
+}
+
+// WishlistItem is a product a user saved for later. Price and Version are
+// what the user was last told about, so the watcher only notifies of changes
+// past them.
+type WishlistItem struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	ProductID primitive.ObjectID `bson:"product_id" json:"product_id"`
+	Price     money.Money        `bson:"price" json:"price"`
+	Version   string             `bson:"version" json:"version"`
+	AddedAt   time.Time          `bson:"added_at" json:"added_at"`
 }
 
 // ReviewStatus defines the status of a review
@@ -200,15 +475,78 @@ type Dispute struct {
 	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
 }
 
-// MarketplaceSettings represents global marketplace configuration
+// CouponType defines how a coupon's value is applied
+type CouponType string
+
+const (
+	CouponTypePercentage CouponType = "percentage"
+	CouponTypeFixed      CouponType = "fixed"
+)
+
+// Coupon is a discount code issued by a creator for their own products or by
+// the platform for any product. An empty ProductIDs applies the coupon
+// store-wide within its issuer's scope. Fixed coupons and coupons with a
+// minimum spend only apply to products priced in Currency.
+type Coupon struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Code string             `bson:"code" json:"code" validate:"required,alphanum,min=3,max=32"`
+	Type CouponType         `bson:"type" json:"type" validate:"required,oneof=percentage fixed"`
+	// Percent is what a percentage coupon takes off
+	Percent float64 `bson:"percent,omitempty" json:"percent,omitempty" validate:"gte=0,lte=100"`
+	// Amount is what a fixed coupon takes off, in Currency
+	Amount          money.Money          `bson:"amount,omitempty" json:"amount" validate:"gte=0"`
+	IssuerID        primitive.ObjectID   `bson:"issuer_id" json:"issuer_id"`
+	CreatorID       primitive.ObjectID   `bson:"creator_id,omitempty" json:"creator_id,omitempty"`
+	ProductIDs      []primitive.ObjectID `bson:"product_ids" json:"product_ids"`
+	StartsAt        time.Time            `bson:"starts_at,omitempty" json:"starts_at,omitempty"`
+	EndsAt          time.Time            `bson:"ends_at,omitempty" json:"ends_at,omitempty"`
+	MaxRedemptions  int                  `bson:"max_redemptions" json:"max_redemptions" validate:"gte=0"`
+	PerUserLimit    int                  `bson:"per_user_limit" json:"per_user_limit" validate:"gte=0"`
+	MinSpend        money.Money          `bson:"min_spend" json:"min_spend" validate:"gte=0"`
+	Currency        string               `bson:"currency,omitempty" json:"currency"`
+	RedemptionCount int                  `bson:"redemption_count" json:"redemption_count"`
+	Active          bool                 `bson:"active" json:"active"`
+	CreatedAt       time.Time            `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time            `bson:"updated_at" json:"updated_at"`
+}
+
+// CouponRedemption records one use of a coupon
+type CouponRedemption struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	CouponID   primitive.ObjectID `bson:"coupon_id" json:"coupon_id"`
+	Code       string             `bson:"code" json:"code"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+	ProductID  primitive.ObjectID `bson:"product_id" json:"product_id"`
+	PurchaseID primitive.ObjectID `bson:"purchase_id,omitempty" json:"purchase_id,omitempty"`
+	Discount   money.Money        `bson:"discount" json:"discount"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	// ReversedAt is set when the purchase was refunded and the use given back
+	ReversedAt *time.Time `bson:"reversed_at,omitempty" json:"reversed_at,omitempty"`
+}
+
+// ExchangeRate is how many units of Currency one unit of
+// SettlementCurrency buys
+type ExchangeRate struct {
+	Currency  string    `bson:"_id" json:"currency"`
+	Rate      float64   `bson:"rate" json:"rate"`
+	Source    string    `bson:"source" json:"source"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// MarketplaceSettings represents global marketplace configuration.
+// CommissionRate is the fraction of each sale the marketplace keeps.
+// Purchases can be refunded for RefundPeriodDays after they were made, and
+// refunds of purchases downloaded at most RefundMaxDownloads times are
+// approved without review.
 type MarketplaceSettings struct {
-	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	CommissionRate    float64            `bson:"commission_rate" json:"commission_rate"`
-	MinimumWithdrawal float64            `bson:"minimum_withdrawal" json:"minimum_withdrawal"`
-	CreatorPayoutRate float64            `bson:"creator_payout_rate" json:"creator_payout_rate"`
-	RefundPeriodDays  int                `bson:"refund_period_days" json:"refund_period_days"`
-	MaintenanceMode   bool               `bson:"maintenance_mode" json:"maintenance_mode"`
-	UpdatedAt         time.Time          `bson:"updated_at" json:"updated_at"`
+	ID                 primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	CommissionRate     float64            `bson:"commission_rate" json:"commission_rate"`
+	MinimumWithdrawal  money.Money        `bson:"minimum_withdrawal" json:"minimum_withdrawal"`
+	CreatorPayoutRate  float64            `bson:"creator_payout_rate" json:"creator_payout_rate"`
+	RefundPeriodDays   int                `bson:"refund_period_days" json:"refund_period_days"`
+	RefundMaxDownloads int                `bson:"refund_max_downloads" json:"refund_max_downloads"`
+	MaintenanceMode    bool               `bson:"maintenance_mode" json:"maintenance_mode"`
+	UpdatedAt          time.Time          `bson:"updated_at" json:"updated_at"`
 }
 
 // CreatorAnalytics provides comprehensive performance tracking for creators
@@ -222,25 +560,25 @@ type MarketplaceSettings struct {
 //   - Payout and financial information
 //
 // The analytics data is stored in MongoDB and can be serialized to/from JSON.
-// All monetary values are stored as float64 in the platform's base currency.
+// Monetary values are money.Money amounts.
 // Time-based fields use time.Time and are stored in UTC.
 type CreatorAnalytics struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	CreatorID primitive.ObjectID `bson:"creator_id" json:"creator_id"`
 
 	// Overall Performance Metrics
-	TotalRevenue      float64 `bson:"total_revenue" json:"total_revenue"`
-	TotalProductsSold int     `bson:"total_products_sold" json:"total_products_sold"`
-	AverageRating     float64 `bson:"average_rating" json:"average_rating"`
-	TotalViews        int     `bson:"total_views" json:"total_views"`
+	TotalRevenue      money.Money `bson:"total_revenue" json:"total_revenue"`
+	TotalProductsSold int         `bson:"total_products_sold" json:"total_products_sold"`
+	AverageRating     float64     `bson:"average_rating" json:"average_rating"`
+	TotalViews        int         `bson:"total_views" json:"total_views"`
 
 	// Product-Level Performance
 	ProductPerformance []ProductPerformance `bson:"product_performance" json:"product_performance"`
 
 	// Time-Based Analytics
-	DailyRevenue   []DailyMetric `bson:"daily_revenue" json:"daily_revenue"`
-	WeeklyRevenue  []DailyMetric `bson:"weekly_revenue" json:"weekly_revenue"`
-	MonthlyRevenue []DailyMetric `bson:"monthly_revenue" json:"monthly_revenue"`
+	DailyRevenue   []RevenueMetric `bson:"daily_revenue" json:"daily_revenue"`
+	WeeklyRevenue  []RevenueMetric `bson:"weekly_revenue" json:"weekly_revenue"`
+	MonthlyRevenue []RevenueMetric `bson:"monthly_revenue" json:"monthly_revenue"`
 
 	// Audience Insights
 	AudienceBreakdown AudienceInsights `bson:"audience_insights" json:"audience_insights"`
@@ -252,9 +590,9 @@ type CreatorAnalytics struct {
 	NegativeReviews int `bson:"negative_reviews" json:"negative_reviews"`
 
 	// Payout Information
-	PendingPayout     float64   `bson:"pending_payout" json:"pending_payout"`
-	LastPayoutDate    time.Time `bson:"last_payout_date" json:"last_payout_date"`
-	TotalPayoutAmount float64   `bson:"total_payout_amount" json:"total_payout_amount"`
+	PendingPayout     money.Money `bson:"pending_payout" json:"pending_payout"`
+	LastPayoutDate    time.Time   `bson:"last_payout_date" json:"last_payout_date"`
+	TotalPayoutAmount money.Money `bson:"total_payout_amount" json:"total_payout_amount"`
 
 	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
 }
@@ -263,7 +601,7 @@ type CreatorAnalytics struct {
 type ProductPerformance struct {
 	ProductID      primitive.ObjectID `bson:"product_id" json:"product_id"`
 	ProductTitle   string             `bson:"product_title" json:"product_title"`
-	TotalRevenue   float64            `bson:"total_revenue" json:"total_revenue"`
+	TotalRevenue   money.Money        `bson:"total_revenue" json:"total_revenue"`
 	UnitsSold      int                `bson:"units_sold" json:"units_sold"`
 	AverageRating  float64            `bson:"average_rating" json:"average_rating"`
 	TotalViews     int                `bson:"total_views" json:"total_views"`
@@ -271,12 +609,18 @@ type ProductPerformance struct {
 	RefundRate     float64            `bson:"refund_rate" json:"refund_rate"`
 }
 
-// DailyMetric represents time-series financial data
+// DailyMetric is a count for one day, such as views
 type DailyMetric struct {
 	Date  time.Time `bson:"date" json:"date"`
 	Value float64   `bson:"value" json:"value"`
 }
 
+// RevenueMetric is revenue for one period of a time series
+type RevenueMetric struct {
+	Date   time.Time   `bson:"date" json:"date"`
+	Amount money.Money `bson:"amount" json:"amount"`
+}
+
 // AudienceInsights provides demographic and behavioral analytics
 type AudienceInsights struct {
 	GeographicDistribution map[string]int `bson:"geographic_distribution" json:"geographic_distribution"`
@@ -291,9 +635,9 @@ type CreatorPayout struct {
 	CreatorID       primitive.ObjectID `bson:"creator_id" json:"creator_id"`
 	PeriodStart     time.Time          `bson:"period_start" json:"period_start"`
 	PeriodEnd       time.Time          `bson:"period_end" json:"period_end"`
-	TotalRevenue    float64            `bson:"total_revenue" json:"total_revenue"`
-	MarketplaceFee  float64            `bson:"marketplace_fee" json:"marketplace_fee"`
-	NetPayout       float64            `bson:"net_payout" json:"net_payout"`
+	TotalRevenue    money.Money        `bson:"total_revenue" json:"total_revenue"`
+	MarketplaceFee  money.Money        `bson:"marketplace_fee" json:"marketplace_fee"`
+	NetPayout       money.Money        `bson:"net_payout" json:"net_payout"`
 	PayoutMethod    string             `bson:"payout_method" json:"payout_method"`
 	Status          string             `bson:"status" json:"status"`
 	PayoutDate      time.Time          `bson:"payout_date" json:"payout_date"`
@@ -305,8 +649,8 @@ type PurchaseDetail struct {
 	ProductID    primitive.ObjectID `bson:"product_id" json:"product_id"`
 	ProductTitle string             `bson:"product_title" json:"product_title"`
 	Quantity     int                `bson:"quantity" json:"quantity"`
-	UnitPrice    float64            `bson:"unit_price" json:"unit_price"`
-	TotalRevenue float64            `bson:"total_revenue" json:"total_revenue"`
+	UnitPrice    money.Money        `bson:"unit_price" json:"unit_price"`
+	TotalRevenue money.Money        `bson:"total_revenue" json:"total_revenue"`
 	PurchaseDate time.Time          `bson:"purchase_date" json:"purchase_date"`
 }
 
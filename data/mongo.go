@@ -8,6 +8,8 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 type MongoDB struct {
@@ -19,9 +21,22 @@ type MongoDB struct {
 
 // Collections
 const (
-	UsersCollection     = "users"
-	ProductsCollection  = "products"
-	PurchasesCollection = "purchases"
+	UsersCollection             = "users"
+	ProductsCollection          = "products"
+	PurchasesCollection         = "purchases"
+	NotificationsCollection     = "notifications"
+	CouponsCollection           = "coupons"
+	CouponUsageCollection       = "coupon_usage"
+	CouponRedemptionsCollection = "coupon_redemptions"
+	EntitlementsCollection      = "entitlements"
+	ProductViewsCollection      = "product_views"
+	WishlistsCollection         = "wishlists"
+	SettingsCollection          = "settings"
+	LedgerCollection            = "ledger_postings"
+	ExchangeRatesCollection     = "exchange_rates"
+	RefundRequestsCollection    = "refund_requests"
+	DepositsCollection          = "deposits"
+	PaymentEventsCollection     = "payment_events"
 )
 
 func NewMongoDB(cfg *config.Config) (*MongoDB, error) {
@@ -66,6 +81,158 @@ func (m *MongoDB) createIndexes(ctx context.Context) error {
 			Options: options.Index().SetUnique(true),
 		},
 	})
+	if err != nil {
+		return err
+	}
+
+	// Products indexes
+	_, err = m.database.Collection(ProductsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// Creator dashboards list their own products newest first
+		{Keys: bson.D{{Key: "creator_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "category", Value: 1}}},
+		{Keys: bson.D{{Key: "tags", Value: 1}}},
+		{Keys: bson.D{{Key: "technologies", Value: 1}}},
+		// Catalog filters on category specific specification keys
+		{Keys: bson.D{{Key: "specifications.$**", Value: 1}}},
+		// Catalog sort orders, with _id as the keyset pagination tie-breaker
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "reference_price.amount", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "download_count", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "average_rating", Value: -1}, {Key: "_id", Value: -1}}},
+		// Catalog search ranks title matches above tags above description
+		{
+			Keys: bson.D{
+				{Key: "title", Value: "text"},
+				{Key: "tags", Value: "text"},
+				{Key: "description", Value: "text"},
+			},
+			Options: options.Index().
+				SetName("product_text").
+				SetWeights(bson.D{{Key: "title", Value: 10}, {Key: "tags", Value: 5}, {Key: "description", Value: 1}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Purchases indexes
+	_, err = m.database.Collection(PurchasesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "product_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Notifications indexes
+	_, err = m.database.Collection(NotificationsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "is_read", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Coupons indexes
+	_, err = m.database.Collection(CouponsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "code", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "creator_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+	// Per-user limits rely on this index to refuse an upsert past the limit
+	_, err = m.database.Collection(CouponUsageCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "coupon_id", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = m.database.Collection(CouponRedemptionsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "coupon_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "purchase_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Entitlements indexes
+	_, err = m.database.Collection(EntitlementsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// Makes granting idempotent
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "product_id", Value: 1}, {Key: "purchase_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "purchase_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Product views indexes: one bucket per product and day
+	_, err = m.database.Collection(ProductViewsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "product_id", Value: 1}, {Key: "date", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "creator_id", Value: 1}, {Key: "date", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Wishlists indexes
+	_, err = m.database.Collection(WishlistsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "product_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "added_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "product_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Ledger indexes: statements list an account's postings newest first
+	_, err = m.database.Collection(LedgerCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "account", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		// An entry posts to each account and side once
+		{
+			Keys:    bson.D{{Key: "entry_id", Value: 1}, {Key: "account", Value: 1}, {Key: "side", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "reference", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Refund request indexes: one request per purchase, listed newest first
+	// by buyer, by creator and by status for moderators
+	_, err = m.database.Collection(RefundRequestsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "purchase_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "creator_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deposit indexes: users list their deposits newest first, and disputes
+	// find the deposit by the payment they name
+	_, err = m.database.Collection(DepositsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+	})
 
 	return err
 }
@@ -98,6 +265,74 @@ func (m *MongoDB) Purchases() *mongo.Collection {
 	return m.database.Collection(PurchasesCollection)
 }
 
+func (m *MongoDB) Notifications() *mongo.Collection {
+	return m.database.Collection(NotificationsCollection)
+}
+
+func (m *MongoDB) Coupons() *mongo.Collection {
+	return m.database.Collection(CouponsCollection)
+}
+
+func (m *MongoDB) CouponUsage() *mongo.Collection {
+	return m.database.Collection(CouponUsageCollection)
+}
+
+func (m *MongoDB) CouponRedemptions() *mongo.Collection {
+	return m.database.Collection(CouponRedemptionsCollection)
+}
+
+func (m *MongoDB) Entitlements() *mongo.Collection {
+	return m.database.Collection(EntitlementsCollection)
+}
+
+func (m *MongoDB) ProductViews() *mongo.Collection {
+	return m.database.Collection(ProductViewsCollection)
+}
+
+func (m *MongoDB) Wishlists() *mongo.Collection {
+	return m.database.Collection(WishlistsCollection)
+}
+
+func (m *MongoDB) Settings() *mongo.Collection {
+	return m.database.Collection(SettingsCollection)
+}
+
+func (m *MongoDB) Ledger() *mongo.Collection {
+	return m.database.Collection(LedgerCollection)
+}
+
+func (m *MongoDB) ExchangeRates() *mongo.Collection {
+	return m.database.Collection(ExchangeRatesCollection)
+}
+
+func (m *MongoDB) RefundRequests() *mongo.Collection {
+	return m.database.Collection(RefundRequestsCollection)
+}
+
+func (m *MongoDB) Deposits() *mongo.Collection {
+	return m.database.Collection(DepositsCollection)
+}
+
+func (m *MongoDB) PaymentEvents() *mongo.Collection {
+	return m.database.Collection(PaymentEventsCollection)
+}
+
 func (m *MongoDB) Client() *mongo.Client {
 	return m.client
 }
+
+// WithTransaction runs fn in a snapshot transaction with majority writes.
+// fn is retried on transient errors, so it must not carry state between
+// attempts.
+func (m *MongoDB) WithTransaction(ctx context.Context, fn func(sc mongo.SessionContext) (interface{}, error)) (interface{}, error) {
+	session, err := m.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	opts := options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.Majority())
+	return session.WithTransaction(ctx, fn, opts)
+}
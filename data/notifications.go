@@ -0,0 +1,63 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Notification types
+const (
+	NotificationProductStatus = "product_status"
+	NotificationPriceDrop     = "price_drop"
+	NotificationNewVersion    = "new_version"
+	NotificationUploadFailed  = "upload_failed"
+	NotificationRefund        = "refund"
+	NotificationDeposit       = "deposit"
+)
+
+// NotificationRepository stores notifications in their own collection rather
+// than on the user document, so they can grow without bloating users.
+type NotificationRepository struct {
+	mongo *MongoDB
+}
+
+func NewNotificationRepository(mongo *MongoDB) *NotificationRepository {
+	return &NotificationRepository{mongo: mongo}
+}
+
+// Notify creates an unread notification for userID
+func (r *NotificationRepository) Notify(ctx context.Context, userID primitive.ObjectID, kind, message string, relatedID primitive.ObjectID) error {
+	_, err := r.mongo.Notifications().InsertOne(ctx, Notification{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Type:      kind,
+		Message:   message,
+		RelatedID: relatedID,
+		CreatedAt: time.Now(),
+	})
+	return err
+}
+
+// ListForUser returns a page of the user's notifications
+func (r *NotificationRepository) ListForUser(ctx context.Context, userID primitive.ObjectID, unreadOnly bool, page pagination.Request) ([]Notification, error) {
+	filter := bson.M{"user_id": userID}
+	if unreadOnly {
+		filter["is_read"] = false
+	}
+	return findPage[Notification](ctx, r.mongo.Notifications(), filter, page)
+}
+
+// MarkRead marks one of the user's notifications, or all of them when id is
+// the zero ObjectID, as read
+func (r *NotificationRepository) MarkRead(ctx context.Context, userID, id primitive.ObjectID) error {
+	filter := bson.M{"user_id": userID, "is_read": false}
+	if !id.IsZero() {
+		filter["_id"] = id
+	}
+	_, err := r.mongo.Notifications().UpdateMany(ctx, filter, bson.M{"$set": bson.M{"is_read": true}})
+	return err
+}
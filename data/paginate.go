@@ -0,0 +1,30 @@
+package data
+
+import (
+	"context"
+
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// findPage runs filter against coll for a single keyset page. The result
+// holds up to page.FetchLimit() items and is meant for pagination.NewPage.
+func findPage[T any](ctx context.Context, coll *mongo.Collection, filter bson.M, page pagination.Request) ([]T, error) {
+	if cursorFilter := page.Filter(); len(cursorFilter) > 0 {
+		filter = bson.M{"$and": bson.A{filter, cursorFilter}}
+	}
+
+	opts := options.Find().SetSort(page.SortSpec()).SetLimit(page.FetchLimit())
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []T{}
+	if err := cursor.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
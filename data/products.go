@@ -0,0 +1,124 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrProductNotFound = errors.New("product not found")
+
+// ProductRepository reads and mutates products. Get goes through the tiered
+// cache; every write invalidates it.
+type ProductRepository struct {
+	mongo *MongoDB
+	cache *TieredCache
+}
+
+func NewProductRepository(mongo *MongoDB, cache *TieredCache) *ProductRepository {
+	return &ProductRepository{
+		mongo: mongo,
+		cache: cache,
+	}
+}
+
+// Get returns a possibly cached product. Use FindByID when the result feeds
+// a write.
+func (r *ProductRepository) Get(ctx context.Context, id primitive.ObjectID) (*Product, error) {
+	var product Product
+	err := r.cache.Fetch(ctx, CacheNamespaceProducts, id.Hex(), &product, func(ctx context.Context) (interface{}, error) {
+		return r.FindByID(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// FindByID loads a product straight from Mongo
+func (r *ProductRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*Product, error) {
+	var product Product
+	err := r.mongo.Products().FindOne(ctx, bson.M{"_id": id}).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// FindMany loads the products with the given IDs straight from Mongo, in no
+// particular order. Missing IDs are skipped.
+func (r *ProductRepository) FindMany(ctx context.Context, ids []primitive.ObjectID) ([]Product, error) {
+	cursor, err := r.mongo.Products().Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	products := []Product{}
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+func (r *ProductRepository) Create(ctx context.Context, product *Product) error {
+	_, err := r.mongo.Products().InsertOne(ctx, product)
+	return err
+}
+
+// Update applies a $set to the product, maintains UpdatedAt and invalidates
+// the cached copy.
+func (r *ProductRepository) Update(ctx context.Context, id primitive.ObjectID, set bson.M) error {
+	fields := bson.M{"updated_at": time.Now()}
+	for k, v := range set {
+		fields[k] = v
+	}
+	return r.UpdateRaw(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+}
+
+// UpdateRaw applies an arbitrary update to the product matched by filter and
+// invalidates the cached copy. filter must select on _id; callers may add
+// conditions to make the update conditional, in which case a non-match is
+// reported as ErrProductNotFound.
+func (r *ProductRepository) UpdateRaw(ctx context.Context, filter bson.M, update interface{}) error {
+	res, err := r.mongo.Products().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if id, ok := filter["_id"].(primitive.ObjectID); ok {
+		r.Invalidate(ctx, id)
+	}
+	if res.MatchedCount == 0 {
+		return ErrProductNotFound
+	}
+	return nil
+}
+
+// Invalidate drops the cached copy of a product on every instance
+func (r *ProductRepository) Invalidate(ctx context.Context, id primitive.ObjectID) {
+	if err := r.cache.Invalidate(ctx, CacheNamespaceProducts, id.Hex()); err != nil {
+		log.Printf("Failed to invalidate cached product %s: %v", id.Hex(), err)
+	}
+}
+
+// ListByCreator returns a page of a creator's products in any status,
+// optionally restricted to one.
+func (r *ProductRepository) ListByCreator(ctx context.Context, creatorID primitive.ObjectID, status ProductStatus, page pagination.Request) ([]Product, error) {
+	filter := bson.M{"creator_id": creatorID}
+	if status != "" {
+		filter["status"] = status
+	}
+	return findPage[Product](ctx, r.mongo.Products(), filter, page)
+}
+
+// IncrementDownloads bumps the product's public download counter
+func (r *ProductRepository) IncrementDownloads(ctx context.Context, id primitive.ObjectID) error {
+	return r.UpdateRaw(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"download_count": 1}})
+}
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrPurchaseNotFound     = errors.New("purchase not found")
+	ErrDownloadLimitReached = errors.New("download limit reached for this purchase")
+)
+
+// PurchaseRepository reads and mutates purchases
+type PurchaseRepository struct {
+	mongo *MongoDB
+}
+
+func NewPurchaseRepository(mongo *MongoDB) *PurchaseRepository {
+	return &PurchaseRepository{mongo: mongo}
+}
+
+func (r *PurchaseRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*Purchase, error) {
+	var purchase Purchase
+	err := r.mongo.Purchases().FindOne(ctx, bson.M{"_id": id}).Decode(&purchase)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPurchaseNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &purchase, nil
+}
+
+// ListForUser returns a page of the user's purchases
+func (r *PurchaseRepository) ListForUser(ctx context.Context, userID primitive.ObjectID, page pagination.Request) ([]Purchase, error) {
+	return findPage[Purchase](ctx, r.mongo.Purchases(), bson.M{"user_id": userID}, page)
+}
+
+// Expired reports whether the purchase's access window has closed. A zero
+// ExpiresAt never expires.
+func (p *Purchase) Expired(now time.Time) bool {
+	return !p.ExpiresAt.IsZero() && now.After(p.ExpiresAt)
+}
+
+// CanDownload reports whether the purchase entitles its buyer to download
+// files at all, regardless of counters.
+func (p *Purchase) CanDownload(now time.Time) bool {
+	return p.Status == PurchaseStatusCompleted && !p.Expired(now)
+}
+
+// maxTrackedDownloadLinks is how many download links a purchase remembers
+// when it has no download limit
+const maxTrackedDownloadLinks = 50
+
+// RecordDownload counts a download through link against the purchase.
+// Every request for a link must go through it: the first one counts, later
+// ones resume the same download and report counted false. When max is
+// positive a new link only counts while the count is below it, so
+// concurrent downloads cannot overshoot the limit.
+func (r *PurchaseRepository) RecordDownload(ctx context.Context, id primitive.ObjectID, link string, max int) (counted bool, err error) {
+	filter := bson.M{"_id": id, "status": PurchaseStatusCompleted, "download_links": bson.M{"$ne": link}}
+	tracked := maxTrackedDownloadLinks
+	if max > 0 {
+		filter["download_count"] = bson.M{"$lt": max}
+		if max > tracked {
+			tracked = max
+		}
+	}
+	res, err := r.mongo.Purchases().UpdateOne(ctx, filter, bson.M{
+		"$inc":  bson.M{"download_count": 1},
+		"$set":  bson.M{"last_download_at": time.Now()},
+		"$push": bson.M{"download_links": bson.M{"$each": bson.A{link}, "$slice": -tracked}},
+	})
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 1 {
+		return true, nil
+	}
+
+	n, err := r.mongo.Purchases().CountDocuments(ctx, bson.M{
+		"_id": id, "status": PurchaseStatusCompleted, "download_links": link,
+	})
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, ErrDownloadLimitReached
+	}
+	return false, nil
+}
@@ -0,0 +1,139 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RateLimitAlgorithm selects how requests are counted against a limit
+type RateLimitAlgorithm string
+
+const (
+	// RateLimitSlidingWindow keeps a log of request timestamps and admits at
+	// most Limit requests in any rolling Window.
+	RateLimitSlidingWindow RateLimitAlgorithm = "sliding_window"
+	// RateLimitTokenBucket refills Limit tokens evenly over Window and allows
+	// bursts up to Limit.
+	RateLimitTokenBucket RateLimitAlgorithm = "token_bucket"
+)
+
+// RateLimitResult describes the outcome of a single rate limit check
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int64
+	Remaining  int64
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+// slidingWindowScript trims expired entries from a sorted set of request
+// timestamps and records the current request when there is room for it.
+//
+// KEYS[1] = log key
+// ARGV    = now (ms), window (ms), limit, unique member
+// returns {allowed, remaining, retry_after_ms, reset_after_ms}
+var slidingWindowScript = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+
+if count < limit then
+	redis.call('ZADD', key, now, ARGV[4])
+	redis.call('PEXPIRE', key, window)
+	local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+	return {1, limit - count - 1, 0, tonumber(oldest[2]) + window - now}
+end
+
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+local retry = tonumber(oldest[2]) + window - now
+return {0, 0, retry, retry}
+`)
+
+// tokenBucketScript refills the bucket according to the time elapsed since
+// the last call and takes a single token if one is available.
+//
+// KEYS[1] = bucket key
+// ARGV    = now (ms), capacity, window (ms)
+// returns {allowed, remaining, retry_after_ms, reset_after_ms}
+var tokenBucketScript = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local window = tonumber(ARGV[3])
+local rate = capacity / window
+
+local state = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * rate)
+end
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+
+redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', key, window)
+return {allowed, math.floor(tokens), retry, math.ceil((capacity - tokens) / rate)}
+`)
+
+var rateLimitSeq uint64
+
+// AllowRequest records a request against key and reports whether it fits
+// within limit requests per window using the given algorithm. The check and
+// the update happen atomically inside a single Lua script.
+func (r *RedisDB) AllowRequest(ctx context.Context, algorithm RateLimitAlgorithm, key string, limit int64, window time.Duration) (*RateLimitResult, error) {
+	now := time.Now().UnixMilli()
+	windowMs := window.Milliseconds()
+
+	var (
+		res []interface{}
+		err error
+	)
+	switch algorithm {
+	case RateLimitSlidingWindow, "":
+		member := fmt.Sprintf("%d-%d", now, atomic.AddUint64(&rateLimitSeq, 1))
+		res, err = slidingWindowScript.Run(ctx, r.client, []string{key}, now, windowMs, limit, member).Slice()
+	case RateLimitTokenBucket:
+		res, err = tokenBucketScript.Run(ctx, r.client, []string{key}, now, limit, windowMs).Slice()
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 4 {
+		return nil, fmt.Errorf("unexpected rate limit script reply: %v", res)
+	}
+
+	values := make([]int64, len(res))
+	for i, v := range res {
+		n, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected rate limit script reply: %v", res)
+		}
+		values[i] = n
+	}
+
+	return &RateLimitResult{
+		Allowed:    values[0] == 1,
+		Limit:      limit,
+		Remaining:  values[1],
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		ResetAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,225 @@
+package data
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SettlementCurrency is the currency credits are held in and sales are
+// settled in. Exchange rates are quoted against it.
+const SettlementCurrency = money.DefaultCurrency
+
+var (
+	ErrUnsupportedCurrency   = errors.New("no exchange rate for currency")
+	ErrInvalidExchangeRate   = errors.New("exchange rates need a three letter currency code and a positive rate")
+	ErrPriceCurrencyMismatch = errors.New("discounted price must be in the same currency as the price")
+)
+
+// Rates maps currencies to how many units of them one unit of
+// SettlementCurrency buys
+type Rates map[string]float64
+
+// Supports reports whether amounts can be converted to and from currency
+func (r Rates) Supports(currency string) bool {
+	_, ok := r.rate(currency)
+	return ok
+}
+
+func (r Rates) rate(currency string) (float64, bool) {
+	currency = money.Zero(currency).Code()
+	if currency == SettlementCurrency {
+		return 1, true
+	}
+	rate, ok := r[currency]
+	return rate, ok
+}
+
+// Convert returns m in currency along with the rate applied, the number of
+// units of currency one unit of m's currency buys
+func (r Rates) Convert(m money.Money, currency string) (money.Money, float64, error) {
+	from, ok := r.rate(m.Code())
+	if !ok {
+		return money.Money{}, 0, ErrUnsupportedCurrency
+	}
+	to, ok := r.rate(currency)
+	if !ok {
+		return money.Money{}, 0, ErrUnsupportedCurrency
+	}
+	if m.SameCurrency(money.Zero(currency)) {
+		return m, 1, nil
+	}
+	rate := to / from
+	return m.Convert(currency, rate), rate, nil
+}
+
+// SetReferencePrice checks that product is priced in a supported currency,
+// with any sale price in the same one, and sets its ReferencePrice
+func (r Rates) SetReferencePrice(product *Product) error {
+	if product.DiscountedPrice.IsPositive() && !product.DiscountedPrice.SameCurrency(product.Price) {
+		return ErrPriceCurrencyMismatch
+	}
+	reference, _, err := r.Convert(product.Price, SettlementCurrency)
+	if err != nil {
+		return err
+	}
+	product.ReferencePrice = reference
+	return nil
+}
+
+// Localize returns product's price in currency
+func (r Rates) Localize(product *Product, currency string) (*LocalPrice, error) {
+	price, rate, err := r.Convert(product.Price, currency)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalPrice{
+		Price:          price,
+		EffectivePrice: product.EffectivePrice().Convert(price.Currency, rate),
+		Rate:           rate,
+	}, nil
+}
+
+// ExchangeRateRepository stores the exchange rates admins maintain. Reads go
+// through the tiered cache; every write invalidates it and reprices the
+// catalog.
+type ExchangeRateRepository struct {
+	mongo *MongoDB
+	cache *TieredCache
+}
+
+func NewExchangeRateRepository(mongo *MongoDB, cache *TieredCache) *ExchangeRateRepository {
+	return &ExchangeRateRepository{mongo: mongo, cache: cache}
+}
+
+// Rates returns the current rates, possibly cached
+func (r *ExchangeRateRepository) Rates(ctx context.Context) (Rates, error) {
+	rates := Rates{}
+	err := r.cache.Fetch(ctx, CacheNamespaceExchangeRates, "all", &rates, func(ctx context.Context) (interface{}, error) {
+		list, err := r.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		loaded := Rates{}
+		for _, rate := range list {
+			loaded[rate.Currency] = rate.Rate
+		}
+		return loaded, nil
+	})
+	return rates, err
+}
+
+// List returns the stored rates by currency
+func (r *ExchangeRateRepository) List(ctx context.Context) ([]ExchangeRate, error) {
+	cursor, err := r.mongo.ExchangeRates().Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	rates := []ExchangeRate{}
+	if err := cursor.All(ctx, &rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// Set stores rates, replacing any earlier rate for the same currencies, and
+// reprices the catalog
+func (r *ExchangeRateRepository) Set(ctx context.Context, rates []ExchangeRate) error {
+	if len(rates) == 0 {
+		return nil
+	}
+	now := time.Now()
+	models := make([]mongo.WriteModel, 0, len(rates))
+	for _, rate := range rates {
+		rate.Currency = strings.ToUpper(strings.TrimSpace(rate.Currency))
+		if len(rate.Currency) != 3 || rate.Currency == SettlementCurrency ||
+			rate.Rate <= 0 || math.IsInf(rate.Rate, 0) || math.IsNaN(rate.Rate) {
+			return fmt.Errorf("%w: %s %v", ErrInvalidExchangeRate, rate.Currency, rate.Rate)
+		}
+		rate.UpdatedAt = now
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": rate.Currency}).
+			SetReplacement(rate).
+			SetUpsert(true))
+	}
+	if _, err := r.mongo.ExchangeRates().BulkWrite(ctx, models); err != nil {
+		return err
+	}
+	if err := r.cache.Invalidate(ctx, CacheNamespaceExchangeRates, "all"); err != nil {
+		return err
+	}
+	return r.Reprice(ctx)
+}
+
+// Import reads rates from CSV lines of "currency,rate", skipping blank lines
+// and # comments, and stores them with source. It returns how many rates
+// were imported.
+func (r *ExchangeRateRepository) Import(ctx context.Context, in io.Reader, source string) (int, error) {
+	reader := csv.NewReader(in)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	var rates []ExchangeRate
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			line, _ := reader.FieldPos(1)
+			return 0, fmt.Errorf("%w: line %d", ErrInvalidExchangeRate, line)
+		}
+		rates = append(rates, ExchangeRate{Currency: record[0], Rate: rate, Source: source})
+	}
+	return len(rates), r.Set(ctx, rates)
+}
+
+// Reprice recomputes every product's ReferencePrice from the stored rates.
+// Products priced in a currency without a rate keep their current reference
+// price.
+func (r *ExchangeRateRepository) Reprice(ctx context.Context) error {
+	list, err := r.List(ctx)
+	if err != nil {
+		return err
+	}
+	list = append(list, ExchangeRate{Currency: SettlementCurrency, Rate: 1})
+
+	// One minor unit of each currency in minor units of SettlementCurrency
+	branches := bson.A{}
+	currencies := bson.A{}
+	for _, rate := range list {
+		factor := math.Pow10(money.Exponent(SettlementCurrency)-money.Exponent(rate.Currency)) / rate.Rate
+		branches = append(branches, bson.M{
+			"case": bson.M{"$eq": bson.A{"$price.currency", rate.Currency}},
+			"then": factor,
+		})
+		currencies = append(currencies, rate.Currency)
+	}
+
+	filter := bson.M{"price.currency": bson.M{"$in": currencies}}
+	_, err = r.mongo.Products().UpdateMany(ctx, filter, mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"reference_price": bson.M{
+			"amount": bson.M{"$toLong": bson.M{"$round": bson.A{
+				bson.M{"$multiply": bson.A{"$price.amount", bson.M{"$switch": bson.M{"branches": branches}}}}, 0,
+			}}},
+			"currency": SettlementCurrency,
+		},
+	}}}})
+	return err
+}
@@ -0,0 +1,51 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRatesConvert(t *testing.T) {
+	rates := Rates{"EUR": 0.8, "JPY": 150}
+
+	eur, rate, err := rates.Convert(usd(1000), "EUR")
+	require.NoError(t, err)
+	assert.Equal(t, money.New(800, "EUR"), eur)
+	assert.Equal(t, 0.8, rate)
+
+	yen, _, err := rates.Convert(money.New(800, "EUR"), "jpy")
+	require.NoError(t, err)
+	assert.Equal(t, money.New(1500, "JPY"), yen, "cross rates go through the settlement currency")
+
+	same, rate, err := rates.Convert(money.New(800, "EUR"), "EUR")
+	require.NoError(t, err)
+	assert.Equal(t, money.New(800, "EUR"), same)
+	assert.Equal(t, 1.0, rate)
+
+	_, _, err = rates.Convert(usd(1000), "GBP")
+	assert.Equal(t, ErrUnsupportedCurrency, err)
+	_, _, err = rates.Convert(money.New(1000, "GBP"), "USD")
+	assert.Equal(t, ErrUnsupportedCurrency, err)
+	assert.True(t, rates.Supports(""), "the settlement currency needs no rate")
+}
+
+func TestSetReferencePrice(t *testing.T) {
+	rates := Rates{"EUR": 0.8}
+
+	p := &Product{Price: money.New(2000, "EUR"), DiscountedPrice: money.New(1600, "EUR")}
+	require.NoError(t, rates.SetReferencePrice(p))
+	assert.Equal(t, usd(2500), p.ReferencePrice)
+
+	local, err := rates.Localize(p, "USD")
+	require.NoError(t, err)
+	assert.Equal(t, &LocalPrice{Price: usd(2500), EffectivePrice: usd(2000), Rate: 1.25}, local)
+
+	p.DiscountedPrice = usd(1000)
+	assert.Equal(t, ErrPriceCurrencyMismatch, rates.SetReferencePrice(p))
+
+	p = &Product{Price: money.New(2000, "GBP")}
+	assert.Equal(t, ErrUnsupportedCurrency, rates.SetReferencePrice(p))
+}
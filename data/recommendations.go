@@ -0,0 +1,391 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	recommendationsKeyPrefix = "recs:product:"
+	popularKeyPrefix         = "recs:popular:"
+	recommendationsLockKey   = "recs:lock"
+	// MaxRecommendations is how many products are kept per list
+	MaxRecommendations = 12
+	// maxBasketSize bounds the pairs counted for a single buyer, so a
+	// handful of collectors cannot dominate the co-purchase counts
+	maxBasketSize = 50
+	// minSimilarity drops products that only share a category
+	minSimilarity = 0.25
+)
+
+// Recommendation is a recommended product and how strongly it is recommended
+type Recommendation struct {
+	ProductID primitive.ObjectID `json:"product_id"`
+	Score     float64            `json:"score"`
+}
+
+// Recommendations are the products shown alongside a product. AlsoBought
+// comes from co-purchases, Related from shared tags and technologies.
+type Recommendations struct {
+	ProductID  primitive.ObjectID `json:"product_id"`
+	AlsoBought []Recommendation   `json:"also_bought"`
+	Related    []Recommendation   `json:"related"`
+	// Fallback is set when there was nothing specific to the product and
+	// popular products in its category were used instead
+	Fallback   bool      `json:"fallback"`
+	ComputedAt time.Time `json:"computed_at"`
+}
+
+// RecommendationEngine precomputes recommendations for every active product
+// and caches them in Redis. Refreshes run on one instance at a time.
+type RecommendationEngine struct {
+	mongo *MongoDB
+	redis *RedisDB
+	ttl   time.Duration
+}
+
+// NewRecommendationEngine caches results for ttl, which should comfortably
+// exceed the refresh interval
+func NewRecommendationEngine(mongo *MongoDB, redis *RedisDB, ttl time.Duration) *RecommendationEngine {
+	return &RecommendationEngine{mongo: mongo, redis: redis, ttl: ttl}
+}
+
+// Run refreshes recommendations now and then every interval until ctx is
+// cancelled
+func (e *RecommendationEngine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := e.Refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to refresh recommendations: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh recomputes and caches every product's recommendations, unless
+// another instance is already doing so
+func (e *RecommendationEngine) Refresh(ctx context.Context) error {
+	locked, err := e.redis.client.SetNX(ctx, recommendationsLockKey, "1", 10*time.Minute).Result()
+	if err != nil || !locked {
+		return err
+	}
+	defer e.redis.client.Del(context.WithoutCancel(ctx), recommendationsLockKey)
+
+	products, err := e.loadProducts(ctx)
+	if err != nil {
+		return err
+	}
+	baskets, err := e.loadBaskets(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	pipe := e.redis.client.Pipeline()
+	for _, recs := range BuildRecommendations(products, baskets, now) {
+		payload, err := json.Marshal(recs)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, recommendationsKeyPrefix+recs.ProductID.Hex(), payload, e.ttl)
+	}
+	for category, popular := range PopularByCategory(products) {
+		payload, err := json.Marshal(popular)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, popularKeyPrefix+string(category), payload, e.ttl)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Get returns the cached recommendations for product, falling back to
+// popular products in its category when it has none yet
+func (e *RecommendationEngine) Get(ctx context.Context, product *Product) (*Recommendations, error) {
+	var recs Recommendations
+	payload, err := e.redis.client.Get(ctx, recommendationsKeyPrefix+product.ID.Hex()).Bytes()
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(payload, &recs); err != nil {
+			return nil, err
+		}
+		if len(recs.AlsoBought) > 0 || len(recs.Related) > 0 {
+			return &recs, nil
+		}
+	case err != redis.Nil:
+		return nil, err
+	}
+
+	popular, err := e.popular(ctx, product.Category)
+	if err != nil {
+		return nil, err
+	}
+	related := make([]Recommendation, 0, len(popular))
+	for _, r := range popular {
+		if r.ProductID != product.ID {
+			related = append(related, r)
+		}
+	}
+	return &Recommendations{
+		ProductID:  product.ID,
+		AlsoBought: []Recommendation{},
+		Related:    related,
+		Fallback:   true,
+		ComputedAt: time.Now(),
+	}, nil
+}
+
+// popular returns the most downloaded active products in category, from the
+// cache when a refresh has run and from Mongo otherwise
+func (e *RecommendationEngine) popular(ctx context.Context, category ProductCategory) ([]Recommendation, error) {
+	payload, err := e.redis.client.Get(ctx, popularKeyPrefix+string(category)).Bytes()
+	if err == nil {
+		var popular []Recommendation
+		if err := json.Unmarshal(payload, &popular); err != nil {
+			return nil, err
+		}
+		return popular, nil
+	}
+	if err != redis.Nil {
+		return nil, err
+	}
+
+	cursor, err := e.mongo.Products().Find(ctx,
+		bson.M{"status": ProductStatusActive, "category": category},
+		options.Find().
+			SetSort(bson.D{{Key: "download_count", Value: -1}, {Key: "_id", Value: 1}}).
+			SetLimit(MaxRecommendations+1).
+			SetProjection(bson.M{"_id": 1, "download_count": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var products []Product
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	return popularOf(products), nil
+}
+
+func (e *RecommendationEngine) loadProducts(ctx context.Context) ([]Product, error) {
+	cursor, err := e.mongo.Products().Find(ctx, bson.M{"status": ProductStatusActive},
+		options.Find().SetProjection(bson.M{
+			"_id": 1, "creator_id": 1, "category": 1, "tags": 1, "technologies": 1, "download_count": 1,
+		}))
+	if err != nil {
+		return nil, err
+	}
+	products := []Product{}
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// loadBaskets returns the distinct products each buyer has bought
+func (e *RecommendationEngine) loadBaskets(ctx context.Context) (map[primitive.ObjectID][]primitive.ObjectID, error) {
+	cursor, err := e.mongo.Purchases().Find(ctx, bson.M{"status": PurchaseStatusCompleted},
+		options.Find().SetProjection(bson.M{"user_id": 1, "product_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	seen := map[[2]primitive.ObjectID]bool{}
+	baskets := map[primitive.ObjectID][]primitive.ObjectID{}
+	for cursor.Next(ctx) {
+		var p struct {
+			UserID    primitive.ObjectID `bson:"user_id"`
+			ProductID primitive.ObjectID `bson:"product_id"`
+		}
+		if err := cursor.Decode(&p); err != nil {
+			return nil, err
+		}
+		if key := [2]primitive.ObjectID{p.UserID, p.ProductID}; !seen[key] {
+			seen[key] = true
+			baskets[p.UserID] = append(baskets[p.UserID], p.ProductID)
+		}
+	}
+	return baskets, cursor.Err()
+}
+
+// BuildRecommendations computes recommendations for products from buyers'
+// baskets. Co-purchases are scored by cosine similarity of the products'
+// buyer sets; related products by the overlap of their tags and
+// technologies. Only products in the list are ever recommended.
+func BuildRecommendations(products []Product, baskets map[primitive.ObjectID][]primitive.ObjectID, now time.Time) []Recommendations {
+	active := make(map[primitive.ObjectID]*Product, len(products))
+	for i := range products {
+		active[products[i].ID] = &products[i]
+	}
+
+	buyers := map[primitive.ObjectID]int{}
+	pairs := map[primitive.ObjectID]map[primitive.ObjectID]int{}
+	for _, basket := range baskets {
+		if len(basket) > maxBasketSize {
+			basket = basket[:maxBasketSize]
+		}
+		for i, a := range basket {
+			buyers[a]++
+			for _, b := range basket[i+1:] {
+				if pairs[a] == nil {
+					pairs[a] = map[primitive.ObjectID]int{}
+				}
+				if pairs[b] == nil {
+					pairs[b] = map[primitive.ObjectID]int{}
+				}
+				pairs[a][b]++
+				pairs[b][a]++
+			}
+		}
+	}
+
+	all := make([]Recommendations, 0, len(products))
+	for i := range products {
+		p := &products[i]
+		recs := Recommendations{
+			ProductID:  p.ID,
+			AlsoBought: []Recommendation{},
+			Related:    []Recommendation{},
+			ComputedAt: now,
+		}
+
+		for other, n := range pairs[p.ID] {
+			if _, ok := active[other]; !ok {
+				continue
+			}
+			score := float64(n) / math.Sqrt(float64(buyers[p.ID]*buyers[other]))
+			recs.AlsoBought = append(recs.AlsoBought, Recommendation{ProductID: other, Score: round3(score)})
+		}
+		for j := range products {
+			other := &products[j]
+			if other.ID == p.ID {
+				continue
+			}
+			if score := Similarity(p, other); score >= minSimilarity {
+				recs.Related = append(recs.Related, Recommendation{ProductID: other.ID, Score: round3(score)})
+			}
+		}
+
+		recs.AlsoBought = topRecommendations(recs.AlsoBought, active)
+		recs.Related = topRecommendations(recs.Related, active)
+		all = append(all, recs)
+	}
+	return all
+}
+
+// Similarity scores how alike two products are from 0 to 1, mostly by shared
+// tags and technologies
+func Similarity(a, b *Product) float64 {
+	score := 0.45*jaccard(a.Tags, b.Tags) + 0.4*jaccard(a.Technologies, b.Technologies)
+	if a.Category == b.Category {
+		score += 0.15
+	}
+	return score
+}
+
+func jaccard(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	set := make(map[string]bool, len(a))
+	for _, v := range a {
+		set[normalizeTerm(v)] = true
+	}
+	union := len(set)
+	shared := 0
+	counted := map[string]bool{}
+	for _, v := range b {
+		v = normalizeTerm(v)
+		if counted[v] {
+			continue
+		}
+		counted[v] = true
+		if set[v] {
+			shared++
+		} else {
+			union++
+		}
+	}
+	return float64(shared) / float64(union)
+}
+
+// topRecommendations orders recs by score, breaking ties by popularity, and
+// keeps the best MaxRecommendations
+func topRecommendations(recs []Recommendation, products map[primitive.ObjectID]*Product) []Recommendation {
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].Score != recs[j].Score {
+			return recs[i].Score > recs[j].Score
+		}
+		di, dj := products[recs[i].ProductID].DownloadCount, products[recs[j].ProductID].DownloadCount
+		if di != dj {
+			return di > dj
+		}
+		return recs[i].ProductID.Hex() < recs[j].ProductID.Hex()
+	})
+	if len(recs) > MaxRecommendations {
+		recs = recs[:MaxRecommendations]
+	}
+	return recs
+}
+
+// PopularByCategory returns the most downloaded products of each category,
+// with one spare so a product can be left out of its own list
+func PopularByCategory(products []Product) map[ProductCategory][]Recommendation {
+	byCategory := map[ProductCategory][]Product{}
+	for _, p := range products {
+		byCategory[p.Category] = append(byCategory[p.Category], p)
+	}
+	popular := make(map[ProductCategory][]Recommendation, len(byCategory))
+	for category, ps := range byCategory {
+		sort.Slice(ps, func(i, j int) bool {
+			if ps[i].DownloadCount != ps[j].DownloadCount {
+				return ps[i].DownloadCount > ps[j].DownloadCount
+			}
+			return ps[i].ID.Hex() < ps[j].ID.Hex()
+		})
+		if len(ps) > MaxRecommendations+1 {
+			ps = ps[:MaxRecommendations+1]
+		}
+		popular[category] = popularOf(ps)
+	}
+	return popular
+}
+
+// popularOf scores products already ordered by popularity relative to the
+// most popular one
+func popularOf(products []Product) []Recommendation {
+	recs := make([]Recommendation, 0, len(products))
+	for _, p := range products {
+		score := 0.0
+		if top := products[0].DownloadCount; top > 0 {
+			score = round3(float64(p.DownloadCount) / float64(top))
+		}
+		recs = append(recs, Recommendation{ProductID: p.ID, Score: score})
+	}
+	return recs
+}
+
+// normalizeTerm lets "Go" and "go " count as the same tag
+func normalizeTerm(v string) string {
+	return strings.ToLower(strings.TrimSpace(v))
+}
+
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSimilarity(t *testing.T) {
+	a := &Product{Category: CategoryTemplate, Tags: []string{"dashboard", "Admin"}, Technologies: []string{"react", "tailwind"}}
+	b := &Product{Category: CategoryTemplate, Tags: []string{"admin ", "dashboard"}, Technologies: []string{"react", "vue"}}
+	c := &Product{Category: CategoryPlugin, Tags: []string{"seo"}}
+
+	assert.InDelta(t, 0.45+0.4/3+0.15, Similarity(a, b), 1e-9, "tags match regardless of case and spacing")
+	assert.Equal(t, Similarity(a, b), Similarity(b, a))
+	assert.Zero(t, Similarity(a, c))
+	assert.InDelta(t, 1.0, Similarity(a, a), 1e-9)
+}
+
+func TestBuildRecommendations(t *testing.T) {
+	id := func() primitive.ObjectID { return primitive.NewObjectID() }
+	kit := Product{ID: id(), Category: CategoryTemplate, Tags: []string{"dashboard"}, Technologies: []string{"react"}}
+	icons := Product{ID: id(), Category: CategoryAsset, Tags: []string{"icons"}}
+	charts := Product{ID: id(), Category: CategoryTemplate, Tags: []string{"dashboard", "charts"}, Technologies: []string{"react"}, DownloadCount: 40}
+	fresh := Product{ID: id(), Category: CategoryCourse}
+	delisted := id()
+
+	baskets := map[primitive.ObjectID][]primitive.ObjectID{
+		id(): {kit.ID, icons.ID},
+		id(): {kit.ID, icons.ID, delisted},
+		id(): {kit.ID, charts.ID},
+		id(): {icons.ID},
+	}
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	all := BuildRecommendations([]Product{kit, icons, charts, fresh}, baskets, now)
+	require.Len(t, all, 4)
+
+	byID := map[primitive.ObjectID]Recommendations{}
+	for _, r := range all {
+		byID[r.ProductID] = r
+	}
+
+	recs := byID[kit.ID]
+	assert.Equal(t, now, recs.ComputedAt)
+	require.Len(t, recs.AlsoBought, 2, "products no longer on sale are never recommended")
+	assert.Equal(t, icons.ID, recs.AlsoBought[0].ProductID)
+	assert.Equal(t, 0.667, recs.AlsoBought[0].Score, "2 shared buyers of 3 and 3")
+	assert.Equal(t, charts.ID, recs.AlsoBought[1].ProductID)
+	require.Len(t, recs.Related, 1)
+	assert.Equal(t, charts.ID, recs.Related[0].ProductID)
+
+	assert.Empty(t, byID[fresh.ID].AlsoBought)
+	assert.Empty(t, byID[fresh.ID].Related)
+	assert.NotNil(t, byID[fresh.ID].Related, "empty lists encode as []")
+}
+
+func TestPopularByCategory(t *testing.T) {
+	top := Product{ID: primitive.NewObjectID(), Category: CategoryPlugin, DownloadCount: 200}
+	next := Product{ID: primitive.NewObjectID(), Category: CategoryPlugin, DownloadCount: 50}
+	other := Product{ID: primitive.NewObjectID(), Category: CategoryAsset}
+
+	popular := PopularByCategory([]Product{next, other, top})
+	assert.Equal(t, []Recommendation{{ProductID: top.ID, Score: 1}, {ProductID: next.ID, Score: 0.25}}, popular[CategoryPlugin])
+	assert.Equal(t, []Recommendation{{ProductID: other.ID, Score: 0}}, popular[CategoryAsset])
+}
+
+func TestRecommendationEngineGet(t *testing.T) {
+	mr := miniredis.RunT(t)
+	engine := NewRecommendationEngine(nil, newTestRedis(t, mr), time.Hour)
+	ctx := context.Background()
+
+	product := &Product{ID: primitive.NewObjectID(), Category: CategoryPlugin}
+	popular := []Recommendation{{ProductID: product.ID, Score: 1}, {ProductID: primitive.NewObjectID(), Score: 0.5}}
+	payload, err := json.Marshal(popular)
+	require.NoError(t, err)
+	require.NoError(t, mr.Set(popularKeyPrefix+string(CategoryPlugin), string(payload)))
+
+	recs, err := engine.Get(ctx, product)
+	require.NoError(t, err)
+	assert.True(t, recs.Fallback, "new products fall back to popular ones")
+	assert.Equal(t, popular[1:], recs.Related, "a product is not recommended alongside itself")
+	assert.Empty(t, recs.AlsoBought)
+
+	stored := Recommendations{
+		ProductID:  product.ID,
+		AlsoBought: []Recommendation{{ProductID: primitive.NewObjectID(), Score: 0.8}},
+		Related:    []Recommendation{},
+	}
+	payload, err = json.Marshal(stored)
+	require.NoError(t, err)
+	require.NoError(t, mr.Set(recommendationsKeyPrefix+product.ID.Hex(), string(payload)))
+
+	recs, err = engine.Get(ctx, product)
+	require.NoError(t, err)
+	assert.False(t, recs.Fallback)
+	assert.Equal(t, stored.AlsoBought, recs.AlsoBought)
+}
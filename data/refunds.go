@@ -0,0 +1,319 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrRefundNotFound   = errors.New("refund request not found")
+	ErrNotRefundable    = errors.New("only completed purchases can be refunded")
+	ErrRefundPeriodOver = errors.New("the refund period for this purchase is over")
+	ErrRefundRequested  = errors.New("a refund was already requested for this purchase")
+	ErrRefundDecided    = errors.New("refund request was already decided")
+)
+
+// CheckRefund reports whether purchase can still be refunded under settings
+// and, if so, whether a refund is approved without review: only purchases
+// downloaded at most RefundMaxDownloads times are.
+func CheckRefund(purchase *Purchase, settings *MarketplaceSettings, now time.Time) (autoApprove bool, err error) {
+	if purchase.Status != PurchaseStatusCompleted {
+		return false, ErrNotRefundable
+	}
+	if settings.RefundPeriodDays <= 0 || now.After(purchase.CreatedAt.AddDate(0, 0, settings.RefundPeriodDays)) {
+		return false, ErrRefundPeriodOver
+	}
+	return purchase.DownloadCount <= settings.RefundMaxDownloads, nil
+}
+
+// RefundService handles buyers' refund requests. A refund returns the
+// purchase price to the buyer's balance, takes back the creator's earnings
+// and the marketplace's commission, gives back any coupon use and revokes
+// the buyer's access, all in one transaction. Buyers and creators are
+// notified of every step once it is committed; a failed notification is
+// logged, not retried.
+type RefundService struct {
+	mongo         *MongoDB
+	purchases     *PurchaseRepository
+	products      *ProductRepository
+	coupons       *CouponRepository
+	entitlements  *EntitlementRepository
+	settings      *SettingsRepository
+	ledger        *LedgerRepository
+	notifications *NotificationRepository
+}
+
+func NewRefundService(mongo *MongoDB, purchases *PurchaseRepository, products *ProductRepository,
+	coupons *CouponRepository, entitlements *EntitlementRepository, settings *SettingsRepository, ledger *LedgerRepository,
+	notifications *NotificationRepository) *RefundService {
+	return &RefundService{
+		mongo:         mongo,
+		purchases:     purchases,
+		products:      products,
+		coupons:       coupons,
+		entitlements:  entitlements,
+		settings:      settings,
+		ledger:        ledger,
+		notifications: notifications,
+	}
+}
+
+// Request files buyerID's request to refund purchaseID. Within the refund
+// period a purchase that was hardly downloaded is refunded straight away;
+// any other request waits for the creator or a moderator to decide it.
+// A purchase can only be the subject of one request.
+func (s *RefundService) Request(ctx context.Context, buyerID, purchaseID primitive.ObjectID, reason string) (*RefundRequest, error) {
+	result, err := s.mongo.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return s.request(sc, buyerID, purchaseID, reason)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrRefundRequested
+	}
+	if err != nil {
+		return nil, err
+	}
+	request := result.(*RefundRequest)
+	if request.Status == RefundStatusPending {
+		s.notify(ctx, request.UserID, request, fmt.Sprintf("Your refund request for %q is waiting for the creator's review", request.ProductTitle))
+		s.notify(ctx, request.CreatorID, request, fmt.Sprintf("A buyer asked for a refund of %q: %s", request.ProductTitle, request.Reason))
+	} else {
+		s.notifyRefunded(ctx, request)
+	}
+	return request, nil
+}
+
+func (s *RefundService) request(ctx mongo.SessionContext, buyerID, purchaseID primitive.ObjectID, reason string) (*RefundRequest, error) {
+	purchase, err := s.purchases.FindByID(ctx, purchaseID)
+	if err != nil {
+		return nil, err
+	}
+	if purchase.UserID != buyerID {
+		return nil, ErrPurchaseNotFound
+	}
+	n, err := s.mongo.RefundRequests().CountDocuments(ctx, bson.M{"purchase_id": purchase.ID})
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, ErrRefundRequested
+	}
+	settings, err := s.settings.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	autoApprove, err := CheckRefund(purchase, settings, now)
+	if err != nil {
+		return nil, err
+	}
+	product, err := s.products.FindByID(ctx, purchase.ProductID)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &RefundRequest{
+		ID:           primitive.NewObjectID(),
+		PurchaseID:   purchase.ID,
+		ProductID:    product.ID,
+		ProductTitle: product.Title,
+		UserID:       buyerID,
+		CreatorID:    product.CreatorID,
+		Amount:       purchase.Price,
+		Reason:       reason,
+		Status:       RefundStatusPending,
+		CreatedAt:    now,
+	}
+	if autoApprove {
+		if err := s.refund(ctx, purchase, product, settings); err != nil {
+			return nil, err
+		}
+		request.Status = RefundStatusApproved
+		request.AutoApproved = true
+		request.DecidedAt = now
+	}
+	if _, err := s.mongo.RefundRequests().InsertOne(ctx, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Decide approves or rejects a pending request on behalf of reviewerID,
+// with response as a note to the buyer. Callers check that the reviewer is
+// the product's creator or a moderator.
+func (s *RefundService) Decide(ctx context.Context, id, reviewerID primitive.ObjectID, approve bool, response string) (*RefundRequest, error) {
+	result, err := s.mongo.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return s.decide(sc, id, reviewerID, approve, response)
+	})
+	if err != nil {
+		return nil, err
+	}
+	request := result.(*RefundRequest)
+	if request.Status == RefundStatusApproved {
+		s.notifyRefunded(ctx, request)
+	} else {
+		message := fmt.Sprintf("Your refund request for %q was declined", request.ProductTitle)
+		if request.Response != "" {
+			message += ": " + request.Response
+		}
+		s.notify(ctx, request.UserID, request, message)
+	}
+	return request, nil
+}
+
+func (s *RefundService) decide(ctx mongo.SessionContext, id, reviewerID primitive.ObjectID, approve bool, response string) (*RefundRequest, error) {
+	request, err := s.FindByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != RefundStatusPending {
+		return nil, ErrRefundDecided
+	}
+
+	request.Status = RefundStatusRejected
+	if approve {
+		purchase, err := s.purchases.FindByID(ctx, request.PurchaseID)
+		if err != nil {
+			return nil, err
+		}
+		product, err := s.products.FindByID(ctx, request.ProductID)
+		if err != nil {
+			return nil, err
+		}
+		settings, err := s.settings.Get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.refund(ctx, purchase, product, settings); err != nil {
+			return nil, err
+		}
+		request.Status = RefundStatusApproved
+	}
+	request.ReviewerID = reviewerID
+	request.Response = response
+	request.DecidedAt = time.Now()
+
+	res, err := s.mongo.RefundRequests().UpdateOne(ctx,
+		bson.M{"_id": request.ID, "status": RefundStatusPending},
+		bson.M{"$set": bson.M{
+			"status":      request.Status,
+			"reviewer_id": request.ReviewerID,
+			"response":    request.Response,
+			"decided_at":  request.DecidedAt,
+		}})
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount == 0 {
+		return nil, ErrRefundDecided
+	}
+	return request, nil
+}
+
+// refund returns purchase's price to its buyer. Where the sale was posted to
+// the ledger its postings are reversed, so the creator and the marketplace
+// give back exactly what they were credited even if the commission rate has
+// changed since; older purchases are split at the current rate. Earnings
+// the creator has already withdrawn leave their pending earnings negative.
+func (s *RefundService) refund(ctx context.Context, purchase *Purchase, product *Product, settings *MarketplaceSettings) error {
+	res, err := s.mongo.Purchases().UpdateOne(ctx,
+		bson.M{"_id": purchase.ID, "status": PurchaseStatusCompleted},
+		bson.M{"$set": bson.M{
+			"status":        PurchaseStatusRefunded,
+			"download_link": "",
+			"license_key":   "",
+		}})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return ErrNotRefundable
+	}
+
+	entry, err := s.ledger.Reversal(ctx, CreditTransactionPurchase, purchase.ID, CreditTransactionRefund,
+		fmt.Sprintf("Refund of %s", product.Title))
+	if err != nil {
+		return err
+	}
+	if len(entry.Postings) == 0 {
+		commission, earnings := SplitSale(purchase.Price, settings.CommissionRate)
+		entry.Credit(BalanceAccount(purchase.UserID), purchase.Price).
+			Debit(EarningsAccount(product.CreatorID), earnings).
+			Debit(AccountCommission, commission)
+	}
+
+	refunded := entry.Net(BalanceAccount(purchase.UserID), SettlementCurrency)
+	if refunded.IsPositive() {
+		if _, err := s.mongo.Users().UpdateOne(ctx, bson.M{"_id": purchase.UserID},
+			bson.M{"$inc": bson.M{"credits.balance.amount": refunded.Amount}}); err != nil {
+			return err
+		}
+	}
+	clawback := entry.Net(EarningsAccount(product.CreatorID), SettlementCurrency).Neg()
+	if clawback.IsPositive() {
+		if _, err := s.mongo.Users().UpdateOne(ctx, bson.M{"_id": product.CreatorID},
+			bson.M{"$inc": bson.M{"credits.pending_earnings.amount": -clawback.Amount}}); err != nil {
+			return err
+		}
+	}
+	if err := s.ledger.Post(ctx, entry); err != nil {
+		return err
+	}
+	if err := s.coupons.Release(ctx, purchase.ID); err != nil {
+		return err
+	}
+	return s.entitlements.Revoke(ctx, purchase.ID)
+}
+
+func (s *RefundService) notifyRefunded(ctx context.Context, request *RefundRequest) {
+	s.notify(ctx, request.UserID, request, fmt.Sprintf("Your purchase of %q was refunded; %s was returned to your balance",
+		request.ProductTitle, request.Amount.Display()))
+	s.notify(ctx, request.CreatorID, request, fmt.Sprintf("A purchase of %q was refunded and its earnings taken back",
+		request.ProductTitle))
+}
+
+func (s *RefundService) notify(ctx context.Context, userID primitive.ObjectID, request *RefundRequest, message string) {
+	if err := s.notifications.Notify(ctx, userID, NotificationRefund, message, request.ID); err != nil {
+		log.Printf("Failed to notify user %s of refund request %s: %v", userID.Hex(), request.ID.Hex(), err)
+	}
+}
+
+// FindByID returns a refund request
+func (s *RefundService) FindByID(ctx context.Context, id primitive.ObjectID) (*RefundRequest, error) {
+	var request RefundRequest
+	err := s.mongo.RefundRequests().FindOne(ctx, bson.M{"_id": id}).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrRefundNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// ListForBuyer returns a page of the refunds a buyer requested
+func (s *RefundService) ListForBuyer(ctx context.Context, userID primitive.ObjectID, page pagination.Request) ([]RefundRequest, error) {
+	return findPage[RefundRequest](ctx, s.mongo.RefundRequests(), bson.M{"user_id": userID}, page)
+}
+
+// ListForCreator returns a page of the refunds requested for a creator's
+// products, optionally restricted to one status
+func (s *RefundService) ListForCreator(ctx context.Context, creatorID primitive.ObjectID, status RefundStatus, page pagination.Request) ([]RefundRequest, error) {
+	filter := bson.M{"creator_id": creatorID}
+	if status != "" {
+		filter["status"] = status
+	}
+	return findPage[RefundRequest](ctx, s.mongo.RefundRequests(), filter, page)
+}
+
+// ListPending returns a page of the requests awaiting a decision
+func (s *RefundService) ListPending(ctx context.Context, page pagination.Request) ([]RefundRequest, error) {
+	return findPage[RefundRequest](ctx, s.mongo.RefundRequests(), bson.M{"status": RefundStatusPending}, page)
+}
@@ -0,0 +1,151 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCheckRefund(t *testing.T) {
+	now := time.Now()
+	settings := &MarketplaceSettings{RefundPeriodDays: 14, RefundMaxDownloads: 1}
+
+	tests := []struct {
+		name     string
+		purchase Purchase
+		settings *MarketplaceSettings
+		auto     bool
+		err      error
+	}{
+		{"fresh", Purchase{Status: PurchaseStatusCompleted, CreatedAt: now.Add(-time.Hour)}, settings, true, nil},
+		{"downloaded once", Purchase{Status: PurchaseStatusCompleted, CreatedAt: now.Add(-time.Hour), DownloadCount: 1}, settings, true, nil},
+		{"downloaded often", Purchase{Status: PurchaseStatusCompleted, CreatedAt: now.Add(-time.Hour), DownloadCount: 2}, settings, false, nil},
+		{"period over", Purchase{Status: PurchaseStatusCompleted, CreatedAt: now.AddDate(0, 0, -15)}, settings, false, ErrRefundPeriodOver},
+		{"refunds disabled", Purchase{Status: PurchaseStatusCompleted, CreatedAt: now}, &MarketplaceSettings{}, false, ErrRefundPeriodOver},
+		{"already refunded", Purchase{Status: PurchaseStatusRefunded, CreatedAt: now}, settings, false, ErrNotRefundable},
+		{"pending", Purchase{Status: PurchaseStatusPending, CreatedAt: now}, settings, false, ErrNotRefundable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auto, err := CheckRefund(&tt.purchase, tt.settings, now)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.auto, auto)
+		})
+	}
+}
+
+func newRefundTestService(t *testing.T) (*RefundService, *CheckoutService, *MongoDB) {
+	checkout, m := newCheckoutTestService(t)
+	refunds := NewRefundService(m, NewPurchaseRepository(m), checkout.products, checkout.coupons, checkout.entitlements,
+		checkout.settings, checkout.ledger, NewNotificationRepository(m))
+	return refunds, checkout, m
+}
+
+func TestRefundAutoApproved(t *testing.T) {
+	refunds, checkout, m := newRefundTestService(t)
+	ctx := context.Background()
+	buyer, creator, products := seedCheckout(t, m, usd(5000), usd(2000))
+
+	result, err := checkout.Checkout(ctx, buyer, products[0], "")
+	require.NoError(t, err)
+
+	_, err = refunds.Request(ctx, creator, result.Purchase.ID, "not mine")
+	assert.Equal(t, ErrPurchaseNotFound, err)
+
+	request, err := refunds.Request(ctx, buyer, result.Purchase.ID, "wrong product")
+	require.NoError(t, err)
+	assert.Equal(t, RefundStatusApproved, request.Status)
+	assert.True(t, request.AutoApproved)
+	assert.Equal(t, usd(2000), request.Amount)
+
+	assert.Equal(t, usd(5000), loadCredits(t, m, buyer).Balance)
+	assert.Equal(t, usd(0), loadCredits(t, m, creator).PendingEarnings)
+	for _, account := range []string{BalanceAccount(buyer), EarningsAccount(creator), AccountCommission} {
+		balance, err := checkout.ledger.Balance(ctx, account)
+		require.NoError(t, err)
+		assert.Equal(t, usd(0), balance, account)
+	}
+
+	purchase, err := NewPurchaseRepository(m).FindByID(ctx, result.Purchase.ID)
+	require.NoError(t, err)
+	assert.Equal(t, PurchaseStatusRefunded, purchase.Status)
+	_, err = checkout.entitlements.Find(ctx, buyer, products[0], purchase.ID)
+	assert.Equal(t, ErrNotEntitled, err)
+
+	n, err := m.Notifications().CountDocuments(ctx, bson.M{"type": NotificationRefund})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, n, "buyer and creator are told")
+
+	_, err = refunds.Request(ctx, buyer, result.Purchase.ID, "again")
+	assert.Equal(t, ErrRefundRequested, err)
+	_, err = checkout.Checkout(ctx, buyer, products[0], "")
+	assert.NoError(t, err, "a refunded product can be bought again")
+}
+
+func TestRefundNeedsReview(t *testing.T) {
+	refunds, checkout, m := newRefundTestService(t)
+	ctx := context.Background()
+	buyer, creator, products := seedCheckout(t, m, usd(5000), usd(2000), usd(1000))
+
+	var purchases []primitive.ObjectID
+	for _, product := range products {
+		result, err := checkout.Checkout(ctx, buyer, product, "")
+		require.NoError(t, err)
+		_, err = m.Purchases().UpdateOne(ctx, bson.M{"_id": result.Purchase.ID}, bson.M{"$set": bson.M{"download_count": 5}})
+		require.NoError(t, err)
+		purchases = append(purchases, result.Purchase.ID)
+	}
+
+	approved, err := refunds.Request(ctx, buyer, purchases[0], "does not work")
+	require.NoError(t, err)
+	assert.Equal(t, RefundStatusPending, approved.Status)
+	rejected, err := refunds.Request(ctx, buyer, purchases[1], "changed my mind")
+	require.NoError(t, err)
+	assert.Equal(t, usd(2000), loadCredits(t, m, buyer).Balance, "nothing is refunded before review")
+
+	approved, err = refunds.Decide(ctx, approved.ID, creator, true, "")
+	require.NoError(t, err)
+	assert.Equal(t, RefundStatusApproved, approved.Status)
+	assert.Equal(t, creator, approved.ReviewerID)
+	rejected, err = refunds.Decide(ctx, rejected.ID, creator, false, "you downloaded it five times")
+	require.NoError(t, err)
+	assert.Equal(t, RefundStatusRejected, rejected.Status)
+
+	_, err = refunds.Decide(ctx, approved.ID, creator, true, "")
+	assert.Equal(t, ErrRefundDecided, err)
+
+	assert.Equal(t, usd(4000), loadCredits(t, m, buyer).Balance)
+	assert.Equal(t, usd(850), loadCredits(t, m, creator).PendingEarnings, "only the rejected sale's earnings remain")
+}
+
+func TestRefundReleasesCoupon(t *testing.T) {
+	refunds, checkout, m := newRefundTestService(t)
+	ctx := context.Background()
+	buyer, _, products := seedCheckout(t, m, usd(5000), usd(2000))
+
+	coupon := &Coupon{Code: "ONCE", Type: CouponTypePercentage, Percent: 10, MaxRedemptions: 1, PerUserLimit: 1, Active: true}
+	require.NoError(t, checkout.coupons.Create(ctx, coupon))
+
+	result, err := checkout.Checkout(ctx, buyer, products[0], "ONCE")
+	require.NoError(t, err)
+	_, err = refunds.Request(ctx, buyer, result.Purchase.ID, "wrong product")
+	require.NoError(t, err)
+
+	coupon, err = checkout.coupons.FindByID(ctx, coupon.ID)
+	require.NoError(t, err)
+	assert.Zero(t, coupon.RedemptionCount, "the refunded use no longer counts against the limit")
+	used, err := checkout.coupons.UserRedemptions(ctx, coupon.ID, buyer)
+	require.NoError(t, err)
+	assert.Zero(t, used)
+	var redemption CouponRedemption
+	require.NoError(t, m.CouponRedemptions().FindOne(ctx, bson.M{"purchase_id": result.Purchase.ID}).Decode(&redemption))
+	assert.NotNil(t, redemption.ReversedAt)
+
+	_, err = checkout.Checkout(ctx, buyer, products[0], "ONCE")
+	assert.NoError(t, err, "the buyer can use the coupon again")
+}
@@ -0,0 +1,227 @@
+package data
+
+import (
+	"context"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ProductSort selects the order of catalog results
+type ProductSort string
+
+const (
+	SortRelevance ProductSort = "relevance"
+	SortNewest    ProductSort = "newest"
+	SortPriceAsc  ProductSort = "price_asc"
+	SortPriceDesc ProductSort = "price_desc"
+	SortDownloads ProductSort = "downloads"
+	SortRating    ProductSort = "rating"
+)
+
+// tagFacetLimit caps how many tags are reported in the tag facet
+const tagFacetLimit = 20
+
+// ProductQuery describes a catalog search. Only active products are ever
+// returned. Specs only make sense with a single category, as each category
+// has its own specification keys. Price bounds are compared with products'
+// reference prices, so they must be in SettlementCurrency.
+type ProductQuery struct {
+	Text         string
+	Categories   []ProductCategory
+	Tags         []string
+	Technologies []string
+	MinPrice     *money.Money
+	MaxPrice     *money.Money
+	Specs        []SpecFilter
+	Sort         ProductSort
+	Page         pagination.Request
+}
+
+// FacetCount is the number of matching products for a single facet value
+type FacetCount struct {
+	Value string `bson:"_id" json:"value"`
+	Count int64  `bson:"count" json:"count"`
+}
+
+// ProductFacets holds facet counts for a search. Category counts ignore the
+// category filter so clients can offer the other categories as alternatives.
+type ProductFacets struct {
+	Categories []FacetCount `json:"categories"`
+	Tags       []FacetCount `json:"tags"`
+}
+
+// ProductHit is a catalog search result. Score is only set for text searches.
+type ProductHit struct {
+	Product `bson:",inline"`
+	Score   float64 `bson:"score,omitempty" json:"-"`
+}
+
+type ProductSearchResult struct {
+	Hits   []ProductHit
+	Total  int64
+	Facets ProductFacets
+}
+
+// baseFilter matches everything in q except the category filter
+func (q *ProductQuery) baseFilter() bson.M {
+	filter := bson.M{"status": ProductStatusActive}
+	if q.Text != "" {
+		filter["$text"] = bson.M{"$search": q.Text}
+	}
+	if len(q.Tags) > 0 {
+		filter["tags"] = bson.M{"$all": q.Tags}
+	}
+	if len(q.Technologies) > 0 {
+		filter["technologies"] = bson.M{"$all": q.Technologies}
+	}
+	price := bson.M{}
+	if q.MinPrice != nil {
+		price["$gte"] = q.MinPrice.Amount
+	}
+	if q.MaxPrice != nil {
+		price["$lte"] = q.MaxPrice.Amount
+	}
+	if len(price) > 0 {
+		filter["reference_price.amount"] = price
+	}
+	return filter
+}
+
+// categoryFilter matches the category and, since specification keys belong
+// to a category, the specification filters
+func (q *ProductQuery) categoryFilter() bson.M {
+	filter := bson.M{}
+	if len(q.Categories) > 0 {
+		filter["category"] = bson.M{"$in": q.Categories}
+	}
+	if len(q.Specs) > 0 {
+		specs := make(bson.A, 0, len(q.Specs))
+		for _, spec := range q.Specs {
+			specs = append(specs, spec.expr())
+		}
+		filter["$and"] = specs
+	}
+	return filter
+}
+
+// PageSort returns the key the catalog is paginated on for q.Sort
+func (q *ProductQuery) PageSort() pagination.Sort {
+	switch q.Sort {
+	case SortRelevance:
+		if q.Text != "" {
+			return pagination.Sort{Field: "score", Desc: true}
+		}
+	case SortPriceAsc:
+		return pagination.Sort{Field: "reference_price.amount"}
+	case SortPriceDesc:
+		return pagination.Sort{Field: "reference_price.amount", Desc: true}
+	case SortDownloads:
+		return pagination.Sort{Field: "download_count", Desc: true}
+	case SortRating:
+		return pagination.Sort{Field: "average_rating", Desc: true}
+	}
+	return pagination.Sort{Field: "created_at", Desc: true}
+}
+
+// SortKey returns the value of hit for the given paginated sort
+func (hit ProductHit) SortKey(sort pagination.Sort) interface{} {
+	switch sort.Field {
+	case "score":
+		return hit.Score
+	case "reference_price.amount":
+		return hit.ReferencePrice.Amount
+	case "download_count":
+		return hit.DownloadCount
+	case "average_rating":
+		return hit.AverageRating
+	}
+	return hit.CreatedAt
+}
+
+// pipeline builds a single aggregation returning the requested page, the
+// total and the facet counts.
+func (q *ProductQuery) pipeline() mongo.Pipeline {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: q.baseFilter()}},
+	}
+	// The text score is materialised so it can be sorted and paged on
+	if q.Text != "" {
+		pipeline = append(pipeline, bson.D{{Key: "$addFields", Value: bson.M{
+			"score": bson.M{"$meta": "textScore"},
+		}}})
+	}
+
+	results := bson.A{
+		bson.M{"$match": q.categoryFilter()},
+		bson.M{"$match": q.Page.Filter()},
+		bson.M{"$sort": q.Page.SortSpec()},
+		bson.M{"$limit": q.Page.FetchLimit()},
+	}
+
+	return append(pipeline,
+		bson.D{{Key: "$facet", Value: bson.M{
+			"results": results,
+			"total": bson.A{
+				bson.M{"$match": q.categoryFilter()},
+				bson.M{"$count": "count"},
+			},
+			"categories": bson.A{
+				bson.M{"$group": bson.M{"_id": "$category", "count": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+			},
+			"tags": bson.A{
+				bson.M{"$match": q.categoryFilter()},
+				bson.M{"$unwind": "$tags"},
+				bson.M{"$group": bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+				bson.M{"$limit": tagFacetLimit},
+			},
+		}}},
+	)
+}
+
+// Search runs a catalog query against active products
+func (r *ProductRepository) Search(ctx context.Context, q ProductQuery) (*ProductSearchResult, error) {
+	cursor, err := r.mongo.Products().Aggregate(ctx, q.pipeline())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var out []struct {
+		Results    []ProductHit            `bson:"results"`
+		Total      []struct{ Count int64 } `bson:"total"`
+		Categories []FacetCount            `bson:"categories"`
+		Tags       []FacetCount            `bson:"tags"`
+	}
+	if err := cursor.All(ctx, &out); err != nil {
+		return nil, err
+	}
+
+	result := &ProductSearchResult{
+		Hits: []ProductHit{},
+		Facets: ProductFacets{
+			Categories: []FacetCount{},
+			Tags:       []FacetCount{},
+		},
+	}
+	if len(out) == 0 {
+		return result, nil
+	}
+	if out[0].Results != nil {
+		result.Hits = out[0].Results
+	}
+	if len(out[0].Total) > 0 {
+		result.Total = out[0].Total[0].Count
+	}
+	if out[0].Categories != nil {
+		result.Facets.Categories = out[0].Categories
+	}
+	if out[0].Tags != nil {
+		result.Facets.Tags = out[0].Tags
+	}
+	return result, nil
+}
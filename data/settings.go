@@ -0,0 +1,41 @@
+package data
+
+import (
+	"context"
+
+	"github.com/kordlab/marketplace/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DefaultSettings apply until an admin stores marketplace settings
+var DefaultSettings = MarketplaceSettings{
+	CommissionRate:     0.15,
+	MinimumWithdrawal:  money.New(2000, money.DefaultCurrency),
+	CreatorPayoutRate:  0.85,
+	RefundPeriodDays:   14,
+	RefundMaxDownloads: 1,
+}
+
+// SettingsRepository reads the marketplace's single settings document
+type SettingsRepository struct {
+	mongo *MongoDB
+}
+
+func NewSettingsRepository(mongo *MongoDB) *SettingsRepository {
+	return &SettingsRepository{mongo: mongo}
+}
+
+// Get returns the stored settings, or DefaultSettings if there are none
+func (r *SettingsRepository) Get(ctx context.Context) (*MarketplaceSettings, error) {
+	var settings MarketplaceSettings
+	err := r.mongo.Settings().FindOne(ctx, bson.M{}).Decode(&settings)
+	if err == mongo.ErrNoDocuments {
+		settings = DefaultSettings
+		return &settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
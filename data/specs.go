@@ -0,0 +1,300 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SpecType is the kind of value a specification holds. Values are stored as
+// strings either way, in a canonical form so they can be filtered on.
+type SpecType string
+
+const (
+	SpecString  SpecType = "string"
+	SpecInteger SpecType = "integer"
+	SpecNumber  SpecType = "number"
+	SpecBoolean SpecType = "boolean"
+	SpecEnum    SpecType = "enum"
+)
+
+// maxSpecLength caps free-form specification values
+const maxSpecLength = 100
+
+// SpecField describes one specification key of a category
+type SpecField struct {
+	Key      string   `json:"key"`
+	Label    string   `json:"label"`
+	Type     SpecType `json:"type"`
+	Required bool     `json:"required"`
+	// Values lists the allowed values of an enum
+	Values []string `json:"values,omitempty"`
+	// Min bounds integers and numbers from below
+	Min  *float64 `json:"min,omitempty"`
+	Unit string   `json:"unit,omitempty"`
+}
+
+// Numeric reports whether the field can be filtered by range
+func (f *SpecField) Numeric() bool {
+	return f.Type == SpecInteger || f.Type == SpecNumber
+}
+
+// SpecSchema lists the specification keys products of a category may carry
+type SpecSchema struct {
+	Category ProductCategory `json:"category"`
+	Fields   []SpecField     `json:"fields"`
+}
+
+// Field returns the schema's field for key
+func (s *SpecSchema) Field(key string) (*SpecField, bool) {
+	for i := range s.Fields {
+		if s.Fields[i].Key == key {
+			return &s.Fields[i], true
+		}
+	}
+	return nil, false
+}
+
+func atLeast(v float64) *float64 { return &v }
+
+// SpecSchemas holds the specification schema of every category
+var SpecSchemas = map[ProductCategory]*SpecSchema{
+	CategoryTemplate: {Category: CategoryTemplate, Fields: []SpecField{
+		{Key: "framework", Label: "Framework", Type: SpecEnum, Required: true,
+			Values: []string{"html", "react", "nextjs", "vue", "nuxt", "svelte", "angular", "astro", "other"}},
+		{Key: "css", Label: "Styling", Type: SpecEnum,
+			Values: []string{"css", "tailwind", "bootstrap", "sass", "css-in-js", "other"}},
+		{Key: "pages", Label: "Pages", Type: SpecInteger, Min: atLeast(1)},
+		{Key: "responsive", Label: "Responsive", Type: SpecBoolean},
+		{Key: "dark_mode", Label: "Dark mode", Type: SpecBoolean},
+	}},
+	CategoryPlugin: {Category: CategoryPlugin, Fields: []SpecField{
+		{Key: "platform", Label: "Platform", Type: SpecEnum, Required: true,
+			Values: []string{"wordpress", "shopify", "figma", "vscode", "chrome", "obsidian", "other"}},
+		{Key: "min_platform_version", Label: "Minimum platform version", Type: SpecString},
+	}},
+	CategoryAsset: {Category: CategoryAsset, Fields: []SpecField{
+		{Key: "format", Label: "Format", Type: SpecEnum, Required: true,
+			Values: []string{"svg", "png", "psd", "figma", "sketch", "blend", "fbx", "obj", "ttf", "otf", "other"}},
+		{Key: "items", Label: "Items", Type: SpecInteger, Min: atLeast(1)},
+		{Key: "resolution", Label: "Resolution", Type: SpecString},
+	}},
+	CategoryCourse: {Category: CategoryCourse, Fields: []SpecField{
+		{Key: "duration", Label: "Duration", Type: SpecInteger, Required: true, Min: atLeast(1), Unit: "minutes"},
+		{Key: "level", Label: "Level", Type: SpecEnum, Required: true,
+			Values: []string{"beginner", "intermediate", "advanced"}},
+		{Key: "lessons", Label: "Lessons", Type: SpecInteger, Min: atLeast(1)},
+		{Key: "certificate", Label: "Certificate", Type: SpecBoolean},
+	}},
+	CategoryGuide: {Category: CategoryGuide, Fields: []SpecField{
+		{Key: "format", Label: "Format", Type: SpecEnum, Required: true,
+			Values: []string{"pdf", "epub", "markdown", "html", "video"}},
+		{Key: "pages", Label: "Pages", Type: SpecInteger, Min: atLeast(1)},
+		{Key: "level", Label: "Level", Type: SpecEnum,
+			Values: []string{"beginner", "intermediate", "advanced"}},
+	}},
+	CategorySource: {Category: CategorySource, Fields: []SpecField{
+		{Key: "language", Label: "Language", Type: SpecString, Required: true},
+		{Key: "framework", Label: "Framework", Type: SpecString},
+		{Key: "license", Label: "License", Type: SpecEnum, Required: true,
+			Values: []string{"mit", "apache-2.0", "bsd-3-clause", "gpl-3.0", "proprietary", "other"}},
+	}},
+}
+
+// SpecErrors maps specification keys to what is wrong with them
+type SpecErrors map[string]string
+
+func (e SpecErrors) Error() string {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+": "+e[k])
+	}
+	return "invalid specifications: " + strings.Join(parts, ", ")
+}
+
+// NormalizeSpecifications checks the product's specifications against its
+// category's schema and rewrites them in canonical form. Bundles take their
+// specifications from their items, so required keys are optional for them.
+// Failures are reported as SpecErrors.
+func (p *Product) NormalizeSpecifications() error {
+	specs, err := normalizeSpecifications(p.Category, p.Specifications, p.Type != ProductTypeBundle)
+	if err != nil {
+		return err
+	}
+	p.Specifications = specs
+	return nil
+}
+
+func normalizeSpecifications(category ProductCategory, specs map[string]string, requireAll bool) (map[string]string, error) {
+	schema, ok := SpecSchemas[category]
+	if !ok {
+		return nil, fmt.Errorf("no specification schema for category %q", category)
+	}
+
+	errs := SpecErrors{}
+	out := make(map[string]string, len(specs))
+	for key, raw := range specs {
+		field, ok := schema.Field(key)
+		if !ok {
+			errs[key] = "unknown"
+			continue
+		}
+		if strings.TrimSpace(raw) == "" {
+			if field.Required && requireAll {
+				errs[key] = "required"
+			}
+			continue
+		}
+		v, err := field.Normalize(raw)
+		if err != nil {
+			errs[key] = err.Error()
+			continue
+		}
+		out[key] = v
+	}
+	for _, field := range schema.Fields {
+		if _, ok := specs[field.Key]; field.Required && requireAll && !ok {
+			errs[field.Key] = "required"
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return out, nil
+}
+
+// Normalize checks raw against the field and returns its canonical form
+func (f *SpecField) Normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch f.Type {
+	case SpecEnum:
+		v := strings.ToLower(raw)
+		for _, allowed := range f.Values {
+			if v == allowed {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("oneof=%s", strings.Join(f.Values, " "))
+	case SpecBoolean:
+		b, err := strconv.ParseBool(strings.ToLower(raw))
+		if err != nil {
+			return "", fmt.Errorf("boolean")
+		}
+		return strconv.FormatBool(b), nil
+	case SpecInteger, SpecNumber:
+		n, err := f.parseNumber(raw)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	default:
+		if len(raw) > maxSpecLength {
+			return "", fmt.Errorf("max=%d", maxSpecLength)
+		}
+		return raw, nil
+	}
+}
+
+func (f *SpecField) parseNumber(raw string) (float64, error) {
+	if f.Type == SpecInteger {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("integer")
+		}
+		if f.Min != nil && float64(n) < *f.Min {
+			return 0, fmt.Errorf("min=%g", *f.Min)
+		}
+		return float64(n), nil
+	}
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("number")
+	}
+	if f.Min != nil && n < *f.Min {
+		return 0, fmt.Errorf("min=%g", *f.Min)
+	}
+	return n, nil
+}
+
+// SpecFilter restricts a catalog search to products whose specification
+// key has one of Values or, for numeric keys, lies within Min and Max
+type SpecFilter struct {
+	Key    string
+	Values []string
+	Min    *float64
+	Max    *float64
+}
+
+// ParseSpecFilter reads a filter on field from a query value: a comma
+// separated list of values, or for numeric fields a range written
+// "min..max" with either end optional
+func ParseSpecFilter(field *SpecField, raw string) (SpecFilter, error) {
+	filter := SpecFilter{Key: field.Key}
+	if lo, hi, isRange := strings.Cut(raw, ".."); isRange {
+		if !field.Numeric() {
+			return filter, fmt.Errorf("%s cannot be filtered by range", field.Key)
+		}
+		for _, bound := range []struct {
+			raw string
+			dst **float64
+		}{{lo, &filter.Min}, {hi, &filter.Max}} {
+			if bound.raw = strings.TrimSpace(bound.raw); bound.raw == "" {
+				continue
+			}
+			n, err := strconv.ParseFloat(bound.raw, 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid range for %s", field.Key)
+			}
+			*bound.dst = &n
+		}
+		if filter.Min == nil && filter.Max == nil {
+			return filter, fmt.Errorf("invalid range for %s", field.Key)
+		}
+		return filter, nil
+	}
+
+	for _, v := range strings.Split(raw, ",") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		normalized, err := field.Normalize(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid value for %s: %s", field.Key, err)
+		}
+		filter.Values = append(filter.Values, normalized)
+	}
+	if len(filter.Values) == 0 {
+		return filter, fmt.Errorf("missing value for %s", field.Key)
+	}
+	return filter, nil
+}
+
+// expr returns the filter as a match clause. Ranges compare the stored
+// string as a number, skipping values that do not parse.
+func (f SpecFilter) expr() bson.M {
+	path := "specifications." + f.Key
+	if len(f.Values) > 0 {
+		return bson.M{path: bson.M{"$in": f.Values}}
+	}
+	conds := bson.A{bson.M{"$isNumber": "$$v"}}
+	if f.Min != nil {
+		conds = append(conds, bson.M{"$gte": bson.A{"$$v", *f.Min}})
+	}
+	if f.Max != nil {
+		conds = append(conds, bson.M{"$lte": bson.A{"$$v", *f.Max}})
+	}
+	return bson.M{"$expr": bson.M{"$let": bson.M{
+		"vars": bson.M{"v": bson.M{"$convert": bson.M{
+			"input": "$" + path, "to": "double", "onError": nil, "onNull": nil,
+		}}},
+		"in": bson.M{"$and": conds},
+	}}}
+}
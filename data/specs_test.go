@@ -0,0 +1,99 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNormalizeSpecifications(t *testing.T) {
+	course := &Product{Category: CategoryCourse, Specifications: map[string]string{
+		"duration":    " 90 ",
+		"level":       "Beginner",
+		"certificate": "TRUE",
+		"lessons":     "",
+	}}
+	require.NoError(t, course.NormalizeSpecifications())
+	assert.Equal(t, map[string]string{"duration": "90", "level": "beginner", "certificate": "true"}, course.Specifications,
+		"values are canonical and empty optional keys dropped")
+
+	template := &Product{Category: CategoryTemplate, Specifications: map[string]string{
+		"pages":  "0",
+		"css":    "less",
+		"colour": "blue",
+	}}
+	err := template.NormalizeSpecifications()
+	var serrs SpecErrors
+	require.ErrorAs(t, err, &serrs)
+	assert.Equal(t, SpecErrors{
+		"framework": "required",
+		"pages":     "min=1",
+		"css":       "oneof=css tailwind bootstrap sass css-in-js other",
+		"colour":    "unknown",
+	}, serrs)
+
+	_, err = normalizeSpecifications(CategoryCourse, map[string]string{"duration": "1.5", "level": "advanced"}, true)
+	require.ErrorAs(t, err, &serrs)
+	assert.Equal(t, SpecErrors{"duration": "integer"}, serrs)
+
+	bundle := &Product{Category: CategoryTemplate, Type: ProductTypeBundle, Specifications: map[string]string{"css": "Tailwind"}}
+	require.NoError(t, bundle.NormalizeSpecifications(), "bundles need not carry required keys")
+	assert.Equal(t, map[string]string{"css": "tailwind"}, bundle.Specifications)
+
+	assert.Error(t, (&Product{Category: "poster"}).NormalizeSpecifications())
+}
+
+func TestEverySpecSchemaIsWellFormed(t *testing.T) {
+	for _, category := range []ProductCategory{CategoryTemplate, CategoryPlugin, CategoryAsset, CategoryCourse, CategoryGuide, CategorySource} {
+		schema, ok := SpecSchemas[category]
+		require.True(t, ok, "missing schema for %s", category)
+		assert.Equal(t, category, schema.Category)
+		seen := map[string]bool{}
+		for _, field := range schema.Fields {
+			assert.False(t, seen[field.Key], "%s.%s is defined twice", category, field.Key)
+			seen[field.Key] = true
+			assert.Equal(t, field.Type == SpecEnum, len(field.Values) > 0, "%s.%s", category, field.Key)
+		}
+	}
+}
+
+func TestParseSpecFilter(t *testing.T) {
+	schema := SpecSchemas[CategoryCourse]
+	duration, _ := schema.Field("duration")
+	level, _ := schema.Field("level")
+
+	f, err := ParseSpecFilter(level, "Beginner, advanced")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"beginner", "advanced"}, f.Values)
+	assert.Equal(t, bson.M{"specifications.level": bson.M{"$in": []string{"beginner", "advanced"}}}, f.expr())
+
+	f, err = ParseSpecFilter(duration, "..120")
+	require.NoError(t, err)
+	assert.Nil(t, f.Min)
+	require.NotNil(t, f.Max)
+	assert.Equal(t, 120.0, *f.Max)
+	assert.Contains(t, f.expr(), "$expr", "ranges compare stored strings as numbers")
+
+	for _, raw := range []string{"expert", "", " , "} {
+		_, err := ParseSpecFilter(level, raw)
+		assert.Error(t, err, raw)
+	}
+	for _, raw := range []string{"..", "a..b", "1.5"} {
+		_, err := ParseSpecFilter(duration, raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestCategoryFilterIncludesSpecs(t *testing.T) {
+	q := ProductQuery{
+		Categories: []ProductCategory{CategoryCourse},
+		Specs:      []SpecFilter{{Key: "level", Values: []string{"beginner"}}},
+	}
+	assert.Equal(t, bson.M{
+		"category": bson.M{"$in": []ProductCategory{CategoryCourse}},
+		"$and":     bson.A{bson.M{"specifications.level": bson.M{"$in": []string{"beginner"}}}},
+	}, q.categoryFilter())
+	assert.NotContains(t, q.baseFilter(), "$and", "the category facet ignores specification filters")
+}
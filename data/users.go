@@ -0,0 +1,153 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+// CachedUser is the view of a User that is kept in Redis. It deliberately
+// leaves out the password hash, credits and notifications, so it must never
+// be used to authenticate a user or to make balance decisions.
+type CachedUser struct {
+	ID        primitive.ObjectID `json:"id"`
+	Username  string             `json:"username"`
+	Email     string             `json:"email"`
+	Role      UserRole           `json:"role"`
+	Status    UserStatus         `json:"status"`
+	Profile   UserProfile        `json:"profile"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+func NewCachedUser(u *User) *CachedUser {
+	return &CachedUser{
+		ID:        u.ID,
+		Username:  u.Username,
+		Email:     u.Email,
+		Role:      u.Role,
+		Status:    u.Status,
+		Profile:   u.Profile,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
+
+// cachedUserProjection loads only the fields CachedUser needs
+var cachedUserProjection = bson.M{
+	"username":   1,
+	"email":      1,
+	"role":       1,
+	"status":     1,
+	"profile":    1,
+	"created_at": 1,
+	"updated_at": 1,
+}
+
+// UserRepository is the single entry point for reading and mutating users.
+// Reads go through the tiered cache, and every mutation invalidates it.
+type UserRepository struct {
+	mongo *MongoDB
+	cache *TieredCache
+}
+
+func NewUserRepository(mongo *MongoDB, cache *TieredCache) *UserRepository {
+	return &UserRepository{
+		mongo: mongo,
+		cache: cache,
+	}
+}
+
+// Get returns the cached view of a user, loading it from Mongo on a miss
+func (r *UserRepository) Get(ctx context.Context, id primitive.ObjectID) (*CachedUser, error) {
+	var user CachedUser
+	err := r.cache.Fetch(ctx, CacheNamespaceUsers, id.Hex(), &user, func(ctx context.Context) (interface{}, error) {
+		var u User
+		err := r.mongo.Users().FindOne(ctx, bson.M{"_id": id},
+			options.FindOne().SetProjection(cachedUserProjection)).Decode(&u)
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return NewCachedUser(&u), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// FindByEmail loads the full user document, including the password hash,
+// straight from Mongo. This is the only lookup suitable for authentication.
+func (r *UserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	var user User
+	err := r.mongo.Users().FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Create inserts a new user. The cache is filled on first read.
+func (r *UserRepository) Create(ctx context.Context, user *User) error {
+	_, err := r.mongo.Users().InsertOne(ctx, user)
+	return err
+}
+
+// Update applies a $set to the user, maintains UpdatedAt and invalidates the
+// cached copy.
+func (r *UserRepository) Update(ctx context.Context, id primitive.ObjectID, set bson.M) error {
+	fields := bson.M{"updated_at": time.Now()}
+	for k, v := range set {
+		fields[k] = v
+	}
+	return r.UpdateRaw(ctx, id, bson.M{"$set": fields})
+}
+
+// UpdateRaw applies an arbitrary update document to the user and invalidates
+// the cached copy. Callers are responsible for maintaining UpdatedAt.
+func (r *UserRepository) UpdateRaw(ctx context.Context, id primitive.ObjectID, update interface{}) error {
+	res, err := r.mongo.Users().UpdateByID(ctx, id, update)
+	if err != nil {
+		return err
+	}
+	r.Invalidate(ctx, id)
+	if res.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Delete removes the user and its cached copy
+func (r *UserRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.mongo.Users().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	r.Invalidate(ctx, id)
+	if res.DeletedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Invalidate drops the cached copy of a user on every instance. It must be
+// called after any write to the users collection that bypasses the repository.
+func (r *UserRepository) Invalidate(ctx context.Context, id primitive.ObjectID) {
+	if err := r.cache.Invalidate(ctx, CacheNamespaceUsers, id.Hex()); err != nil {
+		log.Printf("Failed to invalidate cached user %s: %v", id.Hex(), err)
+	}
+}
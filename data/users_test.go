@@ -0,0 +1,51 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUserRepositoryCache(t *testing.T) {
+	_, m := newCheckoutTestService(t)
+	ctx := context.Background()
+	cache := NewTieredCache(m.redis, 10, time.Minute)
+	users := NewUserRepository(m, cache)
+
+	id := primitive.NewObjectID()
+	require.NoError(t, users.Create(ctx, &User{ID: id, Username: "reader", Email: "reader@example.com",
+		Status: UserStatusActive, Profile: UserProfile{DisplayName: "Before"}}))
+
+	user, err := users.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "Before", user.Profile.DisplayName)
+	_, err = users.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, CacheStats{LocalHits: 1, Misses: 1}, cache.Stats(), "the second read is served from the cache")
+
+	// Writes that bypass the repository are not seen until invalidated
+	_, err = m.Users().UpdateByID(ctx, id, bson.M{"$set": bson.M{"profile.display_name": "Sideways"}})
+	require.NoError(t, err)
+	user, err = users.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "Before", user.Profile.DisplayName)
+	users.Invalidate(ctx, id)
+	user, err = users.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "Sideways", user.Profile.DisplayName)
+
+	require.NoError(t, users.Update(ctx, id, bson.M{"profile.display_name": "After"}))
+	user, err = users.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "After", user.Profile.DisplayName, "updates invalidate the cached copy")
+
+	require.NoError(t, users.Delete(ctx, id))
+	_, err = users.Get(ctx, id)
+	assert.Equal(t, ErrUserNotFound, err)
+	assert.Equal(t, ErrUserNotFound, users.Update(ctx, id, bson.M{"profile.bio": "gone"}))
+}
@@ -0,0 +1,239 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrVersionNotFound     = errors.New("version not found")
+	ErrVersionNotNewer     = errors.New("version must be greater than every existing version")
+	ErrNoPublishedVersion  = errors.New("product has no published version")
+	ErrInvalidVersionState = errors.New("invalid version status change")
+	// ErrVersionConflict is returned when the version list changed between
+	// reading it and writing to it; the caller should reload and retry.
+	ErrVersionConflict = errors.New("product versions were modified concurrently")
+)
+
+// EffectiveStatus treats versions written before statuses existed as published
+func (v *ProductVersion) EffectiveStatus() VersionStatus {
+	if v.Status == "" {
+		return VersionStatusPublished
+	}
+	return v.Status
+}
+
+// HasFile reports whether the version has an uploaded or external file
+func (v *ProductVersion) HasFile() bool {
+	return v.StorageKey != "" || v.DownloadURL != ""
+}
+
+// SemVer parses the version string. Stored versions are validated on
+// publish, so an error means the document was written by something else.
+func (v *ProductVersion) SemVer() (SemVer, error) {
+	return ParseSemVer(v.Version)
+}
+
+// SortedVersions returns the product's versions ordered newest first.
+// Versions that fail to parse sort last.
+func (p *Product) SortedVersions() []ProductVersion {
+	versions := append([]ProductVersion(nil), p.Versions...)
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, aErr := versions[i].SemVer()
+		b, bErr := versions[j].SemVer()
+		if aErr != nil || bErr != nil {
+			return aErr == nil
+		}
+		return a.Compare(b) > 0
+	})
+	return versions
+}
+
+// FindVersion returns the version whose string matches v after normalising
+// away a leading "v".
+func (p *Product) FindVersion(v string) (*ProductVersion, bool) {
+	want, err := ParseSemVer(v)
+	if err != nil {
+		return nil, false
+	}
+	for i := range p.Versions {
+		if got, err := p.Versions[i].SemVer(); err == nil && got.Compare(want) == 0 && got.Build == want.Build {
+			return &p.Versions[i], true
+		}
+	}
+	return nil, false
+}
+
+// LatestVersion resolves the version new buyers get: the highest published
+// stable release, else the highest published prerelease. Deprecated versions
+// are only considered when nothing is published, and yanked versions never.
+func (p *Product) LatestVersion() (*ProductVersion, error) {
+	sorted := p.SortedVersions()
+	pick := func(ok func(v *ProductVersion, sv SemVer) bool) *ProductVersion {
+		for i := range sorted {
+			sv, err := sorted[i].SemVer()
+			if err == nil && ok(&sorted[i], sv) {
+				return &sorted[i]
+			}
+		}
+		return nil
+	}
+
+	rules := []func(v *ProductVersion, sv SemVer) bool{
+		func(v *ProductVersion, sv SemVer) bool {
+			return v.EffectiveStatus() == VersionStatusPublished && sv.Prerelease == ""
+		},
+		func(v *ProductVersion, sv SemVer) bool {
+			return v.EffectiveStatus() == VersionStatusPublished
+		},
+		func(v *ProductVersion, sv SemVer) bool {
+			return v.EffectiveStatus() == VersionStatusDeprecated
+		},
+	}
+	for _, rule := range rules {
+		if v := pick(rule); v != nil {
+			return v, nil
+		}
+	}
+	return nil, ErrNoPublishedVersion
+}
+
+// NewPurchase starts a purchase of the product's latest version. The version
+// is recorded on the purchase so the buyer's entitlement does not move when
+// the creator publishes or yanks versions later. Bundles have no versions of
+// their own; their items' versions are recorded on the entitlements.
+func (p *Product) NewPurchase(userID primitive.ObjectID, price money.Money) (*Purchase, error) {
+	version := ""
+	if !p.IsBundle() {
+		latest, err := p.LatestVersion()
+		if err != nil {
+			return nil, err
+		}
+		version = latest.Version
+	}
+	return &Purchase{
+		ID:             primitive.NewObjectID(),
+		UserID:         userID,
+		ProductID:      p.ID,
+		ProductVersion: version,
+		Price:          price,
+		Status:         PurchaseStatusPending,
+		CreatedAt:      time.Now(),
+	}, nil
+}
+
+// canTransitionVersion reports whether a version may move between statuses.
+// Yanking is final; deprecation can be undone.
+func canTransitionVersion(from, to VersionStatus) bool {
+	switch from {
+	case VersionStatusPublished:
+		return to == VersionStatusDeprecated || to == VersionStatusYanked
+	case VersionStatusDeprecated:
+		return to == VersionStatusPublished || to == VersionStatusYanked
+	}
+	return false
+}
+
+// PublishVersion appends v to the product after checking it is a valid
+// semantic version greater than every existing one, including yanked ones.
+// The write is conditional on the version list being unchanged since
+// product was loaded.
+func (r *ProductRepository) PublishVersion(ctx context.Context, product *Product, v ProductVersion) (*ProductVersion, error) {
+	sv, err := ParseSemVer(v.Version)
+	if err != nil {
+		return nil, err
+	}
+	for i := range product.Versions {
+		existing, err := product.Versions[i].SemVer()
+		if err == nil && sv.Compare(existing) <= 0 {
+			return nil, ErrVersionNotNewer
+		}
+	}
+
+	now := time.Now()
+	v.Version = sv.String()
+	v.Status = VersionStatusPublished
+	v.StatusChangedAt = now
+	v.ReleasedAt = now
+	if v.Compatibility == nil {
+		v.Compatibility = []string{}
+	}
+
+	err = r.UpdateRaw(ctx, bson.M{
+		"_id":      product.ID,
+		"versions": bson.M{"$size": len(product.Versions)},
+	}, bson.M{
+		"$push": bson.M{"versions": v},
+		"$set":  bson.M{"updated_at": now},
+	})
+	if err == ErrProductNotFound {
+		return nil, ErrVersionConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// VersionUpdate is a partial update of a published version
+type VersionUpdate struct {
+	Status        VersionStatus
+	Reason        string
+	ReleaseNotes  *string
+	Compatibility []string
+}
+
+// UpdateVersion changes a version's status and metadata
+func (r *ProductRepository) UpdateVersion(ctx context.Context, product *Product, version string, u VersionUpdate) (*ProductVersion, error) {
+	existing, ok := product.FindVersion(version)
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+	updated := *existing
+	now := time.Now()
+
+	set := bson.M{"updated_at": now}
+	if u.Status != "" && u.Status != existing.EffectiveStatus() {
+		if !canTransitionVersion(existing.EffectiveStatus(), u.Status) {
+			return nil, ErrInvalidVersionState
+		}
+		updated.Status = u.Status
+		updated.StatusReason = u.Reason
+		updated.StatusChangedAt = now
+		set["versions.$.status"] = updated.Status
+		set["versions.$.status_reason"] = updated.StatusReason
+		set["versions.$.status_changed_at"] = now
+	}
+	if u.ReleaseNotes != nil {
+		updated.ReleaseNotes = *u.ReleaseNotes
+		set["versions.$.release_notes"] = updated.ReleaseNotes
+	}
+	if u.Compatibility != nil {
+		updated.Compatibility = u.Compatibility
+		set["versions.$.compatibility"] = updated.Compatibility
+	}
+
+	// Match on the current status too so two concurrent transitions cannot
+	// both succeed. Legacy versions have no status field at all.
+	var statusCond interface{} = existing.Status
+	if existing.Status == "" {
+		statusCond = bson.M{"$in": bson.A{nil, ""}}
+	}
+	err := r.UpdateRaw(ctx, bson.M{
+		"_id":      product.ID,
+		"versions": bson.M{"$elemMatch": bson.M{"version": existing.Version, "status": statusCond}},
+	}, bson.M{"$set": set})
+	if err == ErrProductNotFound {
+		return nil, ErrVersionConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
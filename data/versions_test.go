@@ -0,0 +1,112 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSemVerCompare(t *testing.T) {
+	// Ordered by precedence, from semver.org section 11
+	ordered := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.2.0",
+		"2.0.0",
+	}
+	for i := 0; i < len(ordered)-1; i++ {
+		a, err := ParseSemVer(ordered[i])
+		require.NoError(t, err)
+		b, err := ParseSemVer(ordered[i+1])
+		require.NoError(t, err)
+		assert.Equal(t, -1, a.Compare(b), "%s < %s", ordered[i], ordered[i+1])
+		assert.Equal(t, 1, b.Compare(a), "%s > %s", ordered[i+1], ordered[i])
+	}
+
+	a, _ := ParseSemVer("v1.0.0+build.5")
+	b, _ := ParseSemVer("1.0.0")
+	assert.Equal(t, 0, a.Compare(b))
+	assert.Equal(t, "1.0.0+build.5", a.String())
+
+	for _, invalid := range []string{"1", "1.0", "01.0.0", "1.0.0-", "1.0.0-01", "latest"} {
+		_, err := ParseSemVer(invalid)
+		assert.ErrorIs(t, err, ErrInvalidSemVer, invalid)
+	}
+}
+
+func TestLatestVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []ProductVersion
+		latest   string
+	}{
+		{
+			name: "Highest Stable Wins Over Newer Prerelease",
+			versions: []ProductVersion{
+				{Version: "1.0.0", Status: VersionStatusPublished},
+				{Version: "1.1.0", Status: VersionStatusPublished},
+				{Version: "2.0.0-beta.1", Status: VersionStatusPublished},
+			},
+			latest: "1.1.0",
+		},
+		{
+			name: "Yanked And Deprecated Are Skipped",
+			versions: []ProductVersion{
+				{Version: "1.0.0", Status: VersionStatusPublished},
+				{Version: "1.1.0", Status: VersionStatusDeprecated},
+				{Version: "1.2.0", Status: VersionStatusYanked},
+			},
+			latest: "1.0.0",
+		},
+		{
+			name: "Prerelease When No Stable Release",
+			versions: []ProductVersion{
+				{Version: "0.9.0-rc.1", Status: VersionStatusPublished},
+				{Version: "0.9.0-rc.2", Status: VersionStatusPublished},
+			},
+			latest: "0.9.0-rc.2",
+		},
+		{
+			name: "Deprecated When Nothing Else",
+			versions: []ProductVersion{
+				{Version: "1.0.0", Status: VersionStatusDeprecated},
+				{Version: "1.1.0", Status: VersionStatusYanked},
+			},
+			latest: "1.0.0",
+		},
+		{
+			name: "Legacy Versions Without Status Count As Published",
+			versions: []ProductVersion{
+				{Version: "1.0.0"},
+			},
+			latest: "1.0.0",
+		},
+		{
+			name: "Everything Yanked",
+			versions: []ProductVersion{
+				{Version: "1.0.0", Status: VersionStatusYanked},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Product{Versions: tt.versions}
+			latest, err := p.LatestVersion()
+			if tt.latest == "" {
+				assert.ErrorIs(t, err, ErrNoPublishedVersion)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.latest, latest.Version)
+		})
+	}
+}
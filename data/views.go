@@ -0,0 +1,256 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	viewsPendingKey     = "views:pending"
+	viewsFlushingPrefix = "views:flushing:"
+	viewsSeenPrefix     = "views:seen:"
+	viewsDayLayout      = "20060102"
+	// viewsStaleFlushAge is how long a claimed batch may sit before another
+	// instance assumes its flusher died and takes it over
+	viewsStaleFlushAge = 10 * time.Minute
+)
+
+// recordViewScript counts a view unless the visitor already viewed the
+// product within the dedup window.
+//
+// KEYS = seen key, pending hash
+// ARGV = dedup window (ms), pending field
+var recordViewScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], '1', 'NX', 'PX', ARGV[1]) then
+	redis.call('HINCRBY', KEYS[2], ARGV[2], 1)
+	return 1
+end
+return 0
+`)
+
+// claimViewsScript renames a batch of counts to a key owned by the caller,
+// so counting can carry on into a fresh hash while the batch is flushed.
+//
+// KEYS = batch, claimed key
+var claimViewsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('RENAME', KEYS[1], KEYS[2])
+	return 1
+end
+return 0
+`)
+
+// viewBucket is one product's views on one UTC day
+type viewBucket struct {
+	ProductID primitive.ObjectID
+	CreatorID primitive.ObjectID
+	Day       time.Time
+}
+
+func (b viewBucket) field() string {
+	return b.ProductID.Hex() + ":" + b.CreatorID.Hex() + ":" + b.Day.Format(viewsDayLayout)
+}
+
+func parseViewBucket(field string) (viewBucket, error) {
+	parts := strings.Split(field, ":")
+	if len(parts) != 3 {
+		return viewBucket{}, fmt.Errorf("malformed view bucket %q", field)
+	}
+	productID, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return viewBucket{}, fmt.Errorf("malformed view bucket %q", field)
+	}
+	creatorID, err := primitive.ObjectIDFromHex(parts[1])
+	if err != nil {
+		return viewBucket{}, fmt.Errorf("malformed view bucket %q", field)
+	}
+	day, err := time.Parse(viewsDayLayout, parts[2])
+	if err != nil {
+		return viewBucket{}, fmt.Errorf("malformed view bucket %q", field)
+	}
+	return viewBucket{ProductID: productID, CreatorID: creatorID, Day: day}, nil
+}
+
+// ViewTracker counts product detail views. Views are deduplicated and
+// counted in Redis on the request path, then flushed periodically into the
+// products' view counters and daily buckets in Mongo.
+//
+// A batch is removed from Redis only after it has been written, so a failed
+// flush is retried; an instance dying between the write and the removal
+// counts that batch twice.
+type ViewTracker struct {
+	redis       *RedisDB
+	mongo       *MongoDB
+	products    *ProductRepository
+	dedupWindow time.Duration
+	seq         atomic.Uint64
+}
+
+func NewViewTracker(redis *RedisDB, mongo *MongoDB, products *ProductRepository, dedupWindow time.Duration) *ViewTracker {
+	return &ViewTracker{
+		redis:       redis,
+		mongo:       mongo,
+		products:    products,
+		dedupWindow: dedupWindow,
+	}
+}
+
+// Record counts a view of product by visitor, an opaque stable identifier,
+// unless the same visitor viewed it within the dedup window. It reports
+// whether the view was counted.
+func (t *ViewTracker) Record(ctx context.Context, product *Product, visitor string, now time.Time) (bool, error) {
+	bucket := viewBucket{
+		ProductID: product.ID,
+		CreatorID: product.CreatorID,
+		Day:       now.UTC().Truncate(24 * time.Hour),
+	}
+	seenKey := viewsSeenPrefix + product.ID.Hex() + ":" + visitor
+	counted, err := recordViewScript.Run(ctx, t.redis.client, []string{seenKey, viewsPendingKey},
+		t.dedupWindow.Milliseconds(), bucket.field()).Int()
+	if err != nil {
+		return false, err
+	}
+	return counted == 1, nil
+}
+
+// Run flushes pending views every interval until ctx is cancelled
+func (t *ViewTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := t.Flush(ctx, time.Now()); err != nil {
+				log.Printf("Failed to flush product views: %v", err)
+			}
+		}
+	}
+}
+
+// Flush writes the views counted since the last flush to Mongo, along with
+// any batch an instance claimed but never finished. It returns the number
+// of views written.
+func (t *ViewTracker) Flush(ctx context.Context, now time.Time) (int, error) {
+	batches, err := t.claimBatches(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, key := range batches {
+		n, err := t.flushBatch(ctx, key)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (t *ViewTracker) claimKey(now time.Time) string {
+	return fmt.Sprintf("%s%d-%d", viewsFlushingPrefix, now.UnixMilli(), t.seq.Add(1))
+}
+
+// claimBatches takes ownership of the pending hash and of abandoned batches
+func (t *ViewTracker) claimBatches(ctx context.Context, now time.Time) ([]string, error) {
+	var claimed []string
+	claim := func(key string) error {
+		to := t.claimKey(now)
+		ok, err := claimViewsScript.Run(ctx, t.redis.client, []string{key, to}).Int()
+		if err != nil {
+			return err
+		}
+		if ok == 1 {
+			claimed = append(claimed, to)
+		}
+		return nil
+	}
+
+	iter := t.redis.client.Scan(ctx, 0, viewsFlushingPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		stamp, _, _ := strings.Cut(strings.TrimPrefix(key, viewsFlushingPrefix), "-")
+		ms, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil || now.Sub(time.UnixMilli(ms)) < viewsStaleFlushAge {
+			continue
+		}
+		if err := claim(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := claim(viewsPendingKey); err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (t *ViewTracker) flushBatch(ctx context.Context, key string) (int, error) {
+	counts, err := t.redis.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	productViews := map[primitive.ObjectID]int{}
+	var buckets []mongo.WriteModel
+	for field, raw := range counts {
+		bucket, err := parseViewBucket(field)
+		if err != nil {
+			log.Printf("Dropping views: %v", err)
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			continue
+		}
+		total += n
+		productViews[bucket.ProductID] += n
+		buckets = append(buckets, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"product_id": bucket.ProductID, "date": bucket.Day}).
+			SetUpdate(bson.M{
+				"$inc":         bson.M{"views": n},
+				"$setOnInsert": bson.M{"creator_id": bucket.CreatorID},
+			}).
+			SetUpsert(true))
+	}
+
+	if len(buckets) > 0 {
+		if _, err := t.mongo.ProductViews().BulkWrite(ctx, buckets, options.BulkWrite().SetOrdered(false)); err != nil {
+			return 0, err
+		}
+		var counters []mongo.WriteModel
+		for id, n := range productViews {
+			counters = append(counters, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": id}).
+				SetUpdate(bson.M{"$inc": bson.M{"view_count": n}}))
+		}
+		if _, err := t.mongo.Products().BulkWrite(ctx, counters, options.BulkWrite().SetOrdered(false)); err != nil {
+			return 0, err
+		}
+		for id := range productViews {
+			t.products.Invalidate(ctx, id)
+		}
+	}
+
+	if err := t.redis.client.Del(ctx, key).Err(); err != nil {
+		return total, err
+	}
+	return total, nil
+}
@@ -0,0 +1,84 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestViewTrackerRecordDeduplicates(t *testing.T) {
+	mr := miniredis.RunT(t)
+	tracker := NewViewTracker(newTestRedis(t, mr), nil, nil, 30*time.Minute)
+	ctx := context.Background()
+	product := &Product{ID: primitive.NewObjectID(), CreatorID: primitive.NewObjectID()}
+	now := time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC)
+
+	counted, err := tracker.Record(ctx, product, "a:visitor", now)
+	require.NoError(t, err)
+	assert.True(t, counted)
+	counted, err = tracker.Record(ctx, product, "a:visitor", now)
+	require.NoError(t, err)
+	assert.False(t, counted, "repeat views within the window are ignored")
+	counted, err = tracker.Record(ctx, product, "u:someone", now)
+	require.NoError(t, err)
+	assert.True(t, counted)
+
+	mr.FastForward(31 * time.Minute)
+	counted, err = tracker.Record(ctx, product, "a:visitor", now.Add(31*time.Minute))
+	require.NoError(t, err)
+	assert.True(t, counted, "the window has passed")
+
+	pending, err := mr.HKeys(viewsPendingKey)
+	require.NoError(t, err)
+	require.Len(t, pending, 2, "views are bucketed by UTC day")
+	bucket, err := parseViewBucket(pending[0])
+	require.NoError(t, err)
+	assert.Equal(t, product.ID, bucket.ProductID)
+	assert.Equal(t, product.CreatorID, bucket.CreatorID)
+	assert.Equal(t, "2", mr.HGet(viewsPendingKey, viewBucket{product.ID, product.CreatorID, now.Truncate(24 * time.Hour)}.field()))
+}
+
+func TestViewTrackerClaimBatches(t *testing.T) {
+	mr := miniredis.RunT(t)
+	tracker := NewViewTracker(newTestRedis(t, mr), nil, nil, time.Minute)
+	ctx := context.Background()
+	now := time.Now()
+
+	claimed, err := tracker.claimBatches(ctx, now)
+	require.NoError(t, err)
+	assert.Empty(t, claimed, "nothing pending")
+
+	mr.HSet(viewsPendingKey, "field", "3")
+	abandoned := tracker.claimKey(now.Add(-time.Hour))
+	mr.HSet(abandoned, "field", "1")
+	inFlight := tracker.claimKey(now.Add(-time.Minute))
+	mr.HSet(inFlight, "field", "1")
+
+	claimed, err = tracker.claimBatches(ctx, now)
+	require.NoError(t, err)
+	assert.Len(t, claimed, 2, "the pending hash and the abandoned batch")
+	assert.False(t, mr.Exists(viewsPendingKey))
+	assert.False(t, mr.Exists(abandoned))
+	assert.True(t, mr.Exists(inFlight), "a batch another instance is flushing is left alone")
+	for _, key := range claimed {
+		assert.True(t, mr.Exists(key))
+	}
+}
+
+func TestParseViewBucketRejectsMalformedFields(t *testing.T) {
+	for _, field := range []string{"", "a:b:c", primitive.NewObjectID().Hex() + ":x:20240501", "x:y"} {
+		_, err := parseViewBucket(field)
+		assert.Error(t, err, field)
+	}
+}
+
+func TestConversionRate(t *testing.T) {
+	assert.Equal(t, 0.0, ConversionRate(3, 0))
+	assert.Equal(t, 2.5, ConversionRate(5, 200))
+	assert.Equal(t, 33.33, ConversionRate(1, 3))
+}
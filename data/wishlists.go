@@ -0,0 +1,247 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MaxWishlistItems caps how many products one user can save
+const MaxWishlistItems = 500
+
+// wishlistBatchSize is how many wishlisted products the watcher loads at once
+const wishlistBatchSize = 200
+
+var (
+	ErrWishlistItemNotFound = errors.New("product is not on the wishlist")
+	ErrWishlistFull         = fmt.Errorf("wishlists are limited to %d products", MaxWishlistItems)
+)
+
+// PublishedVersion is the version string buyers currently get, or "" when
+// nothing is published
+func (p *Product) PublishedVersion() string {
+	v, err := p.LatestVersion()
+	if err != nil || v.EffectiveStatus() != VersionStatusPublished {
+		return ""
+	}
+	return v.Version
+}
+
+// Alerts reports what changed since the user was last told about the
+// product: whether its price dropped and whether a newer version is out.
+// A higher price or a withdrawn version is not worth an alert.
+func (item *WishlistItem) Alerts(price money.Money, version string) (priceDropped, newVersion bool) {
+	priceDropped = price.SameCurrency(item.Price) && price.Cmp(item.Price) < 0
+	if version == "" || version == item.Version {
+		return priceDropped, false
+	}
+	if item.Version == "" {
+		return priceDropped, true
+	}
+	latest, err := ParseSemVer(version)
+	if err != nil {
+		return priceDropped, false
+	}
+	seen, err := ParseSemVer(item.Version)
+	return priceDropped, err != nil || latest.Compare(seen) > 0
+}
+
+type WishlistRepository struct {
+	mongo *MongoDB
+}
+
+func NewWishlistRepository(mongo *MongoDB) *WishlistRepository {
+	return &WishlistRepository{mongo: mongo}
+}
+
+// Add saves product to the user's wishlist, remembering its current price
+// and version. Adding a product twice returns the existing item and false.
+func (r *WishlistRepository) Add(ctx context.Context, userID primitive.ObjectID, product *Product) (*WishlistItem, bool, error) {
+	existing, err := r.find(ctx, userID, product.ID)
+	if err == nil {
+		return existing, false, nil
+	}
+	if err != ErrWishlistItemNotFound {
+		return nil, false, err
+	}
+
+	n, err := r.mongo.Wishlists().CountDocuments(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, false, err
+	}
+	if n >= MaxWishlistItems {
+		return nil, false, ErrWishlistFull
+	}
+
+	item := &WishlistItem{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		ProductID: product.ID,
+		Price:     product.EffectivePrice(),
+		Version:   product.PublishedVersion(),
+		AddedAt:   time.Now(),
+	}
+	_, err = r.mongo.Wishlists().InsertOne(ctx, item)
+	if mongo.IsDuplicateKeyError(err) {
+		// Added concurrently
+		existing, err := r.find(ctx, userID, product.ID)
+		return existing, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return item, true, nil
+}
+
+func (r *WishlistRepository) find(ctx context.Context, userID, productID primitive.ObjectID) (*WishlistItem, error) {
+	var item WishlistItem
+	err := r.mongo.Wishlists().FindOne(ctx, bson.M{"user_id": userID, "product_id": productID}).Decode(&item)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrWishlistItemNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Remove takes product off the user's wishlist
+func (r *WishlistRepository) Remove(ctx context.Context, userID, productID primitive.ObjectID) error {
+	result, err := r.mongo.Wishlists().DeleteOne(ctx, bson.M{"user_id": userID, "product_id": productID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrWishlistItemNotFound
+	}
+	return nil
+}
+
+// ListForUser returns a page of the user's wishlist
+func (r *WishlistRepository) ListForUser(ctx context.Context, userID primitive.ObjectID, page pagination.Request) ([]WishlistItem, error) {
+	return findPage[WishlistItem](ctx, r.mongo.Wishlists(), bson.M{"user_id": userID}, page)
+}
+
+// WishlistWatcher notifies users when a product on their wishlist gets
+// cheaper or publishes a new version. Each item is moved on to the product's
+// current price and version before its alert is sent, so concurrent
+// watchers never alert twice; a failed notification is not retried.
+type WishlistWatcher struct {
+	mongo         *MongoDB
+	products      *ProductRepository
+	notifications *NotificationRepository
+}
+
+func NewWishlistWatcher(mongo *MongoDB, products *ProductRepository, notifications *NotificationRepository) *WishlistWatcher {
+	return &WishlistWatcher{mongo: mongo, products: products, notifications: notifications}
+}
+
+// Run checks wishlisted products every interval until ctx is cancelled
+func (w *WishlistWatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := w.Check(ctx); err != nil {
+				log.Printf("Failed to check wishlists: %v", err)
+			}
+		}
+	}
+}
+
+// Check compares every wishlisted product on sale against what its
+// watchers last saw and returns the number of notifications sent
+func (w *WishlistWatcher) Check(ctx context.Context) (int, error) {
+	raw, err := w.mongo.Wishlists().Distinct(ctx, "product_id", bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(raw))
+	for _, v := range raw {
+		if id, ok := v.(primitive.ObjectID); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	sent := 0
+	for start := 0; start < len(ids); start += wishlistBatchSize {
+		end := min(start+wishlistBatchSize, len(ids))
+		products, err := w.products.FindMany(ctx, ids[start:end])
+		if err != nil {
+			return sent, err
+		}
+		for i := range products {
+			if products[i].Status != ProductStatusActive {
+				continue
+			}
+			n, err := w.checkProduct(ctx, &products[i])
+			sent += n
+			if err != nil {
+				return sent, err
+			}
+		}
+	}
+	return sent, nil
+}
+
+func (w *WishlistWatcher) checkProduct(ctx context.Context, product *Product) (int, error) {
+	price, version := product.EffectivePrice(), product.PublishedVersion()
+	cursor, err := w.mongo.Wishlists().Find(ctx, bson.M{
+		"product_id": product.ID,
+		"$or": bson.A{
+			bson.M{"price": bson.M{"$ne": price}},
+			bson.M{"version": bson.M{"$ne": version}},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var items []WishlistItem
+	if err := cursor.All(ctx, &items); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, item := range items {
+		priceDropped, newVersion := item.Alerts(price, version)
+		result, err := w.mongo.Wishlists().UpdateOne(ctx,
+			bson.M{"_id": item.ID, "price": item.Price, "version": item.Version},
+			bson.M{"$set": bson.M{"price": price, "version": version}})
+		if err != nil {
+			return sent, err
+		}
+		if result.ModifiedCount == 0 {
+			// Another watcher got there first, or the item was removed
+			continue
+		}
+
+		if priceDropped {
+			message := fmt.Sprintf("%q on your wishlist dropped to %s (was %s)", product.Title, price.Display(), item.Price.Display())
+			if err := w.notifications.Notify(ctx, item.UserID, NotificationPriceDrop, message, product.ID); err != nil {
+				log.Printf("Failed to notify user %s of a price drop: %v", item.UserID.Hex(), err)
+			} else {
+				sent++
+			}
+		}
+		if newVersion {
+			message := fmt.Sprintf("%q on your wishlist has a new version: %s", product.Title, version)
+			if err := w.notifications.Notify(ctx, item.UserID, NotificationNewVersion, message, product.ID); err != nil {
+				log.Printf("Failed to notify user %s of a new version: %v", item.UserID.Hex(), err)
+			} else {
+				sent++
+			}
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishedVersion(t *testing.T) {
+	p := &Product{Versions: []ProductVersion{
+		{Version: "1.0.0", Status: VersionStatusPublished},
+		{Version: "1.1.0", Status: VersionStatusYanked},
+		{Version: "2.0.0-beta.1", Status: VersionStatusPublished},
+	}}
+	assert.Equal(t, "1.0.0", p.PublishedVersion(), "stable releases win over prereleases")
+
+	p.Versions[0].Status = VersionStatusDeprecated
+	assert.Equal(t, "2.0.0-beta.1", p.PublishedVersion())
+
+	p.Versions[2].Status = VersionStatusDeprecated
+	assert.Equal(t, "", p.PublishedVersion(), "deprecated versions are not news")
+	assert.Equal(t, "", (&Product{}).PublishedVersion())
+}
+
+func TestEffectivePrice(t *testing.T) {
+	assert.Equal(t, usd(4000), (&Product{Price: usd(4000)}).EffectivePrice())
+	assert.Equal(t, usd(2500), (&Product{Price: usd(4000), DiscountedPrice: usd(2500)}).EffectivePrice())
+	assert.Equal(t, usd(4000), (&Product{Price: usd(4000), DiscountedPrice: usd(4500)}).EffectivePrice())
+}
+
+func TestWishlistItemAlerts(t *testing.T) {
+	item := &WishlistItem{Price: usd(4000), Version: "1.2.0"}
+	tests := []struct {
+		name         string
+		price        money.Money
+		version      string
+		dropped, new bool
+	}{
+		{"unchanged", usd(4000), "1.2.0", false, false},
+		{"cheaper", usd(2999), "1.2.0", true, false},
+		{"a cent cheaper", usd(3999), "1.2.0", true, false},
+		{"dearer", usd(4900), "1.2.0", false, false},
+		{"newer release", usd(4000), "1.3.0", false, true},
+		{"both", usd(3000), "2.0.0", true, true},
+		{"version withdrawn", usd(4000), "1.1.0", false, false},
+		{"nothing published", usd(4000), "", false, false},
+	}
+	for _, tt := range tests {
+		dropped, newVersion := item.Alerts(tt.price, tt.version)
+		assert.Equal(t, tt.dropped, dropped, tt.name)
+		assert.Equal(t, tt.new, newVersion, tt.name)
+	}
+
+	_, newVersion := (&WishlistItem{Price: usd(1000)}).Alerts(usd(1000), "0.1.0")
+	assert.True(t, newVersion, "a first release is news")
+}
@@ -0,0 +1,233 @@
+// Package imaging validates uploaded images and renders the resized variants
+// shown in product galleries.
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format; use JPEG, PNG, GIF or WebP")
+	ErrTooSmall          = errors.New("image is too small")
+	ErrTooLarge          = errors.New("image dimensions are too large")
+)
+
+// Output formats
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+)
+
+// jpegQuality is used for every JPEG variant
+const jpegQuality = 85
+
+// Limits bounds the dimensions of accepted images. MaxPixels guards against
+// decompression bombs whose width and height are each within bounds.
+type Limits struct {
+	MinWidth  int
+	MinHeight int
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int
+}
+
+// DefaultLimits suits gallery images
+var DefaultLimits = Limits{
+	MinWidth:  200,
+	MinHeight: 200,
+	MaxWidth:  8000,
+	MaxHeight: 8000,
+	MaxPixels: 40_000_000,
+}
+
+// Size is a variant to render. The image is scaled to fit within Width x
+// Height, keeping its aspect ratio; images are never scaled up.
+type Size struct {
+	Name   string
+	Width  int
+	Height int
+}
+
+// DefaultSizes are the variants rendered for every gallery image, besides
+// the full size original
+var DefaultSizes = []Size{
+	{Name: "thumb", Width: 160, Height: 160},
+	{Name: "small", Width: 480, Height: 480},
+	{Name: "medium", Width: 960, Height: 960},
+	{Name: "large", Width: 1920, Height: 1920},
+}
+
+// OriginalSize names the full size variant
+const OriginalSize = "original"
+
+// Info describes an image without decoding its pixels
+type Info struct {
+	Format string
+	Width  int
+	Height int
+}
+
+// Inspect reads just enough of r to learn the image's format and dimensions
+// and checks them against limits.
+func Inspect(r io.Reader, limits Limits) (*Info, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+	info := &Info{Format: format, Width: cfg.Width, Height: cfg.Height}
+	switch {
+	case info.Width < limits.MinWidth || info.Height < limits.MinHeight:
+		return nil, fmt.Errorf("%w: must be at least %dx%d", ErrTooSmall, limits.MinWidth, limits.MinHeight)
+	case info.Width > limits.MaxWidth || info.Height > limits.MaxHeight,
+		limits.MaxPixels > 0 && info.Width*info.Height > limits.MaxPixels:
+		return nil, fmt.Errorf("%w: must be at most %dx%d", ErrTooLarge, limits.MaxWidth, limits.MaxHeight)
+	}
+	return info, nil
+}
+
+// Decode decodes an image and applies its EXIF orientation, so the result
+// is upright. Metadata is not carried over into anything rendered from it.
+func Decode(src []byte) (image.Image, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, exifOrientation(src))
+	}
+	return img, format, nil
+}
+
+// Rendition is one encoded variant of an image
+type Rendition struct {
+	Size        string
+	Format      string
+	ContentType string
+	Width       int
+	Height      int
+	Data        []byte
+}
+
+// Extension returns the file extension for the rendition's format
+func (r *Rendition) Extension() string {
+	switch r.Format {
+	case FormatJPEG:
+		return "jpg"
+	default:
+		return r.Format
+	}
+}
+
+// Renderer renders the variants of decoded images
+type Renderer struct {
+	Sizes []Size
+	// WebP, if set, adds a WebP rendition of every variant
+	WebP WebPEncoder
+}
+
+// Render returns the full size original followed by each of r.Sizes that is
+// smaller than img. Opaque images are encoded as JPEG and the rest as PNG, in
+// addition to WebP when an encoder is configured.
+func (r *Renderer) Render(ctx context.Context, img image.Image) ([]Rendition, error) {
+	bounds := img.Bounds()
+	sizes := append([]Size{{Name: OriginalSize, Width: bounds.Dx(), Height: bounds.Dy()}}, r.Sizes...)
+
+	var renditions []Rendition
+	for i, size := range sizes {
+		w, h := fit(bounds.Dx(), bounds.Dy(), size.Width, size.Height)
+		if i > 0 && w == bounds.Dx() && h == bounds.Dy() {
+			// Smaller than the box already; the original covers it
+			continue
+		}
+		scaled := scale(img, w, h)
+
+		out, err := encode(scaled)
+		if err != nil {
+			return nil, err
+		}
+		out.Size = size.Name
+		renditions = append(renditions, *out)
+
+		if r.WebP != nil {
+			data, err := r.WebP.EncodeWebP(ctx, scaled)
+			if err != nil {
+				return nil, fmt.Errorf("encoding %s as webp: %w", size.Name, err)
+			}
+			renditions = append(renditions, Rendition{
+				Size:        size.Name,
+				Format:      FormatWebP,
+				ContentType: "image/webp",
+				Width:       w,
+				Height:      h,
+				Data:        data,
+			})
+		}
+	}
+	return renditions, nil
+}
+
+// fit scales w x h down to fit within maxW x maxH, keeping the aspect ratio
+func fit(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	if w*maxH > h*maxW {
+		return maxW, max(1, h*maxW/w)
+	}
+	return max(1, w*maxH/h), maxH
+}
+
+// scale resamples img to w x h. The result is always a fresh image, which
+// also normalises paletted and YCbCr sources for encoding.
+func scale(img image.Image, w, h int) draw.Image {
+	var dst draw.Image
+	if isOpaque(img) {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	} else {
+		dst = image.NewNRGBA(image.Rect(0, 0, w, h))
+	}
+	if w == img.Bounds().Dx() && h == img.Bounds().Dy() {
+		draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+		return dst
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+func encode(img image.Image) (*Rendition, error) {
+	var buf bytes.Buffer
+	b := img.Bounds()
+	out := &Rendition{Width: b.Dx(), Height: b.Dy()}
+	if isOpaque(img) {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		out.Format, out.ContentType = FormatJPEG, "image/jpeg"
+	} else {
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		out.Format, out.ContentType = FormatPNG, "image/png"
+	}
+	out.Data = buf.Bytes()
+	return out, nil
+}
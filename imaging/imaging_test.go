@@ -0,0 +1,153 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func solid(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// jpegWithOrientation encodes img as a JPEG carrying a little-endian EXIF
+// segment with the given orientation
+func jpegWithOrientation(t *testing.T, img image.Image, orientation uint16) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}))
+	plain := buf.Bytes()
+
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1) // one IFD entry
+	tiff = binary.LittleEndian.AppendUint16(tiff, exifTagOrient)
+	tiff = binary.LittleEndian.AppendUint16(tiff, exifTypeShort)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0) // value padding, next IFD
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	out := []byte{0xFF, jpegMarkerSOI, 0xFF, jpegMarkerAPP1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, plain[2:]...)
+}
+
+func TestInspect(t *testing.T) {
+	info, err := Inspect(bytes.NewReader(encodePNG(t, solid(400, 300, color.White))), DefaultLimits)
+	require.NoError(t, err)
+	assert.Equal(t, &Info{Format: "png", Width: 400, Height: 300}, info)
+
+	_, err = Inspect(bytes.NewReader(encodePNG(t, solid(100, 300, color.White))), DefaultLimits)
+	assert.ErrorIs(t, err, ErrTooSmall)
+
+	limits := DefaultLimits
+	limits.MaxPixels = 100_000
+	_, err = Inspect(bytes.NewReader(encodePNG(t, solid(400, 300, color.White))), limits)
+	assert.ErrorIs(t, err, ErrTooLarge)
+
+	_, err = Inspect(strings.NewReader("just some text"), DefaultLimits)
+	assert.Equal(t, ErrUnsupportedFormat, err)
+	_, err = Inspect(strings.NewReader("%PDF-1.7"), DefaultLimits)
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
+
+func TestDecodeAppliesOrientation(t *testing.T) {
+	// A landscape image whose left half is red, stored rotated as cameras do
+	src := solid(40, 20, color.RGBA{B: 255, A: 255})
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			src.Set(x, y, color.RGBA{R: 255, A: 255})
+		}
+	}
+	data := jpegWithOrientation(t, src, 6)
+	assert.Equal(t, 6, exifOrientation(data))
+
+	img, format, err := Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, image.Rect(0, 0, 20, 40), img.Bounds(), "rotating 90° swaps the axes")
+	r, _, b, _ := img.At(10, 5).RGBA()
+	assert.Greater(t, r, b, "the left half ends up on top")
+
+	renditions, err := (&Renderer{}).Render(context.Background(), img)
+	require.NoError(t, err)
+	require.Len(t, renditions, 1)
+	assert.NotContains(t, string(renditions[0].Data), "Exif", "metadata is stripped")
+	assert.Equal(t, 1, exifOrientation(renditions[0].Data))
+}
+
+func TestExifOrientationIgnoresMalformedData(t *testing.T) {
+	assert.Equal(t, 1, exifOrientation(nil))
+	assert.Equal(t, 1, exifOrientation([]byte{0xFF, jpegMarkerSOI, 0xFF, jpegMarkerAPP1, 0xFF, 0xFF}))
+	assert.Equal(t, 1, exifOrientation(encodePNG(t, solid(4, 4, color.White))))
+	assert.Equal(t, 1, tiffOrientation([]byte("II*\x00\xFF\xFF\x00\x00")))
+}
+
+type fakeWebP struct {
+	calls int
+}
+
+func (f *fakeWebP) EncodeWebP(ctx context.Context, img image.Image) ([]byte, error) {
+	f.calls++
+	return []byte("RIFF....WEBP"), nil
+}
+
+func TestRender(t *testing.T) {
+	webp := &fakeWebP{}
+	r := &Renderer{Sizes: DefaultSizes, WebP: webp}
+
+	renditions, err := r.Render(context.Background(), solid(2000, 1000, color.White))
+	require.NoError(t, err)
+	type dims struct {
+		size, format string
+		w, h         int
+	}
+	var got []dims
+	for _, rd := range renditions {
+		got = append(got, dims{rd.Size, rd.Format, rd.Width, rd.Height})
+	}
+	assert.Equal(t, []dims{
+		{"original", FormatJPEG, 2000, 1000}, {"original", FormatWebP, 2000, 1000},
+		{"thumb", FormatJPEG, 160, 80}, {"thumb", FormatWebP, 160, 80},
+		{"small", FormatJPEG, 480, 240}, {"small", FormatWebP, 480, 240},
+		{"medium", FormatJPEG, 960, 480}, {"medium", FormatWebP, 960, 480},
+		{"large", FormatJPEG, 1920, 960}, {"large", FormatWebP, 1920, 960},
+	}, got)
+	assert.Equal(t, 5, webp.calls)
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(renditions[2].Data))
+	require.NoError(t, err)
+	assert.Equal(t, 160, cfg.Width)
+
+	// Small images are never scaled up, and transparency is kept
+	transparent := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	renditions, err = (&Renderer{Sizes: DefaultSizes}).Render(context.Background(), transparent)
+	require.NoError(t, err)
+	require.Len(t, renditions, 2)
+	assert.Equal(t, "original", renditions[0].Size)
+	assert.Equal(t, FormatPNG, renditions[0].Format)
+	assert.Equal(t, "png", renditions[0].Extension())
+	assert.Equal(t, "thumb", renditions[1].Size)
+	assert.Equal(t, 160, renditions[1].Width)
+}
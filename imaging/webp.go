@@ -0,0 +1,62 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// WebPEncoder encodes images as WebP. The standard library and x/image only
+// decode WebP, so encoding is delegated to an implementation of this.
+type WebPEncoder interface {
+	EncodeWebP(ctx context.Context, img image.Image) ([]byte, error)
+}
+
+// CWebP encodes with the cwebp command line tool from libwebp
+type CWebP struct {
+	Path    string
+	Quality int
+}
+
+// LookupCWebP returns a CWebP encoder for the named binary, or nil if it
+// cannot be found, in which case WebP variants are skipped
+func LookupCWebP(name string) *CWebP {
+	if name == "" {
+		name = "cwebp"
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil
+	}
+	return &CWebP{Path: path, Quality: 80}
+}
+
+func (e *CWebP) EncodeWebP(ctx context.Context, img image.Image) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "cwebp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.webp")
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(in, buf.Bytes(), 0o600); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, e.Path, "-quiet", "-metadata", "none",
+		"-q", strconv.Itoa(e.Quality), in, "-o", out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("cwebp: %v: %s", err, bytes.TrimSpace(output))
+	}
+	return os.ReadFile(out)
+}
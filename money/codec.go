@@ -0,0 +1,100 @@
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// stored is how Money is kept in MongoDB
+type stored struct {
+	Amount   int64  `bson:"amount"`
+	Currency string `bson:"currency"`
+}
+
+// MarshalBSONValue stores m as {amount, currency}, so queries and indexes
+// can use "<field>.amount"
+func (m Money) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(stored{Amount: m.Amount, Currency: m.Code()})
+}
+
+// UnmarshalBSONValue reads {amount, currency}, or a plain number of major
+// units of DefaultCurrency as amounts were stored before
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	v := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bsontype.EmbeddedDocument:
+		var s stored
+		if err := bson.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*m = New(s.Amount, s.Currency)
+	case bsontype.Double:
+		*m = FromMajor(v.Double(), DefaultCurrency)
+	case bsontype.Int32:
+		*m = New(int64(v.Int32())*pow10(Exponent(DefaultCurrency)), DefaultCurrency)
+	case bsontype.Int64:
+		*m = New(v.Int64()*pow10(Exponent(DefaultCurrency)), DefaultCurrency)
+	case bsontype.Decimal128:
+		parsed, err := Parse(v.Decimal128().String(), DefaultCurrency)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+	case bsontype.Null, bsontype.Undefined:
+		*m = Money{}
+	default:
+		return fmt.Errorf("money: cannot decode BSON %s", t)
+	}
+	return nil
+}
+
+// jsonMoney is how Money is written to clients. The amount is a decimal
+// string so it survives JSON parsers that read numbers as floats.
+type jsonMoney struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMoney{Amount: m.String(), Currency: m.Code()})
+}
+
+// UnmarshalJSON reads {"amount": "19.99", "currency": "EUR"}, where amount
+// may also be a number, or a bare number or string of DefaultCurrency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	raw, currency := data, DefaultCurrency
+	if bytes.HasPrefix(data, []byte("{")) {
+		var obj struct {
+			Amount   json.RawMessage `json:"amount"`
+			Currency string          `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		raw, currency = bytes.TrimSpace(obj.Amount), obj.Currency
+	}
+
+	var s string
+	if bytes.HasPrefix(raw, []byte(`"`)) {
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return err
+		}
+	} else {
+		s = string(raw)
+	}
+	parsed, err := Parse(s, currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
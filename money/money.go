@@ -0,0 +1,273 @@
+// Package money represents amounts of money exactly, as a whole number of a
+// currency's minor units such as cents.
+//
+// Arithmetic never goes through floating point. Multiplying by a rate or a
+// ratio rounds half to even once, at the end, so repeated commission splits
+// do not drift in either party's favour. In MongoDB an amount is stored as
+// {amount: <minor units>, currency: <code>}; plain numbers written before
+// this type existed still decode, as major units of DefaultCurrency.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of amounts that do not name one
+const DefaultCurrency = "USD"
+
+var (
+	ErrInvalidAmount    = errors.New("invalid amount")
+	ErrTooPrecise       = errors.New("amount has more decimal places than its currency")
+	ErrCurrencyMismatch = errors.New("amounts are in different currencies")
+)
+
+// exponents lists currencies whose minor unit is not a hundredth
+var exponents = map[string]int{
+	"JPY": 0, "KRW": 0, "VND": 0, "CLP": 0, "ISK": 0,
+	"BHD": 3, "JOD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+// Exponent returns how many decimal places currency has
+func Exponent(currency string) int {
+	if exp, ok := exponents[normalize(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+func normalize(currency string) string {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" {
+		return DefaultCurrency
+	}
+	return currency
+}
+
+func pow10(exp int) int64 {
+	n := int64(1)
+	for i := 0; i < exp; i++ {
+		n *= 10
+	}
+	return n
+}
+
+// Money is an amount in a currency's minor units. The zero value is zero
+// in DefaultCurrency.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// New returns amount minor units of currency
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: normalize(currency)}
+}
+
+// Zero returns nothing in currency
+func Zero(currency string) Money {
+	return New(0, currency)
+}
+
+// FromMajor converts a floating point amount of major units, rounding to the
+// nearest minor unit. It exists for values that were stored as floats and
+// must not be used for arithmetic.
+func FromMajor(v float64, currency string) Money {
+	return New(int64(math.Round(v*float64(pow10(Exponent(currency))))), currency)
+}
+
+// Parse reads a decimal amount of major units such as "19.99" or "-5".
+// More decimal places than the currency has are refused rather than
+// rounded.
+func Parse(s, currency string) (Money, error) {
+	currency = normalize(currency)
+	exp := Exponent(currency)
+
+	s = strings.TrimSpace(s)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" || !digits(whole) || !digits(frac) {
+		return Money{}, ErrInvalidAmount
+	}
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > exp {
+		return Money{}, ErrTooPrecise
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	amount, err := strconv.ParseInt(whole+frac, 10, 64)
+	if whole+frac == "" {
+		amount, err = 0, nil
+	}
+	if err != nil {
+		return Money{}, ErrInvalidAmount
+	}
+	if neg {
+		amount = -amount
+	}
+	return New(amount, currency), nil
+}
+
+func digits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Code returns the money's currency, DefaultCurrency for the zero value
+func (m Money) Code() string {
+	return normalize(m.Currency)
+}
+
+// String formats the amount in major units without a currency, e.g. "19.99"
+func (m Money) String() string {
+	exp := Exponent(m.Currency)
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	unit := pow10(exp)
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, exp, amount%unit)
+}
+
+// Display formats the amount with its currency, e.g. "19.99 USD"
+func (m Money) Display() string {
+	return m.String() + " " + m.Code()
+}
+
+// Major returns the amount in major units as a float, for display and
+// ratios only
+func (m Money) Major() float64 {
+	return float64(m.Amount) / float64(pow10(Exponent(m.Currency)))
+}
+
+func (m Money) IsZero() bool     { return m.Amount == 0 }
+func (m Money) IsNegative() bool { return m.Amount < 0 }
+func (m Money) IsPositive() bool { return m.Amount > 0 }
+
+// SameCurrency reports whether m and o can be added or compared
+func (m Money) SameCurrency(o Money) bool {
+	return m.Code() == o.Code()
+}
+
+func (m Money) mustMatch(o Money) {
+	if !m.SameCurrency(o) {
+		panic(fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Code(), o.Code()))
+	}
+}
+
+// Add returns m+o. Adding amounts in different currencies is a programming
+// error and panics; callers check SameCurrency on untrusted input.
+func (m Money) Add(o Money) Money {
+	m.mustMatch(o)
+	return New(m.Amount+o.Amount, m.Currency)
+}
+
+// Sub returns m-o. It panics like Add on mixed currencies.
+func (m Money) Sub(o Money) Money {
+	m.mustMatch(o)
+	return New(m.Amount-o.Amount, m.Currency)
+}
+
+// Neg returns -m
+func (m Money) Neg() Money {
+	return New(-m.Amount, m.Currency)
+}
+
+// Cmp returns -1, 0 or 1 as m is less than, equal to or greater than o. It
+// panics like Add on mixed currencies.
+func (m Money) Cmp(o Money) int {
+	m.mustMatch(o)
+	switch {
+	case m.Amount < o.Amount:
+		return -1
+	case m.Amount > o.Amount:
+		return 1
+	}
+	return 0
+}
+
+// Min returns the smaller of a and b
+func Min(a, b Money) Money {
+	if a.Cmp(b) <= 0 {
+		return a
+	}
+	return b
+}
+
+// Max returns the larger of a and b
+func Max(a, b Money) Money {
+	if a.Cmp(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+// Scale returns m*num/den rounded half to even. den must be positive.
+func (m Money) Scale(num, den int64) Money {
+	if den <= 0 {
+		panic("money: non-positive denominator")
+	}
+	r := new(big.Rat).SetFrac(big.NewInt(num), big.NewInt(den))
+	return New(roundHalfEven(r.Mul(r, new(big.Rat).SetInt64(m.Amount))), m.Currency)
+}
+
+// roundHalfEven rounds r to the nearest integer, ties to even
+func roundHalfEven(r *big.Rat) int64 {
+	n, d := r.Num(), r.Denom()
+	q, rem := new(big.Int).QuoRem(n, d, new(big.Int))
+
+	// Compare twice the remainder with the denominator to round
+	twice := new(big.Int).Abs(rem)
+	twice.Lsh(twice, 1)
+	switch c := twice.Cmp(d); {
+	case c > 0, c == 0 && q.Bit(0) == 1:
+		if n.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64()
+}
+
+// Convert returns m in currency at rate, the number of major units of
+// currency one major unit of m buys, rounded half to even to currency's
+// minor unit
+func (m Money) Convert(currency string, rate float64) Money {
+	r := new(big.Rat).SetFloat64(rate)
+	if r == nil || rate <= 0 {
+		panic(fmt.Sprintf("money: invalid exchange rate %v", rate))
+	}
+	r.Mul(r, new(big.Rat).SetInt64(m.Amount))
+	r.Mul(r, new(big.Rat).SetFrac(big.NewInt(pow10(Exponent(currency))), big.NewInt(pow10(Exponent(m.Currency)))))
+	return New(roundHalfEven(r), currency)
+}
+
+// ppm is the resolution rates are applied at: parts per million
+const ppm = 1_000_000
+
+// Mul returns m multiplied by rate, with the rate taken to six decimal
+// places and the result rounded half to even
+func (m Money) Mul(rate float64) Money {
+	return m.Scale(int64(math.Round(rate*ppm)), ppm)
+}
+
+// Split divides m into the share a rate of it makes, such as a commission,
+// and the rest. The rate is clamped to [0, 1] and the share is rounded half
+// to even; the rest is exact, so share and rest always add up to m.
+func (m Money) Split(rate float64) (share, rest Money) {
+	share = m.Mul(math.Min(math.Max(rate, 0), 1))
+	return share, m.Sub(share)
+}
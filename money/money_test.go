@@ -0,0 +1,166 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		want     Money
+		err      error
+	}{
+		{"19.99", "", New(1999, "USD"), nil},
+		{"19.9", "eur", New(1990, "EUR"), nil},
+		{"-5", "USD", New(-500, "USD"), nil},
+		{".5", "USD", New(50, "USD"), nil},
+		{"20.000", "USD", New(2000, "USD"), nil},
+		{"1500", "JPY", New(1500, "JPY"), nil},
+		{"1.234", "KWD", New(1234, "KWD"), nil},
+		{"19.999", "USD", Money{}, ErrTooPrecise},
+		{"1.5", "JPY", Money{}, ErrTooPrecise},
+		{"1e3", "USD", Money{}, ErrInvalidAmount},
+		{".", "USD", Money{}, ErrInvalidAmount},
+		{"", "USD", Money{}, ErrInvalidAmount},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in, tt.currency)
+		assert.Equal(t, tt.err, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, "19.99", New(1999, "USD").String())
+	assert.Equal(t, "-0.05", New(-5, "USD").String())
+	assert.Equal(t, "1500", New(1500, "JPY").String())
+	assert.Equal(t, "1.005", New(1005, "BHD").String())
+	assert.Equal(t, "0.00", Money{}.String())
+}
+
+func TestArithmetic(t *testing.T) {
+	a, b := New(1999, "USD"), New(500, "USD")
+	assert.Equal(t, New(2499, "USD"), a.Add(b))
+	assert.Equal(t, New(1499, "USD"), a.Sub(b))
+	assert.Equal(t, 1, a.Cmp(b))
+	assert.Equal(t, b, Min(a, b))
+	assert.Equal(t, New(500, "USD"), Money{}.Add(b), "the zero value is in the default currency")
+	assert.Panics(t, func() { a.Add(New(100, "EUR")) })
+}
+
+func TestScaleRoundsHalfToEven(t *testing.T) {
+	tests := []struct {
+		amount, num, den int64
+		want             int64
+	}{
+		{1, 1, 2, 0},
+		{3, 1, 2, 2},
+		{5, 1, 2, 2},
+		{-3, 1, 2, -2},
+		{1000, 1, 3, 333},
+		{2000, 1, 3, 667},
+		{1 << 40, 1 << 30, 1 << 30, 1 << 40},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, New(tt.amount, "USD").Scale(tt.num, tt.den).Amount,
+			"%d*%d/%d", tt.amount, tt.num, tt.den)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		amount int64
+		rate   float64
+		share  int64
+	}{
+		{2000, 0.15, 300},
+		{999, 0.15, 150},  // 149.85
+		{1010, 0.15, 152}, // 151.5 rounds to even
+		{1030, 0.15, 154}, // 154.5 rounds to even
+		{1, 0.3, 0},
+		{1000, 1.5, 1000},
+		{1000, -0.2, 0},
+	}
+	for _, tt := range tests {
+		m := New(tt.amount, "USD")
+		share, rest := m.Split(tt.rate)
+		assert.Equal(t, tt.share, share.Amount, "%d at %v", tt.amount, tt.rate)
+		assert.Equal(t, m, share.Add(rest), "share and rest add up")
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		from Money
+		to   string
+		rate float64
+		want Money
+	}{
+		{New(1999, "USD"), "EUR", 0.92, New(1839, "EUR")},
+		{New(1000, "USD"), "JPY", 151.37, New(1514, "JPY")},
+		{New(1514, "JPY"), "USD", 1 / 151.37, New(1000, "USD")},
+		{New(1000, "USD"), "KWD", 0.3075, New(3075, "KWD")},
+		{New(25, "USD"), "EUR", 0.5, New(12, "EUR")}, // 12.5 rounds to even
+		{New(1000, "EUR"), "EUR", 1, New(1000, "EUR")},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.from.Convert(tt.to, tt.rate), "%s to %s", tt.from.Display(), tt.to)
+	}
+	assert.Panics(t, func() { New(100, "USD").Convert("EUR", 0) })
+}
+
+func TestJSON(t *testing.T) {
+	out, err := json.Marshal(New(1999, "EUR"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"amount":"19.99","currency":"EUR"}`, string(out))
+
+	for in, want := range map[string]Money{
+		`{"amount":"19.99","currency":"EUR"}`: New(1999, "EUR"),
+		`{"amount":19.99,"currency":"gbp"}`:   New(1999, "GBP"),
+		`19.99`:                               New(1999, "USD"),
+		`"5"`:                                 New(500, "USD"),
+		`0`:                                   New(0, "USD"),
+	} {
+		var m Money
+		require.NoError(t, json.Unmarshal([]byte(in), &m), in)
+		assert.Equal(t, want, m, in)
+	}
+
+	var m Money
+	assert.Error(t, json.Unmarshal([]byte(`19.999`), &m))
+}
+
+func TestBSON(t *testing.T) {
+	type doc struct {
+		Price Money `bson:"price"`
+	}
+
+	raw, err := bson.Marshal(doc{Price: New(1999, "EUR")})
+	require.NoError(t, err)
+	var stored bson.M
+	require.NoError(t, bson.Unmarshal(raw, &stored))
+	assert.Equal(t, bson.M{"amount": int64(1999), "currency": "EUR"}, stored["price"])
+
+	var back doc
+	require.NoError(t, bson.Unmarshal(raw, &back))
+	assert.Equal(t, New(1999, "EUR"), back.Price)
+
+	// Amounts stored as plain numbers before the money type
+	for _, legacy := range []interface{}{19.99, int32(20), int64(20)} {
+		raw, err := bson.Marshal(bson.M{"price": legacy})
+		require.NoError(t, err)
+		var d doc
+		require.NoError(t, bson.Unmarshal(raw, &d), "%v", legacy)
+		assert.Equal(t, "USD", d.Price.Currency)
+	}
+	raw, _ = bson.Marshal(bson.M{"price": 19.99})
+	var d doc
+	require.NoError(t, bson.Unmarshal(raw, &d))
+	assert.Equal(t, int64(1999), d.Price.Amount)
+}
@@ -0,0 +1,244 @@
+// Package pagination implements keyset pagination over MongoDB collections.
+//
+// A page is addressed by an opaque cursor holding the (sort key, _id) pair of
+// the item it starts after, so queries stay index-backed no matter how deep a
+// client pages. Cursors are signed with HMAC-SHA256 and bound to the sort and
+// scope they were issued for; a modified or foreign cursor is rejected.
+package pagination
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidLimit  = errors.New("invalid limit")
+)
+
+// Sort is the order a list is paginated in. Ties are always broken by _id in
+// the same direction.
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// cursor is the signed payload behind an opaque cursor string
+type cursor struct {
+	Key      interface{}        `bson:"k"`
+	ID       primitive.ObjectID `bson:"i"`
+	Backward bool               `bson:"b"`
+	Scope    string             `bson:"s"`
+}
+
+type Paginator struct {
+	secret []byte
+}
+
+func New(secret string) *Paginator {
+	return &Paginator{secret: []byte(secret)}
+}
+
+// Request is a parsed page request for a particular sort and scope
+type Request struct {
+	Limit int64
+	Sort  Sort
+
+	p      *Paginator
+	scope  string
+	cursor *cursor
+}
+
+// Parse reads the limit and cursor query parameters. scope names the list
+// being paged (and any filters that shape it) so a cursor issued for one list
+// cannot be replayed against another.
+func (p *Paginator) Parse(values url.Values, sort Sort, scope string) (Request, error) {
+	// Only a digest of the scope is embedded so cursors stay short however
+	// many filters the list has.
+	digest := sha256.Sum256([]byte(sort.Field + "\x00" + strconv.FormatBool(sort.Desc) + "\x00" + scope))
+	r := Request{
+		Limit: DefaultLimit,
+		Sort:  sort,
+		p:     p,
+		scope: base64.RawURLEncoding.EncodeToString(digest[:12]),
+	}
+
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || limit < 1 {
+			return r, ErrInvalidLimit
+		}
+		r.Limit = min(limit, MaxLimit)
+	}
+
+	if token := values.Get("cursor"); token != "" {
+		c, err := p.decode(token)
+		if err != nil || c.Scope != r.scope {
+			return r, ErrInvalidCursor
+		}
+		r.cursor = c
+	}
+	return r, nil
+}
+
+func (p *Paginator) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)[:16]
+}
+
+func (p *Paginator) encode(c *cursor) string {
+	payload, err := bson.Marshal(c)
+	if err != nil {
+		// Sort keys are always plain BSON values
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(p.sign(payload))
+}
+
+func (p *Paginator) decode(token string) (*cursor, error) {
+	encPayload, encSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil || !hmac.Equal(sig, p.sign(payload)) {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+	if err := bson.Unmarshal(payload, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// backward reports whether this request walks towards the start of the list
+func (r Request) backward() bool {
+	return r.cursor != nil && r.cursor.Backward
+}
+
+// Filter returns the condition selecting items past the cursor, or an empty
+// document for the first page. It must be combined with the list's own filter.
+func (r Request) Filter() bson.M {
+	if r.cursor == nil {
+		return bson.M{}
+	}
+
+	// Walking forward on a descending sort, or backward on an ascending one,
+	// means looking for smaller values.
+	op := "$gt"
+	if r.Sort.Desc != r.cursor.Backward {
+		op = "$lt"
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{r.Sort.Field: bson.M{op: r.cursor.Key}},
+		bson.M{r.Sort.Field: r.cursor.Key, "_id": bson.M{op: r.cursor.ID}},
+	}}
+}
+
+// SortSpec returns the sort document to query with. It is reversed when
+// paging backwards; NewPage restores the natural order.
+func (r Request) SortSpec() bson.D {
+	dir := 1
+	if r.Sort.Desc != r.backward() {
+		dir = -1
+	}
+	return bson.D{{Key: r.Sort.Field, Value: dir}, {Key: "_id", Value: dir}}
+}
+
+// FetchLimit is the number of items to query: one more than the page size,
+// so NewPage can tell whether another page exists.
+func (r Request) FetchLimit() int64 {
+	return r.Limit + 1
+}
+
+// Info describes where a page sits in its list
+type Info struct {
+	Limit      int64  `json:"limit"`
+	HasNext    bool   `json:"has_next"`
+	HasPrev    bool   `json:"has_prev"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+	Next       string `json:"next,omitempty"`
+	Prev       string `json:"prev,omitempty"`
+}
+
+// Page is the response envelope shared by every list endpoint
+type Page[T any] struct {
+	Data       []T  `json:"data"`
+	Pagination Info `json:"pagination"`
+}
+
+// KeyFunc returns the sort key and _id of an item
+type KeyFunc[T any] func(item T) (interface{}, primitive.ObjectID)
+
+// NewPage turns the items fetched with r.Filter, r.SortSpec and r.FetchLimit
+// into a page. When self is set, next and prev links are built from it by
+// replacing the cursor parameter.
+func NewPage[T any](r Request, items []T, key KeyFunc[T], self *url.URL) Page[T] {
+	more := int64(len(items)) > r.Limit
+	if more {
+		items = items[:r.Limit]
+	}
+	if r.backward() {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	if items == nil {
+		items = []T{}
+	}
+
+	info := Info{Limit: r.Limit}
+	if r.backward() {
+		info.HasPrev = more
+		info.HasNext = true
+	} else {
+		info.HasPrev = r.cursor != nil
+		info.HasNext = more
+	}
+
+	if len(items) > 0 {
+		if info.HasNext {
+			k, id := key(items[len(items)-1])
+			info.NextCursor = r.p.encode(&cursor{Key: k, ID: id, Scope: r.scope})
+			info.Next = link(self, info.NextCursor)
+		}
+		if info.HasPrev {
+			k, id := key(items[0])
+			info.PrevCursor = r.p.encode(&cursor{Key: k, ID: id, Backward: true, Scope: r.scope})
+			info.Prev = link(self, info.PrevCursor)
+		}
+	}
+
+	return Page[T]{Data: items, Pagination: info}
+}
+
+func link(self *url.URL, token string) string {
+	if self == nil {
+		return ""
+	}
+	q := self.Query()
+	q.Set("cursor", token)
+	u := url.URL{Path: self.Path, RawQuery: q.Encode()}
+	return u.String()
+}
@@ -0,0 +1,122 @@
+package pagination
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type item struct {
+	ID    primitive.ObjectID
+	Price float64
+}
+
+func itemKey(it item) (interface{}, primitive.ObjectID) {
+	return it.Price, it.ID
+}
+
+func makeItems(n int) []item {
+	items := make([]item, n)
+	for i := range items {
+		items[i] = item{ID: primitive.NewObjectID(), Price: float64(i)}
+	}
+	return items
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	p := New("secret")
+	sort := Sort{Field: "price"}
+	self, _ := url.Parse("/products?sort=price_asc")
+
+	first, err := p.Parse(url.Values{"limit": {"2"}}, sort, "products")
+	require.NoError(t, err)
+	assert.Empty(t, first.Filter())
+
+	page := NewPage(first, makeItems(3), itemKey, self)
+	require.Len(t, page.Data, 2)
+	assert.True(t, page.Pagination.HasNext)
+	assert.False(t, page.Pagination.HasPrev)
+	assert.Empty(t, page.Pagination.PrevCursor)
+	assert.True(t, strings.HasPrefix(page.Pagination.Next, "/products?"))
+	assert.Contains(t, page.Pagination.Next, "sort=price_asc")
+
+	next, err := p.Parse(url.Values{"cursor": {page.Pagination.NextCursor}}, sort, "products")
+	require.NoError(t, err)
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.M{"price": bson.M{"$gt": 1.0}},
+		bson.M{"price": 1.0, "_id": bson.M{"$gt": page.Data[1].ID}},
+	}}, next.Filter())
+	assert.Equal(t, bson.D{{Key: "price", Value: 1}, {Key: "_id", Value: 1}}, next.SortSpec())
+}
+
+func TestCursorRejected(t *testing.T) {
+	p := New("secret")
+	sort := Sort{Field: "created_at", Desc: true}
+	first, err := p.Parse(url.Values{"limit": {"1"}}, sort, "products")
+	require.NoError(t, err)
+	token := NewPage(first, makeItems(2), itemKey, nil).Pagination.NextCursor
+	require.NotEmpty(t, token)
+
+	tests := []struct {
+		name   string
+		parser *Paginator
+		token  string
+		sort   Sort
+		scope  string
+	}{
+		{"Tampered Payload", p, "x" + token, sort, "products"},
+		{"Wrong Secret", New("other"), token, sort, "products"},
+		{"Different Scope", p, token, sort, "purchases"},
+		{"Different Sort", p, token, Sort{Field: "price"}, "products"},
+		{"Garbage", p, "not-a-cursor", sort, "products"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.parser.Parse(url.Values{"cursor": {tt.token}}, tt.sort, tt.scope)
+			assert.ErrorIs(t, err, ErrInvalidCursor)
+		})
+	}
+}
+
+func TestBackwardPage(t *testing.T) {
+	p := New("secret")
+	sort := Sort{Field: "price", Desc: true}
+	items := makeItems(3)
+
+	first, err := p.Parse(url.Values{"limit": {"2"}}, sort, "products")
+	require.NoError(t, err)
+	// Second page of a descending list, holding a single item
+	middle := NewPage(first, []item{items[2], items[1], items[0]}, itemKey, nil)
+	second, err := p.Parse(url.Values{"cursor": {middle.Pagination.NextCursor}}, sort, "products")
+	require.NoError(t, err)
+	last := NewPage(second, []item{items[0]}, itemKey, nil)
+	assert.False(t, last.Pagination.HasNext)
+	require.True(t, last.Pagination.HasPrev)
+
+	// Walking back flips the sort and the comparison...
+	back, err := p.Parse(url.Values{"cursor": {last.Pagination.PrevCursor}}, sort, "products")
+	require.NoError(t, err)
+	assert.Equal(t, bson.D{{Key: "price", Value: 1}, {Key: "_id", Value: 1}}, back.SortSpec())
+	assert.Equal(t, bson.M{"price": bson.M{"$gt": 0.0}}, back.Filter()["$or"].(bson.A)[0])
+
+	// ...and the page comes back in natural order
+	page := NewPage(back, []item{items[1], items[2]}, itemKey, nil)
+	assert.Equal(t, []item{items[2], items[1]}, page.Data)
+	assert.True(t, page.Pagination.HasNext)
+	assert.False(t, page.Pagination.HasPrev)
+}
+
+func TestParseLimit(t *testing.T) {
+	p := New("secret")
+	r, err := p.Parse(url.Values{"limit": {"1000"}}, Sort{Field: "price"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(MaxLimit), r.Limit)
+
+	_, err = p.Parse(url.Values{"limit": {"0"}}, Sort{Field: "price"}, "")
+	assert.ErrorIs(t, err, ErrInvalidLimit)
+}
@@ -0,0 +1,322 @@
+// Package payments takes card payments through Stripe. It talks to the
+// Stripe API directly over HTTP, so it can be pointed at stripe-mock or a
+// local fake, and verifies the signatures on Stripe's webhooks.
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+)
+
+const (
+	// DefaultAPIBase is Stripe's production API
+	DefaultAPIBase = "https://api.stripe.com"
+	// stripeAPIVersion pins the shape of API responses and webhook events
+	stripeAPIVersion = "2024-06-20"
+	// WebhookTolerance is how old a webhook's signed timestamp may be before
+	// the event is refused as a possible replay
+	WebhookTolerance       = 5 * time.Minute
+	stripeMaxResponseBytes = 1 << 20
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrSignatureExpired = errors.New("webhook signature is too old")
+)
+
+// Error is an error response from the Stripe API
+type Error struct {
+	Status  int    `json:"-"`
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("stripe: %s (%s): %s", e.Type, e.Code, e.Message)
+	}
+	return fmt.Sprintf("stripe: %s: %s", e.Type, e.Message)
+}
+
+// StripeOptions configures a Stripe client. APIBase defaults to
+// DefaultAPIBase.
+type StripeOptions struct {
+	APIBase       string
+	SecretKey     string
+	WebhookSecret string
+	Client        *http.Client
+}
+
+// Stripe creates Checkout sessions and reads webhook events
+type Stripe struct {
+	opts   StripeOptions
+	client *http.Client
+}
+
+func NewStripe(opts StripeOptions) *Stripe {
+	if opts.APIBase == "" {
+		opts.APIBase = DefaultAPIBase
+	}
+	opts.APIBase = strings.TrimRight(opts.APIBase, "/")
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Stripe{opts: opts, client: client}
+}
+
+// CheckoutParams describes a one-off Checkout payment for a single item.
+// ClientReference and Metadata come back on the session and, through its
+// PaymentIntent, on payment and dispute events.
+type CheckoutParams struct {
+	Amount          money.Money
+	Description     string
+	ClientReference string
+	Metadata        map[string]string
+	SuccessURL      string
+	CancelURL       string
+	// IdempotencyKey makes retries of the same request create one session
+	IdempotencyKey string
+}
+
+// CheckoutSession is a Stripe Checkout session. PaymentIntent is only set
+// once the customer has submitted a payment.
+type CheckoutSession struct {
+	ID              string            `json:"id"`
+	URL             string            `json:"url"`
+	Status          string            `json:"status"`
+	PaymentStatus   string            `json:"payment_status"`
+	PaymentIntent   string            `json:"payment_intent"`
+	ClientReference string            `json:"client_reference_id"`
+	AmountTotal     int64             `json:"amount_total"`
+	Currency        string            `json:"currency"`
+	Metadata        map[string]string `json:"metadata"`
+}
+
+// Total is what the session charged
+func (s *CheckoutSession) Total() money.Money {
+	return money.New(s.AmountTotal, strings.ToUpper(s.Currency))
+}
+
+// PaymentIntent is a single attempt to collect a payment
+type PaymentIntent struct {
+	ID               string            `json:"id"`
+	Status           string            `json:"status"`
+	Amount           int64             `json:"amount"`
+	Currency         string            `json:"currency"`
+	Metadata         map[string]string `json:"metadata"`
+	LastPaymentError *Error            `json:"last_payment_error"`
+}
+
+// Dispute is a cardholder disputing a payment with their bank
+type Dispute struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	Reason        string `json:"reason"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	PaymentIntent string `json:"payment_intent"`
+}
+
+// Total is the disputed amount
+func (d *Dispute) Total() money.Money {
+	return money.New(d.Amount, strings.ToUpper(d.Currency))
+}
+
+// Won reports whether a closed dispute was decided for the merchant.
+// Inquiries that close without becoming disputes never took the funds.
+func (d *Dispute) Won() bool {
+	return d.Status == "won" || d.Status == "warning_closed"
+}
+
+// Refund returns a payment, or part of it, to the customer's card
+type Refund struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	PaymentIntent string `json:"payment_intent"`
+}
+
+// Event is a webhook event. Data.Object holds the object the event is
+// about; Decode reads it.
+type Event struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// Decode unmarshals the event's object into v
+func (e *Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data.Object, v)
+}
+
+// CreateCheckoutSession starts a hosted payment page for params.Amount.
+// The customer is sent to the returned session's URL.
+func (s *Stripe) CreateCheckoutSession(ctx context.Context, params CheckoutParams) (*CheckoutSession, error) {
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("success_url", params.SuccessURL)
+	form.Set("cancel_url", params.CancelURL)
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", strings.ToLower(params.Amount.Code()))
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(params.Amount.Amount, 10))
+	form.Set("line_items[0][price_data][product_data][name]", params.Description)
+	if params.ClientReference != "" {
+		form.Set("client_reference_id", params.ClientReference)
+	}
+	for k, v := range params.Metadata {
+		form.Set("metadata["+k+"]", v)
+		form.Set("payment_intent_data[metadata]["+k+"]", v)
+	}
+
+	var session CheckoutSession
+	if err := s.do(ctx, http.MethodPost, "/v1/checkout/sessions", form, params.IdempotencyKey, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// PaymentIntent fetches a PaymentIntent, whose metadata ties disputes and
+// other charge events back to the Checkout session that created it
+func (s *Stripe) PaymentIntent(ctx context.Context, id string) (*PaymentIntent, error) {
+	var intent PaymentIntent
+	if err := s.do(ctx, http.MethodGet, "/v1/payment_intents/"+url.PathEscape(id), nil, "", &intent); err != nil {
+		return nil, err
+	}
+	return &intent, nil
+}
+
+// RefundPayment refunds the whole of a PaymentIntent. Retries with the same
+// idempotencyKey return the refund the first call created.
+func (s *Stripe) RefundPayment(ctx context.Context, paymentIntentID string, metadata map[string]string, idempotencyKey string) (*Refund, error) {
+	form := url.Values{}
+	form.Set("payment_intent", paymentIntentID)
+	for k, v := range metadata {
+		form.Set("metadata["+k+"]", v)
+	}
+	var refund Refund
+	if err := s.do(ctx, http.MethodPost, "/v1/refunds", form, idempotencyKey, &refund); err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+func (s *Stripe) do(ctx context.Context, method, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	var payload io.Reader
+	if form != nil {
+		payload = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.opts.APIBase+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.opts.SecretKey)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Stripe-Version", stripeAPIVersion)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, stripeMaxResponseBytes))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error *Error `json:"error"`
+		}
+		if json.Unmarshal(body, &e) != nil || e.Error == nil {
+			return fmt.Errorf("stripe %s %s: unexpected status %d", method, path, resp.StatusCode)
+		}
+		e.Error.Status = resp.StatusCode
+		return e.Error
+	}
+	return json.Unmarshal(body, out)
+}
+
+// signature is the hex HMAC-SHA256 Stripe signs webhooks with
+func signature(secret string, payload []byte, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignWebhook returns the Stripe-Signature header Stripe would send with
+// payload at t, for local fakes and tests
+func SignWebhook(secret string, payload []byte, t time.Time) string {
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), signature(secret, payload, t.Unix()))
+}
+
+// ParseWebhook verifies the Stripe-Signature header of a webhook against
+// the raw request body and returns the event. Any of the header's v1
+// signatures may match, which lets Stripe roll secrets; timestamps further
+// than WebhookTolerance from now are refused.
+func (s *Stripe) ParseWebhook(payload []byte, header string, now time.Time) (*Event, error) {
+	var timestamp int64 = -1
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			t, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, ErrInvalidSignature
+			}
+			timestamp = t
+		case "v1":
+			signatures = append(signatures, v)
+		}
+	}
+	if timestamp < 0 || len(signatures) == 0 || s.opts.WebhookSecret == "" {
+		return nil, ErrInvalidSignature
+	}
+
+	want := signature(s.opts.WebhookSecret, payload, timestamp)
+	valid := false
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(want)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(timestamp, 0)); age > WebhookTolerance || age < -WebhookTolerance {
+		return nil, ErrSignatureExpired
+	}
+
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("invalid webhook payload: %w", err)
+	}
+	return &event, nil
+}
@@ -0,0 +1,134 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kordlab/marketplace/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateCheckoutSession(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk_test_123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"type":"invalid_request_error","message":"Invalid API Key provided"}}`)
+			return
+		}
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "/v1/checkout/sessions", r.URL.Path)
+		assert.Equal(t, "deposit-1", r.Header.Get("Idempotency-Key"))
+		assert.Equal(t, "payment", r.PostForm.Get("mode"))
+		assert.Equal(t, "usd", r.PostForm.Get("line_items[0][price_data][currency]"))
+		assert.Equal(t, "2500", r.PostForm.Get("line_items[0][price_data][unit_amount]"))
+		assert.Equal(t, "abc", r.PostForm.Get("payment_intent_data[metadata][deposit_id]"))
+		fmt.Fprintf(w, `{"id":"cs_test_1","url":"https://checkout.stripe.com/c/pay/cs_test_1","status":"open",
+			"payment_status":"unpaid","client_reference_id":%q,"amount_total":2500,"currency":"usd"}`, r.PostForm.Get("client_reference_id"))
+	}))
+	defer srv.Close()
+
+	params := CheckoutParams{
+		Amount:          money.New(2500, "USD"),
+		Description:     "25 credits",
+		ClientReference: "abc",
+		Metadata:        map[string]string{"deposit_id": "abc"},
+		SuccessURL:      "https://example.com/ok",
+		CancelURL:       "https://example.com/cancel",
+		IdempotencyKey:  "deposit-1",
+	}
+	stripe := NewStripe(StripeOptions{APIBase: srv.URL + "/", SecretKey: "sk_test_123"})
+	session, err := stripe.CreateCheckoutSession(context.Background(), params)
+	require.NoError(t, err)
+	assert.Equal(t, "cs_test_1", session.ID)
+	assert.Equal(t, "abc", session.ClientReference)
+	assert.Equal(t, money.New(2500, "USD"), session.Total())
+
+	_, err = NewStripe(StripeOptions{APIBase: srv.URL, SecretKey: "wrong"}).CreateCheckoutSession(context.Background(), params)
+	var stripeErr *Error
+	require.ErrorAs(t, err, &stripeErr)
+	assert.Equal(t, http.StatusUnauthorized, stripeErr.Status)
+	assert.Equal(t, "invalid_request_error", stripeErr.Type)
+}
+
+func TestPaymentIntent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		if r.URL.Path != "/v1/payment_intents/pi_1" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"type":"invalid_request_error","code":"resource_missing","message":"No such payment_intent"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"pi_1","status":"succeeded","amount":2500,"currency":"usd","metadata":{"deposit_id":"abc"}}`)
+	}))
+	defer srv.Close()
+
+	stripe := NewStripe(StripeOptions{APIBase: srv.URL, SecretKey: "sk_test_123"})
+	intent, err := stripe.PaymentIntent(context.Background(), "pi_1")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", intent.Metadata["deposit_id"])
+
+	_, err = stripe.PaymentIntent(context.Background(), "pi_2")
+	var stripeErr *Error
+	require.ErrorAs(t, err, &stripeErr)
+	assert.Equal(t, "resource_missing", stripeErr.Code)
+}
+
+func TestRefundPayment(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/v1/refunds", r.URL.Path)
+		assert.Equal(t, "deposit-refund-abc", r.Header.Get("Idempotency-Key"))
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "pi_1", r.PostForm.Get("payment_intent"))
+		assert.Equal(t, "abc", r.PostForm.Get("metadata[deposit_id]"))
+		fmt.Fprint(w, `{"id":"re_1","status":"succeeded","amount":2500,"currency":"usd","payment_intent":"pi_1"}`)
+	}))
+	defer srv.Close()
+
+	stripe := NewStripe(StripeOptions{APIBase: srv.URL, SecretKey: "sk_test_123"})
+	refund, err := stripe.RefundPayment(context.Background(), "pi_1", map[string]string{"deposit_id": "abc"}, "deposit-refund-abc")
+	require.NoError(t, err)
+	assert.Equal(t, "re_1", refund.ID)
+	assert.Equal(t, int64(2500), refund.Amount)
+}
+
+func TestParseWebhook(t *testing.T) {
+	stripe := NewStripe(StripeOptions{WebhookSecret: "whsec_test"})
+	payload := []byte(`{"id":"evt_1","type":"checkout.session.completed","data":{"object":{"id":"cs_1","payment_status":"paid"}}}`)
+	now := time.Unix(1700000000, 0)
+
+	event, err := stripe.ParseWebhook(payload, SignWebhook("whsec_test", payload, now), now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "evt_1", event.ID)
+	var session CheckoutSession
+	require.NoError(t, event.Decode(&session))
+	assert.Equal(t, "paid", session.PaymentStatus)
+
+	rolled := fmt.Sprintf("t=%d,v1=%s,v1=%s", now.Unix(), signature("whsec_old", payload, now.Unix()), signature("whsec_test", payload, now.Unix()))
+	_, err = stripe.ParseWebhook(payload, rolled, now)
+	assert.NoError(t, err, "any v1 signature may match")
+
+	tests := []struct {
+		name    string
+		payload []byte
+		header  string
+		err     error
+	}{
+		{"wrong secret", payload, SignWebhook("whsec_other", payload, now), ErrInvalidSignature},
+		{"tampered payload", []byte(`{"id":"evt_2"}`), SignWebhook("whsec_test", payload, now), ErrInvalidSignature},
+		{"missing signature", payload, fmt.Sprintf("t=%d", now.Unix()), ErrInvalidSignature},
+		{"missing timestamp", payload, "v1=" + signature("whsec_test", payload, now.Unix()), ErrInvalidSignature},
+		{"replayed", payload, SignWebhook("whsec_test", payload, now.Add(-time.Hour)), ErrSignatureExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := stripe.ParseWebhook(tt.payload, tt.header, now)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
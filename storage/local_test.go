@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, rc io.ReadCloser) string {
+	t.Helper()
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	content := "0123456789abcdef"
+	sum := sha256.Sum256([]byte(content))
+	key := "products/abc/1.0.0/file.zip"
+
+	err = store.Put(ctx, key, strings.NewReader(content), int64(len(content)), PutOptions{
+		SHA256: hex.EncodeToString(sum[:]),
+	})
+	require.NoError(t, err)
+
+	info, err := store.Stat(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	rc, err := store.Open(ctx, key, 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, content, readAll(t, rc))
+
+	rc, err = store.Open(ctx, key, 4, 6)
+	require.NoError(t, err)
+	assert.Equal(t, "456789", readAll(t, rc))
+
+	rc, err = store.Open(ctx, key, 10, -1)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", readAll(t, rc))
+
+	require.NoError(t, store.Delete(ctx, key))
+	_, err = store.Stat(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Open(ctx, key, 0, -1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, store.Delete(ctx, key), "deleting a missing blob is not an error")
+}
+
+func TestLocalStoreRejectsBadWrites(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	err = store.Put(ctx, "a.txt", strings.NewReader("hello"), 5, PutOptions{SHA256: strings.Repeat("0", 64)})
+	assert.Error(t, err)
+	err = store.Put(ctx, "b.txt", strings.NewReader("hello"), 10, PutOptions{})
+	assert.Error(t, err)
+
+	for _, key := range []string{"a.txt", "b.txt"} {
+		_, err = store.Stat(ctx, key)
+		assert.ErrorIs(t, err, ErrNotFound, "failed writes must not leave a blob behind")
+	}
+
+	for _, key := range []string{"", "../escape", "a/../../escape", "/abs", "a//b", "a\\b"} {
+		err = store.Put(ctx, key, strings.NewReader("x"), 1, PutOptions{})
+		assert.ErrorIs(t, err, ErrInvalidKey, key)
+	}
+}
@@ -0,0 +1,107 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultAnalyticsDays = 30
+	maxAnalyticsDays     = 365
+)
+
+type AnalyticsHandler struct {
+	analytics *data.AnalyticsRepository
+	products  *data.ProductRepository
+}
+
+func NewAnalyticsHandler(analytics *data.AnalyticsRepository, products *data.ProductRepository) *AnalyticsHandler {
+	return &AnalyticsHandler{
+		analytics: analytics,
+		products:  products,
+	}
+}
+
+func registerAnalyticsRoutes(e *echo.Echo, h *AnalyticsHandler, authRequired echo.MiddlewareFunc) {
+	analytics := e.Group("/analytics", authRequired, requireRole(data.RoleCreator, data.RoleAdmin))
+	analytics.GET("", h.handleCreatorAnalytics)
+	analytics.GET("/products/:id", h.handleProductAnalytics)
+}
+
+// analyticsPeriod reads ?days= into the period ending now
+func analyticsPeriod(c echo.Context) (time.Time, time.Time, bool) {
+	days := defaultAnalyticsDays
+	if raw := c.QueryParam("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxAnalyticsDays {
+			return time.Time{}, time.Time{}, false
+		}
+		days = n
+	}
+	to := time.Now().UTC()
+	from := to.Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+	return from, to, true
+}
+
+// handleCreatorAnalytics reports the caller's views, sales and conversion
+// rates. Admins may pass ?creator= to look at another creator.
+func (h *AnalyticsHandler) handleCreatorAnalytics(c echo.Context) error {
+	from, to, ok := analyticsPeriod(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "days must be between 1 and 365"})
+	}
+
+	user := currentUser(c)
+	creatorID := user.ID
+	if raw := c.QueryParam("creator"); raw != "" && user.Role == data.RoleAdmin {
+		id, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid creator ID"})
+		}
+		creatorID = id
+	}
+
+	analytics, err := h.analytics.CreatorAnalytics(c.Request().Context(), creatorID, from, to)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to compute analytics"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"from":      from,
+		"to":        to,
+		"analytics": analytics,
+	})
+}
+
+func (h *AnalyticsHandler) handleProductAnalytics(c echo.Context) error {
+	from, to, ok := analyticsPeriod(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "days must be between 1 and 365"})
+	}
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+	}
+	product, err := h.products.Get(c.Request().Context(), id)
+	if err == data.ErrProductNotFound || (err == nil && !canManageProduct(currentUser(c), product)) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Product not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	perf, daily, err := h.analytics.ProductPerformance(c.Request().Context(), product, from, to)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to compute analytics"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"from":        from,
+		"to":          to,
+		"performance": perf,
+		"daily_views": daily,
+	})
+}
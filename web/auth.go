@@ -7,6 +7,7 @@ import (
 
 	"github.com/golang-jwt/jwt"
 	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/money"
 	"github.com/labstack/echo/v4"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -27,17 +28,19 @@ type RegisterRequest struct {
 type AuthHandler struct {
 	mongo *data.MongoDB
 	redis *data.RedisDB
+	users *data.UserRepository
 }
 
-func NewAuthHandler(mongo *data.MongoDB, redis *data.RedisDB) *AuthHandler {
+func NewAuthHandler(mongo *data.MongoDB, redis *data.RedisDB, users *data.UserRepository) *AuthHandler {
 	return &AuthHandler{
 		mongo: mongo,
 		redis: redis,
+		users: users,
 	}
 }
 
-func registerAuthRoutes(e *echo.Echo, h *AuthHandler) {
-	auth := e.Group("/auth")
+func registerAuthRoutes(e *echo.Echo, h *AuthHandler, m ...echo.MiddlewareFunc) {
+	auth := e.Group("/auth", m...)
 	auth.POST("/login", h.handleLogin)
 	auth.POST("/register", h.handleRegister)
 	auth.POST("/logout", h.handleLogout)
@@ -49,9 +52,8 @@ func (h *AuthHandler) handleLogin(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
-	// Find user by email
-	var user data.User
-	err := h.mongo.Users().FindOne(context.Background(), bson.M{"email": req.Email}).Decode(&user)
+	// Find user by email, bypassing the cache since we need the password hash
+	user, err := h.users.FindByEmail(c.Request().Context(), req.Email)
 	if err != nil {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
 	}
@@ -132,41 +134,28 @@ func (h *AuthHandler) handleRegister(c echo.Context) error {
 			DisplayName: req.Username,
 		},
 		Credits: data.Credits{
-			Balance:      0,
-			Transactions: []data.CreditTransaction{},
+			Balance: money.Zero(money.DefaultCurrency),
 		},
 		Notifications: []data.Notification{},
 		CreatedAt:     now,
 		UpdatedAt:     now,
 	}
 
-	// Insert user into database
-	_, err = h.mongo.Users().InsertOne(context.Background(), user)
+	// Insert user into database; the cache is filled on first read
+	err = h.users.Create(c.Request().Context(), user)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
 	}
 
-	// Cache the new user
-	err = h.redis.CacheUser(user)
-	if err != nil {
-		// Log the error but don't fail the request
-		c.Logger().Error("Failed to cache user:", err)
-	}
-
 	return c.JSON(http.StatusCreated, user)
 }
 
 func (h *AuthHandler) handleLogout(c echo.Context) error {
-	token := c.Request().Header.Get("Authorization")
+	token := bearerToken(c)
 	if token == "" {
 		return c.NoContent(http.StatusOK)
 	}
 
-	// Remove "Bearer " prefix if present
-	if len(token) > 7 && token[:7] == "Bearer " {
-		token = token[7:]
-	}
-
 	// Blacklist the token
 	err := h.redis.BlacklistToken(token, time.Hour*24)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/kordlab/marketplace/config"
 	"github.com/kordlab/marketplace/data"
@@ -73,7 +74,7 @@ func TestHandleRegister(t *testing.T) {
 	defer cleanup()
 
 	e := echo.New()
-	h := NewAuthHandler(testMongo, testRedis)
+	h := NewAuthHandler(testMongo, testRedis, data.NewUserRepository(testMongo, data.NewTieredCache(testRedis, 100, time.Second)))
 
 	tests := []struct {
 		name           string
@@ -158,7 +159,7 @@ func TestHandleLogin(t *testing.T) {
 	defer cleanup()
 
 	e := echo.New()
-	h := NewAuthHandler(testMongo, testRedis)
+	h := NewAuthHandler(testMongo, testRedis, data.NewUserRepository(testMongo, data.NewTieredCache(testRedis, 100, time.Second)))
 
 	// Create test user
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
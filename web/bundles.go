@@ -0,0 +1,46 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type BundleRequest struct {
+	Items          []string `json:"items"`
+	IncludeUpdates bool     `json:"include_updates"`
+	ExcludeOwned   bool     `json:"exclude_owned"`
+}
+
+// resolveBundle turns req into bundle options for product after checking the
+// items exist and may be bundled. On failure it writes the response and
+// returns nil options.
+func (h *ProductHandler) resolveBundle(c echo.Context, product *data.Product, req *BundleRequest) (*data.BundleOptions, error) {
+	ids := make([]primitive.ObjectID, 0, len(req.Items))
+	for _, raw := range req.Items {
+		id, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID " + raw})
+		}
+		ids = append(ids, id)
+	}
+
+	items, err := h.products.FindMany(c.Request().Context(), ids)
+	if err != nil {
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	if len(items) != len(ids) {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": data.ErrInvalidBundleItem.Error()})
+	}
+	if err := data.ValidateBundleItems(product, items); err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	return &data.BundleOptions{
+		Items:          ids,
+		IncludeUpdates: req.IncludeUpdates,
+		ExcludeOwned:   req.ExcludeOwned,
+	}, nil
+}
@@ -0,0 +1,85 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type CheckoutRequest struct {
+	ProductID  string `json:"product_id" validate:"required"`
+	CouponCode string `json:"coupon_code" validate:"max=64"`
+}
+
+type CheckoutHandler struct {
+	checkout  *data.CheckoutService
+	purchases *data.PurchaseRepository
+	paginator *pagination.Paginator
+}
+
+func NewCheckoutHandler(checkout *data.CheckoutService, purchases *data.PurchaseRepository, paginator *pagination.Paginator) *CheckoutHandler {
+	return &CheckoutHandler{checkout: checkout, purchases: purchases, paginator: paginator}
+}
+
+func registerCheckoutRoutes(e *echo.Echo, h *CheckoutHandler, authRequired, idempotent echo.MiddlewareFunc) {
+	e.POST("/checkout", h.handleCheckout, authRequired, idempotent)
+	e.GET("/users/me/purchases", h.handleListPurchases, authRequired)
+}
+
+// handleCheckout buys a product with the caller's credits
+func (h *CheckoutHandler) handleCheckout(c echo.Context) error {
+	var req CheckoutRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+	productID, err := primitive.ObjectIDFromHex(req.ProductID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+	}
+
+	result, err := h.checkout.Checkout(c.Request().Context(), currentUser(c).ID, productID, req.CouponCode)
+	switch err {
+	case nil:
+		return c.JSON(http.StatusCreated, result)
+	case data.ErrProductNotForSale:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Product not found"})
+	case data.ErrInsufficientCredits:
+		return c.JSON(http.StatusPaymentRequired, map[string]string{"error": "Insufficient credits"})
+	case data.ErrOwnProduct:
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	case data.ErrAlreadyOwned, data.ErrNoPublishedVersion:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	case data.ErrUserNotFound:
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	case data.ErrCouponNotFound:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Coupon not found"})
+	case data.ErrCouponInactive, data.ErrCouponNotStarted, data.ErrCouponExpired, data.ErrCouponExhausted,
+		data.ErrCouponUserLimit, data.ErrCouponNotApplicable, data.ErrCouponMinSpend:
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	default:
+		c.Logger().Errorf("checkout of %s failed: %v", productID.Hex(), err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Checkout failed"})
+	}
+}
+
+// handleListPurchases lists the caller's purchases, newest first
+func (h *CheckoutHandler) handleListPurchases(c echo.Context) error {
+	sort := pagination.Sort{Field: "created_at", Desc: true}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, "purchases")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	purchases, err := h.purchases.ListForUser(c.Request().Context(), currentUser(c).ID, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return c.JSON(http.StatusOK, pagination.NewPage(req, purchases, func(p data.Purchase) (interface{}, primitive.ObjectID) {
+		return p.CreatedAt, p.ID
+	}, c.Request().URL))
+}
@@ -0,0 +1,284 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type CreateCouponRequest struct {
+	Code           string          `json:"code"`
+	Type           data.CouponType `json:"type"`
+	Percent        float64         `json:"percent"`
+	Amount         money.Money     `json:"amount"`
+	ProductIDs     []string        `json:"product_ids"`
+	StartsAt       time.Time       `json:"starts_at"`
+	EndsAt         time.Time       `json:"ends_at"`
+	MaxRedemptions int             `json:"max_redemptions"`
+	PerUserLimit   int             `json:"per_user_limit"`
+	MinSpend       money.Money     `json:"min_spend"`
+	Currency       string          `json:"currency"`
+}
+
+// UpdateCouponRequest is a partial update; nil fields are left untouched.
+// Codes, types and values are fixed once issued.
+type UpdateCouponRequest struct {
+	Active         *bool        `json:"active"`
+	EndsAt         *time.Time   `json:"ends_at"`
+	MaxRedemptions *int         `json:"max_redemptions" validate:"omitempty,gte=0"`
+	PerUserLimit   *int         `json:"per_user_limit" validate:"omitempty,gte=0"`
+	MinSpend       *money.Money `json:"min_spend" validate:"omitempty,gte=0"`
+}
+
+type CouponHandler struct {
+	coupons      *data.CouponRepository
+	products     *data.ProductRepository
+	entitlements *data.EntitlementRepository
+	rates        *data.ExchangeRateRepository
+	paginator    *pagination.Paginator
+}
+
+func NewCouponHandler(coupons *data.CouponRepository, products *data.ProductRepository, entitlements *data.EntitlementRepository, rates *data.ExchangeRateRepository, paginator *pagination.Paginator) *CouponHandler {
+	return &CouponHandler{
+		coupons:      coupons,
+		products:     products,
+		entitlements: entitlements,
+		rates:        rates,
+		paginator:    paginator,
+	}
+}
+
+func registerCouponRoutes(e *echo.Echo, h *CouponHandler, authRequired echo.MiddlewareFunc) {
+	coupons := e.Group("/coupons", authRequired, requireRole(data.RoleCreator, data.RoleAdmin))
+	coupons.POST("", h.handleCreateCoupon)
+	coupons.GET("", h.handleListCoupons)
+	coupons.PATCH("/:id", h.handleUpdateCoupon)
+
+	e.GET("/products/:id/quote", h.handleQuote)
+}
+
+// couponIssuer returns the creator scope coupons created by user fall under:
+// admins issue platform coupons, which carry no creator.
+func couponIssuer(user *data.CachedUser) primitive.ObjectID {
+	if user.Role == data.RoleAdmin {
+		return primitive.NilObjectID
+	}
+	return user.ID
+}
+
+// validateCouponRules checks the rules that span several fields
+func validateCouponRules(coupon *data.Coupon) string {
+	switch coupon.Type {
+	case data.CouponTypePercentage:
+		if coupon.Percent <= 0 || !coupon.Amount.IsZero() {
+			return "Percentage coupons take a percent between 0 and 100 and no amount"
+		}
+	case data.CouponTypeFixed:
+		if !coupon.Amount.IsPositive() || coupon.Percent != 0 {
+			return "Fixed coupons take a positive amount and no percent"
+		}
+		if !coupon.Amount.SameCurrency(money.Zero(coupon.Currency)) {
+			return "amount must be in the coupon's currency"
+		}
+	}
+	if !coupon.StartsAt.IsZero() && !coupon.EndsAt.IsZero() && !coupon.EndsAt.After(coupon.StartsAt) {
+		return "ends_at must be after starts_at"
+	}
+	if coupon.MinSpend.IsPositive() && !coupon.MinSpend.SameCurrency(money.Zero(coupon.Currency)) {
+		return "min_spend must be in the coupon's currency"
+	}
+	return ""
+}
+
+func (h *CouponHandler) handleCreateCoupon(c echo.Context) error {
+	var req CreateCouponRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user := currentUser(c)
+	now := time.Now()
+	coupon := &data.Coupon{
+		ID:             primitive.NewObjectID(),
+		Code:           data.NormalizeCouponCode(req.Code),
+		Type:           req.Type,
+		Percent:        req.Percent,
+		Amount:         req.Amount,
+		IssuerID:       user.ID,
+		CreatorID:      couponIssuer(user),
+		ProductIDs:     []primitive.ObjectID{},
+		StartsAt:       req.StartsAt,
+		EndsAt:         req.EndsAt,
+		MaxRedemptions: req.MaxRedemptions,
+		PerUserLimit:   req.PerUserLimit,
+		MinSpend:       req.MinSpend,
+		Currency:       money.Zero(req.Currency).Code(),
+		Active:         true,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if err := c.Validate(coupon); err != nil {
+		return validationError(c, err)
+	}
+	if msg := validateCouponRules(coupon); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	// Creators may only discount their own products
+	for _, raw := range req.ProductIDs {
+		id, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID " + raw})
+		}
+		product, err := h.products.Get(c.Request().Context(), id)
+		if err == data.ErrProductNotFound || (err == nil && !canManageProduct(user, product)) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown product " + raw})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		coupon.ProductIDs = append(coupon.ProductIDs, id)
+	}
+
+	err := h.coupons.Create(c.Request().Context(), coupon)
+	if err == data.ErrCouponCodeTaken {
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create coupon"})
+	}
+	return c.JSON(http.StatusCreated, coupon)
+}
+
+// handleListCoupons lists the caller's coupons, or platform coupons for
+// admins, newest first
+func (h *CouponHandler) handleListCoupons(c echo.Context) error {
+	issuer := couponIssuer(currentUser(c))
+	sort := pagination.Sort{Field: "created_at", Desc: true}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, "coupons:"+issuer.Hex())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	coupons, err := h.coupons.ListByCreator(c.Request().Context(), issuer, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, pagination.NewPage(req, coupons, func(coupon data.Coupon) (interface{}, primitive.ObjectID) {
+		return coupon.CreatedAt, coupon.ID
+	}, c.Request().URL))
+}
+
+func (h *CouponHandler) handleUpdateCoupon(c echo.Context) error {
+	var req UpdateCouponRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid coupon ID"})
+	}
+	coupon, err := h.coupons.FindByID(c.Request().Context(), id)
+	if err == data.ErrCouponNotFound || (err == nil && coupon.CreatorID != couponIssuer(currentUser(c))) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Coupon not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	set := bson.M{}
+	if req.Active != nil {
+		coupon.Active = *req.Active
+		set["active"] = coupon.Active
+	}
+	if req.EndsAt != nil {
+		coupon.EndsAt = *req.EndsAt
+		set["ends_at"] = coupon.EndsAt
+	}
+	if req.MaxRedemptions != nil {
+		coupon.MaxRedemptions = *req.MaxRedemptions
+		set["max_redemptions"] = coupon.MaxRedemptions
+	}
+	if req.PerUserLimit != nil {
+		coupon.PerUserLimit = *req.PerUserLimit
+		set["per_user_limit"] = coupon.PerUserLimit
+	}
+	if req.MinSpend != nil {
+		coupon.MinSpend = *req.MinSpend
+		set["min_spend"] = coupon.MinSpend
+	}
+	if len(set) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "No fields to update"})
+	}
+	if msg := validateCouponRules(coupon); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	if err := h.coupons.Update(c.Request().Context(), coupon.ID, set); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update coupon"})
+	}
+	coupon.UpdatedAt = time.Now()
+	return c.JSON(http.StatusOK, coupon)
+}
+
+// handleQuote prices an active product with an optional ?coupon= code. The
+// per-user coupon limit and owned bundle items are only taken into account
+// for signed in callers.
+func (h *CouponHandler) handleQuote(c echo.Context) error {
+	local, err := newLocalizer(c, h.rates)
+	if local == nil {
+		return err
+	}
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+	}
+	product, err := h.products.Get(c.Request().Context(), id)
+	if err == data.ErrProductNotFound || (err == nil && product.Status != data.ProductStatusActive) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Product not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	var userID primitive.ObjectID
+	if raw, ok := c.Get("user_id").(string); ok {
+		userID, _ = primitive.ObjectIDFromHex(raw)
+	}
+
+	var credits []data.PriceAdjustment
+	if product.IsBundle() {
+		items, err := h.products.FindMany(c.Request().Context(), product.Bundle.Items)
+		if err == nil {
+			credits, err = h.entitlements.OwnedItemsCredit(c.Request().Context(), product, items, userID)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+	}
+
+	quote, err := h.coupons.Quote(c.Request().Context(), product, credits, c.QueryParam("coupon"), userID)
+	switch err {
+	case nil:
+		local.quote(quote)
+		return c.JSON(http.StatusOK, quote)
+	case data.ErrCouponNotFound:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Coupon not found"})
+	case data.ErrCouponInactive, data.ErrCouponNotStarted, data.ErrCouponExpired, data.ErrCouponExhausted,
+		data.ErrCouponUserLimit, data.ErrCouponNotApplicable, data.ErrCouponMinSpend:
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to price product"})
+	}
+}
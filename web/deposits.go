@@ -0,0 +1,312 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/kordlab/marketplace/payments"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxWebhookBytes bounds the webhook bodies read before their signature
+// is checked
+const maxWebhookBytes = 1 << 20
+
+type CreateDepositRequest struct {
+	Pack string `json:"pack" validate:"required"`
+}
+
+type DecideDepositRequest struct {
+	Action string `json:"action" validate:"required,oneof=approve reject"`
+	Note   string `json:"note" validate:"max=2000"`
+}
+
+type DepositHandler struct {
+	deposits   *data.DepositService
+	stripe     *payments.Stripe
+	paginator  *pagination.Paginator
+	successURL string
+	cancelURL  string
+}
+
+// NewDepositHandler takes card payments through stripe. A nil stripe
+// disables card top-ups.
+func NewDepositHandler(deposits *data.DepositService, stripe *payments.Stripe, paginator *pagination.Paginator, successURL, cancelURL string) *DepositHandler {
+	return &DepositHandler{
+		deposits:   deposits,
+		stripe:     stripe,
+		paginator:  paginator,
+		successURL: successURL,
+		cancelURL:  cancelURL,
+	}
+}
+
+func registerDepositRoutes(e *echo.Echo, h *DepositHandler, authRequired, idempotent echo.MiddlewareFunc) {
+	e.GET("/credits/packs", h.handleListPacks)
+	e.POST("/credits/deposits", h.handleCreateDeposit, authRequired, idempotent)
+	e.GET("/users/me/deposits", h.handleListDeposits, authRequired)
+	e.GET("/moderation/deposits", h.handleListReviewDeposits, authRequired, requireRole(data.RoleModerator, data.RoleAdmin))
+	e.POST("/moderation/deposits/:id/decision", h.handleDecideDeposit, authRequired, requireRole(data.RoleModerator, data.RoleAdmin), idempotent)
+	// Stripe signs its webhooks; there is no session to check
+	e.POST("/webhooks/stripe", h.handleStripeWebhook)
+}
+
+// depositPage responds with a page of deposits, newest first
+func depositPage(c echo.Context, req pagination.Request, deposits []data.Deposit) error {
+	return c.JSON(http.StatusOK, pagination.NewPage(req, deposits, func(d data.Deposit) (interface{}, primitive.ObjectID) {
+		return d.CreatedAt, d.ID
+	}, c.Request().URL))
+}
+
+// handleListPacks lists the credit packs on sale
+func (h *DepositHandler) handleListPacks(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"packs":     data.CreditPacks,
+		"available": h.stripe != nil,
+	})
+}
+
+// handleCreateDeposit starts a card payment for a credit pack. The client
+// sends the buyer to checkout_url; credits are added once Stripe reports the
+// payment through the webhook.
+func (h *DepositHandler) handleCreateDeposit(c echo.Context) error {
+	if h.stripe == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Card payments are not available"})
+	}
+	var req CreateDepositRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+	pack, err := data.FindCreditPack(req.Pack)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	user := currentUser(c)
+	deposit, err := h.deposits.Create(ctx, user.ID, pack)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	session, err := h.stripe.CreateCheckoutSession(ctx, payments.CheckoutParams{
+		Amount:          deposit.Price,
+		Description:     fmt.Sprintf("%s in marketplace credits", deposit.Credits.Display()),
+		ClientReference: deposit.ID.Hex(),
+		Metadata:        map[string]string{"deposit_id": deposit.ID.Hex(), "user_id": user.ID.Hex()},
+		SuccessURL:      h.successURL,
+		CancelURL:       h.cancelURL,
+		IdempotencyKey:  "deposit-" + deposit.ID.Hex(),
+	})
+	if err != nil {
+		c.Logger().Errorf("creating checkout session for deposit %s failed: %v", deposit.ID.Hex(), err)
+		if err := h.deposits.Fail(ctx, "", "", deposit.ID, "The payment could not be started"); err != nil {
+			c.Logger().Errorf("failed to mark deposit %s failed: %v", deposit.ID.Hex(), err)
+		}
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "Payment provider error"})
+	}
+	if err := h.deposits.AttachCheckout(ctx, deposit.ID, session.ID); err != nil {
+		c.Logger().Errorf("failed to record checkout session %s for deposit %s: %v", session.ID, deposit.ID.Hex(), err)
+	}
+	deposit.CheckoutSessionID = session.ID
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"deposit":      deposit,
+		"checkout_url": session.URL,
+	})
+}
+
+// handleListDeposits lists the caller's card top-ups, newest first
+func (h *DepositHandler) handleListDeposits(c echo.Context) error {
+	sort := pagination.Sort{Field: "created_at", Desc: true}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, "deposits")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	deposits, err := h.deposits.ListForUser(c.Request().Context(), currentUser(c).ID, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return depositPage(c, req, deposits)
+}
+
+// handleListReviewDeposits is the moderators' queue of payments that were
+// collected but could not be credited automatically
+func (h *DepositHandler) handleListReviewDeposits(c echo.Context) error {
+	sort := pagination.Sort{Field: "created_at", Desc: true}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, "deposits:review")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	deposits, err := h.deposits.ListByStatus(c.Request().Context(), data.DepositStatusReview, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return depositPage(c, req, deposits)
+}
+
+// handleDecideDeposit settles a deposit held for review. Approving credits
+// the buyer; rejecting refunds the payment to their card. A rejection whose
+// refund failed stays refunding and is finished by deciding it again: the
+// refund's idempotency key makes sure the card is refunded once.
+func (h *DepositHandler) handleDecideDeposit(c echo.Context) error {
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid deposit ID"})
+	}
+	var req DecideDepositRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+	approve := req.Action == "approve"
+	if !approve && h.stripe == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Card payments are not available"})
+	}
+
+	ctx := c.Request().Context()
+	deposit, err := h.deposits.Decide(ctx, id, currentUser(c).ID, approve, req.Note)
+	switch err {
+	case nil:
+	case data.ErrDepositNotFound:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deposit not found"})
+	case data.ErrDepositNotInReview:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		c.Logger().Errorf("deciding deposit %s failed: %v", id.Hex(), err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to decide deposit"})
+	}
+	if deposit.Status != data.DepositStatusRefunding {
+		return c.JSON(http.StatusOK, deposit)
+	}
+
+	refund, err := h.stripe.RefundPayment(ctx, deposit.PaymentIntentID,
+		map[string]string{"deposit_id": deposit.ID.Hex()}, "deposit-refund-"+deposit.ID.Hex())
+	if err != nil {
+		c.Logger().Errorf("refunding deposit %s failed: %v", id.Hex(), err)
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "Payment provider error"})
+	}
+	deposit, err = h.deposits.Refunded(ctx, id, refund.ID)
+	if err != nil {
+		c.Logger().Errorf("failed to record refund %s for deposit %s: %v", refund.ID, id.Hex(), err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return c.JSON(http.StatusOK, deposit)
+}
+
+// handleStripeWebhook applies a signed Stripe event. Events that were
+// already applied, or that can never apply, are acknowledged so Stripe
+// stops sending them; anything else, including events that arrived before
+// the ones they follow, fails with 500 and is redelivered.
+func (h *DepositHandler) handleStripeWebhook(c echo.Context) error {
+	if h.stripe == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Not found"})
+	}
+	payload, err := io.ReadAll(io.LimitReader(c.Request().Body, maxWebhookBytes))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	event, err := h.stripe.ParseWebhook(payload, c.Request().Header.Get("Stripe-Signature"), time.Now())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	err = h.applyEvent(c.Request().Context(), event)
+	switch {
+	case err == nil, errors.Is(err, data.ErrPaymentEventProcessed):
+	case errors.Is(err, data.ErrDepositNotFound), errors.Is(err, data.ErrDepositNotPending):
+		c.Logger().Warnf("stripe event %s (%s) not applied: %v", event.ID, event.Type, err)
+	case errors.Is(err, data.ErrDepositNotSettled):
+		c.Logger().Warnf("stripe event %s (%s) arrived early, waiting for redelivery: %v", event.ID, event.Type, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Event arrived out of order"})
+	default:
+		c.Logger().Errorf("applying stripe event %s (%s) failed: %v", event.ID, event.Type, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to process event"})
+	}
+	return c.JSON(http.StatusOK, map[string]bool{"received": true})
+}
+
+// depositID reads the deposit a Stripe object was created for
+func depositID(hex string) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return id, data.ErrDepositNotFound
+	}
+	return id, nil
+}
+
+// applyEvent moves the deposit event is about along. Event types the
+// marketplace does not act on are ignored.
+func (h *DepositHandler) applyEvent(ctx context.Context, event *payments.Event) error {
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded",
+		"checkout.session.async_payment_failed", "checkout.session.expired":
+		var session payments.CheckoutSession
+		if err := event.Decode(&session); err != nil {
+			return err
+		}
+		id, err := depositID(session.ClientReference)
+		if err != nil {
+			return err
+		}
+		switch event.Type {
+		case "checkout.session.async_payment_failed":
+			return h.deposits.Fail(ctx, event.ID, event.Type, id, "The payment failed")
+		case "checkout.session.expired":
+			return h.deposits.Fail(ctx, event.ID, event.Type, id, "The checkout session expired")
+		}
+		if session.PaymentStatus != "paid" {
+			// Delayed payment methods complete with an async event later
+			return nil
+		}
+		_, err = h.deposits.Complete(ctx, event.ID, event.Type, id, session.PaymentIntent, session.Total())
+		return err
+
+	case "payment_intent.payment_failed":
+		var intent payments.PaymentIntent
+		if err := event.Decode(&intent); err != nil {
+			return err
+		}
+		id, err := depositID(intent.Metadata["deposit_id"])
+		if err != nil {
+			return err
+		}
+		reason := "The payment failed"
+		if intent.LastPaymentError != nil && intent.LastPaymentError.Message != "" {
+			reason = intent.LastPaymentError.Message
+		}
+		return h.deposits.NoteFailure(ctx, id, reason)
+
+	case "charge.dispute.created", "charge.dispute.closed":
+		var dispute payments.Dispute
+		if err := event.Decode(&dispute); err != nil {
+			return err
+		}
+		// The deposit may not have completed yet, so it is found through
+		// the metadata Checkout copied onto the PaymentIntent
+		intent, err := h.stripe.PaymentIntent(ctx, dispute.PaymentIntent)
+		if err != nil {
+			return err
+		}
+		id, err := depositID(intent.Metadata["deposit_id"])
+		if err != nil {
+			return err
+		}
+		if event.Type == "charge.dispute.created" {
+			return h.deposits.Dispute(ctx, event.ID, event.Type, id, dispute.Total())
+		}
+		return h.deposits.ResolveDispute(ctx, event.ID, event.Type, id, dispute.Won())
+	}
+	return nil
+}
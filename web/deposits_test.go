@@ -0,0 +1,136 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kordlab/marketplace/config"
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/payments"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestHandleStripeWebhook(t *testing.T) {
+	stripe := payments.NewStripe(payments.StripeOptions{WebhookSecret: "whsec_test"})
+	h := NewDepositHandler(nil, stripe, nil, "", "")
+	e := echo.New()
+	e.POST("/webhooks/stripe", h.handleStripeWebhook)
+
+	send := func(payload, signature string) int {
+		req := httptest.NewRequest(http.MethodPost, "/webhooks/stripe", strings.NewReader(payload))
+		req.Header.Set("Stripe-Signature", signature)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	payload := `{"id":"evt_1","type":"customer.created","data":{"object":{}}}`
+	assert.Equal(t, http.StatusOK, send(payload, payments.SignWebhook("whsec_test", []byte(payload), time.Now())),
+		"events the marketplace does not act on are acknowledged")
+	assert.Equal(t, http.StatusBadRequest, send(payload, payments.SignWebhook("whsec_other", []byte(payload), time.Now())))
+	assert.Equal(t, http.StatusBadRequest, send(payload, ""))
+
+	unconfigured := echo.New()
+	unconfigured.POST("/webhooks/stripe", NewDepositHandler(nil, nil, nil, "", "").handleStripeWebhook)
+	rec := httptest.NewRecorder()
+	unconfigured.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/webhooks/stripe", strings.NewReader(payload)))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHandleDecideDeposit(t *testing.T) {
+	cfg := config.LoadConfig()
+	cfg.DatabaseName = "marketplace_deposits_test_" + primitive.NewObjectID().Hex()
+	m, err := data.NewMongoDB(cfg)
+	if err != nil {
+		t.Skipf("MongoDB unavailable: %v", err)
+	}
+	ctx := context.Background()
+	t.Cleanup(func() {
+		m.Client().Database(cfg.DatabaseName).Drop(ctx)
+		m.Close(ctx)
+	})
+
+	refunds := 0
+	stripeDown := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stripeDown {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		refunds++
+		assert.Equal(t, "/v1/refunds", r.URL.Path)
+		fmt.Fprintf(w, `{"id":"re_1","status":"succeeded","payment_intent":%q}`, r.FormValue("payment_intent"))
+	}))
+	defer srv.Close()
+
+	deposits := data.NewDepositService(m, data.NewLedgerRepository(m), data.NewNotificationRepository(m))
+	stripe := payments.NewStripe(payments.StripeOptions{APIBase: srv.URL, SecretKey: "sk_test_123"})
+	h := NewDepositHandler(deposits, stripe, nil, "", "")
+	moderator := &data.CachedUser{ID: primitive.NewObjectID(), Role: data.RoleModerator}
+	e := echo.New()
+	e.Validator = newRequestValidator()
+	e.POST("/moderation/deposits/:id/decision", h.handleDecideDeposit, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("user", moderator)
+			return next(c)
+		}
+	})
+	decide := func(id primitive.ObjectID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/moderation/deposits/"+id.Hex()+"/decision", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	buyer := primitive.NewObjectID()
+	_, err = m.Users().InsertOne(ctx, data.User{ID: buyer, Username: "buyer", Email: "buyer@example.com",
+		Status: data.UserStatusActive, Credits: data.Credits{Balance: money.Zero(data.SettlementCurrency)}})
+	require.NoError(t, err)
+	pack, err := data.FindCreditPack("credits_25")
+	require.NoError(t, err)
+	held := func() primitive.ObjectID {
+		deposit, err := deposits.Create(ctx, buyer, pack)
+		require.NoError(t, err)
+		_, err = deposits.Complete(ctx, "evt_"+deposit.ID.Hex(), "checkout.session.completed", deposit.ID, "pi_"+deposit.ID.Hex(),
+			money.New(100, data.SettlementCurrency))
+		require.NoError(t, err)
+		return deposit.ID
+	}
+	balance := func() money.Money {
+		var user data.User
+		require.NoError(t, m.Users().FindOne(ctx, bson.M{"_id": buyer}).Decode(&user))
+		return user.Credits.Balance
+	}
+
+	assert.Equal(t, http.StatusBadRequest, decide(primitive.NewObjectID(), `{"action":"ignore"}`).Code)
+	assert.Equal(t, http.StatusNotFound, decide(primitive.NewObjectID(), `{"action":"approve"}`).Code)
+
+	approved := held()
+	assert.Equal(t, http.StatusOK, decide(approved, `{"action":"approve"}`).Code)
+	assert.Equal(t, money.New(2500, data.SettlementCurrency), balance())
+	assert.Equal(t, http.StatusOK, decide(approved, `{"action":"approve"}`).Code, "deciding again is a no-op")
+	assert.Equal(t, money.New(2500, data.SettlementCurrency), balance())
+	assert.Equal(t, http.StatusConflict, decide(approved, `{"action":"reject"}`).Code)
+
+	rejected := held()
+	assert.Equal(t, http.StatusBadGateway, decide(rejected, `{"action":"reject","note":"Wrong amount"}`).Code)
+	assert.Equal(t, http.StatusConflict, decide(rejected, `{"action":"approve"}`).Code, "a refunding deposit cannot be credited")
+	stripeDown = false
+	rec := decide(rejected, `{"action":"reject","note":"Wrong amount"}`)
+	require.Equal(t, http.StatusOK, rec.Code, "the interrupted refund is finished")
+	assert.Contains(t, rec.Body.String(), `"status":"reversed"`)
+	assert.Equal(t, http.StatusOK, decide(rejected, `{"action":"reject"}`).Code)
+	assert.Equal(t, 1, refunds, "the payment is refunded once")
+	assert.Equal(t, money.New(2500, data.SettlementCurrency), balance(), "nothing is credited for a refunded payment")
+}
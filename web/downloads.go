@@ -0,0 +1,368 @@
+package web
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/storage"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	errInvalidDownloadSignature = errors.New("invalid download link")
+	errDownloadLinkExpired      = errors.New("download link has expired")
+)
+
+// downloadSigner issues and checks time-limited download URLs. The signature
+// covers the purchase, the product, the version and the expiry, so none of
+// them can be changed without invalidating the link.
+type downloadSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func newDownloadSigner(secret string, ttl time.Duration) *downloadSigner {
+	return &downloadSigner{secret: []byte(secret), ttl: ttl}
+}
+
+func (s *downloadSigner) signature(purchaseID, productID primitive.ObjectID, version string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", purchaseID.Hex(), productID.Hex(), version, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns a relative download URL valid until the returned time
+func (s *downloadSigner) URL(purchaseID, productID primitive.ObjectID, version string, now time.Time) (string, time.Time) {
+	expires := now.Add(s.ttl).Truncate(time.Second)
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("signature", s.signature(purchaseID, productID, version, expires.Unix()))
+	return fmt.Sprintf("/downloads/%s/%s/%s?%s", purchaseID.Hex(), productID.Hex(), url.PathEscape(version), q.Encode()), expires
+}
+
+func (s *downloadSigner) Verify(purchaseID, productID primitive.ObjectID, version, expiresRaw, signature string, now time.Time) error {
+	expires, err := strconv.ParseInt(expiresRaw, 10, 64)
+	if err != nil {
+		return errInvalidDownloadSignature
+	}
+	want := s.signature(purchaseID, productID, version, expires)
+	if !hmac.Equal([]byte(want), []byte(signature)) {
+		return errInvalidDownloadSignature
+	}
+	if now.Unix() > expires {
+		return errDownloadLinkExpired
+	}
+	return nil
+}
+
+// blobReadSeeker adapts a BlobStore object to io.ReadSeeker for
+// http.ServeContent, reopening the blob at the new offset after each seek.
+type blobReadSeeker struct {
+	ctx    context.Context
+	store  storage.BlobStore
+	key    string
+	size   int64
+	offset int64
+	rc     io.ReadCloser
+}
+
+func (b *blobReadSeeker) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.rc == nil {
+		rc, err := b.store.Open(b.ctx, b.key, b.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		b.rc = rc
+	}
+	n, err := b.rc.Read(p)
+	b.offset += int64(n)
+	return n, err
+}
+
+func (b *blobReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative seek offset")
+	}
+	if offset != b.offset {
+		b.Close()
+		b.offset = offset
+	}
+	return offset, nil
+}
+
+func (b *blobReadSeeker) Close() error {
+	if b.rc == nil {
+		return nil
+	}
+	err := b.rc.Close()
+	b.rc = nil
+	return err
+}
+
+type DownloadHandler struct {
+	purchases    *data.PurchaseRepository
+	products     *data.ProductRepository
+	entitlements *data.EntitlementRepository
+	blobs        storage.BlobStore
+	signer       *downloadSigner
+	maxDownloads int
+}
+
+func NewDownloadHandler(purchases *data.PurchaseRepository, products *data.ProductRepository, entitlements *data.EntitlementRepository, blobs storage.BlobStore, signingKey string, linkTTL time.Duration, maxDownloads int) *DownloadHandler {
+	return &DownloadHandler{
+		purchases:    purchases,
+		products:     products,
+		entitlements: entitlements,
+		blobs:        blobs,
+		signer:       newDownloadSigner(signingKey, linkTTL),
+		maxDownloads: maxDownloads,
+	}
+}
+
+func registerDownloadRoutes(e *echo.Echo, h *DownloadHandler, authRequired echo.MiddlewareFunc) {
+	e.POST("/purchases/:id/download-link", h.handleCreateDownloadLink, authRequired)
+	// Signed links carry their own authorisation so download managers can
+	// resume without the buyer's session.
+	e.GET("/downloads/:purchase/:product/:version", h.handleDownload)
+	e.HEAD("/downloads/:purchase/:product/:version", h.handleDownload)
+}
+
+// downloadGrant is what a purchase entitles its buyer to download: a product
+// directly bought, or one contained in a bought bundle
+type downloadGrant struct {
+	purchase *data.Purchase
+	product  *data.Product
+	// pinned is the version the buyer is entitled to; with updates they may
+	// also fetch any later version that has not been yanked
+	pinned          string
+	includesUpdates bool
+	// maxDownloads is the purchase's limit, scaled by the number of items in
+	// a bundle
+	maxDownloads int
+}
+
+// resolveGrant works out what purchase entitles its buyer to for productID,
+// which defaults to the purchased product. It returns data.ErrNotEntitled
+// when the purchase does not cover the product.
+func (h *DownloadHandler) resolveGrant(ctx context.Context, purchase *data.Purchase, productID primitive.ObjectID) (*downloadGrant, error) {
+	if productID.IsZero() {
+		productID = purchase.ProductID
+	}
+	// Cached products do not carry storage keys, so read from Mongo
+	purchased, err := h.products.FindByID(ctx, purchase.ProductID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !purchased.IsBundle() {
+		if productID != purchased.ID {
+			return nil, data.ErrNotEntitled
+		}
+		return &downloadGrant{
+			purchase:        purchase,
+			product:         purchased,
+			pinned:          purchase.ProductVersion,
+			includesUpdates: true,
+			maxDownloads:    h.maxDownloads,
+		}, nil
+	}
+
+	entitlement, err := h.entitlements.Find(ctx, purchase.UserID, productID, purchase.ID)
+	if err != nil {
+		return nil, err
+	}
+	product, err := h.products.FindByID(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	return &downloadGrant{
+		purchase:        purchase,
+		product:         product,
+		pinned:          entitlement.Version,
+		includesUpdates: entitlement.IncludesUpdates,
+		maxDownloads:    h.maxDownloads * len(purchased.Bundle.Items),
+	}, nil
+}
+
+// version picks the version to serve. Buyers always keep their pinned
+// version; with updates they may also fetch any other version that has not
+// been yanked, and default to the latest one when nothing was pinned.
+func (g *downloadGrant) version(requested string) (*data.ProductVersion, bool) {
+	if requested == "" {
+		requested = g.pinned
+	}
+	if requested == "" && g.includesUpdates {
+		if latest, err := g.product.LatestVersion(); err == nil {
+			requested = latest.Version
+		}
+	}
+	version, ok := g.product.FindVersion(requested)
+	if !ok || !version.HasFile() {
+		return nil, false
+	}
+	if version.Version != g.pinned &&
+		(!g.includesUpdates || version.EffectiveStatus() == data.VersionStatusYanked) {
+		return nil, false
+	}
+	return version, true
+}
+
+// loadGrant resolves the grant for a request, writing the error response
+// and returning nil if there is none
+func (h *DownloadHandler) loadGrant(c echo.Context, purchase *data.Purchase, productID primitive.ObjectID, requested string) (*downloadGrant, *data.ProductVersion, error) {
+	if !purchase.CanDownload(time.Now()) {
+		return nil, nil, c.JSON(http.StatusForbidden, map[string]string{"error": "Purchase does not grant downloads"})
+	}
+	grant, err := h.resolveGrant(c.Request().Context(), purchase, productID)
+	if err == data.ErrNotEntitled {
+		return nil, nil, c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return nil, nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	version, ok := grant.version(requested)
+	if !ok {
+		return nil, nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Version not available for download"})
+	}
+	return grant, version, nil
+}
+
+// handleCreateDownloadLink issues a signed link for one of the caller's
+// completed purchases. ?product= picks an item of a purchased bundle and
+// ?version= a version other than the one purchased.
+func (h *DownloadHandler) handleCreateDownloadLink(c echo.Context) error {
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid purchase ID"})
+	}
+	var productID primitive.ObjectID
+	if raw := c.QueryParam("product"); raw != "" {
+		if productID, err = primitive.ObjectIDFromHex(raw); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+		}
+	}
+
+	purchase, err := h.purchases.FindByID(c.Request().Context(), id)
+	if err == data.ErrPurchaseNotFound || (err == nil && purchase.UserID != currentUser(c).ID) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Purchase not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	grant, version, err := h.loadGrant(c, purchase, productID, c.QueryParam("version"))
+	if grant == nil {
+		return err
+	}
+	if grant.maxDownloads > 0 && purchase.DownloadCount >= grant.maxDownloads {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": data.ErrDownloadLimitReached.Error()})
+	}
+
+	link, expires := h.signer.URL(purchase.ID, grant.product.ID, version.Version, time.Now())
+	resp := map[string]interface{}{
+		"url":        link,
+		"product_id": grant.product.ID,
+		"version":    version.Version,
+		"expires_at": expires,
+	}
+	if grant.maxDownloads > 0 {
+		resp["downloads_remaining"] = grant.maxDownloads - purchase.DownloadCount
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleDownload serves a file through a signed link. Range requests are
+// honoured so interrupted downloads can resume; each link counts as one
+// download however many requests it takes.
+func (h *DownloadHandler) handleDownload(c echo.Context) error {
+	purchaseID, err := parseObjectIDParam(c, "purchase")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid purchase ID"})
+	}
+	productID, err := parseObjectIDParam(c, "product")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+	}
+	requested, err := url.PathUnescape(c.Param("version"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid version"})
+	}
+	err = h.signer.Verify(purchaseID, productID, requested, c.QueryParam("expires"), c.QueryParam("signature"), time.Now())
+	if err != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+	ctx := c.Request().Context()
+
+	// Re-check the purchase: it may have been refunded since the link was issued
+	purchase, err := h.purchases.FindByID(ctx, purchaseID)
+	if err == data.ErrPurchaseNotFound {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Purchase not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	grant, version, err := h.loadGrant(c, purchase, productID, requested)
+	if grant == nil {
+		return err
+	}
+
+	if c.Request().Method == http.MethodGet {
+		// Whatever the Range header asks for, the link's first request
+		// counts; later ones resume it
+		counted, err := h.purchases.RecordDownload(ctx, purchase.ID, c.QueryParam("signature"), grant.maxDownloads)
+		if err == data.ErrDownloadLimitReached {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if counted {
+			if err := h.products.IncrementDownloads(ctx, grant.product.ID); err != nil {
+				c.Logger().Errorf("failed to count download of product %s: %v", grant.product.ID.Hex(), err)
+			}
+		}
+	}
+
+	if version.StorageKey == "" {
+		return c.Redirect(http.StatusFound, version.DownloadURL)
+	}
+
+	content := &blobReadSeeker{ctx: ctx, store: h.blobs, key: version.StorageKey, size: version.FileSize}
+	defer content.Close()
+
+	header := c.Response().Header()
+	if version.ContentType != "" {
+		header.Set(echo.HeaderContentType, version.ContentType)
+	}
+	if version.SHA256 != "" {
+		// A strong validator lets clients resume with If-Range
+		header.Set("ETag", `"`+version.SHA256+`"`)
+	}
+	header.Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{
+		"filename": version.FileName,
+	}))
+	header.Set("Cache-Control", "private, no-store")
+	http.ServeContent(c.Response(), c.Request(), version.FileName, version.ReleasedAt, content)
+	return nil
+}
@@ -0,0 +1,188 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kordlab/marketplace/config"
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/storage"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDownloadSigner(t *testing.T) {
+	signer := newDownloadSigner("test-secret", time.Minute)
+	purchaseID, productID := primitive.NewObjectID(), primitive.NewObjectID()
+	now := time.Now()
+
+	link, expires := signer.URL(purchaseID, productID, "1.0.0+build.1", now)
+	assert.WithinDuration(t, now.Add(time.Minute), expires, time.Second)
+
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	assert.Equal(t, "/downloads/"+purchaseID.Hex()+"/"+productID.Hex()+"/1.0.0+build.1", u.Path)
+	q := u.Query()
+
+	assert.NoError(t, signer.Verify(purchaseID, productID, "1.0.0+build.1", q.Get("expires"), q.Get("signature"), now))
+	assert.Equal(t, errInvalidDownloadSignature,
+		signer.Verify(purchaseID, productID, "2.0.0", q.Get("expires"), q.Get("signature"), now))
+	assert.Equal(t, errInvalidDownloadSignature,
+		signer.Verify(primitive.NewObjectID(), productID, "1.0.0+build.1", q.Get("expires"), q.Get("signature"), now))
+	assert.Equal(t, errInvalidDownloadSignature,
+		signer.Verify(purchaseID, primitive.NewObjectID(), "1.0.0+build.1", q.Get("expires"), q.Get("signature"), now))
+	assert.Equal(t, errInvalidDownloadSignature,
+		signer.Verify(purchaseID, productID, "1.0.0+build.1", "9999999999", q.Get("signature"), now))
+	assert.Equal(t, errDownloadLinkExpired,
+		signer.Verify(purchaseID, productID, "1.0.0+build.1", q.Get("expires"), q.Get("signature"), now.Add(2*time.Minute)))
+
+	other := newDownloadSigner("other-secret", time.Minute)
+	assert.Equal(t, errInvalidDownloadSignature,
+		other.Verify(purchaseID, productID, "1.0.0+build.1", q.Get("expires"), q.Get("signature"), now))
+}
+
+func TestDownloadGrantVersion(t *testing.T) {
+	product := &data.Product{Versions: []data.ProductVersion{
+		{Version: "1.0.0", StorageKey: "a", ReleasedAt: time.Now().Add(-2 * time.Hour)},
+		{Version: "1.1.0", StorageKey: "b", ReleasedAt: time.Now().Add(-time.Hour), Status: data.VersionStatusYanked},
+		{Version: "1.2.0", StorageKey: "c", ReleasedAt: time.Now()},
+	}}
+
+	tests := []struct {
+		name      string
+		pinned    string
+		updates   bool
+		requested string
+		want      string
+	}{
+		{"Defaults To Pinned", "1.0.0", true, "", "1.0.0"},
+		{"Later Version With Updates", "1.0.0", true, "1.2.0", "1.2.0"},
+		{"Later Version Without Updates", "1.0.0", false, "1.2.0", ""},
+		{"Yanked Version", "1.0.0", true, "1.1.0", ""},
+		{"Pinned Yanked Version", "1.1.0", false, "", "1.1.0"},
+		{"Nothing Pinned", "", true, "", "1.2.0"},
+		{"Unknown Version", "1.0.0", true, "9.9.9", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grant := &downloadGrant{product: product, pinned: tt.pinned, includesUpdates: tt.updates}
+			version, ok := grant.version(tt.requested)
+			if tt.want == "" {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, tt.want, version.Version)
+		})
+	}
+}
+
+func TestBlobReadSeekerServesRanges(t *testing.T) {
+	ctx := context.Background()
+	store, err := storage.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	content := "0123456789abcdefghij"
+	require.NoError(t, store.Put(ctx, "p/file.bin", strings.NewReader(content), int64(len(content)), storage.PutOptions{}))
+
+	serve := func(rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/downloads/x/1.0.0", nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		rec := httptest.NewRecorder()
+		rs := &blobReadSeeker{ctx: ctx, store: store, key: "p/file.bin", size: int64(len(content))}
+		defer rs.Close()
+		http.ServeContent(rec, req, "file.bin", time.Time{}, rs)
+		return rec
+	}
+
+	rec := serve("")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.String())
+
+	rec = serve("bytes=10-")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "abcdefghij", rec.Body.String())
+	assert.Equal(t, "bytes 10-19/20", rec.Header().Get("Content-Range"))
+
+	rec = serve("bytes=2-4")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "234", rec.Body.String())
+}
+
+func TestHandleDownloadLimit(t *testing.T) {
+	cfg := config.LoadConfig()
+	cfg.DatabaseName = "marketplace_downloads_test_" + primitive.NewObjectID().Hex()
+	m, err := data.NewMongoDB(cfg)
+	if err != nil {
+		t.Skipf("MongoDB unavailable: %v", err)
+	}
+	ctx := context.Background()
+	t.Cleanup(func() {
+		m.Client().Database(cfg.DatabaseName).Drop(ctx)
+		m.Close(ctx)
+	})
+
+	store, err := storage.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	content := strings.Repeat("0123456789", 20)
+	require.NoError(t, store.Put(ctx, "p/file.bin", strings.NewReader(content), int64(len(content)), storage.PutOptions{}))
+
+	product := data.Product{ID: primitive.NewObjectID(), Title: "Pack", Versions: []data.ProductVersion{
+		{Version: "1.0.0", StorageKey: "p/file.bin", FileName: "file.bin", FileSize: int64(len(content)), ReleasedAt: time.Now()},
+	}}
+	_, err = m.Products().InsertOne(ctx, product)
+	require.NoError(t, err)
+	newPurchase := func() primitive.ObjectID {
+		purchase := data.Purchase{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), ProductID: product.ID,
+			ProductVersion: "1.0.0", Status: data.PurchaseStatusCompleted, CreatedAt: time.Now()}
+		_, err := m.Purchases().InsertOne(ctx, purchase)
+		require.NoError(t, err)
+		return purchase.ID
+	}
+
+	products := data.NewProductRepository(m, nil)
+	h := NewDownloadHandler(data.NewPurchaseRepository(m), products, data.NewEntitlementRepository(m), store, "test-secret", time.Hour, 1)
+	e := echo.New()
+	e.GET("/downloads/:purchase/:product/:version", h.handleDownload)
+	get := func(link, rng string) int {
+		req := httptest.NewRequest(http.MethodGet, link, nil)
+		req.Header.Set("Range", rng)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	downloads := func(id primitive.ObjectID) int {
+		purchase, err := data.NewPurchaseRepository(m).FindByID(ctx, id)
+		require.NoError(t, err)
+		return purchase.DownloadCount
+	}
+
+	first := newPurchase()
+	link, _ := h.signer.URL(first, product.ID, "1.0.0", time.Now())
+	assert.Equal(t, http.StatusPartialContent, get(link, "bytes=1-"), "a download starting past the first byte counts")
+	assert.Equal(t, 1, downloads(first))
+	assert.Equal(t, http.StatusPartialContent, get(link, "bytes=-100"), "the same link resumes")
+	assert.Equal(t, 1, downloads(first))
+
+	another, _ := h.signer.URL(first, product.ID, "1.0.0", time.Now().Add(time.Minute))
+	assert.Equal(t, http.StatusForbidden, get(another, "bytes=1-"), "a new link after the limit is reached")
+	assert.Equal(t, http.StatusForbidden, get(another, "bytes=-100"))
+	assert.Equal(t, http.StatusForbidden, get(another, "bytes=0-9,20-29"))
+
+	second := newPurchase()
+	link, _ = h.signer.URL(second, product.ID, "1.0.0", time.Now())
+	assert.Equal(t, http.StatusPartialContent, get(link, "bytes=-100"), "a suffix range counts")
+	assert.Equal(t, 1, downloads(second))
+
+	counted, err := products.FindByID(ctx, product.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, counted.DownloadCount)
+}
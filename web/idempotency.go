@@ -0,0 +1,189 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	// idempotencyLockTTL bounds how long a request that never finishes, for
+	// instance because the server went down, keeps its key claimed. A
+	// request that is still running refreshes its claim every third of it.
+	idempotencyLockTTL = time.Minute
+)
+
+// idempotencySkipHeaders describe the request that produced a response
+// rather than the response itself, so they are not replayed
+var idempotencySkipHeaders = map[string]bool{
+	"Ratelimit-Limit":     true,
+	"Ratelimit-Remaining": true,
+	"Ratelimit-Reset":     true,
+	"Retry-After":         true,
+	"Set-Cookie":          true,
+}
+
+// Idempotency lets clients retry mutating requests safely. A request
+// carrying an Idempotency-Key header claims the key for its caller; the
+// response is stored in Redis and replayed for every retry with the same
+// key, so the handler runs once.
+type Idempotency struct {
+	redis   *data.RedisDB
+	ttl     time.Duration
+	lockTTL time.Duration
+}
+
+// NewIdempotency keeps responses for ttl after the first request
+func NewIdempotency(redis *data.RedisDB, ttl time.Duration) *Idempotency {
+	return &Idempotency{redis: redis, ttl: ttl, lockTTL: idempotencyLockTTL}
+}
+
+// requestFingerprint identifies a request by its method, URL and body
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+"\n"+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// bodyRecorder copies what the handler writes so it can be stored
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Middleware applies idempotency keys to the routes it is attached to.
+// Requests without a key pass through. A retry gets the stored response
+// back; a retry while the first request is still running gets 409, and a
+// key reused for a different request gets 422. Server errors are not
+// stored, so the request can be retried once the problem is fixed. Unlike
+// rate limiting this fails closed: without Redis a retry could not be
+// told apart from a new request.
+func (i *Idempotency) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(idempotencyKeyHeader)
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Idempotency-Key is too long"})
+			}
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			fingerprint := requestFingerprint(c.Request(), body)
+
+			// Keys are per caller, so two users cannot collide or replay
+			// each other's responses
+			storeKey := "idempotency:" + RateLimitByUser(c) + ":" + key
+			// Store the outcome even if the client has gone away
+			ctx := context.WithoutCancel(c.Request().Context())
+			token := primitive.NewObjectID().Hex()
+			stored, claimed, err := i.redis.ClaimIdempotencyKey(ctx, storeKey, fingerprint, token, i.lockTTL)
+			if err != nil {
+				c.Logger().Error("Idempotency key check failed:", err)
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Service unavailable"})
+			}
+			if !claimed {
+				switch {
+				case stored.Fingerprint != fingerprint:
+					return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Idempotency-Key was already used for a different request"})
+				case stored.InFlight():
+					return c.JSON(http.StatusConflict, map[string]string{"error": "A request with this Idempotency-Key is still in progress"})
+				}
+				return replayResponse(c, stored)
+			}
+
+			res := c.Response()
+			recorder := &bodyRecorder{ResponseWriter: res.Writer}
+			res.Writer = recorder
+			stop := i.holdClaim(ctx, c.Logger(), storeKey, fingerprint, token)
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+			stop()
+			res.Writer = recorder.ResponseWriter
+
+			if !res.Committed || res.Status >= http.StatusInternalServerError {
+				if err := i.redis.ReleaseIdempotencyKey(ctx, storeKey, fingerprint, token); err != nil {
+					c.Logger().Error("Failed to release idempotency key:", err)
+				}
+				return nil
+			}
+			header := map[string][]string{}
+			for name, values := range res.Header() {
+				if !idempotencySkipHeaders[name] {
+					header[name] = values
+				}
+			}
+			err = i.redis.StoreIdempotentResponse(ctx, storeKey, token, &data.IdempotentResponse{
+				Fingerprint: fingerprint,
+				Status:      res.Status,
+				Header:      header,
+				Body:        recorder.body.Bytes(),
+			}, i.ttl)
+			if err != nil {
+				c.Logger().Error("Failed to store idempotent response:", err)
+			}
+			return nil
+		}
+	}
+}
+
+// holdClaim refreshes the claim token holds on key until the returned
+// function is called, so a request keeps its key however long its handler
+// runs. A server that goes down stops refreshing and the claim expires.
+func (i *Idempotency) holdClaim(ctx context.Context, logger echo.Logger, key, fingerprint, token string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(i.lockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := i.redis.RefreshIdempotencyKey(ctx, key, fingerprint, token, i.lockTTL); err != nil {
+					logger.Error("Failed to refresh idempotency key:", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// replayResponse writes a stored response again
+func replayResponse(c echo.Context, stored *data.IdempotentResponse) error {
+	header := c.Response().Header()
+	for name, values := range stored.Header {
+		header[name] = values
+	}
+	header.Set(idempotentReplayedHeader, "true")
+	c.Response().WriteHeader(stored.Status)
+	_, err := c.Response().Write(stored.Body)
+	return err
+}
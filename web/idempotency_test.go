@@ -0,0 +1,145 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kordlab/marketplace/config"
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestIdempotency(t *testing.T) (*Idempotency, *data.RedisDB) {
+	idempotency, redis, _ := newTestIdempotencyServer(t)
+	return idempotency, redis
+}
+
+func newTestIdempotencyServer(t *testing.T) (*Idempotency, *data.RedisDB, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	redis, err := data.NewRedisDB(&config.Config{RedisURL: mr.Addr()})
+	require.NoError(t, err)
+	t.Cleanup(func() { redis.Close() })
+	return NewIdempotency(redis, time.Hour), redis, mr
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	idempotency, redis := newTestIdempotency(t)
+	calls := 0
+	status := http.StatusCreated
+	e := echo.New()
+	e.POST("/checkout", func(c echo.Context) error {
+		calls++
+		c.Response().Header().Set("Location", "/purchases/1")
+		return c.JSON(status, map[string]int{"call": calls})
+	}, idempotency.Middleware())
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/checkout", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := send("order-1", `{"product_id":"a"}`)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	retry := send("order-1", `{"product_id":"a"}`)
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "/purchases/1", retry.Header().Get("Location"))
+	assert.Equal(t, "true", retry.Header().Get(idempotentReplayedHeader))
+	assert.Equal(t, 1, calls, "a retry does not run the handler again")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, send("order-1", `{"product_id":"b"}`).Code)
+	send("", `{"product_id":"a"}`)
+	send("", `{"product_id":"a"}`)
+	assert.Equal(t, 3, calls, "requests without a key are not deduplicated")
+
+	_, claimed, err := redis.ClaimIdempotencyKey(context.Background(), "idempotency:ip:192.0.2.1:order-2", "other", "t1", time.Minute)
+	require.NoError(t, err)
+	require.True(t, claimed)
+	assert.Equal(t, http.StatusUnprocessableEntity, send("order-2", `{}`).Code)
+	_, claimed, err = redis.ClaimIdempotencyKey(context.Background(), "idempotency:ip:192.0.2.1:order-3",
+		requestFingerprint(httptest.NewRequest(http.MethodPost, "/checkout", nil), []byte(`{}`)), "t2", time.Minute)
+	require.NoError(t, err)
+	require.True(t, claimed)
+	assert.Equal(t, http.StatusConflict, send("order-3", `{}`).Code, "a retry while the first request runs")
+
+	status = http.StatusInternalServerError
+	send("order-4", `{}`)
+	status = http.StatusCreated
+	assert.Equal(t, http.StatusCreated, send("order-4", `{}`).Code, "server errors can be retried")
+	assert.Equal(t, 5, calls)
+
+	assert.Equal(t, http.StatusBadRequest, send(strings.Repeat("k", maxIdempotencyKeyLength+1), `{}`).Code)
+}
+
+func TestIdempotencyHoldsClaimWhileRunning(t *testing.T) {
+	idempotency, _, mr := newTestIdempotencyServer(t)
+	idempotency.lockTTL = 30 * time.Millisecond
+	key := "idempotency:ip:192.0.2.1:slow"
+	calls := 0
+	e := echo.New()
+	e.POST("/checkout", func(c echo.Context) error {
+		calls++
+		// Without refreshes the claim would expire halfway through
+		for n := 0; n < 3; n++ {
+			mr.FastForward(idempotency.lockTTL / 2)
+			require.Eventually(t, func() bool { return mr.TTL(key) == idempotency.lockTTL }, time.Second, time.Millisecond)
+		}
+		return c.JSON(http.StatusCreated, map[string]int{"call": calls})
+	}, idempotency.Middleware())
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/checkout", strings.NewReader(`{}`))
+		req.Header.Set(idempotencyKeyHeader, "slow")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(t, http.StatusCreated, send().Code)
+	retry := send()
+	assert.Equal(t, "true", retry.Header().Get(idempotentReplayedHeader))
+	assert.Equal(t, 1, calls)
+}
+
+func TestIdempotencyStaleClaim(t *testing.T) {
+	_, redis, mr := newTestIdempotencyServer(t)
+	ctx := context.Background()
+	key := "idempotency:ip:192.0.2.1:order"
+
+	_, claimed, err := redis.ClaimIdempotencyKey(ctx, key, "fp", "first", time.Minute)
+	require.NoError(t, err)
+	require.True(t, claimed)
+	mr.FastForward(time.Minute)
+	_, claimed, err = redis.ClaimIdempotencyKey(ctx, key, "fp", "second", time.Minute)
+	require.NoError(t, err)
+	require.True(t, claimed, "an expired claim can be taken again")
+
+	stale := &data.IdempotentResponse{Fingerprint: "fp", Status: http.StatusCreated, Body: []byte("first")}
+	assert.Equal(t, data.ErrIdempotencyClaimLost, redis.StoreIdempotentResponse(ctx, key, "first", stale, time.Hour))
+	assert.Equal(t, data.ErrIdempotencyClaimLost, redis.ReleaseIdempotencyKey(ctx, key, "fp", "first"))
+	assert.Equal(t, data.ErrIdempotencyClaimLost, redis.RefreshIdempotencyKey(ctx, key, "fp", "first", time.Minute))
+	stored, claimed, err := redis.ClaimIdempotencyKey(ctx, key, "fp", "third", time.Minute)
+	require.NoError(t, err)
+	require.False(t, claimed)
+	assert.True(t, stored.InFlight(), "the stale request left the current claim alone")
+
+	fresh := &data.IdempotentResponse{Fingerprint: "fp", Status: http.StatusCreated, Body: []byte("second")}
+	require.NoError(t, redis.StoreIdempotentResponse(ctx, key, "second", fresh, time.Hour))
+	stored, _, err = redis.ClaimIdempotencyKey(ctx, key, "fp", "third", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), stored.Body)
+	assert.Equal(t, data.ErrIdempotencyClaimLost, redis.ReleaseIdempotencyKey(ctx, key, "fp", "second"),
+		"a stored response is not a claim")
+}
@@ -0,0 +1,418 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/imaging"
+	"github.com/kordlab/marketplace/storage"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// imageSourceFile is where an upload waits for processing. It still carries
+// the uploader's metadata, so it is never served.
+const imageSourceFile = "source"
+
+var errImageQueueFull = errors.New("image processing is busy, try again shortly")
+
+type UpdateImageRequest struct {
+	AltText string `json:"alt_text" validate:"max=300"`
+}
+
+// imageKey locates a file belonging to a gallery image in the blob store
+func imageKey(productID, imageID primitive.ObjectID, file string) string {
+	return fmt.Sprintf("images/%s/%s/%s", productID.Hex(), imageID.Hex(), file)
+}
+
+type imageJob struct {
+	productID primitive.ObjectID
+	imageID   primitive.ObjectID
+}
+
+// ImageProcessor renders the variants of uploaded gallery images in the
+// background. Uploads are acknowledged once their source is stored; the
+// image stays in processing until a worker has rendered and stored every
+// variant.
+type ImageProcessor struct {
+	products *data.ProductRepository
+	blobs    storage.BlobStore
+	renderer *imaging.Renderer
+	workers  int
+	queue    chan imageJob
+}
+
+func NewImageProcessor(products *data.ProductRepository, blobs storage.BlobStore, renderer *imaging.Renderer, workers int) *ImageProcessor {
+	if workers < 1 {
+		workers = 1
+	}
+	return &ImageProcessor{
+		products: products,
+		blobs:    blobs,
+		renderer: renderer,
+		workers:  workers,
+		queue:    make(chan imageJob, 64*workers),
+	}
+}
+
+// Enqueue schedules an image for processing without blocking
+func (p *ImageProcessor) Enqueue(productID, imageID primitive.ObjectID) error {
+	select {
+	case p.queue <- imageJob{productID: productID, imageID: imageID}:
+		return nil
+	default:
+		return errImageQueueFull
+	}
+}
+
+// Run processes queued images until ctx is cancelled. Images left in
+// processing by a previous run are queued again first.
+func (p *ImageProcessor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-p.queue:
+					p.process(ctx, job)
+				}
+			}
+		}()
+	}
+
+	p.requeue(ctx)
+	wg.Wait()
+}
+
+func (p *ImageProcessor) requeue(ctx context.Context) {
+	products, err := p.products.ListProcessingImages(ctx)
+	if err != nil {
+		log.Printf("Failed to list images awaiting processing: %v", err)
+		return
+	}
+	for _, product := range products {
+		for _, img := range product.Images {
+			if img.Status != data.ImageStatusProcessing {
+				continue
+			}
+			select {
+			case p.queue <- imageJob{productID: product.ID, imageID: img.ID}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (p *ImageProcessor) process(ctx context.Context, job imageJob) {
+	sourceKey := imageKey(job.productID, job.imageID, imageSourceFile)
+	variants, err := p.render(ctx, job, sourceKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Already processed, or removed before we got to it
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to process image %s of product %s: %v", job.imageID.Hex(), job.productID.Hex(), err)
+		reason := "Failed to process image"
+		if errors.Is(err, imaging.ErrUnsupportedFormat) {
+			reason = err.Error()
+		}
+		if err := p.products.FailImage(ctx, job.productID, job.imageID, reason); err != nil && err != data.ErrImageNotFound {
+			log.Printf("Failed to mark image %s as failed: %v", job.imageID.Hex(), err)
+			return
+		}
+	} else {
+		var width, height int
+		for _, v := range variants {
+			if v.Size == data.ImageSizeOriginal {
+				width, height = v.Width, v.Height
+			}
+		}
+		err := p.products.CompleteImage(ctx, job.productID, job.imageID, width, height, variants)
+		if err == data.ErrImageNotFound {
+			deleteImageFiles(ctx, p.blobs, job.productID, &data.ProductImage{ID: job.imageID, Variants: variants})
+		} else if err != nil {
+			// Keep the source so the image is retried after a restart
+			log.Printf("Failed to record variants of image %s: %v", job.imageID.Hex(), err)
+			return
+		}
+	}
+
+	if err := p.blobs.Delete(ctx, sourceKey); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Failed to remove image source %s: %v", sourceKey, err)
+	}
+}
+
+// render decodes the stored source, renders its variants and stores them
+func (p *ImageProcessor) render(ctx context.Context, job imageJob, sourceKey string) ([]data.ImageVariant, error) {
+	rc, err := p.blobs.Open(ctx, sourceKey, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	src, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := imaging.Decode(src)
+	if err != nil {
+		return nil, err
+	}
+	renditions, err := p.renderer.Render(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+
+	variants := make([]data.ImageVariant, 0, len(renditions))
+	for _, r := range renditions {
+		file := r.Size + "." + r.Extension()
+		err := p.blobs.Put(ctx, imageKey(job.productID, job.imageID, file), bytes.NewReader(r.Data),
+			int64(len(r.Data)), storage.PutOptions{ContentType: r.ContentType})
+		if err != nil {
+			deleteImageFiles(ctx, p.blobs, job.productID, &data.ProductImage{ID: job.imageID, Variants: variants})
+			return nil, err
+		}
+		variants = append(variants, data.ImageVariant{
+			Size:        r.Size,
+			Format:      r.Format,
+			ContentType: r.ContentType,
+			Width:       r.Width,
+			Height:      r.Height,
+			FileSize:    int64(len(r.Data)),
+			URL:         "/" + imageKey(job.productID, job.imageID, file),
+		})
+	}
+	return variants, nil
+}
+
+// deleteImageFiles removes an uploaded image's variants and source, logging
+// rather than failing on errors
+func deleteImageFiles(ctx context.Context, blobs storage.BlobStore, productID primitive.ObjectID, img *data.ProductImage) {
+	files := []string{imageSourceFile}
+	for _, v := range img.Variants {
+		files = append(files, path.Base(v.URL))
+	}
+	for _, file := range files {
+		key := imageKey(productID, img.ID, file)
+		if err := blobs.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Failed to remove image file %s: %v", key, err)
+		}
+	}
+}
+
+// handleUploadImage accepts a multipart/form-data upload with the image in
+// its "file" part and optional "alt_text". The image is validated and
+// stored straight away; its variants are rendered in the background, so the
+// returned record is still processing.
+func (h *ProductHandler) handleUploadImage(c echo.Context) error {
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"error": "Expected a multipart/form-data upload"})
+	}
+	values, upload, err := readMultipartUpload(c.Request(), c.Response(), h.maxImageUploadSize)
+	switch {
+	case err == errUploadTooLarge:
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+	case err != nil:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid upload: " + err.Error()})
+	}
+	defer upload.Close()
+
+	req := UpdateImageRequest{AltText: strings.TrimSpace(firstValue(values["alt_text"]))}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+
+	product, err := h.loadManagedProduct(c)
+	if product == nil {
+		return err
+	}
+	if len(product.Images) >= data.MaxProductImages {
+		return c.JSON(http.StatusConflict, map[string]string{"error": data.ErrTooManyImages.Error()})
+	}
+
+	r, err := upload.Reader()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to read upload"})
+	}
+	info, err := imaging.Inspect(r, imaging.DefaultLimits)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	img := data.ProductImage{
+		ID:        primitive.NewObjectID(),
+		Status:    data.ImageStatusProcessing,
+		Width:     info.Width,
+		Height:    info.Height,
+		AltText:   req.AltText,
+		Variants:  []data.ImageVariant{},
+		CreatedAt: time.Now(),
+	}
+	ctx := c.Request().Context()
+	sourceKey := imageKey(product.ID, img.ID, imageSourceFile)
+	if r, err = upload.Reader(); err == nil {
+		err = h.blobs.Put(ctx, sourceKey, r, upload.Size, storage.PutOptions{
+			ContentType: upload.ContentType,
+			SHA256:      upload.SHA256,
+		})
+	}
+	if err != nil {
+		c.Logger().Errorf("failed to store image source %s: %v", sourceKey, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store image"})
+	}
+
+	err = h.products.AddImage(ctx, product.ID, img)
+	if err == nil {
+		err = h.images.Enqueue(product.ID, img.ID)
+		if err != nil {
+			// Leave nothing half-processed behind a busy queue
+			if err := h.products.RemoveImage(ctx, product.ID, img.ID); err != nil {
+				c.Logger().Errorf("failed to remove unqueued image %s: %v", img.ID.Hex(), err)
+			}
+		}
+	}
+	if err != nil {
+		deleteImageFiles(ctx, h.blobs, product.ID, &img)
+	}
+	switch err {
+	case nil:
+		return c.JSON(http.StatusAccepted, img)
+	case data.ErrTooManyImages:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	case errImageQueueFull:
+		c.Response().Header().Set("Retry-After", "30")
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add image"})
+	}
+}
+
+// loadImage resolves :image on product, writing a 404 if it has no such image
+func loadImage(c echo.Context, product *data.Product) (*data.ProductImage, error) {
+	id, err := parseObjectIDParam(c, "image")
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid image ID"})
+	}
+	img, ok := product.FindImage(id)
+	if !ok {
+		return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Image not found"})
+	}
+	return img, nil
+}
+
+// handleGetImage returns one image record, so clients can poll an upload
+// until its variants are ready
+func (h *ProductHandler) handleGetImage(c echo.Context) error {
+	product, err := h.loadVisibleProduct(c)
+	if product == nil {
+		return err
+	}
+	img, err := loadImage(c, product)
+	if img == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, img)
+}
+
+func (h *ProductHandler) handleUpdateImage(c echo.Context) error {
+	var req UpdateImageRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	req.AltText = strings.TrimSpace(req.AltText)
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+
+	product, err := h.loadManagedProduct(c)
+	if product == nil {
+		return err
+	}
+	img, err := loadImage(c, product)
+	if img == nil {
+		return err
+	}
+
+	err = h.products.UpdateImageAltText(c.Request().Context(), product.ID, img.ID, req.AltText)
+	if err == data.ErrImageNotFound {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Image not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update image"})
+	}
+	img.AltText = req.AltText
+	return c.JSON(http.StatusOK, img)
+}
+
+func (h *ProductHandler) handleDeleteImage(c echo.Context) error {
+	product, err := h.loadManagedProduct(c)
+	if product == nil {
+		return err
+	}
+	img, err := loadImage(c, product)
+	if img == nil {
+		return err
+	}
+
+	err = h.products.RemoveImage(c.Request().Context(), product.ID, img.ID)
+	if err == data.ErrImageNotFound {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Image not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove image"})
+	}
+	if !img.Linked {
+		deleteImageFiles(c.Request().Context(), h.blobs, product.ID, img)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// handleServeImage serves a rendered variant. Every upload gets a fresh
+// image ID, so variants never change and may be cached indefinitely.
+func (h *ProductHandler) handleServeImage(c echo.Context) error {
+	productID, err := parseObjectIDParam(c, "product")
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Image not found"})
+	}
+	product, err := h.products.Get(c.Request().Context(), productID)
+	if err == data.ErrProductNotFound {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Image not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	img, err := loadImage(c, product)
+	if img == nil {
+		return err
+	}
+	variant, ok := img.FindVariant(c.Param("file"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Image not found"})
+	}
+
+	ctx := c.Request().Context()
+	content := &blobReadSeeker{ctx: ctx, store: h.blobs, key: imageKey(product.ID, img.ID, c.Param("file")), size: variant.FileSize}
+	defer content.Close()
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, variant.ContentType)
+	header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	header.Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(c.Response(), c.Request(), c.Param("file"), img.CreatedAt, content)
+	return nil
+}
@@ -0,0 +1,133 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Statement is a page of one of the caller's ledger accounts, with the
+// account's current balance and its totals over the requested period
+type Statement struct {
+	Account string      `json:"account"`
+	From    *time.Time  `json:"from,omitempty"`
+	To      *time.Time  `json:"to,omitempty"`
+	Balance money.Money `json:"balance"`
+	Credits money.Money `json:"credits"`
+	Debits  money.Money `json:"debits"`
+	pagination.Page[data.Posting]
+}
+
+type LedgerHandler struct {
+	ledger    *data.LedgerRepository
+	paginator *pagination.Paginator
+}
+
+func NewLedgerHandler(ledger *data.LedgerRepository, paginator *pagination.Paginator) *LedgerHandler {
+	return &LedgerHandler{
+		ledger:    ledger,
+		paginator: paginator,
+	}
+}
+
+func registerLedgerRoutes(e *echo.Echo, h *LedgerHandler, authRequired echo.MiddlewareFunc) {
+	e.GET("/users/me/statement", h.handleStatement, authRequired)
+}
+
+// statementAccounts maps ?account= to the caller's ledger accounts
+var statementAccounts = map[string]func(primitive.ObjectID) string{
+	"balance":  data.BalanceAccount,
+	"earnings": data.EarningsAccount,
+}
+
+// parseStatementDate reads an RFC 3339 time or a YYYY-MM-DD date. A date
+// given as ?to= includes that whole day.
+func parseStatementDate(raw string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// handleStatement lists the postings to the caller's credit balance, or
+// with ?account=earnings their pending earnings, newest first. ?from= and
+// ?to= limit it to a period.
+func (h *LedgerHandler) handleStatement(c echo.Context) error {
+	name := c.QueryParam("account")
+	if name == "" {
+		name = "balance"
+	}
+	accountOf, ok := statementAccounts[name]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "account must be balance or earnings"})
+	}
+
+	var from, to time.Time
+	for _, bound := range []struct {
+		param string
+		dst   *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		raw := c.QueryParam(bound.param)
+		if raw == "" {
+			continue
+		}
+		t, err := parseStatementDate(raw, bound.param == "to")
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid " + bound.param + " date"})
+		}
+		*bound.dst = t
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "from must be before to"})
+	}
+
+	scope := name + "\x00" + c.QueryParam("from") + "\x00" + c.QueryParam("to")
+	req, err := h.paginator.Parse(c.QueryParams(), pagination.Sort{Field: "created_at", Desc: true}, scope)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	account := accountOf(currentUser(c).ID)
+	postings, err := h.ledger.Statement(ctx, account, from, to, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	credits, debits, err := h.ledger.Totals(ctx, account, from, to)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	balance, err := h.ledger.Balance(ctx, account)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	statement := Statement{
+		Account: name,
+		Balance: balance,
+		Credits: credits,
+		Debits:  debits,
+		Page: pagination.NewPage(req, postings, func(p data.Posting) (interface{}, primitive.ObjectID) {
+			return p.CreatedAt, p.ID
+		}, c.Request().URL),
+	}
+	if !from.IsZero() {
+		statement.From = &from
+	}
+	if !to.IsZero() {
+		statement.To = &to
+	}
+	return c.JSON(http.StatusOK, statement)
+}
@@ -0,0 +1,152 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type TransitionProductRequest struct {
+	Action data.ProductAction `json:"action" validate:"required"`
+	Reason string             `json:"reason" validate:"max=2000"`
+}
+
+// transitionMessages describe each action from the creator's point of view
+var transitionMessages = map[data.ProductAction]string{
+	data.ProductActionSubmit:     "was submitted for review",
+	data.ProductActionWithdraw:   "was withdrawn from review",
+	data.ProductActionDeactivate: "was deactivated",
+	data.ProductActionReactivate: "is live again",
+	data.ProductActionArchive:    "was archived",
+	data.ProductActionApprove:    "was approved and is now live",
+	data.ProductActionReject:     "was rejected",
+	data.ProductActionTakeDown:   "was taken down",
+}
+
+func isModerator(user *data.CachedUser) bool {
+	return user.Role == data.RoleModerator || user.Role == data.RoleAdmin
+}
+
+// loadProductForTransition loads a product fresh and checks the caller may
+// perform action on it: moderator actions need a moderator or admin, the
+// rest need the owner or an admin.
+func (h *ProductHandler) loadProductForTransition(c echo.Context, action data.ProductAction) (*data.Product, error) {
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+	}
+
+	product, err := h.products.FindByID(c.Request().Context(), id)
+	if err == data.ErrProductNotFound {
+		return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Product not found"})
+	}
+	if err != nil {
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	user := currentUser(c)
+	allowed := canManageProduct(user, product)
+	if action.RequiresModerator() {
+		allowed = isModerator(user)
+	}
+	if !allowed {
+		return nil, c.JSON(http.StatusForbidden, map[string]string{"error": "Insufficient permissions"})
+	}
+	return product, nil
+}
+
+// transition applies action and notifies the creator. On success it responds
+// with status, including the product body unless status is 204.
+func (h *ProductHandler) transition(c echo.Context, product *data.Product, action data.ProductAction, reason string, status int) error {
+	ctx := c.Request().Context()
+	t, err := h.products.Transition(ctx, product, action, currentUser(c), reason)
+	switch err {
+	case nil:
+	case data.ErrUnknownProductAction, data.ErrTransitionReasonRequired:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case data.ErrInvalidProductTransition, data.ErrNotSubmittable, data.ErrBundleTooSmall, data.ErrProductStatusConflict:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update product status"})
+	}
+
+	message := fmt.Sprintf("Your product %q %s", product.Title, transitionMessages[action])
+	if t.Reason != "" {
+		message += ": " + t.Reason
+	}
+	if err := h.notifications.Notify(ctx, product.CreatorID, data.NotificationProductStatus, message, product.ID); err != nil {
+		c.Logger().Errorf("failed to notify creator of product %s: %v", product.ID.Hex(), err)
+	}
+
+	if status == http.StatusNoContent {
+		return c.NoContent(status)
+	}
+	return c.JSON(status, product)
+}
+
+func (h *ProductHandler) handleTransitionProduct(c echo.Context) error {
+	var req TransitionProductRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+
+	product, err := h.loadProductForTransition(c, req.Action)
+	if product == nil {
+		return err
+	}
+	return h.transition(c, product, req.Action, req.Reason, http.StatusOK)
+}
+
+// handleGetProductHistory returns the status history, which includes
+// moderation reasons and so is limited to the owner and staff.
+func (h *ProductHandler) handleGetProductHistory(c echo.Context) error {
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+	}
+
+	product, err := h.products.FindByID(c.Request().Context(), id)
+	if err == data.ErrProductNotFound {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Product not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	if user := currentUser(c); !canManageProduct(user, product) && !isModerator(user) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Insufficient permissions"})
+	}
+
+	history := product.StatusHistory
+	if history == nil {
+		history = []data.ProductTransition{}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":  product.Status,
+		"history": history,
+	})
+}
+
+// handleListPendingReview is the moderation queue, oldest products first
+func (h *ProductHandler) handleListPendingReview(c echo.Context) error {
+	sort := pagination.Sort{Field: "created_at"}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, "products:pending_review")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	products, err := h.products.ListPendingReview(c.Request().Context(), req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, pagination.NewPage(req, products, func(p data.Product) (interface{}, primitive.ObjectID) {
+		return p.CreatedAt, p.ID
+	}, c.Request().URL))
+}
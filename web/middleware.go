@@ -0,0 +1,114 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// bearerToken returns the Authorization header with any "Bearer " prefix removed
+func bearerToken(c echo.Context) string {
+	token := c.Request().Header.Get("Authorization")
+	return strings.TrimPrefix(token, "Bearer ")
+}
+
+// authenticate parses a bearer JWT when one is present and stores the
+// caller's user ID and role on the context. It never rejects a request on its
+// own; routes that need a user are wrapped in requireAuth.
+func authenticate(secret string, redis *data.RedisDB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			raw := bearerToken(c)
+			if raw == "" {
+				return next(c)
+			}
+
+			token, err := jwt.Parse(raw, func(t *jwt.Token) (interface{}, error) {
+				if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+					return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+				}
+				return []byte(secret), nil
+			})
+			if err != nil || !token.Valid || redis.IsTokenBlacklisted(raw) {
+				return next(c)
+			}
+
+			claims, ok := token.Claims.(jwt.MapClaims)
+			if !ok {
+				return next(c)
+			}
+			if userID, ok := claims["user_id"].(string); ok {
+				c.Set("user_id", userID)
+			}
+			if role, ok := claims["role"].(string); ok {
+				c.Set("role", data.UserRole(role))
+			}
+			return next(c)
+		}
+	}
+}
+
+// requireAuth rejects requests without a valid token and loads the caller
+// through the user cache, so suspensions take effect as soon as the cached
+// copy is invalidated rather than when the token expires.
+func requireAuth(users *data.UserRepository) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userID, _ := c.Get("user_id").(string)
+			id, err := primitive.ObjectIDFromHex(userID)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			}
+
+			user, err := users.Get(c.Request().Context(), id)
+			if err == data.ErrUserNotFound {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			}
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+			}
+			if user.Status != data.UserStatusActive {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Account is not active"})
+			}
+
+			c.Set("user", user)
+			c.Set("role", user.Role)
+			return next(c)
+		}
+	}
+}
+
+// currentUser returns the user loaded by requireAuth
+func currentUser(c echo.Context) *data.CachedUser {
+	user, _ := c.Get("user").(*data.CachedUser)
+	return user
+}
+
+// requireRole only admits users whose role is one of roles. It must run after
+// requireAuth.
+func requireRole(roles ...data.UserRole) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user := currentUser(c)
+			if user == nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			}
+			for _, role := range roles {
+				if user.Role == role {
+					return next(c)
+				}
+			}
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Insufficient permissions"})
+		}
+	}
+}
+
+// parseObjectIDParam reads a hex ObjectID from the named path parameter
+func parseObjectIDParam(c echo.Context, name string) (primitive.ObjectID, error) {
+	return primitive.ObjectIDFromHex(c.Param(name))
+}
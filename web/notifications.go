@@ -0,0 +1,71 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type NotificationHandler struct {
+	notifications *data.NotificationRepository
+	paginator     *pagination.Paginator
+}
+
+func NewNotificationHandler(notifications *data.NotificationRepository, paginator *pagination.Paginator) *NotificationHandler {
+	return &NotificationHandler{
+		notifications: notifications,
+		paginator:     paginator,
+	}
+}
+
+func registerNotificationRoutes(e *echo.Echo, h *NotificationHandler, m ...echo.MiddlewareFunc) {
+	notifications := e.Group("/notifications", m...)
+	notifications.GET("", h.handleListNotifications)
+	notifications.POST("/read", h.handleMarkAllRead)
+	notifications.POST("/:id/read", h.handleMarkRead)
+}
+
+// handleListNotifications lists the caller's notifications newest first.
+// Pass unread=true to see only unread ones.
+func (h *NotificationHandler) handleListNotifications(c echo.Context) error {
+	unreadOnly := c.QueryParam("unread") == "true"
+	scope := "notifications"
+	if unreadOnly {
+		scope += ":unread"
+	}
+	sort := pagination.Sort{Field: "created_at", Desc: true}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, scope)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	notifications, err := h.notifications.ListForUser(c.Request().Context(), currentUser(c).ID, unreadOnly, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, pagination.NewPage(req, notifications, func(n data.Notification) (interface{}, primitive.ObjectID) {
+		return n.CreatedAt, n.ID
+	}, c.Request().URL))
+}
+
+func (h *NotificationHandler) handleMarkRead(c echo.Context) error {
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid notification ID"})
+	}
+	if err := h.notifications.MarkRead(c.Request().Context(), currentUser(c).ID, id); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *NotificationHandler) handleMarkAllRead(c echo.Context) error {
+	if err := h.notifications.MarkRead(c.Request().Context(), currentUser(c).ID, primitive.NilObjectID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,514 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/kordlab/marketplace/storage"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type CreateProductRequest struct {
+	Title           string               `json:"title"`
+	Description     string               `json:"description"`
+	Price           money.Money          `json:"price"`
+	DiscountedPrice money.Money          `json:"discounted_price"`
+	Category        data.ProductCategory `json:"category"`
+	Type            data.ProductType     `json:"type"`
+	Bundle          *BundleRequest       `json:"bundle"`
+	Tags            []string             `json:"tags"`
+	Technologies    []string             `json:"technologies"`
+	// Images are URLs of images hosted elsewhere; uploads go through
+	// POST /products/:id/images
+	Images         []string          `json:"images"`
+	Specifications map[string]string `json:"specifications"`
+}
+
+// UpdateProductRequest is a partial update; nil fields are left untouched
+type UpdateProductRequest struct {
+	Title           *string               `json:"title"`
+	Description     *string               `json:"description"`
+	Price           *money.Money          `json:"price"`
+	DiscountedPrice *money.Money          `json:"discounted_price"`
+	Category        *data.ProductCategory `json:"category"`
+	Bundle          *BundleRequest        `json:"bundle"`
+	Tags            []string              `json:"tags"`
+	Technologies    []string              `json:"technologies"`
+	// Images replaces the linked images, leaving uploaded ones in place
+	Images         []string          `json:"images"`
+	Specifications map[string]string `json:"specifications"`
+}
+
+type ProductHandler struct {
+	products           *data.ProductRepository
+	notifications      *data.NotificationRepository
+	paginator          *pagination.Paginator
+	blobs              storage.BlobStore
+	images             *ImageProcessor
+	views              *data.ViewTracker
+	recommendations    *data.RecommendationEngine
+	rates              *data.ExchangeRateRepository
+	maxUploadSize      int64
+	maxImageUploadSize int64
+}
+
+func NewProductHandler(products *data.ProductRepository, notifications *data.NotificationRepository, paginator *pagination.Paginator, blobs storage.BlobStore, images *ImageProcessor, views *data.ViewTracker, recommendations *data.RecommendationEngine, rates *data.ExchangeRateRepository, maxUploadSize, maxImageUploadSize int64) *ProductHandler {
+	return &ProductHandler{
+		products:           products,
+		notifications:      notifications,
+		paginator:          paginator,
+		blobs:              blobs,
+		images:             images,
+		views:              views,
+		recommendations:    recommendations,
+		rates:              rates,
+		maxUploadSize:      maxUploadSize,
+		maxImageUploadSize: maxImageUploadSize,
+	}
+}
+
+func registerProductRoutes(e *echo.Echo, h *ProductHandler, authRequired echo.MiddlewareFunc) {
+	products := e.Group("/products")
+	products.GET("", h.handleSearchProducts)
+	products.GET("/specifications", h.handleListSpecSchemas)
+	products.GET("/specifications/:category", h.handleGetSpecSchema)
+	products.GET("/:id", h.handleGetProduct)
+	products.POST("", h.handleCreateProduct, authRequired, requireRole(data.RoleCreator, data.RoleAdmin))
+	products.PATCH("/:id", h.handleUpdateProduct, authRequired)
+	products.DELETE("/:id", h.handleArchiveProduct, authRequired)
+
+	products.GET("/:id/recommendations", h.handleGetRecommendations)
+	products.GET("/:id/versions", h.handleListVersions)
+	products.GET("/:id/versions/latest", h.handleGetLatestVersion)
+	products.POST("/:id/versions", h.handlePublishVersion, authRequired)
+	products.PATCH("/:id/versions/:version", h.handleUpdateVersion, authRequired)
+	products.GET("/:id/versions/:version/manifest", h.handleGetVersionManifest)
+
+	products.POST("/:id/images", h.handleUploadImage, authRequired)
+	products.GET("/:id/images/:image", h.handleGetImage)
+	products.PATCH("/:id/images/:image", h.handleUpdateImage, authRequired)
+	products.DELETE("/:id/images/:image", h.handleDeleteImage, authRequired)
+	e.GET("/images/:product/:image/:file", h.handleServeImage)
+
+	products.POST("/:id/transitions", h.handleTransitionProduct, authRequired)
+	products.GET("/:id/history", h.handleGetProductHistory, authRequired)
+	e.GET("/moderation/products", h.handleListPendingReview, authRequired, requireRole(data.RoleModerator, data.RoleAdmin))
+
+	e.GET("/users/me/products", h.handleListMyProducts, authRequired)
+}
+
+// parseProductQuery reads catalog search parameters. List filters accept
+// comma separated values. Price bounds are in the client's currency.
+func (h *ProductHandler) parseProductQuery(c echo.Context, local *localizer) (data.ProductQuery, error) {
+	q := data.ProductQuery{
+		Text:         strings.TrimSpace(c.QueryParam("q")),
+		Tags:         splitQueryList(c.QueryParam("tags")),
+		Technologies: splitQueryList(c.QueryParam("technologies")),
+		Sort:         data.ProductSort(c.QueryParam("sort")),
+	}
+	for _, category := range splitQueryList(c.QueryParam("category")) {
+		q.Categories = append(q.Categories, data.ProductCategory(category))
+	}
+
+	switch q.Sort {
+	case "":
+		q.Sort = data.SortNewest
+		if q.Text != "" {
+			q.Sort = data.SortRelevance
+		}
+	case data.SortRelevance, data.SortNewest, data.SortPriceAsc, data.SortPriceDesc, data.SortDownloads, data.SortRating:
+	default:
+		return q, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+
+	for param, values := range c.QueryParams() {
+		key, ok := strings.CutPrefix(param, "spec.")
+		if !ok {
+			continue
+		}
+		if len(q.Categories) != 1 {
+			return q, fmt.Errorf("specification filters need exactly one category")
+		}
+		schema, ok := data.SpecSchemas[q.Categories[0]]
+		if !ok {
+			return q, fmt.Errorf("unknown category %q", q.Categories[0])
+		}
+		field, ok := schema.Field(key)
+		if !ok {
+			return q, fmt.Errorf("unknown specification %q for %s", key, q.Categories[0])
+		}
+		spec, err := data.ParseSpecFilter(field, values[0])
+		if err != nil {
+			return q, err
+		}
+		q.Specs = append(q.Specs, spec)
+	}
+	sort.Slice(q.Specs, func(i, j int) bool { return q.Specs[i].Key < q.Specs[j].Key })
+
+	for param, dst := range map[string]**money.Money{"min_price": &q.MinPrice, "max_price": &q.MaxPrice} {
+		raw := c.QueryParam(param)
+		if raw == "" {
+			continue
+		}
+		v, err := money.Parse(raw, local.currency)
+		if err != nil || v.IsNegative() {
+			return q, fmt.Errorf("invalid %s", param)
+		}
+		if v, _, err = local.rates.Convert(v, data.SettlementCurrency); err != nil {
+			return q, err
+		}
+		*dst = &v
+	}
+
+	// Cursors are only valid for the exact filters they were issued under
+	scope := url.Values{}
+	for _, param := range []string{"q", "category", "tags", "technologies", "min_price", "max_price"} {
+		scope.Set(param, c.QueryParam(param))
+	}
+	for _, spec := range q.Specs {
+		scope.Set("spec."+spec.Key, c.QueryParam("spec."+spec.Key))
+	}
+	scope.Set("currency", local.currency)
+	page, err := h.paginator.Parse(c.QueryParams(), q.PageSort(), "products:"+scope.Encode())
+	if err != nil {
+		return q, err
+	}
+	q.Page = page
+	return q, nil
+}
+
+func splitQueryList(raw string) []string {
+	var values []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func (h *ProductHandler) handleSearchProducts(c echo.Context) error {
+	local, err := newLocalizer(c, h.rates)
+	if local == nil {
+		return err
+	}
+	q, err := h.parseProductQuery(c, local)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	result, err := h.products.Search(c.Request().Context(), q)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	for i := range result.Hits {
+		local.product(&result.Hits[i].Product)
+	}
+
+	page := pagination.NewPage(q.Page, result.Hits, func(hit data.ProductHit) (interface{}, primitive.ObjectID) {
+		return hit.SortKey(q.Page.Sort), hit.ID
+	}, c.Request().URL)
+
+	return c.JSON(http.StatusOK, struct {
+		pagination.Page[data.ProductHit]
+		Total  int64              `json:"total"`
+		Facets data.ProductFacets `json:"facets"`
+	}{page, result.Total, result.Facets})
+}
+
+// handleListMyProducts lists the caller's own products in every status,
+// newest first.
+func (h *ProductHandler) handleListMyProducts(c echo.Context) error {
+	status := data.ProductStatus(c.QueryParam("status"))
+	sort := pagination.Sort{Field: "created_at", Desc: true}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, "products:mine:"+string(status))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	products, err := h.products.ListByCreator(c.Request().Context(), currentUser(c).ID, status, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, pagination.NewPage(req, products, func(p data.Product) (interface{}, primitive.ObjectID) {
+		return p.CreatedAt, p.ID
+	}, c.Request().URL))
+}
+
+// canManageProduct reports whether user may mutate product
+func canManageProduct(user *data.CachedUser, product *data.Product) bool {
+	return user.Role == data.RoleAdmin || product.CreatorID == user.ID
+}
+
+// loadVisibleProduct loads a product for a read endpoint, hiding products that
+// are not on sale from everyone but their owner and admins.
+func (h *ProductHandler) loadVisibleProduct(c echo.Context) (*data.Product, error) {
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+	}
+
+	product, err := h.products.Get(c.Request().Context(), id)
+	if err == data.ErrProductNotFound {
+		return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Product not found"})
+	}
+	if err != nil {
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	if product.Status != data.ProductStatusActive {
+		userID, _ := c.Get("user_id").(string)
+		role, _ := c.Get("role").(data.UserRole)
+		if userID != product.CreatorID.Hex() && role != data.RoleAdmin && role != data.RoleModerator {
+			return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Product not found"})
+		}
+	}
+	return product, nil
+}
+
+// loadManagedProduct loads a product fresh from the database for a write
+// endpoint and checks the caller may modify it.
+func (h *ProductHandler) loadManagedProduct(c echo.Context) (*data.Product, error) {
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+	}
+
+	product, err := h.products.FindByID(c.Request().Context(), id)
+	if err == data.ErrProductNotFound {
+		return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Product not found"})
+	}
+	if err != nil {
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	if !canManageProduct(currentUser(c), product) {
+		return nil, c.JSON(http.StatusForbidden, map[string]string{"error": "Insufficient permissions"})
+	}
+	if product.Status == data.ProductStatusArchived {
+		return nil, c.JSON(http.StatusConflict, map[string]string{"error": "Archived products cannot be modified"})
+	}
+	return product, nil
+}
+
+// referencePrice checks that product is priced in a currency with an exchange
+// rate and sets its reference price. A nil result means an error response
+// has been written.
+func (h *ProductHandler) referencePrice(c echo.Context, product *data.Product) (*money.Money, error) {
+	rates, err := h.rates.Rates(c.Request().Context())
+	if err != nil {
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	switch err := rates.SetReferencePrice(product); err {
+	case nil:
+		return &product.ReferencePrice, nil
+	case data.ErrUnsupportedCurrency:
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Unsupported currency " + product.Price.Code()})
+	default:
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+}
+
+func (h *ProductHandler) handleGetProduct(c echo.Context) error {
+	local, err := newLocalizer(c, h.rates)
+	if local == nil {
+		return err
+	}
+	product, err := h.loadVisibleProduct(c)
+	if product == nil {
+		return err
+	}
+	h.recordView(c, product)
+	local.product(product)
+	return c.JSON(http.StatusOK, product)
+}
+
+func (h *ProductHandler) handleCreateProduct(c echo.Context) error {
+	var req CreateProductRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	now := time.Now()
+	product := &data.Product{
+		ID:              primitive.NewObjectID(),
+		CreatorID:       currentUser(c).ID,
+		Title:           req.Title,
+		Description:     req.Description,
+		Price:           req.Price,
+		DiscountedPrice: req.DiscountedPrice,
+		Category:        req.Category,
+		Type:            req.Type,
+		Status:          data.ProductStatusDraft,
+		Tags:            nonNilStrings(req.Tags),
+		Technologies:    nonNilStrings(req.Technologies),
+		Images:          []data.ProductImage{},
+		Specifications:  req.Specifications,
+		Versions:        []data.ProductVersion{},
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if product.Specifications == nil {
+		product.Specifications = map[string]string{}
+	}
+	product.ReplaceLinkedImages(req.Images)
+	if product.Type == "" {
+		product.Type = data.ProductTypeSingle
+	}
+	if err := c.Validate(product); err != nil {
+		return validationError(c, err)
+	}
+	if err := product.NormalizeSpecifications(); err != nil {
+		return specificationError(c, err)
+	}
+	if len(product.Images) > data.MaxProductImages {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": data.ErrTooManyImages.Error()})
+	}
+	if reference, err := h.referencePrice(c, product); reference == nil {
+		return err
+	}
+	if (product.Type == data.ProductTypeBundle) != (req.Bundle != nil) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bundle products need bundle items, and only bundles may have them"})
+	}
+	if req.Bundle != nil {
+		bundle, err := h.resolveBundle(c, product, req.Bundle)
+		if bundle == nil {
+			return err
+		}
+		product.Bundle = bundle
+	}
+
+	if err := h.products.Create(c.Request().Context(), product); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create product"})
+	}
+
+	return c.JSON(http.StatusCreated, product)
+}
+
+func (h *ProductHandler) handleUpdateProduct(c echo.Context) error {
+	var req UpdateProductRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	product, err := h.loadManagedProduct(c)
+	if product == nil {
+		return err
+	}
+
+	// Apply the changes to the loaded product so the model's validation rules
+	// see the merged result, then persist only the fields that were sent.
+	set := bson.M{}
+	if req.Title != nil {
+		product.Title = *req.Title
+		set["title"] = product.Title
+	}
+	if req.Description != nil {
+		product.Description = *req.Description
+		set["description"] = product.Description
+	}
+	if req.Price != nil {
+		product.Price = *req.Price
+		set["price"] = product.Price
+	}
+	if req.DiscountedPrice != nil {
+		product.DiscountedPrice = *req.DiscountedPrice
+		set["discounted_price"] = product.DiscountedPrice
+	}
+	if req.Category != nil {
+		product.Category = *req.Category
+		set["category"] = product.Category
+	}
+	if req.Bundle != nil {
+		if !product.IsBundle() {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Only bundles have bundle items"})
+		}
+		bundle, err := h.resolveBundle(c, product, req.Bundle)
+		if bundle == nil {
+			return err
+		}
+		product.Bundle = bundle
+		set["bundle"] = bundle
+	}
+	if req.Tags != nil {
+		product.Tags = req.Tags
+		set["tags"] = product.Tags
+	}
+	if req.Technologies != nil {
+		product.Technologies = req.Technologies
+		set["technologies"] = product.Technologies
+	}
+	var linkedImages []data.ProductImage
+	if req.Images != nil {
+		linkedImages = product.ReplaceLinkedImages(req.Images)
+	}
+	if req.Specifications != nil {
+		product.Specifications = req.Specifications
+		set["specifications"] = product.Specifications
+	}
+	if len(set) == 0 && req.Images == nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "No fields to update"})
+	}
+	if err := c.Validate(product); err != nil {
+		return validationError(c, err)
+	}
+	// Specifications are checked whenever they or the category they must
+	// fit change
+	if req.Specifications != nil || req.Category != nil {
+		if err := product.NormalizeSpecifications(); err != nil {
+			return specificationError(c, err)
+		}
+		set["specifications"] = product.Specifications
+	}
+	if len(product.Images) > data.MaxProductImages {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": data.ErrTooManyImages.Error()})
+	}
+	if req.Price != nil || req.DiscountedPrice != nil {
+		reference, err := h.referencePrice(c, product)
+		if reference == nil {
+			return err
+		}
+		set["reference_price"] = *reference
+	}
+
+	if len(set) > 0 {
+		if err := h.products.Update(c.Request().Context(), product.ID, set); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update product"})
+		}
+	}
+	// Images are written separately so uploads being processed are untouched
+	if req.Images != nil {
+		if err := h.products.ReplaceLinkedImages(c.Request().Context(), product.ID, linkedImages); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update product"})
+		}
+	}
+
+	product.UpdatedAt = time.Now()
+	return c.JSON(http.StatusOK, product)
+}
+
+// handleArchiveProduct soft-deletes a product so existing purchases keep
+// pointing at a real document.
+func (h *ProductHandler) handleArchiveProduct(c echo.Context) error {
+	product, err := h.loadManagedProduct(c)
+	if product == nil {
+		return err
+	}
+	return h.transition(c, product, data.ProductActionArchive, "", http.StatusNoContent)
+}
+
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
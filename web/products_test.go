@@ -0,0 +1,229 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/money"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestProductValidation(t *testing.T) {
+	valid := func() *data.Product {
+		return &data.Product{
+			Title:    "Landing page kit",
+			Price:    money.New(2000, money.DefaultCurrency),
+			Category: data.CategoryTemplate,
+			Status:   data.ProductStatusDraft,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		mutate      func(p *data.Product)
+		failedField string
+	}{
+		{
+			name:   "Valid Product",
+			mutate: func(p *data.Product) {},
+		},
+		{
+			name:        "Title Too Short",
+			mutate:      func(p *data.Product) { p.Title = "ab" },
+			failedField: "title",
+		},
+		{
+			name:        "Negative Price",
+			mutate:      func(p *data.Product) { p.Price = money.New(-100, money.DefaultCurrency) },
+			failedField: "price",
+		},
+		{
+			name:        "Unknown Category",
+			mutate:      func(p *data.Product) { p.Category = "furniture" },
+			failedField: "category",
+		},
+		{
+			name:        "Discount Above Price",
+			mutate:      func(p *data.Product) { p.DiscountedPrice = money.New(2500, money.DefaultCurrency) },
+			failedField: "discounted_price",
+		},
+	}
+
+	v := newRequestValidator()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid()
+			tt.mutate(p)
+
+			err := v.Validate(p)
+			if tt.failedField == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var verrs validator.ValidationErrors
+			require.ErrorAs(t, err, &verrs)
+			fields := make([]string, 0, len(verrs))
+			for _, fe := range verrs {
+				fields = append(fields, fe.Field())
+			}
+			assert.Contains(t, fields, tt.failedField)
+		})
+	}
+}
+
+func TestParseProductQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		expectErr bool
+		check     func(t *testing.T, q data.ProductQuery)
+	}{
+		{
+			name:  "Defaults",
+			query: "",
+			check: func(t *testing.T, q data.ProductQuery) {
+				assert.Equal(t, data.SortNewest, q.Sort)
+				assert.Equal(t, int64(pagination.DefaultLimit), q.Page.Limit)
+				assert.Equal(t, pagination.Sort{Field: "created_at", Desc: true}, q.Page.Sort)
+			},
+		},
+		{
+			name:  "Text Search Sorts By Relevance",
+			query: "q=landing+page",
+			check: func(t *testing.T, q data.ProductQuery) {
+				assert.Equal(t, "landing page", q.Text)
+				assert.Equal(t, data.SortRelevance, q.Sort)
+				assert.Equal(t, pagination.Sort{Field: "score", Desc: true}, q.Page.Sort)
+			},
+		},
+		{
+			name:  "Filters And Paging",
+			query: "category=template,plugin&tags=react,+tailwind&min_price=5&max_price=50&sort=price_asc&limit=500",
+			check: func(t *testing.T, q data.ProductQuery) {
+				assert.Equal(t, []data.ProductCategory{data.CategoryTemplate, data.CategoryPlugin}, q.Categories)
+				assert.Equal(t, []string{"react", "tailwind"}, q.Tags)
+				require.NotNil(t, q.MinPrice)
+				require.NotNil(t, q.MaxPrice)
+				assert.Equal(t, money.New(500, money.DefaultCurrency), *q.MinPrice)
+				assert.Equal(t, money.New(5000, money.DefaultCurrency), *q.MaxPrice)
+				assert.Equal(t, data.SortPriceAsc, q.Sort)
+				assert.Equal(t, int64(pagination.MaxLimit), q.Page.Limit)
+			},
+		},
+		{
+			name:  "Specification Filters",
+			query: "category=course&spec.level=Beginner,intermediate&spec.duration=60..",
+			check: func(t *testing.T, q data.ProductQuery) {
+				require.Len(t, q.Specs, 2)
+				assert.Equal(t, "duration", q.Specs[0].Key)
+				require.NotNil(t, q.Specs[0].Min)
+				assert.Equal(t, 60.0, *q.Specs[0].Min)
+				assert.Nil(t, q.Specs[0].Max)
+				assert.Equal(t, data.SpecFilter{Key: "level", Values: []string{"beginner", "intermediate"}}, q.Specs[1])
+			},
+		},
+		{
+			name:      "Specification Filter Without Category",
+			query:     "spec.level=beginner",
+			expectErr: true,
+		},
+		{
+			name:      "Unknown Specification",
+			query:     "category=course&spec.framework=react",
+			expectErr: true,
+		},
+		{
+			name:      "Range On Enum Specification",
+			query:     "category=course&spec.level=1..3",
+			expectErr: true,
+		},
+		{
+			name:      "Unknown Sort",
+			query:     "sort=cheapest",
+			expectErr: true,
+		},
+		{
+			name:      "Negative Price",
+			query:     "min_price=-1",
+			expectErr: true,
+		},
+		{
+			name:      "Forged Cursor",
+			query:     "cursor=e30.AAAAAAAAAAAAAAAAAAAAAA",
+			expectErr: true,
+		},
+	}
+
+	e := echo.New()
+	h := NewProductHandler(nil, nil, pagination.New("test-secret"), nil, nil, nil, nil, nil, 0, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/products?"+tt.query, nil)
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			q, err := h.parseProductQuery(c, &localizer{})
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			tt.check(t, q)
+		})
+	}
+}
+
+func TestParseProductQueryInLocalCurrency(t *testing.T) {
+	e := echo.New()
+	h := NewProductHandler(nil, nil, pagination.New("test-secret"), nil, nil, nil, nil, nil, 0, 0)
+	local := &localizer{currency: "EUR", rates: data.Rates{"EUR": 0.8}}
+
+	req := httptest.NewRequest(http.MethodGet, "/products?currency=eur&min_price=8&max_price=20.5", nil)
+	q, err := h.parseProductQuery(e.NewContext(req, httptest.NewRecorder()), local)
+	require.NoError(t, err)
+	require.NotNil(t, q.MinPrice)
+	require.NotNil(t, q.MaxPrice)
+	assert.Equal(t, money.New(1000, data.SettlementCurrency), *q.MinPrice, "bounds are compared in the settlement currency")
+	assert.Equal(t, money.New(2562, data.SettlementCurrency), *q.MaxPrice, "25.625 rounds to even")
+}
+
+func TestPublishVersionRefusesDownloadURL(t *testing.T) {
+	e := echo.New()
+	e.Validator = newRequestValidator()
+	h := &ProductHandler{}
+	e.POST("/products/:id/versions", h.handlePublishVersion)
+
+	req := httptest.NewRequest(http.MethodPost, "/products/"+primitive.NewObjectID().Hex()+"/versions",
+		strings.NewReader(`{"version":"1.0.0","download_url":"https://files.example.com/pack.zip"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Upload the file")
+}
+
+func TestTransitionSmallBundle(t *testing.T) {
+	e := echo.New()
+	h := &ProductHandler{products: data.NewProductRepository(nil, nil)}
+	product := &data.Product{
+		ID:     primitive.NewObjectID(),
+		Type:   data.ProductTypeBundle,
+		Status: data.ProductStatusDraft,
+		Bundle: &data.BundleOptions{Items: []primitive.ObjectID{primitive.NewObjectID()}},
+	}
+
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec)
+	c.Set("user", &data.CachedUser{ID: primitive.NewObjectID(), Role: data.RoleCreator})
+	require.NoError(t, h.transition(c, product, data.ProductActionSubmit, "", http.StatusOK))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), data.ErrBundleTooSmall.Error())
+}
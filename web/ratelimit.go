@@ -0,0 +1,195 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+)
+
+// RateLimitKeyFunc extracts the identity a request is counted against
+type RateLimitKeyFunc func(c echo.Context) string
+
+// RateLimitPolicy describes how many requests an identity may make on a route
+type RateLimitPolicy struct {
+	Name      string
+	Limit     int64
+	Window    time.Duration
+	Algorithm data.RateLimitAlgorithm
+	KeyFunc   RateLimitKeyFunc
+}
+
+var (
+	// defaultRateLimitPolicy applies to every route
+	defaultRateLimitPolicy = RateLimitPolicy{
+		Name:      "default",
+		Limit:     120,
+		Window:    time.Minute,
+		Algorithm: data.RateLimitTokenBucket,
+		KeyFunc:   RateLimitByUser,
+	}
+
+	// authRateLimitPolicy is stricter to slow down credential stuffing
+	authRateLimitPolicy = RateLimitPolicy{
+		Name:      "auth",
+		Limit:     10,
+		Window:    time.Minute,
+		Algorithm: data.RateLimitSlidingWindow,
+		KeyFunc:   RateLimitByIP,
+	}
+)
+
+// RateLimitByIP keys requests by the client IP
+func RateLimitByIP(c echo.Context) string {
+	return "ip:" + c.RealIP()
+}
+
+// RateLimitByUser keys authenticated requests by user ID and falls back to
+// the client IP for anonymous ones.
+func RateLimitByUser(c echo.Context) string {
+	if userID, ok := c.Get("user_id").(string); ok && userID != "" {
+		return "user:" + userID
+	}
+	return RateLimitByIP(c)
+}
+
+// RateLimitByAPIKey keys requests by a hash of the Authorization header so
+// raw keys never end up in Redis.
+func RateLimitByAPIKey(c echo.Context) string {
+	key := c.Request().Header.Get("Authorization")
+	if key == "" {
+		return RateLimitByIP(c)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:16])
+}
+
+// newIPExtractor decides where c.RealIP() comes from. Without trusted
+// proxies it is the peer address of the connection, so clients cannot pick
+// their own IP with X-Forwarded-For. With them, X-Forwarded-For is read from
+// the right and the first hop outside the trusted proxies (IPs or CIDR
+// ranges) is the client.
+func newIPExtractor(trustedProxies []string) echo.IPExtractor {
+	var options []echo.TrustOption
+	for _, entry := range trustedProxies {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Printf("Ignoring invalid trusted proxy %q", entry)
+				continue
+			}
+			entry = ip.String() + "/128"
+			if ip.To4() != nil {
+				entry = ip.String() + "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid trusted proxy %q: %v", entry, err)
+			continue
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	if len(options) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options = append(options, echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false))
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+type RateLimiter struct {
+	redis     *data.RedisDB
+	allowIPs  map[string]bool
+	allowNets []*net.IPNet
+}
+
+// NewRateLimiter creates a limiter whose allowlist accepts plain IPs and CIDR
+// ranges. Invalid entries are logged and skipped.
+func NewRateLimiter(redis *data.RedisDB, allowlist []string) *RateLimiter {
+	rl := &RateLimiter{
+		redis:    redis,
+		allowIPs: make(map[string]bool),
+	}
+	for _, entry := range allowlist {
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				log.Printf("Ignoring invalid rate limit allowlist entry %q: %v", entry, err)
+				continue
+			}
+			rl.allowNets = append(rl.allowNets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			log.Printf("Ignoring invalid rate limit allowlist entry %q", entry)
+			continue
+		}
+		rl.allowIPs[ip.String()] = true
+	}
+	return rl
+}
+
+func (rl *RateLimiter) isAllowlisted(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	if rl.allowIPs[ip.String()] {
+		return true
+	}
+	for _, ipNet := range rl.allowNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware enforces policy on the routes it is attached to. Redis failures
+// are logged and the request is let through rather than taking the API down.
+func (rl *RateLimiter) Middleware(policy RateLimitPolicy) echo.MiddlewareFunc {
+	keyFunc := policy.KeyFunc
+	if keyFunc == nil {
+		keyFunc = RateLimitByIP
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if rl.isAllowlisted(c.RealIP()) {
+				return next(c)
+			}
+
+			key := "ratelimit:" + policy.Name + ":" + keyFunc(c)
+			res, err := rl.redis.AllowRequest(c.Request().Context(), policy.Algorithm, key, policy.Limit, policy.Window)
+			if err != nil {
+				c.Logger().Error("Rate limit check failed:", err)
+				return next(c)
+			}
+
+			header := c.Response().Header()
+			header.Set("RateLimit-Limit", strconv.FormatInt(res.Limit, 10))
+			header.Set("RateLimit-Remaining", strconv.FormatInt(res.Remaining, 10))
+			header.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(res.ResetAfter), 10))
+
+			if !res.Allowed {
+				header.Set("Retry-After", strconv.FormatInt(ceilSeconds(res.RetryAfter), 10))
+				return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many requests"})
+			}
+
+			return next(c)
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,126 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kordlab/marketplace/config"
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRateLimiter(t *testing.T, allowlist []string) *RateLimiter {
+	mr := miniredis.RunT(t)
+	redis, err := data.NewRedisDB(&config.Config{RedisURL: mr.Addr()})
+	require.NoError(t, err)
+	t.Cleanup(func() { redis.Close() })
+	return NewRateLimiter(redis, allowlist)
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm data.RateLimitAlgorithm
+		allowlist []string
+		remoteIP  string
+		limited   bool
+	}{
+		{
+			name:      "Sliding Window",
+			algorithm: data.RateLimitSlidingWindow,
+			remoteIP:  "203.0.113.7",
+			limited:   true,
+		},
+		{
+			name:      "Token Bucket",
+			algorithm: data.RateLimitTokenBucket,
+			remoteIP:  "203.0.113.7",
+			limited:   true,
+		},
+		{
+			name:      "Allowlisted CIDR",
+			algorithm: data.RateLimitSlidingWindow,
+			allowlist: []string{"10.0.0.0/8"},
+			remoteIP:  "10.1.2.3",
+			limited:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := newTestRateLimiter(t, tt.allowlist)
+			e := echo.New()
+			e.Use(rl.Middleware(RateLimitPolicy{
+				Name:      "test",
+				Limit:     3,
+				Window:    time.Minute,
+				Algorithm: tt.algorithm,
+				KeyFunc:   RateLimitByIP,
+			}))
+			e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+			var rec *httptest.ResponseRecorder
+			for i := 0; i < 4; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = tt.remoteIP + ":1234"
+				rec = httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+
+				if i < 3 {
+					assert.Equal(t, http.StatusOK, rec.Code)
+				}
+				if !tt.limited {
+					assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+				}
+			}
+
+			if !tt.limited {
+				assert.Equal(t, http.StatusOK, rec.Code)
+				return
+			}
+			assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+			assert.Equal(t, "3", rec.Header().Get("RateLimit-Limit"))
+			assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+			assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestRateLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		remoteIP       string
+		forwardedFor   string
+		want           string
+	}{
+		{"No Trusted Proxies", nil, "203.0.113.7", "198.51.100.1", "ip:203.0.113.7"},
+		{"Private Peer Is Not Trusted By Default", nil, "10.0.0.1", "198.51.100.1", "ip:10.0.0.1"},
+		{"Untrusted Peer", []string{"10.0.0.1"}, "203.0.113.7", "198.51.100.1", "ip:203.0.113.7"},
+		{"Trusted Proxy", []string{"10.0.0.0/8"}, "10.0.0.1", "198.51.100.1, 203.0.113.7", "ip:203.0.113.7"},
+		{"Trusted Proxy Chain", []string{"10.0.0.1", "10.0.0.2"}, "10.0.0.1", "203.0.113.7, 10.0.0.2", "ip:203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			e.IPExtractor = newIPExtractor(tt.trustedProxies)
+			var key string
+			e.GET("/", func(c echo.Context) error {
+				key = RateLimitByIP(c)
+				return c.NoContent(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteIP + ":1234"
+			req.Header.Set(echo.HeaderXForwardedFor, tt.forwardedFor)
+			req.Header.Set(echo.HeaderXRealIP, "198.51.100.2")
+			e.ServeHTTP(httptest.NewRecorder(), req)
+			assert.Equal(t, tt.want, key)
+		})
+	}
+}
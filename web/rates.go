@@ -0,0 +1,143 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+)
+
+// SetRatesRequest maps currencies to how many units of them one unit of the
+// settlement currency buys
+type SetRatesRequest struct {
+	Rates map[string]float64 `json:"rates"`
+}
+
+type RatesHandler struct {
+	rates *data.ExchangeRateRepository
+}
+
+func NewRatesHandler(rates *data.ExchangeRateRepository) *RatesHandler {
+	return &RatesHandler{rates: rates}
+}
+
+func registerRatesRoutes(e *echo.Echo, h *RatesHandler, authRequired echo.MiddlewareFunc) {
+	e.GET("/exchange-rates", h.handleListRates)
+	e.PUT("/exchange-rates", h.handleSetRates, authRequired, requireRole(data.RoleAdmin))
+}
+
+// importExchangeRates loads the rates file, if one is configured, and
+// reprices the catalog so products listed before their currency had a rate
+// can be found by price
+func importExchangeRates(ctx context.Context, rates *data.ExchangeRateRepository, path string) {
+	if path != "" {
+		n, err := importRatesFile(ctx, rates, path)
+		if err != nil {
+			log.Printf("Failed to import exchange rates from %s: %v", path, err)
+		} else if n > 0 {
+			log.Printf("imported %d exchange rates from %s", n, path)
+			return
+		}
+	}
+	if err := rates.Reprice(ctx); err != nil {
+		log.Printf("Failed to reprice the catalog: %v", err)
+	}
+}
+
+func importRatesFile(ctx context.Context, rates *data.ExchangeRateRepository, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return rates.Import(ctx, f, "file:"+path)
+}
+
+// localizer converts prices into the currency a client asked for
+type localizer struct {
+	currency string
+	rates    data.Rates
+}
+
+// newLocalizer reads the currency prices should be shown in from ?currency=
+// or the X-Currency header. Without one, prices are shown as creators set
+// them. A nil localizer means an error response has been written.
+func newLocalizer(c echo.Context, rates *data.ExchangeRateRepository) (*localizer, error) {
+	currency := c.QueryParam("currency")
+	if currency == "" {
+		currency = c.Request().Header.Get("X-Currency")
+	}
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" {
+		return &localizer{}, nil
+	}
+
+	table, err := rates.Rates(c.Request().Context())
+	if err != nil {
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	if !table.Supports(currency) {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Unsupported currency " + currency})
+	}
+	return &localizer{currency: currency, rates: table}, nil
+}
+
+// product sets product's local price. Products in a currency that lost its
+// rate are left as they are.
+func (l *localizer) product(product *data.Product) {
+	if l.currency == "" {
+		return
+	}
+	product.Local, _ = l.rates.Localize(product, l.currency)
+}
+
+// quote sets the local final price of q
+func (l *localizer) quote(q *data.PriceQuote) {
+	if l.currency == "" {
+		return
+	}
+	if local, _, err := l.rates.Convert(q.FinalPrice, l.currency); err == nil {
+		q.LocalFinalPrice = &local
+	}
+}
+
+// handleListRates lists the currencies prices can be shown and set in
+func (h *RatesHandler) handleListRates(c echo.Context) error {
+	rates, err := h.rates.List(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"base":  data.SettlementCurrency,
+		"rates": rates,
+	})
+}
+
+// handleSetRates stores the given rates, leaving other currencies' rates in
+// place, and reprices the catalog
+func (h *RatesHandler) handleSetRates(c echo.Context) error {
+	var req SetRatesRequest
+	if err := c.Bind(&req); err != nil || len(req.Rates) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	rates := make([]data.ExchangeRate, 0, len(req.Rates))
+	for currency, rate := range req.Rates {
+		rates = append(rates, data.ExchangeRate{Currency: currency, Rate: rate, Source: "admin"})
+	}
+	ctx := c.Request().Context()
+	err := h.rates.Set(ctx, rates)
+	if errors.Is(err, data.ErrInvalidExchangeRate) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		log.Printf("Failed to set exchange rates: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to set exchange rates"})
+	}
+	return h.handleListRates(c)
+}
@@ -0,0 +1,86 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const defaultRecommendationLimit = 6
+
+// RecommendedProduct is a product listed alongside another one
+type RecommendedProduct struct {
+	data.Product
+	Score float64 `json:"score"`
+}
+
+// handleGetRecommendations lists the products customers also bought and
+// related products. New products without any get popular products from
+// their category instead.
+func (h *ProductHandler) handleGetRecommendations(c echo.Context) error {
+	product, err := h.loadVisibleProduct(c)
+	if product == nil {
+		return err
+	}
+
+	limit := defaultRecommendationLimit
+	if raw := c.QueryParam("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > data.MaxRecommendations {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 12"})
+		}
+		limit = n
+	}
+
+	ctx := c.Request().Context()
+	recs, err := h.recommendations.Get(ctx, product)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load recommendations"})
+	}
+
+	// Recommendations are up to a refresh old, so products taken off sale
+	// since are dropped here
+	ids := make([]primitive.ObjectID, 0, len(recs.AlsoBought)+len(recs.Related))
+	for _, r := range recs.AlsoBought {
+		ids = append(ids, r.ProductID)
+	}
+	for _, r := range recs.Related {
+		ids = append(ids, r.ProductID)
+	}
+	onSale := map[primitive.ObjectID]data.Product{}
+	if len(ids) > 0 {
+		products, err := h.products.FindMany(ctx, ids)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		for _, p := range products {
+			if p.Status == data.ProductStatusActive {
+				onSale[p.ID] = p
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"also_bought": recommendedProducts(recs.AlsoBought, onSale, limit),
+		"related":     recommendedProducts(recs.Related, onSale, limit),
+		"fallback":    recs.Fallback,
+	})
+}
+
+// recommendedProducts keeps up to limit of recs that are still on sale, in
+// order
+func recommendedProducts(recs []data.Recommendation, onSale map[primitive.ObjectID]data.Product, limit int) []RecommendedProduct {
+	out := []RecommendedProduct{}
+	for _, r := range recs {
+		if len(out) == limit {
+			break
+		}
+		if p, ok := onSale[r.ProductID]; ok {
+			out = append(out, RecommendedProduct{Product: p, Score: r.Score})
+		}
+	}
+	return out
+}
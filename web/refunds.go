@@ -0,0 +1,164 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type RequestRefundRequest struct {
+	Reason string `json:"reason" validate:"required,max=2000"`
+}
+
+type DecideRefundRequest struct {
+	Action   string `json:"action" validate:"required,oneof=approve reject"`
+	Response string `json:"response" validate:"max=2000"`
+}
+
+type RefundHandler struct {
+	refunds   *data.RefundService
+	paginator *pagination.Paginator
+}
+
+func NewRefundHandler(refunds *data.RefundService, paginator *pagination.Paginator) *RefundHandler {
+	return &RefundHandler{
+		refunds:   refunds,
+		paginator: paginator,
+	}
+}
+
+func registerRefundRoutes(e *echo.Echo, h *RefundHandler, authRequired, idempotent echo.MiddlewareFunc) {
+	e.POST("/purchases/:id/refund", h.handleRequestRefund, authRequired, idempotent)
+	e.POST("/refunds/:id/decision", h.handleDecideRefund, authRequired, idempotent)
+	e.GET("/users/me/refunds", h.handleListMyRefunds, authRequired)
+	e.GET("/users/me/refund-requests", h.handleListRefundRequests, authRequired)
+	e.GET("/moderation/refunds", h.handleListPendingRefunds, authRequired, requireRole(data.RoleModerator, data.RoleAdmin))
+}
+
+// refundPage responds with a page of refund requests, newest first
+func refundPage(c echo.Context, req pagination.Request, requests []data.RefundRequest) error {
+	return c.JSON(http.StatusOK, pagination.NewPage(req, requests, func(r data.RefundRequest) (interface{}, primitive.ObjectID) {
+		return r.CreatedAt, r.ID
+	}, c.Request().URL))
+}
+
+// handleRequestRefund asks for one of the caller's purchases to be
+// refunded. The response is the request, already approved if the purchase
+// qualified for an automatic refund.
+func (h *RefundHandler) handleRequestRefund(c echo.Context) error {
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid purchase ID"})
+	}
+	var req RequestRefundRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+
+	request, err := h.refunds.Request(c.Request().Context(), currentUser(c).ID, id, req.Reason)
+	switch err {
+	case nil:
+		return c.JSON(http.StatusCreated, request)
+	case data.ErrPurchaseNotFound:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Purchase not found"})
+	case data.ErrNotRefundable, data.ErrRefundRequested:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	case data.ErrRefundPeriodOver:
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	default:
+		c.Logger().Errorf("refund request for purchase %s failed: %v", id.Hex(), err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to request refund"})
+	}
+}
+
+// handleDecideRefund approves or rejects a pending refund request. The
+// creator of the refunded product and moderators may decide it.
+func (h *RefundHandler) handleDecideRefund(c echo.Context) error {
+	id, err := parseObjectIDParam(c, "id")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid refund request ID"})
+	}
+	var req DecideRefundRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+
+	ctx := c.Request().Context()
+	user := currentUser(c)
+	request, err := h.refunds.FindByID(ctx, id)
+	if err == data.ErrRefundNotFound || (err == nil && request.CreatorID != user.ID && !isModerator(user)) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Refund request not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	request, err = h.refunds.Decide(ctx, id, user.ID, req.Action == "approve", req.Response)
+	switch err {
+	case nil:
+		return c.JSON(http.StatusOK, request)
+	case data.ErrRefundDecided, data.ErrNotRefundable:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		c.Logger().Errorf("deciding refund request %s failed: %v", id.Hex(), err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to decide refund request"})
+	}
+}
+
+// handleListMyRefunds lists the refunds the caller requested
+func (h *RefundHandler) handleListMyRefunds(c echo.Context) error {
+	sort := pagination.Sort{Field: "created_at", Desc: true}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, "refunds:mine")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	requests, err := h.refunds.ListForBuyer(c.Request().Context(), currentUser(c).ID, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return refundPage(c, req, requests)
+}
+
+// handleListRefundRequests lists the refunds requested for the caller's
+// products. ?status= restricts it to pending, approved or rejected ones.
+func (h *RefundHandler) handleListRefundRequests(c echo.Context) error {
+	status := data.RefundStatus(c.QueryParam("status"))
+	switch status {
+	case "", data.RefundStatusPending, data.RefundStatusApproved, data.RefundStatusRejected:
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid status"})
+	}
+	sort := pagination.Sort{Field: "created_at", Desc: true}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, "refunds:creator:"+string(status))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	requests, err := h.refunds.ListForCreator(c.Request().Context(), currentUser(c).ID, status, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return refundPage(c, req, requests)
+}
+
+// handleListPendingRefunds is the moderators' queue of undecided requests
+func (h *RefundHandler) handleListPendingRefunds(c echo.Context) error {
+	sort := pagination.Sort{Field: "created_at", Desc: true}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, "refunds:pending")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	requests, err := h.refunds.ListPending(c.Request().Context(), req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return refundPage(c, req, requests)
+}
@@ -1,20 +1,61 @@
 package web
 
 import (
+	"context"
 	"log"
 	"os"
 
 	"github.com/kordlab/marketplace/config"
 	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/imaging"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/kordlab/marketplace/payments"
+	"github.com/kordlab/marketplace/storage"
 	"github.com/labstack/echo/v4"
 	unkeygo "github.com/unkeyed/unkey-go"
 )
 
 type AppState struct {
-	UnkeyClient *unkeygo.Unkey
-	MongoDB     *data.MongoDB
-	RedisDB     *data.RedisDB
-	AuthHandler *AuthHandler
+	Config              *config.Config
+	UnkeyClient         *unkeygo.Unkey
+	MongoDB             *data.MongoDB
+	RedisDB             *data.RedisDB
+	Cache               *data.TieredCache
+	Paginator           *pagination.Paginator
+	Users               *data.UserRepository
+	Products            *data.ProductRepository
+	Purchases           *data.PurchaseRepository
+	Notifications       *data.NotificationRepository
+	Coupons             *data.CouponRepository
+	Entitlements        *data.EntitlementRepository
+	Analytics           *data.AnalyticsRepository
+	Views               *data.ViewTracker
+	Recommendations     *data.RecommendationEngine
+	Wishlists           *data.WishlistRepository
+	WishlistWatcher     *data.WishlistWatcher
+	Settings            *data.SettingsRepository
+	Ledger              *data.LedgerRepository
+	Rates               *data.ExchangeRateRepository
+	Checkout            *data.CheckoutService
+	Refunds             *data.RefundService
+	Deposits            *data.DepositService
+	Blobs               storage.BlobStore
+	ImageProcessor      *ImageProcessor
+	AuthHandler         *AuthHandler
+	UserHandler         *UserHandler
+	NotificationHandler *NotificationHandler
+	ProductHandler      *ProductHandler
+	DownloadHandler     *DownloadHandler
+	CouponHandler       *CouponHandler
+	AnalyticsHandler    *AnalyticsHandler
+	WishlistHandler     *WishlistHandler
+	CheckoutHandler     *CheckoutHandler
+	LedgerHandler       *LedgerHandler
+	RatesHandler        *RatesHandler
+	RefundHandler       *RefundHandler
+	DepositHandler      *DepositHandler
+	RateLimiter         *RateLimiter
+	Idempotency         *Idempotency
 }
 
 func initializeAppState() (*AppState, error) {
@@ -32,12 +73,73 @@ func initializeAppState() (*AppState, error) {
 	if err != nil {
 		return nil, err
 	}
+	blobs, err := storage.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cache := data.NewTieredCache(redis, cfg.CacheLocalSize, cfg.CacheLocalTTL)
 	appState := &AppState{
-		UnkeyClient: unkeyClient,
-		MongoDB:     mongodb,
-		RedisDB:     redis,
+		Config:        cfg,
+		UnkeyClient:   unkeyClient,
+		MongoDB:       mongodb,
+		RedisDB:       redis,
+		Cache:         cache,
+		Paginator:     pagination.New(cfg.CursorSecret),
+		Users:         data.NewUserRepository(mongodb, cache),
+		Products:      data.NewProductRepository(mongodb, cache),
+		Purchases:     data.NewPurchaseRepository(mongodb),
+		Notifications: data.NewNotificationRepository(mongodb),
+		Coupons:       data.NewCouponRepository(mongodb),
+		Entitlements:  data.NewEntitlementRepository(mongodb),
+		Analytics:     data.NewAnalyticsRepository(mongodb),
+		Wishlists:     data.NewWishlistRepository(mongodb),
+		Settings:      data.NewSettingsRepository(mongodb),
+		Ledger:        data.NewLedgerRepository(mongodb),
+		Rates:         data.NewExchangeRateRepository(mongodb, cache),
+		Blobs:         blobs,
+	}
+	appState.Views = data.NewViewTracker(redis, mongodb, appState.Products, cfg.ViewDedupWindow)
+	appState.Recommendations = data.NewRecommendationEngine(mongodb, redis, 3*cfg.RecommendRefresh)
+	appState.WishlistWatcher = data.NewWishlistWatcher(mongodb, appState.Products, appState.Notifications)
+	appState.Checkout = data.NewCheckoutService(mongodb, appState.Products, appState.Coupons, appState.Entitlements,
+		appState.Settings, appState.Ledger, appState.Rates)
+	appState.Refunds = data.NewRefundService(mongodb, appState.Purchases, appState.Products, appState.Coupons, appState.Entitlements,
+		appState.Settings, appState.Ledger, appState.Notifications)
+	appState.Deposits = data.NewDepositService(mongodb, appState.Ledger, appState.Notifications)
+	appState.AuthHandler = NewAuthHandler(mongodb, redis, appState.Users)
+	appState.UserHandler = NewUserHandler(appState.Users, appState.Cache)
+	appState.NotificationHandler = NewNotificationHandler(appState.Notifications, appState.Paginator)
+	renderer := &imaging.Renderer{Sizes: imaging.DefaultSizes}
+	if webp := imaging.LookupCWebP(cfg.CWebPPath); webp != nil {
+		renderer.WebP = webp
+	} else {
+		log.Printf("cwebp not found at %q; WebP image variants are disabled", cfg.CWebPPath)
+	}
+	appState.ImageProcessor = NewImageProcessor(appState.Products, blobs, renderer, cfg.ImageWorkers)
+	appState.ProductHandler = NewProductHandler(appState.Products, appState.Notifications, appState.Paginator, blobs,
+		appState.ImageProcessor, appState.Views, appState.Recommendations, appState.Rates, cfg.MaxUploadSize, cfg.MaxImageUploadSize)
+	appState.DownloadHandler = NewDownloadHandler(appState.Purchases, appState.Products, appState.Entitlements, blobs,
+		cfg.DownloadSigningKey, cfg.DownloadLinkTTL, cfg.MaxDownloads)
+	appState.CouponHandler = NewCouponHandler(appState.Coupons, appState.Products, appState.Entitlements, appState.Rates, appState.Paginator)
+	appState.AnalyticsHandler = NewAnalyticsHandler(appState.Analytics, appState.Products)
+	appState.WishlistHandler = NewWishlistHandler(appState.Wishlists, appState.Products, appState.Paginator)
+	appState.CheckoutHandler = NewCheckoutHandler(appState.Checkout, appState.Purchases, appState.Paginator)
+	appState.LedgerHandler = NewLedgerHandler(appState.Ledger, appState.Paginator)
+	appState.RatesHandler = NewRatesHandler(appState.Rates)
+	appState.RefundHandler = NewRefundHandler(appState.Refunds, appState.Paginator)
+	var stripe *payments.Stripe
+	if cfg.StripeSecretKey != "" {
+		stripe = payments.NewStripe(payments.StripeOptions{
+			APIBase:       cfg.StripeAPIBase,
+			SecretKey:     cfg.StripeSecretKey,
+			WebhookSecret: cfg.StripeWebhookKey,
+		})
+	} else {
+		log.Printf("STRIPE_SECRET_KEY is not set; card top-ups are disabled")
 	}
-	appState.AuthHandler = NewAuthHandler(mongodb, redis)
+	appState.DepositHandler = NewDepositHandler(appState.Deposits, stripe, appState.Paginator, cfg.DepositSuccessURL, cfg.DepositCancelURL)
+	appState.RateLimiter = NewRateLimiter(redis, cfg.RateLimitAllowlist)
+	appState.Idempotency = NewIdempotency(redis, cfg.IdempotencyTTL)
 	return appState, nil
 }
 
@@ -47,8 +149,49 @@ func Serve() {
 		log.Fatalf("Failed to initialize app state: %v", err)
 	}
 
+	// Amounts still stored as plain numbers are rewritten before serving,
+	// since queries on "<field>.amount" would miss them. This is not bound
+	// by the connection timeout, and a failed run resumes on restart.
+	if err := appState.MongoDB.MigrateMoney(context.Background()); err != nil {
+		log.Fatalf("Failed to migrate money amounts: %v", err)
+	}
+
+	go appState.Cache.Run(context.Background())
+	go appState.ImageProcessor.Run(context.Background())
+	go appState.Views.Run(context.Background(), appState.Config.ViewFlushInterval)
+	go appState.Recommendations.Run(context.Background(), appState.Config.RecommendRefresh)
+	go appState.WishlistWatcher.Run(context.Background(), appState.Config.WishlistInterval)
+	go func() {
+		n, err := appState.Ledger.MigrateEmbedded(context.Background())
+		if err != nil {
+			log.Printf("ledger migration stopped after %d users: %v", n, err)
+		} else if n > 0 {
+			log.Printf("migrated embedded credits of %d users to the ledger", n)
+		}
+	}()
+	go importExchangeRates(context.Background(), appState.Rates, appState.Config.ExchangeRatesFile)
+
 	e := echo.New()
-	registerAuthRoutes(e, appState.AuthHandler)
+	e.IPExtractor = newIPExtractor(appState.Config.TrustedProxies)
+	e.Validator = newRequestValidator()
+	e.Use(authenticate(appState.Config.JWTSecret, appState.RedisDB))
+	e.Use(appState.RateLimiter.Middleware(defaultRateLimitPolicy))
+
+	authRequired := requireAuth(appState.Users)
+	idempotent := appState.Idempotency.Middleware()
+	registerAuthRoutes(e, appState.AuthHandler, appState.RateLimiter.Middleware(authRateLimitPolicy))
+	registerUserRoutes(e, appState.UserHandler, authRequired)
+	registerNotificationRoutes(e, appState.NotificationHandler, authRequired)
+	registerProductRoutes(e, appState.ProductHandler, authRequired)
+	registerDownloadRoutes(e, appState.DownloadHandler, authRequired)
+	registerCouponRoutes(e, appState.CouponHandler, authRequired)
+	registerAnalyticsRoutes(e, appState.AnalyticsHandler, authRequired)
+	registerWishlistRoutes(e, appState.WishlistHandler, authRequired)
+	registerCheckoutRoutes(e, appState.CheckoutHandler, authRequired, idempotent)
+	registerLedgerRoutes(e, appState.LedgerHandler, authRequired)
+	registerRatesRoutes(e, appState.RatesHandler, authRequired)
+	registerRefundRoutes(e, appState.RefundHandler, authRequired, idempotent)
+	registerDepositRoutes(e, appState.DepositHandler, authRequired, idempotent)
 
 	e.Logger.Fatal(e.Start(":8080"))
 }
@@ -0,0 +1,30 @@
+package web
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+)
+
+// handleListSpecSchemas lists the specification schema of every category so
+// clients can build product forms and catalog filters
+func (h *ProductHandler) handleListSpecSchemas(c echo.Context) error {
+	schemas := make([]*data.SpecSchema, 0, len(data.SpecSchemas))
+	for _, schema := range data.SpecSchemas {
+		schemas = append(schemas, schema)
+	}
+	sort.Slice(schemas, func(i, j int) bool {
+		return schemas[i].Category < schemas[j].Category
+	})
+	return c.JSON(http.StatusOK, schemas)
+}
+
+func (h *ProductHandler) handleGetSpecSchema(c echo.Context) error {
+	schema, ok := data.SpecSchemas[data.ProductCategory(c.Param("category"))]
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown category"})
+	}
+	return c.JSON(http.StatusOK, schema)
+}
@@ -0,0 +1,176 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// sniffLen is how much of a file http.DetectContentType looks at
+	sniffLen = 512
+	// maxFormValueSize bounds the non-file fields of a multipart upload
+	maxFormValueSize = 64 << 10
+	// multipartOverhead allows for boundaries and part headers on top of
+	// the file itself when capping the request body
+	multipartOverhead = 1 << 20
+)
+
+var (
+	errUploadTooLarge = errors.New("file exceeds the maximum upload size")
+	errUploadMissing  = errors.New("missing file")
+)
+
+// spooledUpload is an uploaded file buffered to a temporary file with its
+// size, digest and sniffed content type
+type spooledUpload struct {
+	file        *os.File
+	Name        string
+	Size        int64
+	SHA256      string
+	ContentType string
+}
+
+// Reader rewinds the spooled file for reading
+func (u *spooledUpload) Reader() (io.Reader, error) {
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return u.file, nil
+}
+
+func (u *spooledUpload) Close() error {
+	u.file.Close()
+	return os.Remove(u.file.Name())
+}
+
+// sniffWriter keeps the first sniffLen bytes written to it
+type sniffWriter struct {
+	buf []byte
+}
+
+func (w *sniffWriter) Write(p []byte) (int, error) {
+	if room := sniffLen - len(w.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		w.buf = append(w.buf, p[:room]...)
+	}
+	return len(p), nil
+}
+
+// readMultipartUpload streams a multipart/form-data body without buffering
+// the file in memory. The part named "file" is spooled to disk and rejected
+// once it grows past maxSize; other parts are returned as form values.
+// The caller must Close the returned upload.
+func readMultipartUpload(r *http.Request, w http.ResponseWriter, maxSize int64) (map[string][]string, *spooledUpload, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+multipartOverhead)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := map[string][]string{}
+	var upload *spooledUpload
+	fail := func(err error) (map[string][]string, *spooledUpload, error) {
+		if upload != nil {
+			upload.Close()
+		}
+		return nil, nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return fail(errUploadTooLarge)
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		if part.FormName() != "file" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormValueSize))
+			part.Close()
+			if err != nil {
+				return fail(err)
+			}
+			values[part.FormName()] = append(values[part.FormName()], string(value))
+			continue
+		}
+		if upload != nil {
+			part.Close()
+			return fail(errors.New("only one file may be uploaded"))
+		}
+		upload, err = spoolPart(part, maxSize)
+		part.Close()
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if upload == nil {
+		return nil, nil, errUploadMissing
+	}
+	return values, upload, nil
+}
+
+func spoolPart(part *multipart.Part, maxSize int64) (*spooledUpload, error) {
+	tmp, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	upload := &spooledUpload{file: tmp, Name: sanitizeFileName(part.FileName())}
+
+	hash := sha256.New()
+	sniff := &sniffWriter{}
+	n, err := io.Copy(io.MultiWriter(tmp, hash, sniff), io.LimitReader(part, maxSize+1))
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr), err == nil && n > maxSize:
+		upload.Close()
+		return nil, errUploadTooLarge
+	case err != nil:
+		upload.Close()
+		return nil, err
+	case n == 0:
+		upload.Close()
+		return nil, errUploadMissing
+	}
+
+	upload.Size = n
+	upload.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	// The client's declared type is not trusted
+	upload.ContentType = http.DetectContentType(sniff.buf)
+	return upload, nil
+}
+
+// sanitizeFileName keeps the base name of a client supplied file name,
+// replacing anything outside a conservative character set.
+func sanitizeFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	name = strings.TrimLeft(name, ".")
+	if name == "" || name == "_" {
+		return "file"
+	}
+	if len(name) > 128 {
+		name = name[len(name)-128:]
+	}
+	return name
+}
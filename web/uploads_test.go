@@ -0,0 +1,66 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newUploadRequest(t *testing.T, fileName string, content []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	require.NoError(t, mw.WriteField("version", "1.0.0"))
+	require.NoError(t, mw.WriteField("compatibility", "go1.22, go1.23"))
+	fw, err := mw.CreateFormFile("file", fileName)
+	require.NoError(t, err)
+	_, err = fw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/products/x/versions", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestReadMultipartUpload(t *testing.T) {
+	// Starts with a zip local file header signature
+	content := append([]byte("PK\x03\x04"), make([]byte, 26)...)
+	req := newUploadRequest(t, "../../etc/my template.zip", content)
+
+	values, upload, err := readMultipartUpload(req, httptest.NewRecorder(), 1024)
+	require.NoError(t, err)
+	defer upload.Close()
+
+	sum := sha256.Sum256(content)
+	assert.Equal(t, []string{"1.0.0"}, values["version"])
+	assert.Equal(t, []string{"go1.22, go1.23"}, values["compatibility"])
+	assert.Equal(t, "my_template.zip", upload.Name)
+	assert.Equal(t, int64(len(content)), upload.Size)
+	assert.Equal(t, hex.EncodeToString(sum[:]), upload.SHA256)
+	assert.Equal(t, "application/zip", upload.ContentType)
+
+	r, err := upload.Reader()
+	require.NoError(t, err)
+	stored, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content, stored)
+}
+
+func TestReadMultipartUploadLimits(t *testing.T) {
+	req := newUploadRequest(t, "big.bin", bytes.Repeat([]byte("a"), 2048))
+	_, _, err := readMultipartUpload(req, httptest.NewRecorder(), 1024)
+	assert.Equal(t, errUploadTooLarge, err)
+
+	req = newUploadRequest(t, "empty.bin", nil)
+	_, _, err = readMultipartUpload(req, httptest.NewRecorder(), 1024)
+	assert.Equal(t, errUploadMissing, err)
+}
@@ -0,0 +1,96 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type UpdateProfileRequest struct {
+	DisplayName *string  `json:"display_name" validate:"omitempty,max=100"`
+	Avatar      *string  `json:"avatar" validate:"omitempty,url,max=2048"`
+	Bio         *string  `json:"bio" validate:"omitempty,max=2000"`
+	Interests   []string `json:"interests" validate:"max=20,dive,max=50"`
+	SocialLinks []string `json:"social_links" validate:"max=10,dive,url,max=2048"`
+	Skills      []string `json:"skills" validate:"max=20,dive,max=50"`
+	Links       []string `json:"links" validate:"max=10,dive,url,max=2048"`
+}
+
+type UserHandler struct {
+	users *data.UserRepository
+	cache *data.TieredCache
+}
+
+func NewUserHandler(users *data.UserRepository, cache *data.TieredCache) *UserHandler {
+	return &UserHandler{
+		users: users,
+		cache: cache,
+	}
+}
+
+func registerUserRoutes(e *echo.Echo, h *UserHandler, authRequired echo.MiddlewareFunc) {
+	users := e.Group("/users", authRequired)
+	users.GET("/me", h.handleGetMe)
+	users.PATCH("/me", h.handleUpdateProfile)
+
+	e.GET("/admin/cache/stats", h.handleCacheStats, authRequired, requireRole(data.RoleAdmin))
+}
+
+func (h *UserHandler) handleGetMe(c echo.Context) error {
+	return c.JSON(http.StatusOK, currentUser(c))
+}
+
+// handleCacheStats reports the hits and misses of this instance's tiered
+// cache since it started
+func (h *UserHandler) handleCacheStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.cache.Stats())
+}
+
+func (h *UserHandler) handleUpdateProfile(c echo.Context) error {
+	var req UpdateProfileRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+
+	set := bson.M{}
+	if req.DisplayName != nil {
+		set["profile.display_name"] = *req.DisplayName
+	}
+	if req.Avatar != nil {
+		set["profile.avatar"] = *req.Avatar
+	}
+	if req.Bio != nil {
+		set["profile.bio"] = *req.Bio
+	}
+	if req.Interests != nil {
+		set["profile.interests"] = req.Interests
+	}
+	if req.SocialLinks != nil {
+		set["profile.social_links"] = req.SocialLinks
+	}
+	if req.Skills != nil {
+		set["profile.skills"] = req.Skills
+	}
+	if req.Links != nil {
+		set["profile.links"] = req.Links
+	}
+	if len(set) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "No fields to update"})
+	}
+
+	user := currentUser(c)
+	if err := h.users.Update(c.Request().Context(), user.ID, set); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update profile"})
+	}
+
+	updated, err := h.users.Get(c.Request().Context(), user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return c.JSON(http.StatusOK, updated)
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kordlab/marketplace/config"
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleUpdateProfileValidation(t *testing.T) {
+	e := echo.New()
+	e.Validator = newRequestValidator()
+	h := NewUserHandler(nil, nil)
+	e.PATCH("/users/me", h.handleUpdateProfile)
+
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"Bio Too Long", `{"bio":"` + strings.Repeat("a", 2001) + `"}`, "bio"},
+		{"Avatar Not A URL", `{"avatar":"not a url"}`, "avatar"},
+		{"Social Link Not A URL", `{"social_links":["https://example.com","javascript"]}`, "social_links[1]"},
+		{"Too Many Links", `{"links":[` + strings.TrimSuffix(strings.Repeat(`"https://example.com",`, 11), ",") + `]}`, "links"},
+		{"Interest Too Long", `{"interests":["` + strings.Repeat("a", 51) + `"]}`, "interests[0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/users/me", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusBadRequest, rec.Code)
+
+			var resp struct {
+				Fields map[string]string `json:"fields"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Contains(t, resp.Fields, tt.field)
+		})
+	}
+}
+
+func TestHandleCacheStats(t *testing.T) {
+	mr := miniredis.RunT(t)
+	redis, err := data.NewRedisDB(&config.Config{RedisURL: mr.Addr()})
+	require.NoError(t, err)
+	t.Cleanup(func() { redis.Close() })
+	cache := data.NewTieredCache(redis, 10, time.Minute)
+	var thing struct{}
+	require.NoError(t, cache.Fetch(context.Background(), "things", "1", &thing, func(ctx context.Context) (interface{}, error) {
+		return struct{}{}, nil
+	}))
+
+	e := echo.New()
+	e.GET("/admin/cache/stats", NewUserHandler(nil, cache).handleCacheStats)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/cache/stats", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"local_hits":0,"redis_hits":0,"misses":1,"errors":0}`, rec.Body.String())
+}
@@ -0,0 +1,80 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/money"
+	"github.com/labstack/echo/v4"
+)
+
+// requestValidator plugs the validate struct tags used on requests and models
+// into echo's c.Validate.
+type requestValidator struct {
+	validate *validator.Validate
+}
+
+func newRequestValidator() *requestValidator {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	// Report fields by their JSON names so errors match what clients sent
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	// Amounts are validated as their minor units, so gte=0 means not negative
+	v.RegisterCustomTypeFunc(func(v reflect.Value) interface{} {
+		return v.Interface().(money.Money).Amount
+	}, money.Money{})
+	return &requestValidator{validate: v}
+}
+
+func (rv *requestValidator) Validate(i interface{}) error {
+	return rv.validate.Struct(i)
+}
+
+// validationError renders a validation failure as a 400 listing the failed
+// rule for each field.
+func validationError(c echo.Context, err error) error {
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	fields := make(map[string]string, len(verrs))
+	for _, fe := range verrs {
+		rule := fe.Tag()
+		if fe.Param() != "" {
+			rule += "=" + fe.Param()
+		}
+		fields[fe.Field()] = rule
+	}
+	return c.JSON(http.StatusBadRequest, map[string]interface{}{
+		"error":  "Validation failed",
+		"fields": fields,
+	})
+}
+
+// specificationError renders specifications that do not match their
+// category's schema like a validation failure
+func specificationError(c echo.Context, err error) error {
+	var serrs data.SpecErrors
+	if !errors.As(err, &serrs) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	fields := make(map[string]string, len(serrs))
+	for key, rule := range serrs {
+		fields["specifications."+key] = rule
+	}
+	return c.JSON(http.StatusBadRequest, map[string]interface{}{
+		"error":  "Validation failed",
+		"fields": fields,
+	})
+}
@@ -0,0 +1,251 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kordlab/marketplace/archive"
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/storage"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type PublishVersionRequest struct {
+	Version       string   `json:"version" validate:"required"`
+	ReleaseNotes  string   `json:"release_notes" validate:"max=20000"`
+	Compatibility []string `json:"compatibility"`
+	// DownloadURL is refused: files must be uploaded so they can be
+	// inspected. Versions published with one before keep it.
+	DownloadURL string `json:"download_url"`
+}
+
+type UpdateVersionRequest struct {
+	Status        data.VersionStatus `json:"status" validate:"omitempty,oneof=published deprecated yanked"`
+	Reason        string             `json:"reason" validate:"max=1000"`
+	ReleaseNotes  *string            `json:"release_notes" validate:"omitempty,max=20000"`
+	Compatibility []string           `json:"compatibility"`
+}
+
+func (h *ProductHandler) handleListVersions(c echo.Context) error {
+	product, err := h.loadVisibleProduct(c)
+	if product == nil {
+		return err
+	}
+
+	resp := map[string]interface{}{
+		"versions": product.SortedVersions(),
+		"latest":   nil,
+	}
+	if latest, err := product.LatestVersion(); err == nil {
+		resp["latest"] = latest
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *ProductHandler) handleGetLatestVersion(c echo.Context) error {
+	product, err := h.loadVisibleProduct(c)
+	if product == nil {
+		return err
+	}
+
+	latest, err := product.LatestVersion()
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "No published version"})
+	}
+	return c.JSON(http.StatusOK, latest)
+}
+
+// handlePublishVersion accepts a multipart/form-data upload whose "file"
+// part is inspected and stored in the blob store alongside the metadata
+// fields, or JSON metadata for a version without a file. Externally hosted
+// files are refused since they would never be inspected.
+func (h *ProductHandler) handlePublishVersion(c echo.Context) error {
+	var req PublishVersionRequest
+	var upload *spooledUpload
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		values, u, err := readMultipartUpload(c.Request(), c.Response(), h.maxUploadSize)
+		switch {
+		case err == errUploadTooLarge:
+			return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+		case err != nil:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid upload: " + err.Error()})
+		}
+		defer u.Close()
+		upload = u
+		req = PublishVersionRequest{
+			Version:      firstValue(values["version"]),
+			ReleaseNotes: firstValue(values["release_notes"]),
+		}
+		for _, v := range values["compatibility"] {
+			req.Compatibility = append(req.Compatibility, splitQueryList(v)...)
+		}
+	} else if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+	if req.DownloadURL != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Upload the file instead of linking to it, so it can be checked before it is published"})
+	}
+
+	product, err := h.loadManagedProduct(c)
+	if product == nil {
+		return err
+	}
+	if product.IsBundle() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Bundles do not have versions of their own"})
+	}
+
+	version := data.ProductVersion{
+		Version:       req.Version,
+		ReleaseNotes:  req.ReleaseNotes,
+		Compatibility: req.Compatibility,
+	}
+	if upload != nil {
+		// Uploads are inspected before they are stored, so a file that fails
+		// never becomes downloadable
+		report := archive.Inspect(upload.file, upload.Size, upload.Name, data.ArchivePolicy(product.Category))
+		if !report.Passed() {
+			report.Files = nil
+			h.notifyFailedUpload(c, product, req.Version, report)
+			return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error":  "The file failed safety checks",
+				"report": report,
+			})
+		}
+		version.Manifest = data.NewVersionManifest(report, time.Now())
+
+		key, err := h.storeUpload(c, product, upload)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store file"})
+		}
+		version.StorageKey = key
+		version.FileName = upload.Name
+		version.FileSize = upload.Size
+		version.SHA256 = upload.SHA256
+		version.ContentType = upload.ContentType
+	}
+
+	published, err := h.products.PublishVersion(c.Request().Context(), product, version)
+	if err != nil && version.StorageKey != "" {
+		if err := h.blobs.Delete(c.Request().Context(), version.StorageKey); err != nil {
+			c.Logger().Errorf("failed to remove orphaned upload %s: %v", version.StorageKey, err)
+		}
+	}
+	switch err {
+	case nil:
+		return c.JSON(http.StatusCreated, published)
+	case data.ErrInvalidSemVer:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Version must be a semantic version such as 1.2.0"})
+	case data.ErrVersionNotNewer, data.ErrVersionConflict:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to publish version"})
+	}
+}
+
+// notifyFailedUpload sends the creator the problems an upload was rejected
+// for, so the report outlives the response
+func (h *ProductHandler) notifyFailedUpload(c echo.Context, product *data.Product, version string, report *archive.Report) {
+	problems := make([]string, 0, len(report.Problems))
+	for _, p := range report.Problems {
+		if p.Path != "" {
+			problems = append(problems, p.Path+": "+p.Message)
+		} else {
+			problems = append(problems, p.Message)
+		}
+	}
+	if report.Truncated {
+		problems = append(problems, "and more")
+	}
+	message := fmt.Sprintf("Version %s of %q was not published because the file failed safety checks: %s",
+		version, product.Title, strings.Join(problems, "; "))
+	if err := h.notifications.Notify(c.Request().Context(), product.CreatorID, data.NotificationUploadFailed, message, product.ID); err != nil {
+		c.Logger().Errorf("failed to notify creator of product %s: %v", product.ID.Hex(), err)
+	}
+}
+
+// storeUpload writes an uploaded file under a fresh key so a failed or
+// concurrent publish never overwrites a file another version points at.
+func (h *ProductHandler) storeUpload(c echo.Context, product *data.Product, upload *spooledUpload) (string, error) {
+	r, err := upload.Reader()
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("products/%s/%s/%s", product.ID.Hex(), primitive.NewObjectID().Hex(), upload.Name)
+	err = h.blobs.Put(c.Request().Context(), key, r, upload.Size, storage.PutOptions{
+		ContentType: upload.ContentType,
+		SHA256:      upload.SHA256,
+	})
+	if err != nil {
+		c.Logger().Errorf("failed to store upload %s: %v", key, err)
+		return "", err
+	}
+	return key, nil
+}
+
+// handleGetVersionManifest lists the files in an uploaded version.
+// Externally hosted versions have no manifest.
+func (h *ProductHandler) handleGetVersionManifest(c echo.Context) error {
+	product, err := h.loadVisibleProduct(c)
+	if product == nil {
+		return err
+	}
+	// Manifests are not cached with the product
+	product, err = h.products.FindByID(c.Request().Context(), product.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	version, ok := product.FindVersion(c.Param("version"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Version not found"})
+	}
+	if version.Manifest == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Version has no manifest"})
+	}
+	return c.JSON(http.StatusOK, version.Manifest)
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (h *ProductHandler) handleUpdateVersion(c echo.Context) error {
+	var req UpdateVersionRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+
+	product, err := h.loadManagedProduct(c)
+	if product == nil {
+		return err
+	}
+
+	version, err := h.products.UpdateVersion(c.Request().Context(), product, c.Param("version"), data.VersionUpdate{
+		Status:        req.Status,
+		Reason:        req.Reason,
+		ReleaseNotes:  req.ReleaseNotes,
+		Compatibility: req.Compatibility,
+	})
+	switch err {
+	case nil:
+		return c.JSON(http.StatusOK, version)
+	case data.ErrVersionNotFound:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Version not found"})
+	case data.ErrInvalidVersionState, data.ErrVersionConflict:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update version"})
+	}
+}
@@ -0,0 +1,70 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/labstack/echo/v4"
+)
+
+// botUserAgentMarkers are lower-case fragments of the user agents of
+// crawlers, link previewers, monitors and HTTP libraries
+var botUserAgentMarkers = []string{
+	"bot", "crawl", "spider", "slurp", "archiver", "facebookexternalhit",
+	"embedly", "preview", "headless", "lighthouse", "pingdom", "uptime",
+	"monitor", "curl", "wget", "httpclient", "python-requests", "go-http-client",
+	"okhttp", "axios", "node-fetch", "java/", "libwww", "scrapy",
+}
+
+// isBot reports whether a user agent looks automated. Browsers always send
+// one, so a missing user agent counts as a bot.
+func isBot(userAgent string) bool {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+	if ua == "" {
+		return true
+	}
+	for _, marker := range botUserAgentMarkers {
+		if strings.Contains(ua, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrefetch reports whether the browser is speculatively loading the page
+// rather than showing it
+func isPrefetch(c echo.Context) bool {
+	purpose := c.Request().Header.Get("Sec-Purpose") + c.Request().Header.Get("Purpose")
+	return strings.Contains(strings.ToLower(purpose), "prefetch")
+}
+
+// visitorID identifies a viewer for deduplication: signed in users by ID,
+// anonymous ones by a hash of their IP and user agent so neither is stored
+func visitorID(c echo.Context) string {
+	if userID, ok := c.Get("user_id").(string); ok && userID != "" {
+		return "u:" + userID
+	}
+	sum := sha256.Sum256([]byte(c.RealIP() + "\n" + c.Request().UserAgent()))
+	return "a:" + hex.EncodeToString(sum[:12])
+}
+
+// recordView counts a view of an active product's detail page. Bots,
+// prefetches and the creator's own views are ignored, and failures are only
+// logged so tracking never breaks the page.
+func (h *ProductHandler) recordView(c echo.Context, product *data.Product) {
+	if h.views == nil || product.Status != data.ProductStatusActive {
+		return
+	}
+	if isBot(c.Request().UserAgent()) || isPrefetch(c) {
+		return
+	}
+	if userID, _ := c.Get("user_id").(string); userID == product.CreatorID.Hex() {
+		return
+	}
+	if _, err := h.views.Record(c.Request().Context(), product, visitorID(c), time.Now()); err != nil {
+		c.Logger().Errorf("failed to record view of product %s: %v", product.ID.Hex(), err)
+	}
+}
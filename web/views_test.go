@@ -0,0 +1,49 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsBot(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      bool
+	}{
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15", false},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0", false},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"facebookexternalhit/1.1", true},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0 Safari/537.36", true},
+		{"curl/8.4.0", true},
+		{"python-requests/2.31.0", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, isBot(tt.userAgent), tt.userAgent)
+	}
+}
+
+func TestVisitorID(t *testing.T) {
+	e := echo.New()
+	newContext := func(ip, ua string) echo.Context {
+		req := httptest.NewRequest(http.MethodGet, "/products/x", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("User-Agent", ua)
+		return e.NewContext(req, httptest.NewRecorder())
+	}
+
+	a := visitorID(newContext("203.0.113.7", "Firefox"))
+	assert.Equal(t, a, visitorID(newContext("203.0.113.7", "Firefox")))
+	assert.NotEqual(t, a, visitorID(newContext("203.0.113.8", "Firefox")))
+	assert.NotEqual(t, a, visitorID(newContext("203.0.113.7", "Safari")))
+	assert.NotContains(t, a, "203.0.113.7")
+
+	c := newContext("203.0.113.7", "Firefox")
+	c.Set("user_id", "abc123")
+	assert.Equal(t, "u:abc123", visitorID(c))
+}
@@ -0,0 +1,138 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/kordlab/marketplace/data"
+	"github.com/kordlab/marketplace/pagination"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type AddWishlistItemRequest struct {
+	ProductID string `json:"product_id" validate:"required"`
+}
+
+// WishlistEntry is a wishlist item with its product. Product is nil once
+// the product is no longer on sale.
+type WishlistEntry struct {
+	data.WishlistItem
+	Product *data.Product `json:"product"`
+}
+
+type WishlistHandler struct {
+	wishlists *data.WishlistRepository
+	products  *data.ProductRepository
+	paginator *pagination.Paginator
+}
+
+func NewWishlistHandler(wishlists *data.WishlistRepository, products *data.ProductRepository, paginator *pagination.Paginator) *WishlistHandler {
+	return &WishlistHandler{
+		wishlists: wishlists,
+		products:  products,
+		paginator: paginator,
+	}
+}
+
+func registerWishlistRoutes(e *echo.Echo, h *WishlistHandler, authRequired echo.MiddlewareFunc) {
+	wishlist := e.Group("/users/me/wishlist", authRequired)
+	wishlist.GET("", h.handleListWishlist)
+	wishlist.POST("", h.handleAddToWishlist)
+	wishlist.DELETE("/:product", h.handleRemoveFromWishlist)
+}
+
+// handleListWishlist lists the caller's saved products, most recently added
+// first
+func (h *WishlistHandler) handleListWishlist(c echo.Context) error {
+	sort := pagination.Sort{Field: "added_at", Desc: true}
+	req, err := h.paginator.Parse(c.QueryParams(), sort, "wishlist")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	items, err := h.wishlists.ListForUser(ctx, currentUser(c).ID, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ProductID)
+	}
+	onSale := map[primitive.ObjectID]*data.Product{}
+	if len(ids) > 0 {
+		products, err := h.products.FindMany(ctx, ids)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		for i := range products {
+			if products[i].Status == data.ProductStatusActive {
+				onSale[products[i].ID] = &products[i]
+			}
+		}
+	}
+
+	entries := make([]WishlistEntry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, WishlistEntry{WishlistItem: item, Product: onSale[item.ProductID]})
+	}
+	return c.JSON(http.StatusOK, pagination.NewPage(req, entries, func(e WishlistEntry) (interface{}, primitive.ObjectID) {
+		return e.AddedAt, e.ID
+	}, c.Request().URL))
+}
+
+// handleAddToWishlist saves a product on sale to the caller's wishlist.
+// Saving it again is not an error.
+func (h *WishlistHandler) handleAddToWishlist(c echo.Context) error {
+	var req AddWishlistItemRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := c.Validate(&req); err != nil {
+		return validationError(c, err)
+	}
+	productID, err := primitive.ObjectIDFromHex(req.ProductID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+	}
+
+	ctx := c.Request().Context()
+	product, err := h.products.FindByID(ctx, productID)
+	if err == data.ErrProductNotFound || (err == nil && product.Status != data.ProductStatusActive) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Product not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	item, created, err := h.wishlists.Add(ctx, currentUser(c).ID, product)
+	switch err {
+	case nil:
+	case data.ErrWishlistFull:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update wishlist"})
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	return c.JSON(status, WishlistEntry{WishlistItem: *item, Product: product})
+}
+
+func (h *WishlistHandler) handleRemoveFromWishlist(c echo.Context) error {
+	productID, err := parseObjectIDParam(c, "product")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid product ID"})
+	}
+	switch err := h.wishlists.Remove(c.Request().Context(), currentUser(c).ID, productID); err {
+	case nil:
+		return c.NoContent(http.StatusNoContent)
+	case data.ErrWishlistItemNotFound:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update wishlist"})
+	}
+}